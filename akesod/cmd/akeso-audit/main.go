@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+func printEntries(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e audit.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+
+		keys := make([]string, 0, len(e.Fields))
+		for k := range e.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var fields []string
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s=%q", k, e.Fields[k]))
+		}
+
+		fmt.Printf("%d %s %s group=%s epoch=%d %s\n", e.Seq, e.Time.Format("2006-01-02T15:04:05.000Z"),
+			e.Type, e.Group, e.Epoch, strings.Join(fields, " "))
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	pub, err := art.ReadPublicIKFromFile(opts.keyFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: reading audit key: %v", err)
+	}
+
+	f, err := os.Open(opts.logFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer f.Close()
+
+	n, lastHash, err := audit.Verify(f, pub)
+	if err != nil {
+		mu.Fatalf("error: %s: verification failed after %d valid entries: %v", opts.logFile, n, err)
+	}
+
+	if opts.print {
+		printEntries(opts.logFile)
+	}
+	fmt.Printf("%s: OK, %d entries, last hash %s\n", opts.logFile, n, lastHash)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/etclab/mu"
+)
+
+const usage = `Usage: akeso-audit [options] LOG_FILE
+
+Verify akesod's audit log: every entry must chain to the previous one by
+hash, the sequence numbers must be contiguous from 1, and every entry must
+be signed with the audit key.
+
+positional arguments:
+  LOG_FILE
+    The audit log, as configured by akesod.audit_log.
+
+options:
+  -key PUB_KEY_FILE
+    The PEM-encoded public audit key.
+    Default: keys/akesod-audit-pub.pem
+
+  -print
+    Also print each entry on a line of its own.
+
+  -help
+    Display this usage statement and exit.
+
+example:
+  $ ./akeso-audit keys/audit.log
+`
+
+type Options struct {
+	// positional
+	logFile string
+
+	// optional
+	keyFile string
+	print   bool
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.keyFile, "key", "keys/akesod-audit-pub.pem", "")
+	flag.BoolVar(&opts.print, "print", false, "")
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf("error: expected one positional argument but got %d", flag.NArg())
+	}
+	opts.logFile = flag.Arg(0)
+
+	return &opts
+}
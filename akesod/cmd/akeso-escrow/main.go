@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/escrow"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+func openStore(opts *Options) *store.Store {
+	storeOpts := &store.Options{}
+	if opts.keyFile != "" {
+		key, err := aesx.ReadKeyFile(opts.keyFile)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		storeOpts.Key = key
+	} else if opts.passphraseEnv != "" {
+		storeOpts.Passphrase = []byte(os.Getenv(opts.passphraseEnv))
+	}
+
+	st, err := store.Open(opts.stateDir, storeOpts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	return st
+}
+
+func keygen(opts *Options, name string) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if err := os.MkdirAll(opts.outDir, 0700); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	privFile := filepath.Join(opts.outDir, name+"-escrow.pem")
+	pubFile := filepath.Join(opts.outDir, name+"-escrow-pub.pem")
+	if err := art.WritePrivateEKToFile(priv, privFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if err := art.WritePublicEKToFile(priv.PublicKey(), pubFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	fmt.Printf("Wrote %s; send %s to the akesod operator.\n", privFile, pubFile)
+}
+
+func split(opts *Options) {
+	custodians, err := escrow.ParseCustodians(opts.custodians)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	_, state, err := openStore(opts).Load()
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer secret.Zero(state)
+	info, _, err := artx.UnmarshalGroupState(state)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	group := opts.group
+	if group == "" {
+		group = "default"
+	}
+	paths, err := escrow.Escrow(opts.outDir, group, info.ID, info.Epoch, state, custodians, opts.threshold)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	fmt.Printf("Split epoch %d of group %s (%s) into %d shares, any %d of which recover it:\n",
+		info.Epoch, group, info.ID, len(paths), opts.threshold)
+	for _, p := range paths {
+		fmt.Printf("  %s\n", p)
+	}
+}
+
+func open(opts *Options, path string) {
+	ss, err := escrow.ReadSealedShare(path)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	ek, err := art.ReadPrivateEKFromFile(opts.ekFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	share, err := ss.Open(ek)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer share.Data.Zero()
+
+	out := opts.out
+	if out == "" {
+		out = fmt.Sprintf("%s-epoch-%d.opened", share.Custodian, share.Epoch)
+	}
+	if err := escrow.WriteShare(out, share); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	fmt.Printf("Opened the share of %s for epoch %d of group %s (%d of %d needed) into %s.\n",
+		share.Custodian, share.Epoch, share.Group, share.Threshold, share.Total, out)
+}
+
+func combine(opts *Options, paths []string) {
+	var shares []*escrow.Share
+	for _, p := range paths {
+		share, err := escrow.ReadShare(p)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		defer share.Data.Zero()
+		shares = append(shares, share)
+	}
+
+	state, err := escrow.Combine(shares)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer secret.Zero(state)
+	info, _, err := artx.UnmarshalGroupState(state)
+	if err != nil {
+		mu.Fatalf("error: recovered state is malformed: %v", err)
+	}
+	if info.ID != shares[0].GroupID || info.Epoch != shares[0].Epoch {
+		mu.Fatalf("error: recovered state is epoch %d of group %s, but the shares are for epoch %d of group %s",
+			info.Epoch, info.ID, shares[0].Epoch, shares[0].GroupID)
+	}
+
+	st := openStore(opts)
+	current, err := st.Current()
+	if err != nil && !errors.Is(err, store.ErrNoSnapshot) {
+		mu.Fatalf("error: %v", err)
+	}
+	hasCurrent := err == nil
+
+	if err := st.Commit(info.Epoch, state); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	// importing an older epoch, e.g. to resume a rotation, keeps the
+	// newer snapshot current
+	if hasCurrent && current > info.Epoch {
+		if err := st.Rollback(current); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+	fmt.Printf("Recovered epoch %d of group %s (%s) into %s.\n", info.Epoch, shares[0].Group, info.ID, opts.stateDir)
+
+	if info.PendingRotation {
+		fmt.Printf("A rotation to epoch %d was pending; to resume it akesod also needs epoch %d, so recover that epoch's shares too.\n",
+			info.Epoch, info.Epoch-1)
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	switch opts.command {
+	case "keygen":
+		keygen(opts, opts.args[0])
+	case "split":
+		split(opts)
+	case "open":
+		open(opts, opts.args[0])
+	case "combine":
+		combine(opts, opts.args)
+	}
+}
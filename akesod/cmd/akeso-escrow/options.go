@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/etclab/mu"
+)
+
+const usage = `Usage: akeso-escrow [options] COMMAND [ARGS]
+
+Back up a group's ART state, including its stage key, with K-of-N
+custodians, and recover it.  The state is split with Shamir secret sharing
+and each share is sealed to one custodian's X25519 key.
+
+commands:
+  keygen NAME
+    Create a custodian key pair, NAME-escrow.pem and NAME-escrow-pub.pem, in
+    the -out-dir.  Custodians run this themselves and send only the public
+    key to the akesod operator.
+
+  split
+    Split the current snapshot of the store in -dir among the -custodians,
+    any -threshold of whom can recover it.  The sealed shares are written to
+    OUT_DIR/epoch-EPOCH/NAME.share, one per custodian, to be handed out.
+    akesod does this on every new epoch when escrow.threshold is set.
+
+  open SHARE
+    Open a sealed share with the custodian's private key (-ek).  The opened
+    share is written to -out; hand it to whoever recovers the group over a
+    secure channel.
+
+  combine SHARE...
+    Combine at least the threshold number of opened shares and import the
+    recovered state into the store in -dir as the snapshot of its epoch.
+    Run this only while akesod is stopped.
+
+options:
+  -dir STATE_DIR
+    The akesod state directory of the group.
+    Default: keys/state
+
+  -key KEY_FILE
+    The 32-byte key file the store is sealed with, if any.
+
+  -passphrase-env VAR
+    The environment variable holding the store passphrase, if any.
+
+  -group NAME
+    The group's name, recorded in the shares (split).
+
+  -custodians NAME=FILE,...
+    The custodians and their public keys (split).
+
+  -threshold K
+    The number of shares needed to recover the state (split).
+    Default: 2
+
+  -out-dir DIR
+    Where keygen and split write their files.
+    Default: keys/escrow
+
+  -ek FILE
+    The custodian's private key (open).
+
+  -out FILE
+    Where open writes the opened share.
+    Default: NAME-epoch-EPOCH.opened in the current directory
+
+  -help
+    Display this usage statement and exit.
+
+example:
+  $ ./akeso-escrow keygen alice
+  $ ./akeso-escrow -threshold 2 -custodians alice=alice-escrow-pub.pem,bob=bob-escrow-pub.pem,cici=cici-escrow-pub.pem split
+  $ ./akeso-escrow -ek alice-escrow.pem open keys/escrow/epoch-00000000000000000003/alice.share
+  $ ./akeso-escrow -dir keys/state combine alice-epoch-3.opened cici-epoch-3.opened
+`
+
+type Options struct {
+	// positional
+	command string
+	args    []string
+
+	// optional
+	stateDir      string
+	keyFile       string
+	passphraseEnv string
+	group         string
+	custodians    []string
+	threshold     int
+	outDir        string
+	ekFile        string
+	out           string
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+	var custodians string
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.stateDir, "dir", "keys/state", "")
+	flag.StringVar(&opts.keyFile, "key", "", "")
+	flag.StringVar(&opts.passphraseEnv, "passphrase-env", "", "")
+	flag.StringVar(&opts.group, "group", "", "")
+	flag.StringVar(&custodians, "custodians", "", "")
+	flag.IntVar(&opts.threshold, "threshold", 2, "")
+	flag.StringVar(&opts.outDir, "out-dir", "keys/escrow", "")
+	flag.StringVar(&opts.ekFile, "ek", "", "")
+	flag.StringVar(&opts.out, "out", "", "")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		mu.Fatalf("error: expected a command")
+	}
+	opts.command = flag.Arg(0)
+	opts.args = flag.Args()[1:]
+
+	for _, c := range strings.Split(custodians, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			opts.custodians = append(opts.custodians, c)
+		}
+	}
+
+	switch opts.command {
+	case "keygen":
+		if len(opts.args) != 1 {
+			mu.Fatalf("error: keygen expects a NAME")
+		}
+	case "split":
+		if len(opts.args) != 0 {
+			mu.Fatalf("error: split takes no arguments")
+		}
+		if len(opts.custodians) < 2 {
+			mu.Fatalf("error: split needs at least 2 -custodians")
+		}
+		if opts.threshold < 2 || opts.threshold > len(opts.custodians) {
+			mu.Fatalf("error: -threshold must be between 2 and the number of custodians (%d)", len(opts.custodians))
+		}
+	case "open":
+		if len(opts.args) != 1 {
+			mu.Fatalf("error: open expects a SHARE")
+		}
+		if opts.ekFile == "" {
+			mu.Fatalf("error: open needs the custodian's private key (-ek)")
+		}
+	case "combine":
+		if len(opts.args) < 2 {
+			mu.Fatalf("error: combine expects at least 2 SHAREs")
+		}
+	default:
+		mu.Fatalf("error: unknown command %q", opts.command)
+	}
+
+	return &opts
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/mu"
+)
+
+func printReport(w io.Writer, url string, r *encstr.Report) {
+	width := 0
+	for _, f := range r.Fields {
+		width = max(width, len(f.Name))
+	}
+
+	fmt.Fprintf(w, "%s\n", url)
+	for _, f := range r.Fields {
+		fmt.Fprintf(w, "  %-*s  %s\n", width+1, f.Name+":", f.Value)
+	}
+	if len(r.Problems) == 0 {
+		fmt.Fprintf(w, "  no problems found\n")
+		return
+	}
+	fmt.Fprintf(w, "  problems:\n")
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "  - %s\n", p)
+	}
+}
+
+func main() {
+	// the strategies log their errors; the report has them
+	log.SetOutput(io.Discard)
+
+	opts := parseOptions()
+	ctx := context.Background()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		mu.Fatalf("storage.NewClient failed: %v", err)
+	}
+	defer client.Close()
+
+	failed := false
+	for i, url := range opts.urls {
+		bucketName, objectName, err := gcsx.ParseUrl(url)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+
+		r, err := encstr.Inspect(ctx, client.Bucket(bucketName), objectName, opts.key, opts.verify)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			failed = true
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		printReport(os.Stdout, url, r)
+		if opts.raw {
+			fmt.Println()
+			gcsx.DumpObjectAttrs(os.Stdout, r.Attrs)
+		}
+		failed = failed || len(r.Problems) > 0
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
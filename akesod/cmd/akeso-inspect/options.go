@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/mu"
+)
+
+const usage = `Usage: akeso-inspect [options] gs://BUCKET/OBJECT...
+
+Decode the strategy metadata of akesod's objects and check it for
+consistency.
+
+For akeso objects this shows the header's layer count and base IV, how many
+layers are applied to the data, times_updated, ongoing_reencryption, the
+epoch whose key encrypts the header and the format version.  Problems, such
+as a header whose layer count doesn't match times_updated, or an
+ongoing_reencryption that disagrees with the applied layers, are listed
+after each object.  The exit status is 1 if any object has a problem.
+
+options:
+  -key KEY_FILE
+    The object's 32-byte key (for akeso, the header key of the object's
+    epoch).  With it, akeso-inspect also checks that the key opens the
+    header or wrapped key, and that the newest layer in the header is the
+    one the metadata names.
+
+  -kms KMS_KEY
+    For cmek objects, the KMS key they should be encrypted with.
+
+  -verify
+    Also download and decrypt each object.  For akeso objects this finds
+    how many layers are really applied to the data.  Needs -key or -kms.
+
+  -raw
+    Also print all of each object's GCS attributes.
+
+  -help
+    Display this usage statement and exit.
+
+example:
+  $ ./akeso-inspect gs://wmsr-test-bucket/wonderland.txt
+  $ ./akeso-inspect -key keys/key -verify gs://wmsr-test-bucket/wonderland.txt
+`
+
+type Options struct {
+	// positional
+	urls []string
+
+	// optional
+	keyFile string
+	kmsKey  string
+	verify  bool
+	raw     bool
+
+	// derived
+	key []byte
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	var err error
+	opts := Options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.keyFile, "key", "", "")
+	flag.StringVar(&opts.kmsKey, "kms", "", "")
+	flag.BoolVar(&opts.verify, "verify", false, "")
+	flag.BoolVar(&opts.raw, "raw", false, "")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		mu.Fatalf("error: expected at least one gs://BUCKET/OBJECT")
+	}
+	for _, url := range flag.Args() {
+		if !strings.HasPrefix(url, "gs://") {
+			mu.Fatalf("error: %q is not a gs:// URL", url)
+		}
+	}
+	opts.urls = flag.Args()
+
+	if opts.keyFile != "" && opts.kmsKey != "" {
+		mu.Fatalf("error: -key and -kms are mutually exclusive")
+	}
+	if opts.keyFile != "" {
+		opts.key, err = aesx.ReadKeyFile(opts.keyFile)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	} else if opts.kmsKey != "" {
+		opts.key = []byte(opts.kmsKey)
+	}
+	if opts.verify && opts.key == nil {
+		mu.Fatalf("error: -verify needs -key or -kms")
+	}
+
+	return &opts
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/mu"
+)
+
+func list(st *store.Store) {
+	versions, err := st.Versions()
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	current, err := st.Current()
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	for _, v := range versions {
+		marker := " "
+		if v == current {
+			marker = "*"
+		}
+
+		data, err := st.LoadVersion(v)
+		if err != nil {
+			fmt.Printf("%s %d  unreadable: %v\n", marker, v, err)
+			continue
+		}
+		info, tree, err := artx.UnmarshalGroupState(data)
+		if err != nil {
+			fmt.Printf("%s %d  unreadable: %v\n", marker, v, err)
+			continue
+		}
+		fmt.Printf("%s %d  group %s, %d members\n", marker, v, info.ID, len(tree.IKeys))
+	}
+}
+
+func main() {
+	opts := parseOptions()
+
+	storeOpts := &store.Options{}
+	if opts.keyFile != "" {
+		key, err := aesx.ReadKeyFile(opts.keyFile)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		storeOpts.Key = key
+	} else if opts.passphraseEnv != "" {
+		storeOpts.Passphrase = []byte(os.Getenv(opts.passphraseEnv))
+	}
+
+	st, err := store.Open(opts.stateDir, storeOpts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	switch opts.command {
+	case "list":
+		list(st)
+	case "rollback":
+		if err := st.Rollback(opts.version); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		fmt.Printf("Snapshot %d is now current.\n", opts.version)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/etclab/mu"
+)
+
+const usage = `Usage: akeso-state [options] COMMAND [VERSION]
+
+Inspect and roll back akesod's versioned group state.  Run this only while
+akesod is stopped.
+
+commands:
+  list
+    List the retained snapshots (one per epoch), marking the current one.
+
+  rollback VERSION
+    Make snapshot VERSION current.  The snapshot must decrypt with the given
+    key or passphrase.  The newer snapshots can be rolled forward to until
+    akesod commits the next epoch, which replaces them.
+
+options:
+  -dir STATE_DIR
+    The akesod state directory.
+    Default: keys/state
+
+  -key KEY_FILE
+    The 32-byte key file the store is sealed with, if any.
+
+  -passphrase-env VAR
+    The environment variable holding the store passphrase, if any.
+
+  -help
+    Display this usage statement and exit.
+
+example:
+  $ ./akeso-state list
+  $ AKESOD_STATE_PASSPHRASE=... ./akeso-state -passphrase-env AKESOD_STATE_PASSPHRASE rollback 3
+`
+
+type Options struct {
+	// positional
+	command string
+	version uint64
+
+	// optional
+	stateDir      string
+	keyFile       string
+	passphraseEnv string
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	var err error
+	opts := Options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.stateDir, "dir", "keys/state", "")
+	flag.StringVar(&opts.keyFile, "key", "", "")
+	flag.StringVar(&opts.passphraseEnv, "passphrase-env", "", "")
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		mu.Fatalf("error: expected a command")
+	}
+	opts.command = flag.Arg(0)
+
+	switch opts.command {
+	case "list":
+		if flag.NArg() != 1 {
+			mu.Fatalf("error: list takes no arguments")
+		}
+	case "rollback":
+		if flag.NArg() != 2 {
+			mu.Fatalf("error: rollback expects a VERSION")
+		}
+		opts.version, err = strconv.ParseUint(flag.Arg(1), 10, 64)
+		if err != nil {
+			mu.Fatalf("error: invalid VERSION %q: %v", flag.Arg(1), err)
+		}
+	default:
+		mu.Fatalf("error: unknown command %q", opts.command)
+	}
+
+	return &opts
+}
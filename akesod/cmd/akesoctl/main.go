@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/mu"
+)
+
+// How often rotate -wait polls the rotation's progress
+const pollInterval = 2 * time.Second
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func printGroups(groups []control.Group) {
+	tw := newTable()
+	fmt.Fprintln(tw, "GROUP\tID\tEPOCH\tPENDING\tBUCKETS")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%t\t%s\n", g.Name, g.ID, g.Epoch, g.PendingRotation, strings.Join(g.Buckets, ","))
+	}
+	tw.Flush()
+}
+
+func printMembers(g *control.Group) {
+	fmt.Printf("group %s (%s), epoch %d", g.Name, g.ID, g.Epoch)
+	if g.PendingRotation {
+		fmt.Printf(", rotation pending")
+	}
+	fmt.Println()
+
+	tw := newTable()
+	fmt.Fprintln(tw, "IDX\tMEMBER")
+	for _, m := range g.Members {
+		fmt.Fprintf(tw, "%d\t%s\n", m.Idx, m.Name)
+	}
+	tw.Flush()
+}
+
+func printRotation(r *control.Rotation) {
+	fmt.Printf("group %s, epoch %d (%s", r.Group, r.Epoch, r.Trigger)
+	if r.MsgID != "" {
+		fmt.Printf(", msg id %s", r.MsgID)
+	}
+	fmt.Printf("): %s\n", r.State)
+	fmt.Printf("  objects: %d/%d rotated, %d failed, %d already rotated\n", r.Done, r.Total, r.Failed, r.Skipped)
+	if r.Layers > 0 {
+		fmt.Printf("  layers: %d/%d applied, %d superseded, %d failed\n", r.LayersApplied, r.Layers, r.LayersSuperseded, r.LayersFailed)
+	}
+	fmt.Printf("  started: %s, finished: %s\n", formatTime(&r.Started), formatTime(r.Finished))
+	if r.LayersDone != nil {
+		fmt.Printf("  layers done: %s (%v end to end)\n", formatTime(r.LayersDone), r.LayersDone.Sub(r.Started).Round(time.Millisecond))
+	}
+	if r.Error != "" {
+		fmt.Printf("  error: %s\n", r.Error)
+	}
+}
+
+func printRotations(rs []control.Rotation) {
+	tw := newTable()
+	fmt.Fprintln(tw, "GROUP\tEPOCH\tTRIGGER\tSTATE\tDONE\tFAILED\tTOTAL\tSTARTED\tFINISHED")
+	for i := range rs {
+		r := &rs[i]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", r.Group, r.Epoch, r.Trigger, r.State,
+			r.Done, r.Failed, r.Total, formatTime(&r.Started), formatTime(r.Finished))
+	}
+	tw.Flush()
+}
+
+func printStuck(objs []control.StuckObject) {
+	tw := newTable()
+	fmt.Fprintln(tw, "BUCKET\tOBJECT\tSIZE\tUPDATED")
+	for i := range objs {
+		o := &objs[i]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", o.Bucket, o.Name, o.Size, formatTime(&o.Updated))
+	}
+	tw.Flush()
+}
+
+// Polls the group's rotation to epoch until it is no longer running or
+// applying layers.  The rotation starts in the background, so until it
+// shows up the API may report none or the previous one.
+func waitRotation(ctx context.Context, c *control.Client, group string, epoch uint64) *control.Rotation {
+	for {
+		r, err := c.Rotation(ctx, group)
+		if err != nil && !errors.Is(err, control.ErrNotFound) {
+			mu.Fatalf("error: %v", err)
+		}
+		if err == nil && r.Epoch == epoch {
+			switch r.State {
+			case control.StateRunning:
+				fmt.Fprintf(os.Stderr, "\r%d/%d objects rotated, %d failed", r.Done, r.Total, r.Failed)
+			case control.StateApplying:
+				fmt.Fprintf(os.Stderr, "\r%d/%d layers applied, %d failed    ", r.LayersApplied+r.LayersSuperseded, r.Layers, r.LayersFailed)
+			default:
+				return r
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Derives the bucket key that akesod rotated the bucket to at the epoch of
+// the member's tree state.
+func deriveKey(opts *Options) {
+	state, err := artx.ReadTreeStateFile(opts.stateFile)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer secret.Zero(state.Sk)
+
+	purpose := aesx.PurposeDataKEK
+	if opts.strategy == "akeso" {
+		purpose = aesx.PurposeHeaderKEK
+	}
+	info := &artx.GroupInfo{ID: opts.groupID, Epoch: opts.epoch, KeySchedule: aesx.CurrentSchedule}
+	key, err := artx.BucketKey(state, info, []byte(opts.kdfSalt), opts.bucket, purpose)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	defer secret.Zero(key)
+
+	if err := os.WriteFile(opts.out, key, 0600); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	fmt.Printf("Wrote the %s key of bucket %s at epoch %d to %s\n", purpose, opts.bucket, opts.epoch, opts.out)
+}
+
+func main() {
+	opts := parseOptions()
+	ctx := context.Background()
+
+	if opts.command == "derive-key" {
+		deriveKey(opts)
+		return
+	}
+
+	c, err := control.NewClient(opts.addr, os.Getenv(opts.tokenEnv))
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	var out any
+	failed := false
+	switch opts.command {
+	case "status":
+		if opts.group != "" {
+			g, err := c.Group(ctx, opts.group)
+			if err != nil {
+				mu.Fatalf("error: %v", err)
+			}
+			out = g
+			if !opts.json {
+				printGroups([]control.Group{*g})
+			}
+			break
+		}
+		groups, err := c.Groups(ctx)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = groups
+		if !opts.json {
+			printGroups(groups)
+		}
+
+	case "members":
+		g, err := c.Group(ctx, opts.group)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = g
+		if !opts.json {
+			printMembers(g)
+		}
+
+	case "rotate":
+		res, err := c.StartRotation(ctx, opts.group)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = res
+		if !opts.json {
+			if res.Resumed {
+				fmt.Printf("Resumed the pending rotation of group %s to epoch %d.\n", res.Group, res.Epoch)
+			} else {
+				fmt.Printf("Group %s moved to epoch %d (msg id %s); rotating its buckets.\n", res.Group, res.Epoch, res.MsgID)
+			}
+		}
+		if opts.wait {
+			r := waitRotation(ctx, c, opts.group, res.Epoch)
+			out = r
+			if !opts.json {
+				fmt.Fprintln(os.Stderr)
+				printRotation(r)
+			}
+			failed = r.State != control.StateCompleted
+		}
+
+	case "progress":
+		r, err := c.Rotation(ctx, opts.group)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = r
+		if !opts.json {
+			printRotation(r)
+		}
+
+	case "cancel":
+		r, err := c.CancelRotation(ctx, opts.group)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = r
+		if !opts.json {
+			fmt.Printf("Cancelling the rotation of group %s to epoch %d once the objects in flight are done.\n", r.Group, r.Epoch)
+		}
+
+	case "history":
+		rs, err := c.Rotations(ctx, opts.group)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = rs
+		if !opts.json {
+			printRotations(rs)
+		}
+
+	case "stuck":
+		objs, err := c.Stuck(ctx, opts.group, opts.olderThan)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		out = objs
+		if !opts.json {
+			printStuck(objs)
+		}
+	}
+
+	if opts.json {
+		printJSON(out)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/etclab/mu"
+)
+
+const usage = `Usage: akesoctl [options] COMMAND [GROUP]
+
+Administer a running akesod through its control API (control.listen in
+akesod's config), or derive a member's bucket keys.
+
+commands:
+  status              List the groups with their epoch and buckets, or show
+                      one group.
+  members GROUP       Show the group's epoch and members.
+  rotate GROUP        Move the group to a new epoch by updating akesod's own
+                      leaf key, and rotate its buckets.  A pending rotation
+                      is resumed instead.
+  progress GROUP      Show the running (or last) rotation of the group.
+  cancel GROUP        Stop the group's running rotation after the objects in
+                      flight; it stays pending until resumed with rotate.
+  history [GROUP]     List recent rotations.
+  stuck GROUP         List objects still marked ongoing_reencryption=true.
+  derive-key BUCKET   Derive the bucket's key from a member's tree state,
+                      without akesod, and write it to -out for cloud-cp
+                      -key.  Needs -state, -group-id and -epoch.
+
+GROUP is the group name from akesod's config, or "default" for a daemon
+with a single group.
+
+options:
+  -addr ADDRESS
+    The control API, as unix:///PATH or tcp://HOST:PORT.
+    Default: unix:///tmp/akesod-control.sock
+
+  -token-env VAR
+    Environment variable holding the control token, if akesod requires one.
+    Default: AKESOD_CONTROL_TOKEN
+
+  -older-than DURATION
+    For stuck, only list objects last updated longer ago than this.
+    Default: 10m
+
+  -wait
+    For rotate, follow the rotation's progress until it finishes, including
+    the workers applying its akeso layers.
+
+  -json
+    Print the API's JSON responses instead of tables.
+
+derive-key options:
+  -state STATE_FILE
+    The member's ART tree state at -epoch, as trigger-key-update -state
+    keeps it.
+
+  -group-id ID
+    The GroupID of akesod's setup message.
+
+  -epoch EPOCH
+    The group's epoch that -state is at: 0 after setup, plus one per
+    applied update.
+
+  -strategy STRATEGY
+    The buckets' strategy (akesod.strategy).  akeso derives the object
+    header key, the others the data key.
+    Default: akeso
+
+  -kdf-salt SALT
+    akesod's art.kdf_salt.
+    Default: ""
+
+  -out KEY_FILE
+    Where to write the key.
+    Default: keys/key
+
+  -help
+    Display this usage statement and exit.
+
+examples:
+  $ ./akesoctl status
+  $ ./akesoctl rotate -wait team-a
+  $ ./akesoctl -older-than 1h stuck team-a
+  $ ./akesoctl -state keys/bob-state.json -group-id $GROUP_ID -epoch 3 derive-key wmsr-test-bucket
+`
+
+type Options struct {
+	// positional
+	command string
+	group   string
+
+	// optional
+	addr      string
+	tokenEnv  string
+	olderThan time.Duration
+	wait      bool
+	json      bool
+
+	// derive-key
+	bucket    string
+	stateFile string
+	groupID   string
+	epoch     uint64
+	strategy  string
+	kdfSalt   string
+	out       string
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+// Commands and whether they need a group
+var commands = map[string]bool{
+	"status":   false,
+	"members":  true,
+	"rotate":   true,
+	"progress": true,
+	"cancel":   true,
+	"history":  false,
+	"stuck":    true,
+
+	// takes a BUCKET, and runs without akesod
+	"derive-key": true,
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.addr, "addr", "unix:///tmp/akesod-control.sock", "")
+	flag.StringVar(&opts.tokenEnv, "token-env", "AKESOD_CONTROL_TOKEN", "")
+	flag.DurationVar(&opts.olderThan, "older-than", 10*time.Minute, "")
+	flag.BoolVar(&opts.wait, "wait", false, "")
+	flag.BoolVar(&opts.json, "json", false, "")
+	flag.StringVar(&opts.stateFile, "state", "", "")
+	flag.StringVar(&opts.groupID, "group-id", "", "")
+	flag.Uint64Var(&opts.epoch, "epoch", 0, "")
+	flag.StringVar(&opts.strategy, "strategy", "akeso", "")
+	flag.StringVar(&opts.kdfSalt, "kdf-salt", "", "")
+	flag.StringVar(&opts.out, "out", "keys/key", "")
+
+	flag.Parse()
+
+	// allow options after the command, as in the examples
+	args := flag.Args()
+	if len(args) > 0 {
+		opts.command = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+
+	if opts.command == "" {
+		mu.Fatalf("error: expected a COMMAND; see -help")
+	}
+	needsGroup, ok := commands[opts.command]
+	if !ok {
+		mu.Fatalf("error: unknown command %q", opts.command)
+	}
+	if len(args) > 1 {
+		mu.Fatalf("error: too many arguments")
+	}
+	if len(args) == 1 {
+		opts.group = args[0]
+	}
+	if opts.command == "derive-key" {
+		opts.bucket, opts.group = opts.group, ""
+		if opts.bucket == "" {
+			mu.Fatalf("error: derive-key needs a BUCKET")
+		}
+		if opts.stateFile == "" || opts.groupID == "" {
+			mu.Fatalf("error: derive-key needs -state and -group-id")
+		}
+	} else if needsGroup && opts.group == "" {
+		mu.Fatalf("error: %s needs a GROUP", opts.command)
+	}
+
+	return &opts
+}
@@ -12,7 +12,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
 	"github.com/etclab/art"
 	"github.com/etclab/mu"
 )
@@ -140,7 +144,7 @@ func generateKeys(keytype string, outform, basePath string, encoding art.KeyEnco
 		}
 
 	} else if keytype == "ek" {
-		keyPairJSON, err = generateEKPair(pubPath, privPath, encoding, "private")
+		keyPairJSON, err = generateEKPair(pubPath, privPath, encoding, "public")
 		if err != nil {
 			mu.Fatalf("failed to generate keypair: %v", err)
 		}
@@ -159,7 +163,7 @@ func generateKeys(keytype string, outform, basePath string, encoding art.KeyEnco
 	return keyPairJSON
 }
 
-func setup_group(opts *Options) (setup_msg, setup_msg_sig []byte) {
+func setup_group(opts *Options) (setup_msg, setup_msg_sig []byte, groupID string) {
 	if opts.outDir == "" {
 		opts.outDir = filepath.Base(opts.artConfigFile)
 	}
@@ -170,7 +174,6 @@ func setup_group(opts *Options) (setup_msg, setup_msg_sig []byte) {
 
 	opts.msgFile = filepath.Join(opts.outDir, opts.msgFile)
 	opts.sigFile = filepath.Join(opts.outDir, opts.sigFile)
-	opts.treeStateFile = filepath.Join(opts.outDir, opts.treeStateFile)
 
 	outDir := "./"
 	err := os.MkdirAll(outDir, 0750)
@@ -184,8 +187,21 @@ func setup_group(opts *Options) (setup_msg, setup_msg_sig []byte) {
 	setupMsg.Save(opts.msgFile)
 	setupMsg.SaveSign(opts.sigFile, opts.msgFile, opts.privIKFile)
 	log.Println("Setup Msg and Sig Saved.")
-	state.Save(opts.treeStateFile)
-	state.SaveStageKey(filepath.Join(opts.outDir, "stage-key.pem"))
+
+	groupInfo := artx.NewGroupInfo()
+	groupInfo.KeySchedule = aesx.CurrentSchedule
+	if err := commitGroupState(openStore(opts), opts, groupInfo, state); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	log.Printf("Group %q (%s) created at epoch %d.\n", opts.groupName(), groupInfo.ID, groupInfo.Epoch)
+	recordAudit(audit.EventSetup, opts, groupInfo.Epoch, map[string]string{
+		"groupId":        groupInfo.ID,
+		"initiator":      opts.initiator,
+		"members":        strings.Join(opts.members, ","),
+		"buckets":        strings.Join(opts.buckets, ","),
+		"keyFingerprint": audit.Fingerprint(state.StageKey()),
+	})
+	escrowGroupState(opts, groupInfo, state)
 
 	sig, err := art.SignFile(opts.basePath+"-ik.pem", opts.msgFile)
 	if err != nil {
@@ -193,5 +209,5 @@ func setup_group(opts *Options) (setup_msg, setup_msg_sig []byte) {
 	}
 
 	setupMsgJSON, _ := json.Marshal(setupMsg)
-	return setupMsgJSON, sig
+	return setupMsgJSON, sig, groupInfo.ID
 }
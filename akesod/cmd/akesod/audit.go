@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// nil when auditing is disabled; audit.Log discards entries then
+var auditLog *audit.Log
+
+// Opens the audit log, creating its signing key on first use.  The public
+// key is written next to the private key for use with akeso-audit.
+func openAuditLog(opts *Options) *audit.Log {
+	if opts.auditLog == "" {
+		return nil
+	}
+
+	key, err := art.ReadPrivateIKFromFile(opts.auditKeyFile, art.EncodingPEM)
+	if errors.Is(err, os.ErrNotExist) {
+		pub, priv, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			mu.Fatalf("error: generating audit key: %v", genErr)
+		}
+		if err := art.WritePrivateIKToFile(priv, opts.auditKeyFile, art.EncodingPEM); err != nil {
+			mu.Fatalf("error: writing audit key: %v", err)
+		}
+		if err := art.WritePublicIKToFile(pub, auditPubKeyFile(opts), art.EncodingPEM); err != nil {
+			mu.Fatalf("error: writing public audit key: %v", err)
+		}
+		log.Printf("Created audit signing key %s.\n", opts.auditKeyFile)
+		key, err = priv, nil
+	}
+	if err != nil {
+		mu.Fatalf("error: reading audit key: %v", err)
+	}
+
+	l, err := audit.Open(opts.auditLog, key)
+	if err != nil {
+		mu.Fatalf("error: opening audit log: %v", err)
+	}
+	if n := l.Recovered(); n > 0 {
+		log.Printf("Removed a torn %d-byte entry from the end of audit log %s, left by a crash.\n", n, opts.auditLog)
+	}
+	return l
+}
+
+func auditPubKeyFile(opts *Options) string {
+	base := strings.TrimSuffix(opts.auditKeyFile, ".pem")
+	return base + "-pub.pem"
+}
+
+// Appends to the audit log.  Failing to audit does not stop key management,
+// but is logged.
+func recordAudit(typ string, opts *Options, epoch uint64, fields map[string]string) {
+	if err := auditLog.Append(typ, opts.groupName(), epoch, fields); err != nil {
+		log.Printf("error: writing %s audit entry: %v\n", typ, err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/escrow"
+	"github.com/etclab/art"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Every config file key can also be given as a flag named after the key
+// (-akesod-max-concurrent-updates for akesod.max_concurrent_updates) or an
+// environment variable (AKESOD_AKESOD_MAX_CONCURRENT_UPDATES).  Flags take
+// precedence over the environment, which takes precedence over the file.
+// Only the groups list is file-only.
+const envPrefix = "AKESOD"
+
+// Value kinds of config keys
+const (
+	kindString   = "string"
+	kindInt      = "int"
+	kindBool     = "bool"
+	kindDuration = "duration"
+	kindList     = "list" // comma- or space-separated on flags and in the environment
+)
+
+type configKey struct {
+	name  string
+	kind  string
+	def   any
+	usage string
+}
+
+var configKeys = []configKey{
+	{"cloud.project_id", kindString, "", "Google Cloud project; required for the pubsub bus"},
+	{"cloud.bucket", kindString, "", "bucket to rotate"},
+	{"cloud.buckets", kindList, nil, "more buckets to rotate"},
+	{"cloud.setup_topic", kindString, "GroupSetup", "topic for group setup messages"},
+	{"cloud.registration_topic", kindString, "MemberRegistration", "topic for member registrations"},
+	{"cloud.update_topic", kindString, "KeyUpdate", "topic for key updates"},
+	{"cloud.metadata_update_topic", kindString, "MetadataUpdate", "topic for metadata update events (akeso strategy)"},
+	{"cloud.worker_key_file", kindString, "keys/worker-pub.pem", "public key the rotation DEK is wrapped to for the cloud function or encrypt-worker (akeso strategy)"},
+	{"cloud.completion_topic", kindString, "ReencryptionComplete", "topic the cloud function or encrypt-worker reports each object on (akeso strategy); empty stops following layers"},
+
+	{"bus.kind", kindString, "pubsub", "message bus: pubsub, local or memory"},
+	{"bus.address", kindString, "unix:///tmp/akeso-bus.sock", "local broker address, unix:///PATH or tcp://HOST:PORT"},
+	{"bus.serve", kindBool, false, "run the local broker in akesod"},
+
+	{"metrics.listen", kindString, "", "HOST:PORT for /metrics, /healthz and /readyz; empty disables"},
+	{"metrics.scan_interval", kindDuration, time.Minute, "how often buckets are rescanned for pending re-encryptions"},
+
+	{"control.listen", kindString, "", "control API address for akesoctl, unix:///PATH or tcp://HOST:PORT; empty disables"},
+	{"control.token_env", kindString, "", "environment variable holding the control API bearer token"},
+
+	{"escrow.threshold", kindInt, 0, "custodians needed to recover an escrowed group state; 0 disables escrow"},
+	{"escrow.custodians", kindList, nil, "escrow custodians as NAME=FILE, FILE being the custodian's public key from akeso-escrow keygen"},
+	{"escrow.dir", kindString, "keys/escrow", "where the sealed shares of each epoch are written"},
+
+	{"ingest.policy", kindString, "off", "what to do with objects uploaded without encryption: off, encrypt, quarantine or alert"},
+	{"ingest.scan_interval", kindDuration, 5 * time.Minute, "how often buckets are scanned for objects without valid akeso metadata; 0 only checks during rotations"},
+	{"ingest.quarantine_prefix", kindString, "quarantine/", "where the quarantine policy moves objects; rotations skip it"},
+
+	{"art.strategy", kindString, "akeso", "rotation strategy: " + strings.Join(strategies, ", ")},
+	{"art.setup_required", kindBool, false, "set up the ART group on start"},
+	{"art.outform", kindString, "pem", "key file encoding: pem, der or raw"},
+	{"art.keytype", kindString, "", "ik, ek or empty"},
+	{"art.num_of_members", kindInt, 0, "number of leaves, including akesod"},
+	{"art.members", kindList, nil, "members expected to register"},
+	{"art.require_pinned_ik", kindBool, false, "reject registrations from members without a pinned IK instead of trusting their first one"},
+	{"art.config_file", kindString, "", "ART group config file written at setup"},
+	{"art.initiator", kindString, "akesod", "name of akesod's leaf"},
+	{"art.priv_IK_file", kindString, "", "akesod's private identity key"},
+	{"art.outdir", kindString, "keys", "directory for keys and setup messages"},
+	{"art.sigfile", kindString, "setup.msg.sig", "setup message signature file"},
+	{"art.msgfile", kindString, "setup.msg", "setup message file"},
+	{"art.kdf_salt", kindString, "", "salt for deriving AES keys from stage keys"},
+
+	{"akesod.max_reencryptions", kindInt, 50, "layers before an object is fully re-encrypted (akeso strategy)"},
+	{"akesod.max_concurrent_updates", kindInt, 50, "objects rotated in parallel"},
+	{"akesod.state_dir", kindString, "keys/state", "versioned group state"},
+	{"akesod.state_key_file", kindString, "", "32-byte key sealing the group state"},
+	{"akesod.state_passphrase_env", kindString, "", "environment variable holding a passphrase sealing the group state"},
+	{"akesod.state_snapshots", kindInt, 0, "state snapshots to keep; 0 keeps all"},
+	{"akesod.dead_letter_topic", kindString, "", "topic for key updates that can't be applied; empty drops them"},
+	{"akesod.max_delivery_attempts", kindInt, 5, "deliveries of a key update before it is dead-lettered"},
+	{"akesod.shutdown_timeout", kindDuration, 30 * time.Second, "time in-flight objects get to finish on shutdown"},
+	{"akesod.audit_log", kindString, "", "signed audit log; empty disables"},
+	{"akesod.audit_key_file", kindString, "keys/akesod-audit.pem", "audit log signing key, created if missing"},
+}
+
+var strategies = []string{"strawman", "keywrap", "akeso", "csek", "cmek"}
+
+func (k *configKey) flagName() string {
+	return strings.ToLower(strings.NewReplacer(".", "-", "_", "-").Replace(k.name))
+}
+
+func (k *configKey) envName() string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(k.name, ".", "_"))
+}
+
+// boolFlag is a string flag that can also be given bare, as -bus-serve, so
+// that a malformed value is still reported by validateConfig
+type boolFlag string
+
+func (b *boolFlag) String() string     { return string(*b) }
+func (b *boolFlag) Set(s string) error { *b = boolFlag(s); return nil }
+func (b *boolFlag) IsBoolFlag() bool   { return true }
+
+// Registers a flag for each config key.  The flags hold the strings given;
+// values are checked by validateConfig whichever source they come from.
+func defineConfigFlags(fs *flag.FlagSet) {
+	for i := range configKeys {
+		k := &configKeys[i]
+		if k.kind == kindBool {
+			fs.Var(new(boolFlag), k.flagName(), k.usage)
+			continue
+		}
+		fs.String(k.flagName(), "", k.usage)
+	}
+}
+
+// Sets up viper's defaults and environment, and copies the flags that were
+// given on the command line over the config file.
+func bindConfig(fs *flag.FlagSet) {
+	byFlag := make(map[string]*configKey)
+	for i := range configKeys {
+		k := &configKeys[i]
+		byFlag[k.flagName()] = k
+		if k.def != nil {
+			viper.SetDefault(k.name, k.def)
+		}
+		viper.BindEnv(k.name, k.envName())
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if k, ok := byFlag[f.Name]; ok {
+			viper.Set(k.name, f.Value.String())
+		}
+	})
+}
+
+// Returns a list key as given in the file, or split on commas and spaces
+// when given as a flag or environment variable.
+func getList(key string) []string {
+	if s, ok := viper.Get(key).(string); ok {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return viper.GetStringSlice(key)
+}
+
+// Returns the effective value of k, converted to its kind
+func configValue(k *configKey) (any, error) {
+	v := viper.Get(k.name)
+	switch k.kind {
+	case kindInt:
+		return cast.ToIntE(v)
+	case kindBool:
+		return cast.ToBoolE(v)
+	case kindDuration:
+		if s, ok := v.(string); ok {
+			// cast reads a bare number as nanoseconds
+			return time.ParseDuration(s)
+		}
+		return cast.ToDurationE(v)
+	case kindList:
+		return getList(k.name), nil
+	}
+	return cast.ToStringE(v)
+}
+
+// configErrors collects every problem with the configuration, so they can
+// be reported together.
+type configErrors []string
+
+func (e *configErrors) add(key, format string, args ...any) {
+	*e = append(*e, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+func oneOf(v string, allowed ...string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the types of all keys and the values that akesod can't run with.
+// Checks that depend on the groups list are done in groupOptions.
+func validateConfig() error {
+	var errs configErrors
+
+	for i := range configKeys {
+		k := &configKeys[i]
+		if _, err := configValue(k); err != nil {
+			errs.add(k.name, "not a valid %s: %v", k.kind, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if s := strings.ToLower(viper.GetString("art.strategy")); !oneOf(s, strategies...) {
+		errs.add("art.strategy", "unknown strategy %q (must be one of %s)", s, strings.Join(strategies, ", "))
+	}
+	if _, err := art.StringToKeyEncoding(viper.GetString("art.outform")); err != nil {
+		errs.add("art.outform", "%v (must be pem, der or raw)", err)
+	}
+	if s := strings.ToLower(viper.GetString("art.keytype")); !oneOf(s, "ik", "ek", "") {
+		errs.add("art.keytype", "must be ik, ek or empty, not %q", s)
+	}
+
+	busKind := viper.GetString("bus.kind")
+	if !oneOf(busKind, "pubsub", "local", "memory") {
+		errs.add("bus.kind", "must be pubsub, local or memory, not %q", busKind)
+	}
+	if busKind == "pubsub" && !viper.GetBool("bus.serve") && viper.GetString("cloud.project_id") == "" {
+		errs.add("cloud.project_id", "required with the pubsub bus")
+	}
+	if busKind == "local" || viper.GetBool("bus.serve") {
+		if _, _, err := bus.ParseAddress(viper.GetString("bus.address")); err != nil {
+			errs.add("bus.address", "%v", err)
+		}
+	}
+
+	if viper.GetString("cloud.update_topic") == "" {
+		errs.add("cloud.update_topic", "required")
+	}
+	if viper.GetBool("art.setup_required") {
+		for _, key := range []string{"cloud.setup_topic", "cloud.registration_topic"} {
+			if viper.GetString(key) == "" {
+				errs.add(key, "required when art.setup_required is set")
+			}
+		}
+	}
+	if strings.ToLower(viper.GetString("art.strategy")) == "akeso" {
+		if viper.GetString("cloud.metadata_update_topic") == "" {
+			errs.add("cloud.metadata_update_topic", "required for the akeso strategy")
+		}
+		if _, err := art.ReadPublicEKFromFile(viper.GetString("cloud.worker_key_file"), art.EncodingPEM); err != nil {
+			errs.add("cloud.worker_key_file", "required for the akeso strategy (create it with encrypt-worker -keygen): %v", err)
+		}
+	}
+
+	if n := viper.GetInt("akesod.max_concurrent_updates"); n < 1 {
+		errs.add("akesod.max_concurrent_updates", "must be at least 1, not %d", n)
+	}
+	if n := viper.GetInt("akesod.max_reencryptions"); n < 0 {
+		errs.add("akesod.max_reencryptions", "must not be negative")
+	}
+	if n := viper.GetInt("akesod.max_delivery_attempts"); n < 1 {
+		errs.add("akesod.max_delivery_attempts", "must be at least 1, not %d", n)
+	}
+	// resuming an interrupted rotation needs the previous epoch's key
+	if n := viper.GetInt("akesod.state_snapshots"); n < 0 || n == 1 {
+		errs.add("akesod.state_snapshots", "must be 0 (keep all) or at least 2, not %d", n)
+	}
+	if viper.GetString("akesod.state_key_file") != "" && viper.GetString("akesod.state_passphrase_env") != "" {
+		errs.add("akesod.state_key_file", "can't be combined with akesod.state_passphrase_env")
+	}
+	for _, key := range []string{"akesod.shutdown_timeout", "metrics.scan_interval"} {
+		if d := viper.GetDuration(key); d <= 0 {
+			errs.add(key, "must be positive, not %v", d)
+		}
+	}
+
+	if addr := viper.GetString("metrics.listen"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs.add("metrics.listen", "%v", err)
+		}
+	}
+	if addr := viper.GetString("control.listen"); addr != "" {
+		if _, _, err := control.ParseAddress(addr); err != nil {
+			errs.add("control.listen", "%v", err)
+		}
+	}
+
+	if k := viper.GetInt("escrow.threshold"); k != 0 {
+		custodians := getList("escrow.custodians")
+		if k < 2 || k > len(custodians) {
+			errs.add("escrow.threshold", "must be 0, or between 2 and the number of escrow.custodians (%d), not %d", len(custodians), k)
+		}
+		if _, err := escrow.ParseCustodians(custodians); err != nil {
+			errs.add("escrow.custodians", "%v", err)
+		}
+	}
+
+	switch policy := strings.ToLower(viper.GetString("ingest.policy")); {
+	case !oneOf(policy, ingestPolicies...):
+		errs.add("ingest.policy", "must be one of %s, not %q", strings.Join(ingestPolicies, ", "), policy)
+	case policy == ingestEncrypt && strings.ToLower(viper.GetString("art.strategy")) == "cmek":
+		errs.add("ingest.policy", "encrypt can't be used with the cmek strategy; set a default KMS key on the buckets instead")
+	case policy == ingestQuarantine && viper.GetString("ingest.quarantine_prefix") == "":
+		errs.add("ingest.quarantine_prefix", "required for the quarantine policy")
+	}
+	if d := viper.GetDuration("ingest.scan_interval"); d < 0 {
+		errs.add("ingest.scan_interval", "must not be negative, not %v", d)
+	}
+
+	if len(getList("cloud.buckets")) == 0 && viper.GetString("cloud.bucket") == "" && !viper.IsSet("groups") {
+		errs.add("cloud.bucket", "no buckets configured")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Writes the merged file, environment, flag and default values as YAML
+func printConfig(w io.Writer) error {
+	settings := make(map[string]map[string]any)
+	for i := range configKeys {
+		k := &configKeys[i]
+		v, err := configValue(k)
+		if err != nil {
+			v = viper.Get(k.name)
+		}
+		section, name, _ := strings.Cut(k.name, ".")
+		if settings[section] == nil {
+			settings[section] = make(map[string]any)
+		}
+		settings[section][name] = v
+	}
+
+	out := make(map[string]any, len(settings)+1)
+	for section, values := range settings {
+		out[section] = values
+	}
+	if viper.IsSet("groups") {
+		out["groups"] = viper.Get("groups")
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Describes every config key for the usage message
+func configUsage() string {
+	keys := make([]*configKey, len(configKeys))
+	for i := range configKeys {
+		keys[i] = &configKeys[i]
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  -%s %s\n    %s.\n    Config: %s, env: %s", k.flagName(), strings.ToUpper(k.kind), k.usage, k.name, k.envName())
+		if k.def != nil && fmt.Sprint(k.def) != "" && fmt.Sprint(k.def) != "false" && fmt.Sprint(k.def) != "0" {
+			fmt.Fprintf(&b, ", default: %v", k.def)
+		}
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
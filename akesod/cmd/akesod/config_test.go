@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Reads config and the flags in args into viper as main does
+func parseTestConfig(t *testing.T, config string, args ...string) {
+	t.Helper()
+	readTestConfig(t, config)
+	fs := flag.NewFlagSet("akesod", flag.ContinueOnError)
+	defineConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	bindConfig(fs)
+}
+
+func TestConfigFlags(t *testing.T) {
+	parseTestConfig(t, "art: {setup_required: true, require_pinned_ik: true}",
+		"-bus-serve", "-art-setup-required=false", "-akesod-max-concurrent-updates", "7", "-cloud-buckets", "a,b")
+	if !viper.GetBool("bus.serve") {
+		t.Error("a bare bool flag isn't true")
+	}
+	if viper.GetBool("art.setup_required") {
+		t.Error("-art-setup-required=false didn't override the file")
+	}
+	if !viper.GetBool("art.require_pinned_ik") {
+		t.Error("the file's art.require_pinned_ik was lost")
+	}
+	if n := viper.GetInt("akesod.max_concurrent_updates"); n != 7 {
+		t.Errorf("akesod.max_concurrent_updates is %d; expected 7", n)
+	}
+	if buckets := getList("cloud.buckets"); strings.Join(buckets, " ") != "a b" {
+		t.Errorf("cloud.buckets is %q", buckets)
+	}
+
+	// a bool flag given a value that isn't one is reported like any other
+	parseTestConfig(t, "", "-bus-serve=maybe")
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "bus.serve: not a valid bool") {
+		t.Errorf("-bus-serve=maybe: %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	const valid = `
+art: {strategy: strawman}
+bus: {kind: memory}
+cloud: {bucket: b}
+`
+	parseTestConfig(t, valid)
+	if err := validateConfig(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"zero concurrent updates", []string{"-akesod-max-concurrent-updates", "0"}, "akesod.max_concurrent_updates: must be at least 1, not 0"},
+		{"int not a number", []string{"-akesod-max-concurrent-updates", "many"}, "akesod.max_concurrent_updates: not a valid int"},
+		{"unknown strategy", []string{"-art-strategy", "rot13"}, `art.strategy: unknown strategy "rot13"`},
+		{"unknown bus", []string{"-bus-kind", "carrier-pigeon"}, "bus.kind: must be pubsub, local or memory"},
+		{"pubsub without a project", []string{"-bus-kind", "pubsub"}, "cloud.project_id: required with the pubsub bus"},
+		{"bad metrics listen address", []string{"-metrics-listen", "9090"}, "metrics.listen: address 9090: missing port"},
+		{"bad control listen address", []string{"-control-listen", "127.0.0.1:8080"}, "control.listen: bad control address"},
+		{"bad local bus address", []string{"-bus-kind", "local", "-bus-address", "/tmp/bus.sock"}, "bus.address:"},
+		{"bad duration", []string{"-akesod-shutdown-timeout", "30"}, "akesod.shutdown_timeout: not a valid duration"},
+		{"zero duration", []string{"-metrics-scan-interval", "0s"}, "metrics.scan_interval: must be positive"},
+		{"one snapshot", []string{"-akesod-state-snapshots", "1"}, "akesod.state_snapshots: must be 0 (keep all) or at least 2"},
+		{"two state keys", []string{"-akesod-state-key-file", "k", "-akesod-state-passphrase-env", "P"}, "can't be combined"},
+		{"escrow threshold above custodians", []string{"-escrow-threshold", "3", "-escrow-custodians", "a=x,b=y"}, "escrow.threshold: must be 0, or between 2"},
+		{"unknown ingest policy", []string{"-ingest-policy", "ignore"}, "ingest.policy: must be one of"},
+		{"encrypt on ingest with cmek", []string{"-ingest-policy", "encrypt", "-art-strategy", "cmek"}, "can't be used with the cmek strategy"},
+		{"setup without a topic", []string{"-art-setup-required", "-cloud-registration-topic", ""}, "cloud.registration_topic: required when art.setup_required is set"},
+		{"no buckets", []string{"-cloud-bucket", ""}, "cloud.bucket: no buckets configured"},
+	}
+	for _, tt := range tests {
+		parseTestConfig(t, valid, tt.args...)
+		err := validateConfig()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v; expected an error about %q", tt.name, err, tt.err)
+		}
+	}
+
+	// every problem is reported at once
+	parseTestConfig(t, valid, "-akesod-max-concurrent-updates", "0", "-art-strategy", "rot13")
+	if errs, ok := validateConfig().(configErrors); !ok || len(errs) != 2 {
+		t.Errorf("got %v; expected two errors", errs)
+	}
+}
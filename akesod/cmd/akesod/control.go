@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/art"
+)
+
+// Rotations kept for the control API's history, across all groups
+const maxRotationHistory = 100
+
+// rotationStatus is the progress of one rotation as reported on the
+// control API.  Closing cancel stops the rotation after the objects in
+// flight.
+type rotationStatus struct {
+	mtx        sync.Mutex
+	r          control.Rotation
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+func (rs *rotationStatus) snapshot() control.Rotation {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	return rs.r
+}
+
+// Records the objects of a bucket about to be rotated, and those skipped
+// because a previous attempt already rotated them.
+func (rs *rotationStatus) addObjects(total, skipped int) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.r.Total += total
+	rs.r.Skipped += skipped
+}
+
+func (rs *rotationStatus) objectDone(err error) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	if err != nil {
+		rs.r.Failed++
+	} else {
+		rs.r.Done++
+	}
+}
+
+// Records an akeso layer left to the workers
+func (rs *rotationStatus) layerQueued() {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.r.Layers++
+}
+
+// Forgets a layer that was queued but not added, and had got to state.
+// Reports what layerSettled does.
+func (rs *rotationStatus) layerDropped(state string) (control.Rotation, bool) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.r.Layers--
+	rs.countLayer(state, -1)
+	return rs.r, rs.checkLayersDone()
+}
+
+// Moves a layer from state prev to state.  Reports whether that accounted
+// for the rotation's last layer, and the rotation as of then.
+func (rs *rotationStatus) layerSettled(prev, state string) (control.Rotation, bool) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.countLayer(prev, -1)
+	rs.countLayer(state, 1)
+	return rs.r, rs.checkLayersDone()
+}
+
+func (rs *rotationStatus) countLayer(state string, n int) {
+	switch state {
+	case layerApplied:
+		rs.r.LayersApplied += n
+	case layerSuperseded:
+		rs.r.LayersSuperseded += n
+	case layerFailed:
+		rs.r.LayersFailed += n
+	}
+}
+
+// Completes a rotation that is only waiting for its layers once none are
+// pending; it fails if any layer did.  A rotation failed by its layers is
+// completed again if they are applied after all.  The caller holds rs.mtx.
+func (rs *rotationStatus) checkLayersDone() bool {
+	waiting := rs.r.State == control.StateApplying || (rs.r.State == control.StateFailed && rs.r.LayersDone != nil)
+	if !waiting || rs.r.LayersApplied+rs.r.LayersSuperseded+rs.r.LayersFailed < rs.r.Layers {
+		return false
+	}
+	now := time.Now().UTC()
+	rs.r.LayersDone = &now
+	rs.r.State = control.StateCompleted
+	rs.r.Error = ""
+	if rs.r.LayersFailed > 0 {
+		rs.r.State = control.StateFailed
+		rs.r.Error = fmt.Sprintf("%d of %d layers failed", rs.r.LayersFailed, rs.r.Layers)
+	}
+	return true
+}
+
+func (rs *rotationStatus) requestCancel() {
+	rs.cancelOnce.Do(func() { close(rs.cancel) })
+}
+
+// Records the end of the rotation's objects.  A completed rotation that
+// left layers to the workers is applying them until they are all accounted
+// for; finish reports whether they already are.
+func (rs *rotationStatus) finish(state string, err error) (control.Rotation, bool) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	now := time.Now().UTC()
+	rs.r.Finished = &now
+	rs.r.State = state
+	if err != nil {
+		rs.r.Error = err.Error()
+	}
+	if state == control.StateCompleted && rs.r.Layers > 0 {
+		rs.r.State = control.StateApplying
+	}
+	return rs.r, rs.checkLayersDone()
+}
+
+// rotationTracker holds the running rotation of each group and the most
+// recent finished ones.
+type rotationTracker struct {
+	mtx     sync.Mutex
+	active  map[string]*rotationStatus // by group name
+	history []*rotationStatus          // oldest first
+}
+
+func newRotationTracker() *rotationTracker {
+	return &rotationTracker{active: make(map[string]*rotationStatus)}
+}
+
+func (t *rotationTracker) start(group string, epoch uint64, trigger, msgID string) *rotationStatus {
+	rs := &rotationStatus{
+		r: control.Rotation{
+			Group:   group,
+			Epoch:   epoch,
+			Trigger: trigger,
+			MsgID:   msgID,
+			State:   control.StateRunning,
+			Started: time.Now().UTC(),
+		},
+		cancel: make(chan struct{}),
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.active[group] = rs
+	return rs
+}
+
+// Moves the rotation to the history.  Reports, as rotationStatus.finish
+// does, whether its layers are all accounted for.
+func (t *rotationTracker) finish(rs *rotationStatus, state string, err error) (control.Rotation, bool) {
+	r, layersDone := rs.finish(state, err)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.active[r.Group] == rs {
+		delete(t.active, r.Group)
+	}
+	t.history = append(t.history, rs)
+	if len(t.history) > maxRotationHistory {
+		t.history = t.history[len(t.history)-maxRotationHistory:]
+	}
+	return r, layersDone
+}
+
+// Returns the group's running rotation, or else its most recent one
+func (t *rotationTracker) get(group string) (*rotationStatus, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if rs, ok := t.active[group]; ok {
+		return rs, true
+	}
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if t.history[i].r.Group == group {
+			return t.history[i], true
+		}
+	}
+	return nil, false
+}
+
+func (t *rotationTracker) running(group string) (*rotationStatus, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	rs, ok := t.active[group]
+	return rs, ok
+}
+
+// Lists finished and running rotations, oldest first; an empty group
+// lists those of all groups.
+func (t *rotationTracker) list(group string) []control.Rotation {
+	t.mtx.Lock()
+	all := append([]*rotationStatus(nil), t.history...)
+	for _, rs := range t.active {
+		all = append(all, rs)
+	}
+	t.mtx.Unlock()
+
+	rotations := []control.Rotation{}
+	for _, rs := range all {
+		r := rs.snapshot()
+		if group == "" || r.Group == group {
+			rotations = append(rotations, r)
+		}
+	}
+	sort.SliceStable(rotations, func(i, j int) bool {
+		return rotations[i].Started.Before(rotations[j].Started)
+	})
+	return rotations
+}
+
+// Advances the group to a new epoch by replacing akesod's own leaf key,
+// as a member does with art.UpdateKey, and publishes the update so the
+// members follow.  The caller holds h.mtx and rotates the buckets next.
+func (h *keyUpdateHandler) updateLeaf(ctx context.Context, g *groupHandler, groupInfo *artx.GroupInfo, treeState *art.TreeState) error {
+	ik, err := art.ReadPrivateIKFromFile(g.opts.privIKFile, g.opts.encoding)
+	if err != nil {
+		return fmt.Errorf("reading akesod's IK: %w", err)
+	}
+	defer secret.Zero(ik)
+
+	// NewLeafUpdate wipes the old stage key
+	oldFingerprint := audit.Fingerprint(treeState.StageKey())
+	prevEpoch := groupInfo.Epoch
+
+	update, err := artx.NewLeafUpdate(treeState, groupInfo, akesodIdx, ik)
+	if err != nil {
+		return err
+	}
+	groupInfo.KeySchedule = aesx.CurrentSchedule
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	// committed before publishing, so members never see an update that
+	// akesod could lose
+	groupInfo.PendingRotation = true
+	groupInfo.UpdateMsgID = ""
+	groupInfo.PendingUpdate = data
+	if err := commitGroupState(g.st, g.opts, groupInfo, treeState); err != nil {
+		return err
+	}
+	log.Printf("Group %q (%s) advanced to epoch %d by akesod.\n", g.opts.groupName(), groupInfo.ID, groupInfo.Epoch)
+	recordAudit(audit.EventEpoch, g.opts, groupInfo.Epoch, map[string]string{
+		"groupId":           groupInfo.ID,
+		"previousEpoch":     strconv.FormatUint(prevEpoch, 10),
+		"sender":            strconv.Itoa(akesodIdx),
+		"trigger":           control.TriggerControl,
+		"oldKeyFingerprint": oldFingerprint,
+		"newKeyFingerprint": audit.Fingerprint(treeState.StageKey()),
+	})
+	escrowGroupState(g.opts, groupInfo, treeState)
+
+	return h.publishPendingUpdate(ctx, g, groupInfo, treeState)
+}
+
+// Publishes akesod's own key update if it was committed but not yet
+// published.  akesod receives it back on the update topic and acks it as
+// stale.
+func (h *keyUpdateHandler) publishPendingUpdate(ctx context.Context, g *groupHandler, groupInfo *artx.GroupInfo, treeState *art.TreeState) error {
+	if len(groupInfo.PendingUpdate) == 0 {
+		return nil
+	}
+
+	id, err := h.msgBus.Publish(ctx, h.topic, &bus.Message{
+		Data: groupInfo.PendingUpdate,
+		Attributes: map[string]string{
+			"initiator": "akesod",
+			"timedate":  time.Now().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("publishing key update for epoch %d of group %q: %w", groupInfo.Epoch, g.opts.groupName(), err)
+	}
+	log.Printf("Published key update for epoch %d of group %q to %s; msg id: %v\n", groupInfo.Epoch, g.opts.groupName(), h.topic, id)
+
+	groupInfo.UpdateMsgID = id
+	groupInfo.PendingUpdate = nil
+	return commitGroupState(g.st, g.opts, groupInfo, treeState)
+}
+
+// controlServer serves the control API for akesoctl
+type controlServer struct {
+	h      *keyUpdateHandler
+	groups map[string]*groupHandler // by group name
+	token  string
+}
+
+func newControlServer(h *keyUpdateHandler, token string) *controlServer {
+	s := &controlServer{h: h, groups: make(map[string]*groupHandler), token: token}
+	for _, g := range h.groups {
+		s.groups[g.opts.groupName()] = g
+	}
+	return s
+}
+
+func (s *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/groups", s.listGroups)
+	mux.HandleFunc("GET /v1/groups/{group}", s.getGroup)
+	mux.HandleFunc("POST /v1/groups/{group}/rotations", s.startRotation)
+	mux.HandleFunc("GET /v1/groups/{group}/rotation", s.getRotation)
+	mux.HandleFunc("DELETE /v1/groups/{group}/rotation", s.cancelRotation)
+	mux.HandleFunc("GET /v1/groups/{group}/stuck", s.listStuck)
+	mux.HandleFunc("GET /v1/rotations", s.listRotations)
+
+	if s.token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + s.token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong control token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &control.Error{Error: err.Error()})
+}
+
+// Looks up the group named in the request path, replying 404 if there is
+// none.
+func (s *controlServer) group(w http.ResponseWriter, r *http.Request) *groupHandler {
+	name := r.PathValue("group")
+	g, ok := s.groups[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no group %q", name))
+	}
+	return g
+}
+
+func (s *controlServer) describe(g *groupHandler, withMembers bool) (control.Group, error) {
+	groupInfo, _, err := loadGroupState(g.st, g.opts)
+	if err != nil {
+		return control.Group{}, err
+	}
+	desc := control.Group{
+		Name:            g.opts.groupName(),
+		ID:              groupInfo.ID,
+		Epoch:           groupInfo.Epoch,
+		PendingRotation: groupInfo.PendingRotation,
+		Buckets:         g.opts.buckets,
+	}
+	if withMembers {
+		// leaves are numbered in ART config order: akesod, then members
+		desc.Members = append(desc.Members, control.Member{Idx: akesodIdx, Name: g.opts.initiator})
+		for i, name := range g.opts.members {
+			desc.Members = append(desc.Members, control.Member{Idx: akesodIdx + 1 + i, Name: name})
+		}
+	}
+	return desc, nil
+}
+
+func (s *controlServer) listGroups(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []control.Group{}
+	for _, name := range names {
+		desc, err := s.describe(s.groups[name], false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		groups = append(groups, desc)
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (s *controlServer) getGroup(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r)
+	if g == nil {
+		return
+	}
+	desc, err := s.describe(g, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, desc)
+}
+
+// Starts a rotation in the background: a pending rotation is resumed,
+// otherwise akesod moves the group to a new epoch itself.  Key updates are
+// held back until it is done.
+func (s *controlServer) startRotation(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r)
+	if g == nil {
+		return
+	}
+
+	h := s.h
+	if !h.mtx.TryLock() {
+		writeError(w, http.StatusConflict, errors.New("a key update or rotation is in progress"))
+		return
+	}
+	ctx := h.workCtx
+
+	groupInfo, treeState, err := loadGroupState(g.st, g.opts)
+	if err != nil {
+		h.mtx.Unlock()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := &control.StartResult{Group: g.opts.groupName(), Resumed: groupInfo.PendingRotation}
+
+	var oldKeys *epochKeys
+	if !res.Resumed {
+		oldKeys = newEpochKeys(groupInfo, treeState, g.opts)
+		if err := h.updateLeaf(ctx, g, groupInfo, treeState); err != nil {
+			oldKeys.destroy()
+			h.mtx.Unlock()
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	res.Epoch = groupInfo.Epoch
+	res.MsgID = groupInfo.UpdateMsgID
+
+	go func() {
+		defer h.mtx.Unlock()
+
+		var err error
+		if res.Resumed {
+			err = h.resumeRotation(ctx, g, groupInfo, treeState)
+		} else {
+			err = h.rotate(ctx, g, groupInfo, treeState, oldKeys, control.TriggerControl)
+		}
+		if err != nil {
+			log.Printf("error: rotation of group %q: %v\n", g.opts.groupName(), err)
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, res)
+}
+
+func (s *controlServer) getRotation(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r)
+	if g == nil {
+		return
+	}
+
+	rs, ok := s.h.rotations.get(g.opts.groupName())
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("group %q has had no rotations since akesod started", g.opts.groupName()))
+		return
+	}
+	writeJSON(w, http.StatusOK, rs.snapshot())
+}
+
+func (s *controlServer) cancelRotation(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r)
+	if g == nil {
+		return
+	}
+
+	rs, ok := s.h.rotations.running(g.opts.groupName())
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("group %q has no running rotation", g.opts.groupName()))
+		return
+	}
+	rs.requestCancel()
+	log.Printf("Cancelling rotation of group %q to epoch %d.\n", g.opts.groupName(), rs.snapshot().Epoch)
+	writeJSON(w, http.StatusAccepted, rs.snapshot())
+}
+
+func (s *controlServer) listRotations(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if _, ok := s.groups[group]; group != "" && !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no group %q", group))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.h.rotations.list(group))
+}
+
+// Lists the group's objects still marked for re-encryption by the cloud
+// function whose last update is older than older_than (default 0).
+func (s *controlServer) listStuck(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r)
+	if g == nil {
+		return
+	}
+
+	var olderThan time.Duration
+	if v := r.URL.Query().Get("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad older_than: %w", err))
+			return
+		}
+		olderThan = d
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	stuck := []control.StuckObject{}
+	for _, bucket := range g.opts.buckets {
+		objects, err := listObjects(r.Context(), bucket, g.bkts[bucket])
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Errorf("bucket %s: %w", bucket, err))
+			return
+		}
+		for _, o := range objects {
+			if o.Metadata["ongoing_reencryption"] == "true" && o.Updated.Before(cutoff) {
+				stuck = append(stuck, control.StuckObject{Bucket: bucket, Name: o.Name, Size: o.Size, Updated: o.Updated})
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, stuck)
+}
+
+// Reports whether addr, a TCP HOST:PORT, only accepts connections from this
+// host
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serves the control API on opts.controlListen until ctx is done.  A Unix
+// socket is only accessible to akesod's user; a TCP address other than
+// loopback needs a token.
+func serveControl(ctx context.Context, opts *Options, h *keyUpdateHandler) error {
+	network, addr, err := control.ParseAddress(opts.controlListen)
+	if err != nil {
+		return err
+	}
+
+	token := ""
+	if opts.controlTokenEnv != "" {
+		token = os.Getenv(opts.controlTokenEnv)
+		if token == "" {
+			return fmt.Errorf("control token variable %s is empty", opts.controlTokenEnv)
+		}
+	} else if network == "tcp" && !isLoopback(addr) {
+		return fmt.Errorf("control API on %s needs a token; set control.token_env or listen on a loopback address", opts.controlListen)
+	}
+
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	srv := &http.Server{
+		Handler:           newControlServer(h, token).handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving the control API on %s.\n", opts.controlListen)
+	err = srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
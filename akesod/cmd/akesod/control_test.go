@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etclab/akesod/internal/control"
+)
+
+func TestControlToken(t *testing.T) {
+	th := newTestHandler(t)
+	srv := httptest.NewServer(newControlServer(th.keyUpdateHandler, "s3cret").handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name, auth string
+		code       int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"token prefix", "Bearer s3cre", http.StatusUnauthorized},
+		{"token without scheme", "s3cret", http.StatusUnauthorized},
+		{"other scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"right token", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", srv.URL+"/v1/groups", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: got %d; expected %d", tt.name, resp.StatusCode, tt.code)
+		}
+		if resp.StatusCode == http.StatusOK {
+			var groups []control.Group
+			if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil || len(groups) != 1 {
+				t.Errorf("%s: got %v, %v", tt.name, groups, err)
+			}
+		}
+		resp.Body.Close()
+	}
+
+	// without a token every request is served
+	open := httptest.NewServer(newControlServer(th.keyUpdateHandler, "").handler())
+	defer open.Close()
+	resp, err := http.Get(open.URL + "/v1/groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("without a token: got %d", resp.StatusCode)
+	}
+}
+
+func TestServeControlNeedsTokenOffLoopback(t *testing.T) {
+	th := newTestHandler(t)
+
+	for _, addr := range []string{"tcp://0.0.0.0:0", "tcp://:0", "tcp://[::]:0", "tcp://example.com:8080"} {
+		opts := &Options{controlListen: addr}
+		err := serveControl(context.Background(), opts, th.keyUpdateHandler)
+		if err == nil || !strings.Contains(err.Error(), "needs a token") {
+			t.Errorf("%s without a token: %v", addr, err)
+		}
+	}
+
+	t.Setenv("AKESOD_TEST_CONTROL_TOKEN", "")
+	opts := &Options{controlListen: "tcp://0.0.0.0:0", controlTokenEnv: "AKESOD_TEST_CONTROL_TOKEN"}
+	if err := serveControl(context.Background(), opts, th.keyUpdateHandler); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("with an empty token variable: %v", err)
+	}
+
+	for _, addr := range []string{"tcp://127.0.0.1:0", "tcp://[::1]:0", "tcp://localhost:0"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() { errc <- serveControl(ctx, &Options{controlListen: addr}, th.keyUpdateHandler) }()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errc:
+			if err != nil && !strings.Contains(err.Error(), "cannot assign requested address") {
+				t.Errorf("%s without a token: %v", addr, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("serveControl on %s didn't return after ctx was done", addr)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/escrow"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/art"
+)
+
+// newTestGroup sets up an ART group of akesod and two members, and returns
+// akesod's state and the private IKs of the leaves
+func newTestGroup(t *testing.T) (*artx.GroupInfo, *art.TreeState, []ed25519.PrivateKey) {
+	dir := t.TempDir()
+	conf := ""
+	var iks []ed25519.PrivateKey
+	for _, name := range []string{"akesod", "bob", "cici"} {
+		ik, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePublicIKToFile(ik, filepath.Join(dir, name+"-ik-pub.pem"), art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePublicEKToFile(ek.PublicKey(), filepath.Join(dir, name+"-ek-pub.pem"), art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		conf += fmt.Sprintf("%s %s-ik-pub.pem %s-ek-pub.pem\n", name, name, name)
+		iks = append(iks, priv)
+	}
+	confFile := filepath.Join(dir, "3.conf")
+	if err := os.WriteFile(confFile, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, _ := art.SetupGroup(confFile, "akesod")
+	info := artx.NewGroupInfo()
+	info.Epoch = 4
+
+	// SetupGroup leaves the stage key as a bare seed; akesod holds the
+	// full key once the state has been through the store
+	data, err := artx.MarshalGroupState(info, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, tree, err = artx.UnmarshalGroupState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info, tree, iks
+}
+
+// The host running akesod is lost: two of three custodians open their
+// shares of the last escrowed epoch, and the state is recovered into a
+// new store with the same bucket keys.
+func TestEscrowRecovery(t *testing.T) {
+	info, tree, _ := newTestGroup(t)
+
+	dir := t.TempDir()
+	var specs []string
+	privs := make(map[string]*ecdh.PrivateKey)
+	for _, name := range []string{"alice", "bob", "cici"} {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubFile := filepath.Join(dir, name+"-escrow-pub.pem")
+		if err := art.WritePublicEKToFile(priv.PublicKey(), pubFile, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, name+"="+pubFile)
+		privs[name] = priv
+	}
+
+	opts := &Options{
+		group:            "team",
+		kdfSalt:          []byte("salt"),
+		strategy:         "akeso",
+		escrowThreshold:  2,
+		escrowCustodians: specs,
+		escrowDir:        filepath.Join(dir, "escrow"),
+	}
+	escrowGroupState(opts, info, tree)
+
+	var shares []*escrow.Share
+	for _, name := range []string{"cici", "alice"} {
+		ss, err := escrow.ReadSealedShare(filepath.Join(escrow.EpochDir(opts.escrowDir, info.Epoch), name+".share"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		share, err := ss.Open(privs[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, share)
+	}
+
+	if _, err := escrow.Combine(shares[:1]); err == nil {
+		t.Fatal("one custodian recovered the state")
+	}
+	data, err := escrow.Combine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what akeso-escrow combine does on the new host
+	st, err := store.Open(filepath.Join(dir, "state"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Commit(info.Epoch, data); err != nil {
+		t.Fatal(err)
+	}
+	gotInfo, gotTree, err := loadGroupState(st, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotInfo.ID != info.ID || gotInfo.Epoch != info.Epoch {
+		t.Fatalf("recovered epoch %d of group %s, expected epoch %d of group %s", gotInfo.Epoch, gotInfo.ID, info.Epoch, info.ID)
+	}
+	if !bytes.Equal(gotTree.StageKey(), tree.StageKey()) {
+		t.Fatal("recovered a different stage key")
+	}
+	want := newEpochKeys(info, tree, opts).bucketKey("bucket")
+	got := newEpochKeys(gotInfo, gotTree, opts).bucketKey("bucket")
+	if !bytes.Equal(got, want) {
+		t.Fatal("recovered state derives a different bucket key")
+	}
+}
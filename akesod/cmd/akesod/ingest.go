@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/etclab/akesod/internal/secret"
+)
+
+// What akesod does with objects found without valid akeso metadata, e.g.
+// plaintext uploaded with gsutil
+const (
+	ingestOff        = "off"
+	ingestEncrypt    = "encrypt"
+	ingestQuarantine = "quarantine"
+	ingestAlert      = "alert"
+)
+
+var ingestPolicies = []string{ingestOff, ingestEncrypt, ingestQuarantine, ingestAlert}
+
+// Reports whether an object is one the ingest policy leaves alone: objects
+// already quarantined, and, with the policy off, all of them.
+func ingestSkips(opts *Options, name string) bool {
+	return opts.ingestPolicy == ingestOff || (opts.quarantinePrefix != "" && strings.HasPrefix(name, opts.quarantinePrefix))
+}
+
+// Returns the error for an object without valid akeso metadata, or nil
+func checkIngest(attrs *storage.ObjectAttrs) error {
+	_, err := encstr.DetectStrategy(attrs)
+	if errors.Is(err, encstr.ErrNoStrategy) || errors.Is(err, encstr.ErrBadMetadata) {
+		return err
+	}
+	return nil
+}
+
+// The quarantined copy of an object keeps its name under the quarantine
+// prefix and its generation, so that uploads of the same name don't collide.
+func quarantineName(opts *Options, attrs *storage.ObjectAttrs) string {
+	return opts.quarantinePrefix + strconv.FormatInt(attrs.Generation, 10) + "/" + attrs.Name
+}
+
+// Applies the ingest policy to an object that failed checkIngest with
+// reason.  With the encrypt policy the object is encrypted in place under
+// key, the bucket's key at epoch; objects whose akeso metadata is broken
+// rather than missing might be ciphertext, so they are only ever
+// quarantined or alerted on.  An object changed since attrs were read is
+// left for the next scan.
+func enforceIngest(ctx context.Context, opts *Options, epoch uint64, bucket string, bkt *storage.BucketHandle,
+	attrs *storage.ObjectAttrs, key []byte, reason error) error {
+	policy := opts.ingestPolicy
+	if policy == ingestEncrypt && errors.Is(reason, encstr.ErrBadMetadata) {
+		policy = ingestAlert
+	}
+
+	var action string
+	var err error
+	switch policy {
+	case ingestEncrypt:
+		action = "encrypted"
+		var metadata map[string]string
+		if opts.strategy == "akeso" {
+			metadata = map[string]string{encstr.MetaEpoch: strconv.FormatUint(epoch, 10)}
+		}
+		err = encstr.EncryptInPlace(ctx, bkt, attrs, opts.strategy, key, metadata)
+	case ingestQuarantine:
+		action = "quarantined"
+		err = gcsx.MoveObject(ctx, bkt, attrs, quarantineName(opts, attrs))
+	default:
+		action = "alerted"
+	}
+	if gcsx.IsPreconditionFailed(err) {
+		log.Printf("gs://%s/%s changed while applying the ingest policy; leaving it for the next scan.\n", bucket, attrs.Name)
+		return nil
+	}
+
+	fields := map[string]string{
+		"bucket": bucket,
+		"object": attrs.Name,
+		"action": action,
+		"reason": reason.Error(),
+	}
+	if err != nil {
+		fields["action"] = "failed"
+		fields["error"] = err.Error()
+		metrics.IngestActions.WithLabelValues("failed").Inc()
+		recordAudit(audit.EventIngest, opts, epoch, fields)
+		return fmt.Errorf("%s under the %s ingest policy: %w", attrs.Name, policy, err)
+	}
+
+	metrics.IngestActions.WithLabelValues(action).Inc()
+	recordAudit(audit.EventIngest, opts, epoch, fields)
+	if action == "alerted" {
+		log.Printf("warning: gs://%s/%s is not encrypted by akesod: %v\n", bucket, attrs.Name, reason)
+	} else {
+		log.Printf("%s gs://%s/%s, which was not encrypted by akesod: %v\n", strings.ToUpper(action[:1])+action[1:], bucket, attrs.Name, reason)
+	}
+	return nil
+}
+
+// Periodically scans the group's buckets for objects without valid akeso
+// metadata and applies the ingest policy to them.  A scan holds the
+// handler's lock, like a rotation, so that objects are encrypted under the
+// current epoch's key; groups with a pending rotation are skipped, since
+// the rotation applies the policy itself.
+func (h *keyUpdateHandler) scanIngest(ctx context.Context, g *groupHandler) {
+	ticker := time.NewTicker(g.opts.ingestScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.mtx.Lock()
+			h.scanGroupIngest(g)
+			h.mtx.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *keyUpdateHandler) scanGroupIngest(g *groupHandler) {
+	ctx := h.workCtx
+
+	groupInfo, treeState, err := loadGroupState(g.st, g.opts)
+	if err != nil {
+		log.Printf("error: ingest scan: %v\n", err)
+		return
+	}
+	if groupInfo.PendingRotation {
+		return
+	}
+	keys := newEpochKeys(groupInfo, treeState, g.opts)
+	defer keys.destroy()
+
+	for bucket, bkt := range g.bkts {
+		objects, err := listObjects(ctx, bucket, bkt)
+		if err != nil {
+			log.Printf("error: ingest scan of %s: %v\n", bucket, err)
+			continue
+		}
+
+		var key []byte
+		found := 0
+		for _, object := range objects {
+			if stopped(h.stopping) {
+				break
+			}
+			if ingestSkips(g.opts, object.Name) {
+				continue
+			}
+			reason := checkIngest(object)
+			if reason == nil {
+				continue
+			}
+			found++
+			if key == nil && g.opts.ingestPolicy == ingestEncrypt {
+				key = keys.bucketKey(bucket)
+			}
+			if err := enforceIngest(ctx, g.opts, groupInfo.Epoch, bucket, bkt, object, key, reason); err != nil {
+				log.Printf("error: %v\n", err)
+			}
+		}
+		secret.Zero(key)
+		metrics.UnencryptedObjects.WithLabelValues(bucket).Set(float64(found))
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/completion"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/metrics"
+)
+
+// How a layer left to the workers ended
+const (
+	layerPending    = ""
+	layerApplied    = "applied"
+	layerSuperseded = "superseded"
+	layerFailed     = "failed"
+)
+
+type objectKey struct {
+	bucket, name string
+}
+
+// pendingLayer is the akeso layer a rotation left on one object
+type pendingLayer struct {
+	status     *rotationStatus
+	opts       *Options
+	epoch      uint64
+	bucket     string
+	name       string
+	rotation   string            // dekwrap scope
+	layerAttrs map[string]string // to republish the metadata update event
+	queued     time.Time
+	failures   int
+	state      string
+}
+
+// layerTracker follows the akeso layers that rotations leave to the cloud
+// function or encrypt-worker, by the completion events the workers publish.
+// An object has at most one pending layer, since AkesoUpdate drops a layer
+// that was never applied, so layers are tracked by object.
+//
+// A worker that gives up on a layer has the object's metadata update event
+// republished, until the layer has failed akesod.max_delivery_attempts
+// times; it is then counted as failed, unless a later event reports it
+// applied.  Applied and superseded layers are forgotten.
+type layerTracker struct {
+	mtx    sync.Mutex
+	ctx    context.Context
+	msgBus bus.Bus
+	layers map[objectKey]*pendingLayer
+}
+
+func newLayerTracker(ctx context.Context, msgBus bus.Bus) *layerTracker {
+	return &layerTracker{ctx: ctx, msgBus: msgBus, layers: make(map[objectKey]*pendingLayer)}
+}
+
+// Registers the layer the rotation is about to add to an object, before
+// AkesoUpdate, so that its completion can't arrive first.  A layer of an
+// earlier rotation still pending on the object is superseded.
+func (t *layerTracker) expect(status *rotationStatus, opts *Options, epoch uint64, bucket, name string, layerAttrs map[string]string) *pendingLayer {
+	l := &pendingLayer{
+		status:     status,
+		opts:       opts,
+		epoch:      epoch,
+		bucket:     bucket,
+		name:       name,
+		rotation:   layerAttrs[dekwrap.AttrRotation],
+		layerAttrs: layerAttrs,
+		queued:     time.Now(),
+	}
+
+	t.mtx.Lock()
+	prev := t.layers[objectKey{bucket, name}]
+	t.layers[objectKey{bucket, name}] = l
+	t.mtx.Unlock()
+
+	status.layerQueued()
+	if prev != nil && prev.state == layerPending {
+		t.settle(prev, layerSuperseded)
+	}
+	return l
+}
+
+// Forgets l, for which AkesoUpdate left no layer
+func (t *layerTracker) drop(l *pendingLayer) {
+	t.mtx.Lock()
+	key := objectKey{l.bucket, l.name}
+	if t.layers[key] == l {
+		delete(t.layers, key)
+	}
+	state := l.state
+	t.mtx.Unlock()
+
+	if r, done := l.status.layerDropped(state); done {
+		recordLayersDone(l.opts, r)
+	}
+}
+
+// Handles a completion event.  Events are always acked: one that can't be
+// used would be no more useful redelivered.
+func (t *layerTracker) handle(_ context.Context, msg *bus.Message) {
+	defer msg.Ack()
+
+	ev, err := completion.Parse(msg)
+	if err != nil {
+		log.Printf("Dropping completion event %s: %v\n", msg.ID, err)
+		return
+	}
+
+	key := objectKey{ev.Bucket, ev.Name}
+	t.mtx.Lock()
+	l, ok := t.layers[key]
+	if !ok || l.rotation != ev.Rotation {
+		t.mtx.Unlock()
+		metrics.LayerEvents.WithLabelValues("unknown").Inc()
+		log.Printf("Ignoring %s completion of gs://%s/%s for rotation %s, which has no layer pending.\n", ev.Result, ev.Bucket, ev.Name, ev.Rotation)
+		return
+	}
+	metrics.LayerEvents.WithLabelValues(ev.Result).Inc()
+
+	var retry, gaveUp bool
+	next := l.state
+	switch ev.Result {
+	case completion.ResultApplied, completion.ResultAlreadyApplied:
+		next = layerApplied
+	case completion.ResultNotPending:
+		next = layerSuperseded
+	case completion.ResultFailed:
+		l.failures++
+		if l.state == layerPending {
+			if l.failures >= l.opts.maxDeliveryAttempts {
+				next, gaveUp = layerFailed, true
+			} else {
+				retry = !ev.Retrying
+			}
+		}
+	}
+	if next == layerApplied || next == layerSuperseded {
+		delete(t.layers, key)
+	}
+	prev, failures := l.state, l.failures
+	t.mtx.Unlock()
+
+	switch {
+	case next != prev:
+		if next == layerApplied {
+			metrics.LayerLatency.Observe(ev.Finished.Sub(l.queued).Seconds())
+		}
+		if gaveUp {
+			log.Printf("error: giving up on the layer of gs://%s/%s after %d failures: %s\n", l.bucket, l.name, failures, ev.Error)
+		}
+		t.settle(l, next)
+	case retry:
+		log.Printf("%s gave up on the layer of gs://%s/%s (failure %d of %d): %s; republishing its event.\n", ev.Worker, l.bucket, l.name, failures, l.opts.maxDeliveryAttempts, ev.Error)
+		metrics.LayerRetries.Inc()
+		if err := publishMetadataUpdate(t.ctx, t.msgBus, l.opts, l.bucket, l.name, l.layerAttrs); err != nil {
+			log.Printf("error: republishing the metadata update event of gs://%s/%s: %v\n", l.bucket, l.name, err)
+		}
+	case ev.Result == completion.ResultFailed:
+		log.Printf("%s failed to apply the layer of gs://%s/%s (failure %d): %s\n", ev.Worker, l.bucket, l.name, failures, ev.Error)
+	}
+}
+
+// Moves l to state and records it, and its rotation once all the rotation's
+// layers are accounted for
+func (t *layerTracker) settle(l *pendingLayer, state string) {
+	t.mtx.Lock()
+	prev, failures := l.state, l.failures
+	l.state = state
+	t.mtx.Unlock()
+	if prev == state {
+		return
+	}
+
+	fields := map[string]string{
+		"bucket": l.bucket,
+		"object": l.name,
+		"result": state,
+	}
+	if failures > 0 {
+		fields["failures"] = strconv.Itoa(failures)
+	}
+	recordAudit(audit.EventLayer, l.opts, l.epoch, fields)
+
+	if r, done := l.status.layerSettled(prev, state); done {
+		recordLayersDone(l.opts, r)
+	}
+}
+
+// Records a rotation whose layers are all accounted for
+func recordLayersDone(opts *Options, r control.Rotation) {
+	elapsed := r.LayersDone.Sub(r.Started)
+	metrics.RotationEndToEnd.Observe(elapsed.Seconds())
+	log.Printf("Rotation of group %q to epoch %d is done end to end in %v: %d of %d layers applied, %d superseded, %d failed.\n",
+		r.Group, r.Epoch, elapsed, r.LayersApplied, r.Layers, r.LayersSuperseded, r.LayersFailed)
+	recordAudit(audit.EventLayersDone, opts, r.Epoch, map[string]string{
+		"layers":     strconv.Itoa(r.Layers),
+		"applied":    strconv.Itoa(r.LayersApplied),
+		"superseded": strconv.Itoa(r.LayersSuperseded),
+		"failed":     strconv.Itoa(r.LayersFailed),
+		"seconds":    strconv.FormatFloat(elapsed.Seconds(), 'f', 3, 64),
+	})
+}
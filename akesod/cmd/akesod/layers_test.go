@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/completion"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func sendCompletion(t *testing.T, lt *layerTracker, rotation, name, result string, retrying bool) {
+	ev := &completion.Event{
+		Rotation: rotation,
+		Bucket:   "bucket",
+		Name:     name,
+		Result:   result,
+		Retrying: retrying,
+		Worker:   "test",
+		Started:  time.Now(),
+		Finished: time.Now(),
+	}
+	if result == completion.ResultFailed {
+		ev.Error = "boom"
+	}
+	msg, err := ev.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.handle(context.Background(), msg)
+}
+
+func TestLayerTracker(t *testing.T) {
+	opts := &Options{group: "g", metadataUpdateTopic: "metadata-updates", maxDeliveryAttempts: 3}
+	mb := bus.NewMemory()
+	mb.CreateSubscription(opts.metadataUpdateTopic, "test")
+	lt := newLayerTracker(context.Background(), mb)
+
+	rotations := newRotationTracker()
+	status := rotations.start("g", 1, control.TriggerControl, "")
+	scope := dekwrap.Scope("g", 1, "bucket")
+	attrs := map[string]string{dekwrap.AttrRotation: scope}
+
+	a := lt.expect(status, opts, 1, "bucket", "a", attrs)
+	b := lt.expect(status, opts, 1, "bucket", "b", attrs)
+	c := lt.expect(status, opts, 1, "bucket", "c", attrs)
+	lt.drop(c) // AkesoUpdate rewrote c instead
+
+	// a worker may finish before the rotation's objects do
+	sendCompletion(t, lt, scope, "a", completion.ResultApplied, false)
+	if _, done := rotations.finish(status, control.StateCompleted, nil); done {
+		t.Fatal("rotation done with a layer pending")
+	}
+	r := status.snapshot()
+	if r.State != control.StateApplying || r.Layers != 2 || r.LayersApplied != 1 {
+		t.Fatalf("after finishing the objects: %+v", r)
+	}
+
+	// events for other rotations or objects are ignored
+	sendCompletion(t, lt, dekwrap.Scope("g", 0, "bucket"), "b", completion.ResultApplied, false)
+	sendCompletion(t, lt, scope, "c", completion.ResultApplied, false)
+	if r := status.snapshot(); r.LayersApplied != 1 {
+		t.Fatalf("stale events were counted: %+v", r)
+	}
+
+	// a worker that gives up has the event republished
+	sendCompletion(t, lt, scope, "b", completion.ResultFailed, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var republished *bus.Message
+	mb.Subscribe(ctx, opts.metadataUpdateTopic, "test", func(ctx context.Context, m *bus.Message) {
+		republished = m
+		m.Ack()
+		cancel()
+	})
+	if republished == nil || republished.Attributes[dekwrap.AttrRotation] != scope {
+		t.Fatalf("republished event = %+v", republished)
+	}
+
+	sendCompletion(t, lt, scope, "b", completion.ResultAlreadyApplied, false)
+	r = status.snapshot()
+	if r.State != control.StateCompleted || r.LayersApplied != 2 || r.LayersDone == nil {
+		t.Fatalf("after the last layer: %+v", r)
+	}
+	if a.state != layerApplied || b.state != layerApplied {
+		t.Errorf("layer states %q, %q", a.state, b.state)
+	}
+}
+
+func TestLayerTrackerGivesUp(t *testing.T) {
+	opts := &Options{group: "g", metadataUpdateTopic: "metadata-updates", maxDeliveryAttempts: 2}
+	lt := newLayerTracker(context.Background(), bus.NewMemory())
+
+	rotations := newRotationTracker()
+	status := rotations.start("g", 2, control.TriggerControl, "")
+	scope := dekwrap.Scope("g", 2, "bucket")
+	lt.expect(status, opts, 2, "bucket", "a", map[string]string{dekwrap.AttrRotation: scope})
+	rotations.finish(status, control.StateCompleted, nil)
+
+	sendCompletion(t, lt, scope, "a", completion.ResultFailed, true)
+	if r := status.snapshot(); r.State != control.StateApplying {
+		t.Fatalf("failed after one failure: %+v", r)
+	}
+	sendCompletion(t, lt, scope, "a", completion.ResultFailed, true)
+	r := status.snapshot()
+	if r.State != control.StateFailed || r.LayersFailed != 1 || r.LayersDone == nil {
+		t.Fatalf("after %d failures: %+v", opts.maxDeliveryAttempts, r)
+	}
+
+	// the worker's own retry may still succeed
+	sendCompletion(t, lt, scope, "a", completion.ResultApplied, false)
+	if r := status.snapshot(); r.State != control.StateCompleted || r.LayersFailed != 0 || r.LayersApplied != 1 {
+		t.Fatalf("after a late success: %+v", r)
+	}
+}
+
+// layerBus feeds completion events to a layerTracker over the memory bus,
+// the way akesod subscribes it to the completion topic
+type layerBus struct {
+	mb    *bus.Memory
+	opts  *Options
+	acked chan bool // whether each event was acked
+}
+
+func newLayerBus(t *testing.T, opts *Options) (*layerBus, *layerTracker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lb := &layerBus{mb: bus.NewMemory(), opts: opts, acked: make(chan bool, 1)}
+	lb.mb.CreateSubscription(opts.completionTopic, "akesod")
+	lb.mb.CreateSubscription(opts.metadataUpdateTopic, "workers")
+	lt := newLayerTracker(ctx, lb.mb)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.mb.Subscribe(ctx, opts.completionTopic, "akesod", func(ctx context.Context, m *bus.Message) {
+			lt.handle(ctx, bus.NewMessage(m.ID, m.Data, m.Attributes, func(ok bool) {
+				if ok {
+					m.Ack()
+				} else {
+					m.Nack()
+				}
+				lb.acked <- ok
+			}))
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return lb, lt
+}
+
+// Publishes a worker's completion event and waits for the tracker to
+// handle it
+func (lb *layerBus) send(t *testing.T, rotation, name, result string, retrying bool) {
+	t.Helper()
+	ev := &completion.Event{
+		Rotation: rotation,
+		Bucket:   "bucket",
+		Name:     name,
+		Result:   result,
+		Retrying: retrying,
+		Worker:   "test",
+		Started:  time.Now(),
+		Finished: time.Now(),
+	}
+	if result == completion.ResultFailed {
+		ev.Error = "boom"
+	}
+	msg, err := ev.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.mb.Publish(context.Background(), lb.opts.completionTopic, msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-lb.acked:
+		if !ok {
+			t.Fatalf("the %s event of %s was nacked", result, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the %s event of %s wasn't handled", result, name)
+	}
+}
+
+// Returns the objects whose metadata update events were republished since
+// the last call
+func (lb *layerBus) republished(t *testing.T) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var names []string
+	lb.mb.Subscribe(ctx, lb.opts.metadataUpdateTopic, "workers", func(ctx context.Context, m *bus.Message) {
+		var ev struct{ Name string }
+		if err := json.Unmarshal(m.Data, &ev); err != nil {
+			t.Error(err)
+		}
+		names = append(names, ev.Name)
+		m.Ack()
+	})
+	return names
+}
+
+// Writes the audit log to a temporary file for the duration of the test,
+// and returns a function that reads its entries of type typ
+func testAuditLog(t *testing.T) func(typ string) []audit.Entry {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := auditLog
+	auditLog = l
+	t.Cleanup(func() {
+		auditLog = prev
+		l.Close()
+	})
+
+	return func(typ string) []audit.Entry {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []audit.Entry
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			var e audit.Entry
+			if err := json.Unmarshal(line, &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type == typ {
+				entries = append(entries, e)
+			}
+		}
+		return entries
+	}
+}
+
+// Two rotations' layers, fed their completion events over the bus: the
+// retries of failed layers, the failure threshold, superseded and dropped
+// layers, and the end of each rotation once its layers are accounted for
+func TestLayerTrackerOverBus(t *testing.T) {
+	opts := &Options{
+		group:               "g",
+		metadataUpdateTopic: "metadata-updates",
+		completionTopic:     "completions",
+		maxDeliveryAttempts: 3,
+	}
+	lb, lt := newLayerBus(t, opts)
+	auditEntries := testAuditLog(t)
+	events := func(result string) float64 { return testutil.ToFloat64(metrics.LayerEvents.WithLabelValues(result)) }
+	retries, unknown, failed := testutil.ToFloat64(metrics.LayerRetries), events("unknown"), events(completion.ResultFailed)
+
+	rotations := newRotationTracker()
+	status1 := rotations.start("g", 1, control.TriggerControl, "")
+	scope1 := dekwrap.Scope("g", 1, "bucket")
+	attrs1 := map[string]string{dekwrap.AttrRotation: scope1}
+	a := lt.expect(status1, opts, 1, "bucket", "a", attrs1)
+	b := lt.expect(status1, opts, 1, "bucket", "b", attrs1)
+	c := lt.expect(status1, opts, 1, "bucket", "c", attrs1)
+	d1 := lt.expect(status1, opts, 1, "bucket", "d", attrs1)
+	lt.drop(c) // AkesoUpdate rewrote c instead
+	if _, done := rotations.finish(status1, control.StateCompleted, nil); done {
+		t.Fatal("rotation 1 done with its layers pending")
+	}
+	if r := status1.snapshot(); r.State != control.StateApplying || r.Layers != 3 {
+		t.Fatalf("after rotation 1's objects: %+v", r)
+	}
+
+	// a worker that gives up has the event republished; one that retries
+	// itself doesn't
+	lb.send(t, scope1, "a", completion.ResultFailed, false)
+	lb.send(t, scope1, "a", completion.ResultFailed, true)
+	if names := lb.republished(t); len(names) != 1 || names[0] != "a" {
+		t.Fatalf("republished %v; expected a once", names)
+	}
+	lb.send(t, scope1, "a", completion.ResultApplied, false)
+	if a.state != layerApplied || a.failures != 2 {
+		t.Errorf("a: %q after %d failures", a.state, a.failures)
+	}
+
+	// b fails max_delivery_attempts times, and is republished until then
+	for range opts.maxDeliveryAttempts {
+		lb.send(t, scope1, "b", completion.ResultFailed, false)
+	}
+	if names := lb.republished(t); len(names) != opts.maxDeliveryAttempts-1 {
+		t.Fatalf("republished %v; expected b %d times", names, opts.maxDeliveryAttempts-1)
+	}
+	if b.state != layerFailed {
+		t.Fatalf("b: %q after %d failures", b.state, b.failures)
+	}
+	// further failures don't count it again
+	lb.send(t, scope1, "b", completion.ResultFailed, false)
+	if names := lb.republished(t); len(names) != 0 {
+		t.Fatalf("republished %v for a failed layer", names)
+	}
+
+	// the next rotation gets to d before its layer is applied
+	status2 := rotations.start("g", 2, control.TriggerControl, "")
+	scope2 := dekwrap.Scope("g", 2, "bucket")
+	attrs2 := map[string]string{dekwrap.AttrRotation: scope2}
+	d2 := lt.expect(status2, opts, 2, "bucket", "d", attrs2)
+	if d1.state != layerSuperseded {
+		t.Fatalf("d's layer of rotation 1: %q", d1.state)
+	}
+	r := status1.snapshot()
+	if r.State != control.StateFailed || r.LayersDone == nil ||
+		r.Layers != 3 || r.LayersApplied != 1 || r.LayersFailed != 1 || r.LayersSuperseded != 1 {
+		t.Fatalf("rotation 1 once its layers are accounted for: %+v", r)
+	}
+
+	// the superseded layer's events are ignored
+	lb.send(t, scope1, "d", completion.ResultApplied, false)
+	if r := status1.snapshot(); r.LayersApplied != 1 {
+		t.Fatalf("a superseded layer was counted applied: %+v", r)
+	}
+
+	// a completion can arrive before AkesoUpdate reports that it left no
+	// layer; dropping the layer then takes back its count
+	e := lt.expect(status2, opts, 2, "bucket", "e", attrs2)
+	lb.send(t, scope2, "e", completion.ResultApplied, false)
+	lt.drop(e)
+	if r := status2.snapshot(); r.Layers != 1 || r.LayersApplied != 0 {
+		t.Fatalf("after dropping an applied layer: %+v", r)
+	}
+
+	rotations.finish(status2, control.StateCompleted, nil)
+	lb.send(t, scope2, "d", completion.ResultNotPending, false)
+	r = status2.snapshot()
+	if d2.state != layerSuperseded || r.State != control.StateCompleted || r.LayersDone == nil || r.LayersSuperseded != 1 {
+		t.Fatalf("rotation 2 once its layers are accounted for: %+v", r)
+	}
+
+	done := auditEntries(audit.EventLayersDone)
+	if len(done) != 2 {
+		t.Fatalf("%d rotations audited as done; expected 2", len(done))
+	}
+	for i, expected := range []map[string]string{
+		{"layers": "3", "applied": "1", "superseded": "1", "failed": "1"},
+		{"layers": "1", "applied": "0", "superseded": "1", "failed": "0"},
+	} {
+		for k, v := range expected {
+			if done[i].Fields[k] != v {
+				t.Errorf("rotation %d audited with %s=%s; expected %s", done[i].Epoch, k, done[i].Fields[k], v)
+			}
+		}
+	}
+	// a, b, d twice and e; c was dropped before it settled
+	if n := len(auditEntries(audit.EventLayer)); n != 5 {
+		t.Errorf("%d settled layers audited; expected 5", n)
+	}
+
+	if got := testutil.ToFloat64(metrics.LayerRetries) - retries; got != 3 {
+		t.Errorf("%v retries counted; expected 1 for a and 2 for b", got)
+	}
+	if got := events("unknown") - unknown; got != 1 {
+		t.Errorf("%v unknown events counted; expected 1", got)
+	}
+	if got := events(completion.ResultFailed) - failed; got != 6 {
+		t.Errorf("%v failure events counted; expected 6", got)
+	}
+}
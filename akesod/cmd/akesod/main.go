@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"log"
-
-	"cloud.google.com/go/pubsub"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/etclab/mu"
 )
 
 func main() {
@@ -14,63 +20,86 @@ func main() {
 
 	opts := parseOptions()
 
-	ctx := context.Background()
+	// SIGINT/SIGTERM stop new work; a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
-	setupTopic := opts.setupTopic
 	updateTopic := opts.updateTopic
-	projectID := opts.project
-	pubsubClient, _ := pubsub.NewClient(ctx, projectID)
-	// Message to publish in the pub/sub SetupGroup channel
-	type SetupGroupMessage struct {
-		EKeys       map[string][]byte `json:"EKeys"`
-		IKeys       map[string][]byte `json:"IKeys"`
-		InPubKey    []byte            `json:"InPubKey"`
-		SetupMsg    []byte            `json:"SetupMsg"`
-		SetupMsgSig []byte            `json:"SetupMsgSig"`
+	msgBus := openBus(ctx, opts)
+
+	auditLog = openAuditLog(opts)
+	defer auditLog.Close()
+
+	if opts.metricsListen != "" {
+		go func() {
+			if err := metrics.ListenAndServe(ctx, opts.metricsListen); err != nil {
+				mu.Fatalf("error: metrics server: %v", err)
+			}
+		}()
 	}
 
-	setupGroupMessage := &SetupGroupMessage{}
+	var setupGroups []*Options
+	for _, g := range opts.groups {
+		if g.setupRequired {
+			setupGroups = append(setupGroups, g)
+		}
+	}
 
-	if opts.setupRequired {
+	if len(setupGroups) > 0 {
+		for _, g := range setupGroups {
+			if err := os.MkdirAll(g.outDir, 0750); err != nil {
+				mu.Fatalf("error: can't create key dir: %v", err)
+			}
+		}
 
-		if opts.basePath == "" {
-			opts.basePath = "keys/akesod"
+		// Members generate their own IK/EK and only submit the public halves
+		regs := collectRegistrations(ctx, msgBus, opts.registrationTopic, setupGroups)
+
+		for _, g := range setupGroups {
+			setupGroup(ctx, msgBus, g, regs[g.group])
 		}
+	}
 
-		generateKeys("ek", opts.outform, opts.basePath, opts.encoding)
-		initiator_pub_ik := generateKeys("ik", opts.outform, opts.basePath, opts.encoding)
-		log.Println("Keys for inititator generated.")
-
-		// TODO: Make the members key generation and publishing automated
-		bob_ek := generateKeys("ek", opts.outform, "keys/bob", opts.encoding)
-		bob_ik := generateKeys("ik", opts.outform, "keys/bob", opts.encoding)
-
-		cici_ek := generateKeys("ek", opts.outform, "keys/cici", opts.encoding)
-		cici_ik := generateKeys("ik", opts.outform, "keys/cici", opts.encoding)
-
-		dave_ek := generateKeys("ek", opts.outform, "keys/dave", opts.encoding)
-		dave_ik := generateKeys("ik", opts.outform, "keys/dave", opts.encoding)
-		log.Println("Keys for members generated.")
-
-		setupGroupMessage.InPubKey = initiator_pub_ik
-		setupGroupMessage.EKeys = make(map[string][]byte)
-		setupGroupMessage.EKeys["bob"] = bob_ek
-		setupGroupMessage.EKeys["cici"] = cici_ek
-		setupGroupMessage.EKeys["dave"] = dave_ek
-		setupGroupMessage.IKeys = make(map[string][]byte)
-		setupGroupMessage.IKeys["bob"] = bob_ik
-		setupGroupMessage.IKeys["cici"] = cici_ik
-		setupGroupMessage.IKeys["dave"] = dave_ik
-		setup_msg, setup_msg_sig := setup_group(opts)
-		setupGroupMessage.SetupMsg = setup_msg
-		setupGroupMessage.SetupMsgSig = setup_msg_sig
-		jsonData, _ := json.Marshal(setupGroupMessage)
-		publish(ctx, setupTopic, pubsubClient, jsonData)
-		log.Printf("Setup Group Message published to %s channel.\n", setupTopic)
+	err := handleKeyUpdateSubscription(ctx, updateTopic, msgBus, opts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
 	}
 
-	go handleKeyUpdateSubscription(ctx, updateTopic, pubsubClient, opts)
+	msgBus.Close()
+	log.Println("Exiting.")
+}
 
-	select {}
+// Message to publish in the pub/sub SetupGroup channel.  Members already
+// hold their own keys, so only public material is sent.  Key updates must
+// carry GroupID to be accepted; Group is the configured group name.
+type SetupGroupMessage struct {
+	Group       string `json:"Group,omitempty"`
+	GroupID     string `json:"GroupID"`
+	InPubKey    []byte `json:"InPubKey"`
+	SetupMsg    []byte `json:"SetupMsg"`
+	SetupMsgSig []byte `json:"SetupMsgSig"`
+}
 
+// Generates akesod's keys for the group, sets up the ART tree from the
+// registered members and publishes the setup message.
+func setupGroup(ctx context.Context, msgBus bus.Bus, opts *Options, regs map[string]*artx.Registration) {
+	generateKeys("ek", opts.outform, opts.basePath, opts.encoding)
+	initiator_pub_ik := generateKeys("ik", opts.outform, opts.basePath, opts.encoding)
+	log.Printf("Keys for inititator of group %q generated.\n", opts.groupName())
+
+	writeGroupConfig(opts, regs)
+	log.Printf("Public keys for members of group %q registered.\n", opts.groupName())
+
+	setup_msg, setup_msg_sig, group_id := setup_group(opts)
+	setupGroupMessage := &SetupGroupMessage{
+		Group:       opts.group,
+		GroupID:     group_id,
+		InPubKey:    initiator_pub_ik,
+		SetupMsg:    setup_msg,
+		SetupMsgSig: setup_msg_sig,
+	}
+	jsonData, _ := json.Marshal(setupGroupMessage)
+	publish(ctx, opts.setupTopic, msgBus, jsonData)
+	log.Printf("Setup Group Message for group %q published to %s channel.\n", opts.groupName(), opts.setupTopic)
 }
@@ -1,50 +1,131 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/etclab/akesod/internal/bus"
 	"github.com/etclab/art"
 	"github.com/etclab/mu"
 	"github.com/spf13/viper"
 )
 
-const usage = `Usage: akesod`
+const usage = `Usage: akesod [options] [BASE_PATH]
+
+Runs the Akeso daemon: sets up the ART group(s) if required, then applies
+key updates and rotates the groups' buckets to each new epoch.
+
+Settings are read from config/config.yaml (see config/config.yaml.example).
+Each setting can be overridden by an environment variable or a flag, which
+takes precedence; only the groups list must come from the file.  Lists are
+comma-separated on flags and in the environment.
+
+positional arguments:
+  BASE_PATH
+    Path prefix of akesod's key files.
+    Default: keys/akesod
+
+options:
+  -config FILE
+    Read this config file instead of config/config.yaml.
+
+  -print-config
+    Print the effective configuration as YAML, check it, and exit.
+
+  -help
+    Display this usage statement and exit.
+
+`
 
 type Options struct {
 	// optional
 	setupRequired       bool
 	setupTopic          string
+	registrationTopic   string
 	updateTopic         string
 	metadataUpdateTopic string
+	workerKeyFile       string
+	completionTopic     string
 	project             string
 	outform             string
 	keytype             string
 	artConfigFile       string
 	numOfMembers        int
+	members             []string
+	requirePinnedIK     bool
 	initiator           string
 	outDir              string
 	sigFile             string
 	msgFile             string
-	treeStateFile       string
 	privIKFile          string
 	kdfSalt             []byte
 	strategy            string
 	maxReencryptions    int
 	maxConcUpdates      int
+	busKind             string
+	busAddress          string
+	busServe            bool
+	stateDir            string
+	stateKeyFile        string
+	statePassphraseEnv  string
+	stateSnapshots      int
+	deadLetterTopic     string
+	maxDeliveryAttempts int
+	metricsListen       string
+	metricsScanInterval time.Duration
+	shutdownTimeout     time.Duration
+	auditLog            string
+	auditKeyFile        string
+	controlListen       string
+	controlTokenEnv     string
+	escrowThreshold     int
+	escrowCustodians    []string
+	escrowDir           string
+	ingestPolicy        string
+	ingestScanInterval  time.Duration
+	quarantinePrefix    string
 
 	// positional
-	bucket   string
 	basePath string
 
+	// per group; see groupOptions
+	group   string
+	buckets []string
+
 	//derived
-	encoding art.KeyEncoding // derived from outform
+	encoding  art.KeyEncoding // derived from outform
+	workerKey *ecdh.PublicKey // read from workerKeyFile (akeso strategy)
+	groups    []*Options      // one copy of the options per group
+}
+
+// groupConfig is an entry of the groups list in the config file
+type groupConfig struct {
+	Name          string   `mapstructure:"name"`
+	Buckets       []string `mapstructure:"buckets"`
+	Members       []string `mapstructure:"members"`
+	SetupRequired bool     `mapstructure:"setup_required"`
+}
+
+var groupNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Name used for the group in logs and metrics
+func (opts *Options) groupName() string {
+	if opts.group == "" {
+		return "default"
+	}
+	return opts.group
 }
 
 func printUsage() {
-	fmt.Fprintf(os.Stdout, "%s", usage)
+	fmt.Fprintf(os.Stdout, "%s\n%s", usage, configUsage())
 }
 
 func parseOptions() *Options {
@@ -52,47 +133,104 @@ func parseOptions() *Options {
 
 	opts := Options{}
 
+	flag.Usage = printUsage
+	configFile := flag.String("config", "", "")
+	printConfigOnly := flag.Bool("print-config", false, "")
+	defineConfigFlags(flag.CommandLine)
+	flag.Parse()
+
 	// Reading from Config.yaml
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("config")
+	if *configFile != "" {
+		viper.SetConfigFile(*configFile)
+	} else {
+		viper.SetConfigName("config")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath("config")
+	}
 
 	err = viper.ReadInConfig()
-	if err != nil {
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) {
+		// flags and environment variables alone may be enough
+		log.Printf("No config file in config/; using flags, environment and defaults.\n")
+	} else if err != nil {
 		mu.Fatalf("Error reading config file: %v", err)
 	}
 
+	// Override from environment and flags if given
+	bindConfig(flag.CommandLine)
+
+	if *printConfigOnly {
+		if err := printConfig(os.Stdout); err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+	if err := validateConfig(); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if *printConfigOnly {
+		os.Exit(0)
+	}
+
 	opts.project = viper.GetString("cloud.project_id")
-	opts.bucket = viper.GetString("cloud.bucket")
+	opts.buckets = getList("cloud.buckets")
+	if bucket := viper.GetString("cloud.bucket"); bucket != "" {
+		opts.buckets = append([]string{bucket}, opts.buckets...)
+	}
 	opts.setupTopic = viper.GetString("cloud.setup_topic")
+	opts.registrationTopic = viper.GetString("cloud.registration_topic")
 	opts.updateTopic = viper.GetString("cloud.update_topic")
 	opts.metadataUpdateTopic = viper.GetString("cloud.metadata_update_topic")
+	opts.workerKeyFile = viper.GetString("cloud.worker_key_file")
+	opts.completionTopic = viper.GetString("cloud.completion_topic")
 	opts.setupRequired = viper.GetBool("art.setup_required")
 	opts.artConfigFile = viper.GetString("art.config_file")
 	opts.numOfMembers = viper.GetInt("art.num_of_members")
+	opts.members = getList("art.members")
+	opts.requirePinnedIK = viper.GetBool("art.require_pinned_ik")
 	opts.initiator = viper.GetString("art.initiator")
-	opts.keytype = viper.GetString("art.keytype")
+	opts.keytype = strings.ToLower(viper.GetString("art.keytype"))
 	opts.outform = viper.GetString("art.outform")
 	opts.outDir = viper.GetString("art.outdir")
 	opts.sigFile = viper.GetString("art.sigfile")
 	opts.msgFile = viper.GetString("art.msgfile")
-	opts.treeStateFile = viper.GetString("art.tree_state_file")
 	opts.privIKFile = viper.GetString("art.priv_IK_file")
 	opts.kdfSalt = []byte(viper.GetString("art.kdf_salt"))
-	opts.strategy = viper.GetString("art.strategy")
+	opts.strategy = strings.ToLower(viper.GetString("art.strategy"))
 	opts.maxReencryptions = viper.GetInt("akesod.max_reencryptions")
 	opts.maxConcUpdates = viper.GetInt("akesod.max_concurrent_updates")
-	// Override from flags if given
-	flag.Usage = printUsage
-
-	flag.Parse()
+	opts.busKind = viper.GetString("bus.kind")
+	opts.busAddress = viper.GetString("bus.address")
+	opts.busServe = viper.GetBool("bus.serve")
+	opts.stateDir = viper.GetString("akesod.state_dir")
+	opts.stateKeyFile = viper.GetString("akesod.state_key_file")
+	opts.statePassphraseEnv = viper.GetString("akesod.state_passphrase_env")
+	opts.stateSnapshots = viper.GetInt("akesod.state_snapshots")
+	opts.deadLetterTopic = viper.GetString("akesod.dead_letter_topic")
+	opts.maxDeliveryAttempts = viper.GetInt("akesod.max_delivery_attempts")
+	opts.metricsListen = viper.GetString("metrics.listen")
+	opts.metricsScanInterval = viper.GetDuration("metrics.scan_interval")
+	opts.shutdownTimeout = viper.GetDuration("akesod.shutdown_timeout")
+	opts.auditLog = viper.GetString("akesod.audit_log")
+	opts.auditKeyFile = viper.GetString("akesod.audit_key_file")
+	opts.controlListen = viper.GetString("control.listen")
+	opts.controlTokenEnv = viper.GetString("control.token_env")
+	opts.escrowThreshold = viper.GetInt("escrow.threshold")
+	opts.escrowCustodians = getList("escrow.custodians")
+	opts.escrowDir = viper.GetString("escrow.dir")
+	opts.ingestPolicy = strings.ToLower(viper.GetString("ingest.policy"))
+	opts.ingestScanInterval = viper.GetDuration("ingest.scan_interval")
+	opts.quarantinePrefix = viper.GetString("ingest.quarantine_prefix")
 
 	// ART related options
-	opts.keytype = strings.ToLower(opts.keytype)
 	opts.basePath = flag.Arg(0)
+	if opts.basePath == "" {
+		opts.basePath = "keys/akesod"
+	}
 
-	if opts.keytype != "ik" && opts.keytype != "ek" && opts.keytype != "" {
-		mu.Fatalf("error: -keytype invalid value %q (must be ik|ek or empty)", opts.keytype)
+	if opts.busServe {
+		// the in-process broker is the bus
+		opts.busKind = bus.KindLocal
 	}
 
 	opts.outform = strings.ToLower(opts.outform)
@@ -101,5 +239,86 @@ func parseOptions() *Options {
 		mu.Fatalf("error: %v", err)
 	}
 
+	if opts.strategy == "akeso" {
+		opts.workerKey, err = art.ReadPublicEKFromFile(opts.workerKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+	}
+
+	opts.groups, err = groupOptions(&opts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
 	return &opts
 }
+
+// Derives the options of each group.  Without a groups list in the config,
+// the top-level settings form a single unnamed group that uses the original
+// key and state paths.  A named group keeps its keys and ART config under
+// OUTDIR/NAME, its state under STATE_DIR/NAME and its escrowed shares
+// under ESCROW_DIR/NAME.
+func groupOptions(opts *Options) ([]*Options, error) {
+	var configs []groupConfig
+	if err := viper.UnmarshalKey("groups", &configs); err != nil {
+		return nil, fmt.Errorf("parsing groups: %w", err)
+	}
+
+	var groups []*Options
+	if len(configs) == 0 {
+		g := *opts
+		g.groups = nil
+		groups = append(groups, &g)
+	}
+
+	for _, c := range configs {
+		if !groupNameRE.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid group name %q", c.Name)
+		}
+
+		g := *opts
+		g.groups = nil
+		g.group = c.Name
+		g.buckets = c.Buckets
+		g.members = c.Members
+		g.numOfMembers = len(c.Members) + 1
+		g.setupRequired = c.SetupRequired
+		g.outDir = filepath.Join(opts.outDir, c.Name)
+		g.basePath = filepath.Join(g.outDir, "akesod")
+		g.privIKFile = g.basePath + "-ik." + opts.outform
+		g.artConfigFile = filepath.Join(g.outDir, fmt.Sprintf("%d.conf", g.numOfMembers))
+		g.stateDir = filepath.Join(opts.stateDir, c.Name)
+		g.escrowDir = filepath.Join(opts.escrowDir, c.Name)
+		groups = append(groups, &g)
+	}
+
+	names := make(map[string]bool)
+	owners := make(map[string]string)
+	for _, g := range groups {
+		if names[g.group] {
+			return nil, fmt.Errorf("group %q is configured twice", g.group)
+		}
+		names[g.group] = true
+
+		if len(g.buckets) == 0 {
+			return nil, fmt.Errorf("group %q has no buckets", g.groupName())
+		}
+		// a bucket has exactly one key lineage
+		for _, b := range g.buckets {
+			if owner, ok := owners[b]; ok {
+				return nil, fmt.Errorf("bucket %q is in groups %q and %q", b, owner, g.groupName())
+			}
+			owners[b] = g.groupName()
+		}
+
+		if g.setupRequired && g.registrationTopic == "" {
+			return nil, fmt.Errorf("cloud.registration_topic is required for group setup")
+		}
+		if g.setupRequired && len(g.members) == 0 {
+			return nil, fmt.Errorf("group %q must list the members expected to register", g.groupName())
+		}
+	}
+
+	return groups, nil
+}
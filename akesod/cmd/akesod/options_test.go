@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Reads config, a YAML config file, into viper for the duration of the test
+func readTestConfig(t *testing.T, config string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupOptions(t *testing.T) {
+	base := &Options{
+		outDir:            "keys",
+		outform:           "pem",
+		stateDir:          "keys/state",
+		escrowDir:         "keys/escrow",
+		registrationTopic: "registration",
+		buckets:           []string{"top-level"},
+	}
+
+	// without a groups list, the top-level settings are the only group
+	readTestConfig(t, "")
+	groups, err := groupOptions(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].group != "" || groups[0].stateDir != "keys/state" || groups[0].buckets[0] != "top-level" {
+		t.Fatalf("without groups: %+v", groups)
+	}
+
+	readTestConfig(t, `
+groups:
+  - name: finance
+    buckets: [ledger, invoices]
+    members: [bob, cici]
+    setup_required: true
+  - name: hr
+    buckets: [people]
+`)
+	groups, err = groupOptions(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups; expected 2", len(groups))
+	}
+	finance, hr := groups[0], groups[1]
+	expected := []struct{ got, want string }{
+		{finance.group, "finance"},
+		{strings.Join(finance.buckets, ","), "ledger,invoices"},
+		{strings.Join(finance.members, ","), "bob,cici"},
+		{finance.outDir, filepath.Join("keys", "finance")},
+		{finance.basePath, filepath.Join("keys", "finance", "akesod")},
+		{finance.privIKFile, filepath.Join("keys", "finance", "akesod-ik.pem")},
+		{finance.artConfigFile, filepath.Join("keys", "finance", "3.conf")},
+		{finance.stateDir, filepath.Join("keys", "state", "finance")},
+		{finance.escrowDir, filepath.Join("keys", "escrow", "finance")},
+		{hr.stateDir, filepath.Join("keys", "state", "hr")},
+		{strings.Join(hr.buckets, ","), "people"},
+	}
+	for _, e := range expected {
+		if e.got != e.want {
+			t.Errorf("got %q; expected %q", e.got, e.want)
+		}
+	}
+	if !finance.setupRequired || hr.setupRequired || finance.numOfMembers != 3 {
+		t.Errorf("finance: setup %t, %d members; hr: setup %t", finance.setupRequired, finance.numOfMembers, hr.setupRequired)
+	}
+	if finance.groups != nil || base.group != "" {
+		t.Error("the group options share state with the top-level options")
+	}
+
+	tests := []struct {
+		name, config, err string
+	}{
+		{"bad name", "groups: [{name: ../x, buckets: [a]}]", "invalid group name"},
+		{"twice", "groups: [{name: a, buckets: [a]}, {name: a, buckets: [b]}]", "configured twice"},
+		{"no buckets", "groups: [{name: a}]", "no buckets"},
+		{"shared bucket", "groups: [{name: a, buckets: [x]}, {name: b, buckets: [y, x]}]", `bucket "x" is in groups "a" and "b"`},
+		{"setup without members", "groups: [{name: a, buckets: [x], setup_required: true}]", "must list the members"},
+	}
+	for _, tt := range tests {
+		readTestConfig(t, tt.config)
+		_, err := groupOptions(base)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v; expected an error about %q", tt.name, err, tt.err)
+		}
+	}
+
+	readTestConfig(t, "groups: [{name: a, buckets: [x], members: [bob], setup_required: true}]")
+	noTopic := *base
+	noTopic.registrationTopic = ""
+	if _, err := groupOptions(&noTopic); err == nil || !strings.Contains(err.Error(), "registration_topic") {
+		t.Errorf("setup without a registration topic: %v", err)
+	}
+}
@@ -2,38 +2,49 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"os"
+	"maps"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
-	"github.com/etclab/aes256"
 	"github.com/etclab/akesod/internal/aesx"
-	"github.com/etclab/akesod/internal/encstr"
-	"github.com/etclab/akesod/internal/gcsx"
-	"github.com/etclab/art"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/store"
 	"github.com/etclab/mu"
 	"google.golang.org/api/iterator"
 )
 
-type UpdateKeyMessage struct {
-	UpdateMsg    art.UpdateMessage `json:"updateMsg"`
-	UpdateMsgMac []byte            `json:"updateMsgMac"`
-}
+// akesod is always the first leaf of the ART tree
+const akesodIdx = 1
+
+const (
+	processedMessagesFile = "processed-messages.log"
+	maxProcessedMessages  = 10000
+	deliveryAttemptsFile  = "delivery-attempts.json"
+)
 
-// List all objects in a given bucket
-func listObjects(ctx context.Context, bkt *storage.BucketHandle) []string {
+// List all objects in a given bucket.  As a side effect, updates the
+// count of objects with a pending cloud function re-encryption.
+func listObjects(ctx context.Context, bucket string, bkt *storage.BucketHandle) ([]*storage.ObjectAttrs, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
 	query := &storage.Query{Prefix: ""}
 
-	var names []string
+	var objects []*storage.ObjectAttrs
+	pending := 0
 	it := bkt.Objects(ctx, query)
 	for {
 		attrs, err := it.Next()
@@ -41,201 +52,410 @@ func listObjects(ctx context.Context, bkt *storage.BucketHandle) []string {
 			break
 		}
 		if err != nil {
-			mu.Fatalf("Listing Objects failed: %v", err)
+			return nil, fmt.Errorf("listing objects failed: %w", err)
+		}
+		if attrs.Metadata["ongoing_reencryption"] == "true" {
+			pending++
+		}
+		objects = append(objects, attrs)
+	}
+	metrics.PendingReencryptions.WithLabelValues(bucket).Set(float64(pending))
+	return objects, nil
+}
+
+// Periodically rescans the bucket so the pending re-encryption gauge
+// follows the cloud function's progress between rotations.
+func scanPendingReencryptions(ctx context.Context, bucket string, bkt *storage.BucketHandle, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := listObjects(ctx, bucket, bkt); err != nil {
+				log.Printf("error: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Opens the configured message bus.  With bus.serve set, akesod also runs
+// the local broker in-process and uses it directly.
+func openBus(ctx context.Context, opts *Options) bus.Bus {
+	if opts.busServe {
+		network, addr, err := bus.ParseAddress(opts.busAddress)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
 		}
-		names = append(names, attrs.Name)
+
+		mb := bus.NewMemory()
+		go func() {
+			err := bus.ListenAndServe(ctx, network, addr, mb)
+			if err != nil {
+				mu.Fatalf("error: local bus broker: %v", err)
+			}
+		}()
+		log.Printf("Serving local bus at %s.\n", opts.busAddress)
+		return mb
 	}
-	return names
+
+	msgBus, err := bus.Open(ctx, opts.busKind, opts.project, opts.busAddress)
+	if err != nil {
+		mu.Fatalf("error: opening %s bus: %v", opts.busKind, err)
+	}
+	return msgBus
 }
 
-// Publishes to Pub/Sub Topic
-func publish(ctx context.Context, topicID string, client *pubsub.Client, content []byte) {
-	topic := client.Topic(topicID)
-	result := topic.Publish(ctx, &pubsub.Message{
+// Publishes to a bus topic
+func publish(ctx context.Context, topic string, msgBus bus.Bus, content []byte) {
+	id, err := msgBus.Publish(ctx, topic, &bus.Message{
 		Data: content,
 		Attributes: map[string]string{
 			"initiator": "akesod",
 			"timedate":  time.Now().Format(time.RFC3339),
 		},
 	})
-
-	id, err := result.Get(ctx)
 	if err != nil {
 		mu.Panicf(err.Error())
 	}
 	log.Printf("Published to %s; msg id: %v\n", topic, id)
 }
 
-// Handles subscription to Pub/Sub Topic (KeyUpdate specifically)
-func handleKeyUpdateSubscription(ctx context.Context, updateTopic string, pubsubClient *pubsub.Client, opts *Options) error {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+// Without Pub/Sub there are no bucket notifications, so akesod publishes the
+// metadata update event for the encrypt worker itself.  The payload carries
+// the same bucket and name fields as a GCS JSON notification payload, and
+// the attributes those of the rotation's notification: layerAttrs, which
+// hold the wrapped rotation key.
+func publishMetadataUpdate(ctx context.Context, msgBus bus.Bus, opts *Options, bucket, objectName string, layerAttrs map[string]string) error {
+	payload, err := json.Marshal(map[string]string{"bucket": bucket, "name": objectName})
+	if err != nil {
+		return err
+	}
 
-	client, err := storage.NewClient(ctx)
+	attrs := maps.Clone(layerAttrs)
+	attrs["eventType"] = "OBJECT_METADATA_UPDATE"
+	_, err = msgBus.Publish(ctx, opts.metadataUpdateTopic, &bus.Message{
+		Data:       payload,
+		Attributes: attrs,
+	})
+	return err
+}
+
+// Publishes a message that can't be processed to the dead-letter topic,
+// along with why it was given up on.  Attributes that may carry keys are
+// redacted in the copy, which can outlive the key.  If no dead-letter topic
+// is configured the message is only logged.
+func deadLetter(ctx context.Context, msgBus bus.Bus, opts *Options, topic string, msg *bus.Message, attempts int, reason string) error {
+	if opts.deadLetterTopic == "" {
+		log.Printf("Dropping message %s from %s: %s\n", msg.ID, topic, reason)
+		return nil
+	}
+
+	attrs := secret.RedactAttrs(msg.Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string, 4)
+	}
+	attrs["dead_letter_reason"] = reason
+	attrs["source_topic"] = topic
+	attrs["original_message_id"] = msg.ID
+	attrs["delivery_attempts"] = strconv.Itoa(attempts)
+
+	id, err := msgBus.Publish(ctx, opts.deadLetterTopic, &bus.Message{Data: msg.Data, Attributes: attrs})
 	if err != nil {
-		mu.Fatalf("storage.NewClient failed: %v", err)
+		return err
 	}
-	defer client.Close()
+	log.Printf("Moved message %s from %s to %s (msg id %s): %s\n", msg.ID, topic, opts.deadLetterTopic, id, reason)
+	return nil
+}
 
-	bucket := opts.bucket
-	bkt := client.Bucket(bucket)
+// groupHandler holds one ART group's state store and buckets
+type groupHandler struct {
+	opts *Options
+	st   *store.Store
+	bkts map[string]*storage.BucketHandle // by bucket name
+}
 
-	// Create Subscription if doesn't exist
-	topic := pubsubClient.Topic(updateTopic)
+// keyUpdateHandler processes messages from the KeyUpdate topic one at a
+// time, routing each to its group by the update's group ID.  A message is
+// acked only once the tree update and the rotation of the group's buckets
+// have been committed to the group's state store; any failure before that
+// nacks it for redelivery.
+//
+// On shutdown, stopping is closed and no new objects are started; workCtx,
+// used for all storage operations, is only cancelled once the shutdown
+// timeout expires, so in-flight objects can finish and be checkpointed.
+type keyUpdateHandler struct {
+	mtx       sync.Mutex
+	topic     string
+	opts      *Options
+	msgBus    bus.Bus
+	groups    map[string]*groupHandler // by group ID
+	processed *store.Set               // IDs of messages already handled
+	attempts  *store.Counts            // delivery attempts per message ID
+	workCtx   context.Context
+	stopping  <-chan struct{}
+	rotations *rotationTracker
+	layers    *layerTracker // nil unless following akeso layers
+}
 
-	var sub *pubsub.Subscription
-	sub, err = pubsubClient.CreateSubscription(ctx, updateTopic+"-akesod", pubsub.SubscriptionConfig{
-		Topic:                 topic,
-		AckDeadline:           20 * time.Second,
-		EnableMessageOrdering: true,
-	})
+// rejectedError marks a message that will never be accepted, so it is
+// dead-lettered without further attempts.
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+func (h *keyUpdateHandler) handle(_ context.Context, msg *bus.Message) {
+	ctx := h.workCtx
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	log.Printf("Received Message in %s. Message ID: %s\n", h.topic, msg.ID)
+
+	if msg.Attributes["messageType"] == "update_key" {
+		msg.Ack()
+		return
+	}
+
+	if h.processed.Contains(msg.ID) {
+		log.Printf("Ignoring duplicate delivery of message %s.\n", msg.ID)
+		metrics.KeyUpdates.WithLabelValues("duplicate").Inc()
+		msg.Ack()
+		return
+	}
+
+	// counted in the state dir, so a message that crashes akesod is still
+	// given up on after maxDeliveryAttempts
+	attempts, err := h.attempts.Inc(msg.ID)
 	if err != nil {
-		sub = pubsubClient.Subscription(updateTopic + "-akesod")
+		log.Printf("error: recording delivery attempt of message %s: %v\n", msg.ID, err)
+		msg.Nack()
+		return
+	}
+	if attempts > h.opts.maxDeliveryAttempts {
+		h.giveUp(ctx, msg, attempts-1, fmt.Sprintf("still failing after %d delivery attempts", attempts-1))
+		return
+	}
+
+	log.Printf("Key Updates triggered by Message ID: %s (attempt %d of %d)\n", msg.ID, attempts, h.opts.maxDeliveryAttempts)
+
+	err = h.process(ctx, msg)
+
+	var rejected *rejectedError
+	switch {
+	case err == nil:
+		metrics.KeyUpdates.WithLabelValues("applied").Inc()
+		h.finish(msg)
+	case errors.Is(err, artx.ErrStaleUpdate):
+		// already applied, e.g. republished under a new message ID
+		log.Printf("Ignoring key update (msg id %s): %v\n", msg.ID, err)
+		metrics.KeyUpdates.WithLabelValues("stale").Inc()
+		h.finish(msg)
+	case errors.Is(err, errRotationCancelled):
+		// the rotation stays pending in the group state, so the message
+		// itself has been handled
+		log.Printf("Rotation for key update (msg id %s) cancelled; it resumes on the next update, restart or `akesoctl rotate`.\n", msg.ID)
+		metrics.KeyUpdates.WithLabelValues("applied").Inc()
+		h.finish(msg)
+	case errors.As(err, &rejected):
+		log.Printf("Rejected key update (msg id %s): %v\n", msg.ID, err)
+		h.giveUp(ctx, msg, attempts, err.Error())
+	default:
+		log.Printf("error: key update (msg id %s) failed, will retry: %v\n", msg.ID, err)
+		metrics.KeyUpdates.WithLabelValues("retried").Inc()
+		msg.Nack()
+	}
+}
+
+// Records msg as processed and acks it
+func (h *keyUpdateHandler) finish(msg *bus.Message) {
+	if err := h.processed.Add(msg.ID); err != nil {
+		// the epoch check still rejects a redelivery as stale
+		log.Printf("error: recording message %s as processed: %v\n", msg.ID, err)
 	}
+	if err := h.attempts.Delete(msg.ID); err != nil {
+		log.Printf("error: clearing delivery attempts of message %s: %v\n", msg.ID, err)
+	}
+	msg.Ack()
+}
 
-	// Channel to receive messages
-	msgChan := make(chan *pubsub.Message)
+func (h *keyUpdateHandler) giveUp(ctx context.Context, msg *bus.Message, attempts int, reason string) {
+	if err := deadLetter(ctx, h.msgBus, h.opts, h.topic, msg, attempts, reason); err != nil {
+		log.Printf("error: dead-lettering message %s: %v\n", msg.ID, err)
+		msg.Nack()
+		return
+	}
+	metrics.KeyUpdates.WithLabelValues("dead_lettered").Inc()
+	h.finish(msg)
+}
 
-	// Handle key update from received message
-	go func() {
-		for {
-			err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-				log.Printf("Received Message in %s. Message ID: %s\n", updateTopic, msg.ID)
+func (h *keyUpdateHandler) process(ctx context.Context, msg *bus.Message) error {
+	var update artx.SignedUpdate
+	if err := json.Unmarshal(msg.Data, &update); err != nil {
+		return &rejectedError{fmt.Errorf("malformed message: %w", err)}
+	}
 
-				msg.Ack()
-				msgChan <- msg
-			})
-			if err != nil {
-				mu.Panicf("error in subcription handling: %v", err)
-			}
+	g, ok := h.groups[update.GroupID]
+	if !ok {
+		return &rejectedError{fmt.Errorf("update is for unknown group %q", update.GroupID)}
+	}
+
+	groupInfo, treeState, err := loadGroupState(g.st, g.opts)
+	if err != nil {
+		return err
+	}
+
+	// Finish an interrupted rotation before moving to the next epoch
+	if groupInfo.PendingRotation {
+		resumedMsgID := groupInfo.UpdateMsgID
+		if err := h.resumeRotation(ctx, g, groupInfo, treeState); err != nil {
+			return err
+		}
+		if resumedMsgID == msg.ID {
+			return nil
 		}
-	}()
+	}
 
-	// Handle key updates
-	for {
-		select {
-		case msg := <-msgChan:
-			if msg.Attributes["messageType"] == "update_key" {
-				continue
-			}
+	if err := update.Verify(treeState, groupInfo, akesodIdx); err != nil {
+		if errors.Is(err, artx.ErrStaleUpdate) || errors.Is(err, artx.ErrFutureUpdate) {
+			return err
+		}
+		return &rejectedError{err}
+	}
 
-			log.Printf("Key Updates triggered by Message ID: %s\n", msg.ID)
+	oldKeys := newEpochKeys(groupInfo, treeState, g.opts)
+	prevEpoch := groupInfo.Epoch
 
-			treeStateFile := "keys/state.json"
-			updateMsgFile := "keys/update_key.msg"
-			updateMsgMacFile := "keys/update_key.msg.mac"
+	update.Apply(treeState, groupInfo, akesodIdx)
+	groupInfo.KeySchedule = aesx.CurrentSchedule
+	groupInfo.PendingRotation = true
+	groupInfo.UpdateMsgID = msg.ID
+	if err := commitGroupState(g.st, g.opts, groupInfo, treeState); err != nil {
+		return err
+	}
+	log.Printf("Group %q (%s) advanced to epoch %d by member %d.\n", g.opts.groupName(), groupInfo.ID, groupInfo.Epoch, update.UpdateMsg.Idx)
+	recordAudit(audit.EventEpoch, g.opts, groupInfo.Epoch, map[string]string{
+		"groupId":           groupInfo.ID,
+		"previousEpoch":     strconv.FormatUint(prevEpoch, 10),
+		"sender":            strconv.Itoa(update.UpdateMsg.Idx),
+		"msgId":             msg.ID,
+		"oldKeyFingerprint": oldKeys.fingerprint(),
+		"newKeyFingerprint": audit.Fingerprint(treeState.StageKey()),
+	})
+	escrowGroupState(g.opts, groupInfo, treeState)
 
-			// Process the received message to update_key and update_key_mac
-			var updateMsg *UpdateKeyMessage
-			json.Unmarshal(msg.Data, &updateMsg)
+	return h.rotate(ctx, g, groupInfo, treeState, oldKeys, control.TriggerKeyUpdate)
+}
 
-			updateMsg.UpdateMsg.Save(updateMsgFile)
-			os.WriteFile(updateMsgMacFile, updateMsg.UpdateMsgMac, 0666)
+// Handles subscription to the KeyUpdate topic
+func handleKeyUpdateSubscription(ctx context.Context, updateTopic string, msgBus bus.Bus, opts *Options) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient failed: %w", err)
+	}
+	defer client.Close()
 
-			// update treeState using update_key
-			treeStageKey := "keys/stage-key.pem"
-			old_key, err := aesx.AESFromPEM(treeStageKey, opts.kdfSalt)
-			if err != nil {
-				mu.Fatalf("error: %v", err)
-			}
+	processed, err := store.OpenSet(filepath.Join(opts.stateDir, processedMessagesFile), maxProcessedMessages)
+	if err != nil {
+		return fmt.Errorf("opening processed message log: %w", err)
+	}
+	defer processed.Close(false)
 
-			updatedTreeState := art.ProcessUpdateMessage(1, treeStateFile, updateMsgFile, updateMsgMacFile)
-			os.Remove(treeStateFile)
-			updatedTreeState.Save(treeStateFile)
-			os.Remove(treeStageKey)
-			updatedTreeState.SaveStageKey(treeStageKey)
+	attempts, err := store.OpenCounts(filepath.Join(opts.stateDir, deliveryAttemptsFile))
+	if err != nil {
+		return fmt.Errorf("opening delivery attempt counts: %w", err)
+	}
 
-			// generate new aes key from the updated stage key
-			new_key, err := aesx.AESFromPEM(treeStageKey, opts.kdfSalt)
-			if err != nil {
-				mu.Fatalf("error: %v", err)
-			}
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+	stopDrain := context.AfterFunc(ctx, func() {
+		log.Printf("Shutting down: no new messages or objects; waiting up to %v for in-flight objects.\n", opts.shutdownTimeout)
+		time.AfterFunc(opts.shutdownTimeout, cancelWork)
+	})
+	defer stopDrain()
+
+	h := &keyUpdateHandler{
+		topic:     updateTopic,
+		opts:      opts,
+		msgBus:    msgBus,
+		groups:    make(map[string]*groupHandler),
+		processed: processed,
+		attempts:  attempts,
+		workCtx:   workCtx,
+		stopping:  ctx.Done(),
+		rotations: newRotationTracker(),
+	}
 
-			dek := aes256.NewRandomKey()
-
-			files := listObjects(ctx, bkt)
-
-			// Configure Notifications to trigger Cloud Function in case akeso strategy is being run
-			if opts.strategy == "akeso" {
-				err = gcsx.RemoveNotification(ctx, bkt, opts.metadataUpdateTopic, opts.project, "OBJECT_METADATA_UPDATE")
-				if err != nil {
-					log.Printf("gcsx.RemoveNotification failed: %v", err)
-					return nil
-				}
-				keys := map[string]string{
-					"new_dek": base64.StdEncoding.EncodeToString(dek),
-				}
-
-				_, err := gcsx.AddNotification(ctx, bkt, &storage.Notification{
-					TopicID:          opts.metadataUpdateTopic,
-					TopicProjectID:   opts.project,
-					EventTypes:       []string{"OBJECT_METADATA_UPDATE"},
-					CustomAttributes: keys,
-					PayloadFormat:    storage.JSONPayload,
-				})
-				log.Printf("Notification Keys is \"%v\"", keys) // Testing Jul 5
-
-				if err != nil {
-					log.Printf("gcsx.AddNotification failed: %v", err)
-					return nil
-				}
+	// the workers report each layer on the completion topic
+	if opts.strategy == "akeso" && opts.completionTopic != "" {
+		h.layers = newLayerTracker(workCtx, msgBus)
+		go func() {
+			err := msgBus.Subscribe(ctx, opts.completionTopic, opts.completionTopic+"-akesod", h.layers.handle)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				mu.Fatalf("error: subscription to %s failed: %v", opts.completionTopic, err)
 			}
+		}()
+	}
 
-			var bucketUpdateStart time.Time
-
-			var wg sync.WaitGroup
-			sem := make(chan struct{}, opts.maxConcUpdates)
-			errChan := make(chan error, len(files))
-
-			for _, file := range files {
-				// rencrypt and upload the list of objects using new aes key
-				bucketUpdateStart = time.Now()
-
-				wg.Add(1)
-				sem <- struct{}{} // Acquire semaphore
-
-				go func(file string) {
-					defer wg.Done()
-					defer func() { <-sem }() // Release semaphore
-
-					switch opts.strategy {
-					case "strawman":
-						err = encstr.StrawmanUpdate(bkt, file, old_key, new_key)
-					case "keywrap":
-						err = encstr.KeyWrapUpdate(bkt, file, old_key, new_key)
-					case "akeso":
-						err = encstr.AkesoUpdate(bkt, file, opts.maxReencryptions, old_key, new_key, dek, ctx)
-					case "csek":
-						err = encstr.RotateCSEKKey(bkt, file, old_key, new_key)
-					case "cmek":
-						err = encstr.UpdateCMEKKey(bkt, file, old_key, new_key, ctx)
-					}
-					if err != nil {
-						errChan <- err
-						mu.Fatalf("error: %v", err)
-					}
-				}(file)
-
-				go func() {
-					wg.Wait()
-					close(errChan)
-				}()
-
-				for err := range errChan {
-					if err != nil {
-						log.Printf("error: %v\n", err)
-					}
-				}
+	for _, gopts := range opts.groups {
+		g := &groupHandler{opts: gopts, st: openStore(gopts), bkts: make(map[string]*storage.BucketHandle)}
+		for _, bucket := range gopts.buckets {
+			g.bkts[bucket] = client.Bucket(bucket)
+		}
 
-			}
-			duration := time.Since(bucketUpdateStart)
-			log.Printf("Duration for update/rotate keys of bucket by %s strategy is %v\n", opts.strategy, duration)
+		if _, err := g.st.Current(); err != nil && !hasLegacyState(gopts) {
+			log.Printf("Group %q has no state in %s yet; its key updates can't be processed.\n", gopts.groupName(), gopts.stateDir)
 			continue
+		}
 
-		case <-ctx.Done():
-			log.Printf("\nExiting")
-			return nil
+		groupInfo, treeState, err := loadGroupState(g.st, gopts)
+		if err != nil {
+			return err
+		}
+		if other, ok := h.groups[groupInfo.ID]; ok {
+			return fmt.Errorf("groups %q and %q have the same group ID %s", other.opts.groupName(), gopts.groupName(), groupInfo.ID)
+		}
+		h.groups[groupInfo.ID] = g
+		metrics.Epoch.WithLabelValues(gopts.groupName()).Set(float64(groupInfo.Epoch))
+
+		// A rotation interrupted by a crash is resumed right away rather
+		// than waiting for its message to be redelivered.
+		if groupInfo.PendingRotation {
+			if err := h.resumeRotation(workCtx, g, groupInfo, treeState); err != nil {
+				log.Printf("error: %v\n", err)
+			}
+		}
+
+		if gopts.ingestPolicy != ingestOff && gopts.ingestScanInterval > 0 {
+			go h.scanIngest(ctx, g)
 		}
 
+		if opts.strategy == "akeso" && opts.metricsListen != "" {
+			for bucket, bkt := range g.bkts {
+				go scanPendingReencryptions(ctx, bucket, bkt, opts.metricsScanInterval)
+			}
+		}
+	}
+
+	if opts.controlListen != "" {
+		go func() {
+			if err := serveControl(ctx, opts, h); err != nil {
+				mu.Fatalf("error: control API: %v", err)
+			}
+		}()
+	}
+
+	metrics.SetReady(true)
+	err = msgBus.Subscribe(ctx, updateTopic, updateTopic+"-akesod", h.handle)
+	metrics.SetReady(false)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("subscription to %s failed: %w", updateTopic, err)
 	}
 
+	return nil
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/art"
+)
+
+const testDeadLetterTopic = "dead-letters"
+
+// A key update handler for one group without buckets, so a rotation only
+// commits the state.  Dead letters can be read from the "test"
+// subscription of testDeadLetterTopic.
+type testHandler struct {
+	*keyUpdateHandler
+	mb     *bus.Memory
+	g      *groupHandler
+	info   *artx.GroupInfo
+	tree   *art.TreeState
+	iks    []ed25519.PrivateKey
+	nextID int
+}
+
+func newTestHandler(t *testing.T) *testHandler {
+	dir := t.TempDir()
+	opts := &Options{
+		group:               "g",
+		strategy:            "strawman",
+		stateDir:            dir,
+		deadLetterTopic:     testDeadLetterTopic,
+		maxDeliveryAttempts: 2,
+	}
+
+	info, tree, iks := newTestGroup(t)
+	st, err := store.Open(filepath.Join(dir, "g"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitGroupState(st, opts, info, tree); err != nil {
+		t.Fatal(err)
+	}
+
+	th := &testHandler{mb: bus.NewMemory(), info: info, tree: tree, iks: iks}
+	th.mb.CreateSubscription(testDeadLetterTopic, "test")
+	th.g = &groupHandler{opts: opts, st: st}
+	th.keyUpdateHandler = &keyUpdateHandler{
+		topic:     "key-updates",
+		opts:      opts,
+		msgBus:    th.mb,
+		groups:    map[string]*groupHandler{info.ID: th.g},
+		workCtx:   context.Background(),
+		stopping:  make(chan struct{}),
+		rotations: newRotationTracker(),
+	}
+	th.reopen(t)
+	return th
+}
+
+// Reopens the processed message log and the delivery attempts, as a
+// restart of akesod does
+func (th *testHandler) reopen(t *testing.T) {
+	var err error
+	if th.processed != nil {
+		th.processed.Close(false)
+	}
+	th.processed, err = store.OpenSet(filepath.Join(th.opts.stateDir, processedMessagesFile), maxProcessedMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { th.processed.Close(false) })
+	th.attempts, err = store.OpenCounts(filepath.Join(th.opts.stateDir, deliveryAttemptsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns bob's update from epoch to epoch+1
+func (th *testHandler) update(t *testing.T, epoch uint64) []byte {
+	return memberUpdate(t, th.info.ID, epoch, th.tree, th.iks[1])
+}
+
+// Returns the update of the member at leaf 2 of group groupID, whose IK is
+// ik, from epoch to epoch+1.  The member works on a copy of akesod's tree:
+// the update only needs the public tree and the stage key.
+func memberUpdate(t *testing.T, groupID string, epoch uint64, akesodTree *art.TreeState, ik ed25519.PrivateKey) []byte {
+	data, err := artx.MarshalGroupState(&artx.GroupInfo{ID: groupID, Epoch: epoch}, akesodTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, tree, err := artx.UnmarshalGroupState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su, err := artx.NewLeafUpdate(tree, info, 2, ik)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = json.Marshal(su); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (th *testHandler) newID() string {
+	th.nextID++
+	return fmt.Sprintf("msg-%d", th.nextID)
+}
+
+// Delivers a message and returns whether it was acked
+func (th *testHandler) deliver(t *testing.T, id string, data []byte, attrs map[string]string) bool {
+	t.Helper()
+	settled := make(chan bool, 1)
+	th.handle(context.Background(), bus.NewMessage(id, data, attrs, func(ok bool) { settled <- ok }))
+	select {
+	case ok := <-settled:
+		return ok
+	default:
+		t.Fatalf("message %s left unsettled", id)
+		return false
+	}
+}
+
+func (th *testHandler) epoch(t *testing.T) uint64 {
+	t.Helper()
+	return groupEpoch(t, th.g)
+}
+
+func groupEpoch(t *testing.T, g *groupHandler) uint64 {
+	t.Helper()
+	info, _, err := loadGroupState(g.st, g.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PendingRotation {
+		t.Errorf("epoch %d has a pending rotation", info.Epoch)
+	}
+	return info.Epoch
+}
+
+// Returns the reasons of the dead letters published since the last call
+func (th *testHandler) deadLetters(t *testing.T) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var reasons []string
+	err := th.mb.Subscribe(ctx, testDeadLetterTopic, "test", func(ctx context.Context, msg *bus.Message) {
+		reasons = append(reasons, msg.Attributes["dead_letter_reason"])
+		msg.Ack()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reasons
+}
+
+func TestKeyUpdateHandlerApplies(t *testing.T) {
+	th := newTestHandler(t)
+	update := th.update(t, 4)
+
+	if !th.deliver(t, th.newID(), []byte("{}"), map[string]string{"messageType": "update_key"}) {
+		t.Error("update_key trigger was nacked")
+	}
+
+	id := th.newID()
+	if !th.deliver(t, id, update, nil) {
+		t.Fatal("valid update was nacked")
+	}
+	if epoch := th.epoch(t); epoch != 5 {
+		t.Fatalf("after the update: epoch %d; expected 5", epoch)
+	}
+	if !th.processed.Contains(id) {
+		t.Error("applied update not recorded as processed")
+	}
+
+	// redelivered, also after a restart, and republished under another ID
+	if !th.deliver(t, id, update, nil) {
+		t.Error("duplicate delivery was nacked")
+	}
+	th.reopen(t)
+	if !th.deliver(t, id, update, nil) {
+		t.Error("duplicate delivery after a restart was nacked")
+	}
+	if !th.deliver(t, th.newID(), update, nil) {
+		t.Error("stale update was nacked")
+	}
+	if epoch := th.epoch(t); epoch != 5 {
+		t.Errorf("after replays: epoch %d; expected 5", epoch)
+	}
+	if reasons := th.deadLetters(t); len(reasons) > 0 {
+		t.Errorf("dead letters: %q", reasons)
+	}
+}
+
+func TestKeyUpdateHandlerDeadLetters(t *testing.T) {
+	th := newTestHandler(t)
+
+	var wrongGroup artx.SignedUpdate
+	if err := json.Unmarshal(th.update(t, 4), &wrongGroup); err != nil {
+		t.Fatal(err)
+	}
+	wrongGroup.GroupID = "other"
+	other, _ := json.Marshal(&wrongGroup)
+
+	forged := th.update(t, 4)
+	var su artx.SignedUpdate
+	json.Unmarshal(forged, &su)
+	su.Sig = ed25519.Sign(th.iks[2], []byte("not the update"))
+	forged, _ = json.Marshal(&su)
+
+	for _, data := range [][]byte{[]byte("{"), other, forged} {
+		id := th.newID()
+		if !th.deliver(t, id, data, nil) {
+			t.Errorf("rejected message %s was nacked", id)
+		}
+		if !th.processed.Contains(id) {
+			t.Errorf("rejected message %s not recorded as processed", id)
+		}
+	}
+	if reasons := th.deadLetters(t); len(reasons) != 3 {
+		t.Errorf("got dead letters %q; expected 3", reasons)
+	}
+
+	// an update that skips an epoch may still become valid: it is retried
+	// until it has been delivered maxDeliveryAttempts times, also across
+	// restarts
+	id, future := th.newID(), th.update(t, 5)
+	if th.deliver(t, id, future, nil) {
+		t.Fatal("future update was acked on its first delivery")
+	}
+	th.reopen(t)
+	if th.deliver(t, id, future, nil) {
+		t.Fatal("future update was acked on its second delivery")
+	}
+	if reasons := th.deadLetters(t); len(reasons) > 0 {
+		t.Fatalf("dead-lettered before the last attempt: %q", reasons)
+	}
+	th.reopen(t)
+	if !th.deliver(t, id, future, nil) {
+		t.Fatal("future update was nacked after maxDeliveryAttempts")
+	}
+	if reasons := th.deadLetters(t); len(reasons) != 1 || reasons[0] != "still failing after 2 delivery attempts" {
+		t.Errorf("got dead letters %q", reasons)
+	}
+	if th.epoch(t) != 4 {
+		t.Error("a rejected update changed the epoch")
+	}
+}
+
+func TestKeyUpdateHandlerNacksOnStateErrors(t *testing.T) {
+	th := newTestHandler(t)
+	th.opts.maxDeliveryAttempts = 3
+	dir := filepath.Join(th.opts.stateDir, "g")
+	update := th.update(t, 4)
+
+	// the next snapshot can't be written
+	blocker := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.json", 5), "x")
+	if err := os.MkdirAll(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+	id := th.newID()
+	if th.deliver(t, id, update, nil) {
+		t.Fatal("update was acked although its state wasn't committed")
+	}
+	if th.processed.Contains(id) {
+		t.Error("uncommitted update recorded as processed")
+	}
+	if err := os.RemoveAll(filepath.Dir(blocker)); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := th.epoch(t); epoch != 4 {
+		t.Fatalf("after the failed commit: epoch %d; expected 4", epoch)
+	}
+
+	// the current snapshot can't be read
+	current := filepath.Join(dir, "CURRENT")
+	if err := os.WriteFile(current, []byte("9\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if th.deliver(t, id, update, nil) {
+		t.Fatal("update was acked although the state couldn't be loaded")
+	}
+	if err := os.WriteFile(current, []byte("4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the store works again, the last attempt is applied
+	if !th.deliver(t, id, update, nil) {
+		t.Fatal("redelivered update was nacked")
+	}
+	if epoch := th.epoch(t); epoch != 5 {
+		t.Errorf("after the redelivery: epoch %d; expected 5", epoch)
+	}
+	if reasons := th.deadLetters(t); len(reasons) > 0 {
+		t.Errorf("dead letters: %q", reasons)
+	}
+}
+
+// Each group's updates advance only that group, under its own state
+func TestKeyUpdateHandlerRoutesByGroup(t *testing.T) {
+	th := newTestHandler(t)
+
+	hrOpts := *th.opts
+	hrOpts.group = "hr"
+	hrOpts.stateDir = filepath.Join(th.opts.stateDir, "hr")
+	info, tree, iks := newTestGroup(t)
+	st, err := store.Open(hrOpts.stateDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitGroupState(st, &hrOpts, info, tree); err != nil {
+		t.Fatal(err)
+	}
+	hr := &groupHandler{opts: &hrOpts, st: st}
+	th.groups[info.ID] = hr
+
+	if !th.deliver(t, th.newID(), memberUpdate(t, info.ID, 4, tree, iks[1]), nil) {
+		t.Fatal("update of the second group was nacked")
+	}
+	if epoch := groupEpoch(t, hr); epoch != 5 {
+		t.Errorf("hr: epoch %d; expected 5", epoch)
+	}
+	if epoch := th.epoch(t); epoch != 4 {
+		t.Errorf("g: epoch %d; expected 4", epoch)
+	}
+
+	// signed by a member of the other group
+	if !th.deliver(t, th.newID(), memberUpdate(t, th.info.ID, 4, th.tree, iks[1]), nil) {
+		t.Error("forged update was nacked")
+	}
+	if epoch := th.epoch(t); epoch != 4 {
+		t.Errorf("g after a forged update: epoch %d; expected 4", epoch)
+	}
+	if reasons := th.deadLetters(t); len(reasons) != 1 || !strings.Contains(reasons[0], "signature") {
+		t.Errorf("got dead letters %q", reasons)
+	}
+
+	if !th.deliver(t, th.newID(), th.update(t, 4), nil) {
+		t.Fatal("update of the first group was nacked")
+	}
+	if epoch := th.epoch(t); epoch != 5 {
+		t.Errorf("g: epoch %d; expected 5", epoch)
+	}
+	if epoch := groupEpoch(t, hr); epoch != 5 {
+		t.Errorf("hr: epoch %d; expected 5", epoch)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// Waits on the registration topic until every member of each group in
+// groups has submitted a valid registration bundle.  Bundles are routed by
+// their group name.  Invalid bundles are logged and dropped; a later valid
+// bundle from the same member is still accepted.  The result maps group and
+// member names to registrations.
+func collectRegistrations(ctx context.Context, msgBus bus.Bus, topic string, groups []*Options) map[string]map[string]*artx.Registration {
+	var mtx sync.Mutex
+	regs := make(map[string]map[string]*artx.Registration)
+	byName := make(map[string]*Options)
+	expected, received := 0, 0
+	for _, g := range groups {
+		regs[g.group] = make(map[string]*artx.Registration)
+		byName[g.group] = g
+		expected += len(g.members)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Printf("Waiting for %d member registrations on %s.\n", expected, topic)
+	err := msgBus.Subscribe(ctx, topic, topic+"-akesod", func(ctx context.Context, msg *bus.Message) {
+		msg.Ack()
+
+		var reg artx.Registration
+		if err := json.Unmarshal(msg.Data, &reg); err != nil {
+			log.Printf("Rejected registration (msg id %s): malformed bundle: %v\n", msg.ID, err)
+			return
+		}
+
+		g, ok := byName[reg.Group]
+		if !ok {
+			log.Printf("Rejected registration (msg id %s): %q is not a group awaiting setup\n", msg.ID, reg.Group)
+			return
+		}
+
+		if !slices.Contains(g.members, reg.Name) {
+			log.Printf("Rejected registration (msg id %s): %q is not a configured member of group %q\n", msg.ID, reg.Name, g.groupName())
+			return
+		}
+
+		pinnedIK, err := readPinnedIK(g, reg.Name)
+		if err != nil {
+			log.Printf("Rejected registration (msg id %s): %v\n", msg.ID, err)
+			return
+		}
+		if pinnedIK == nil && g.requirePinnedIK {
+			log.Printf("Rejected registration (msg id %s): member %q of group %q has no pinned IK\n", msg.ID, reg.Name, g.groupName())
+			return
+		}
+
+		ik, _, err := reg.Verify(pinnedIK)
+		if err != nil {
+			log.Printf("Rejected registration (msg id %s): %v\n", msg.ID, err)
+			return
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		// without a pin the first registration is trusted, and pins the IK
+		// for the rest of the setup: a member may resend its bundle, but no
+		// one else may replace it
+		if prev, ok := regs[g.group][reg.Name]; ok {
+			prevIK, _, _ := prev.Verify(nil)
+			if !prevIK.Equal(ik) {
+				log.Printf("Rejected registration (msg id %s): member %q of group %q already registered with another IK\n", msg.ID, reg.Name, g.groupName())
+				return
+			}
+		} else {
+			received++
+		}
+		regs[g.group][reg.Name] = &reg
+		recordAudit(audit.EventMember, g, 0, map[string]string{
+			"action":        "registered",
+			"member":        reg.Name,
+			"ikFingerprint": audit.Fingerprint(reg.IK),
+			"msgId":         msg.ID,
+		})
+		log.Printf("Registered member %q of group %q (%d/%d).\n", reg.Name, g.groupName(), received, expected)
+		if received == expected {
+			cancel()
+		}
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		mu.Fatalf("error: receiving registrations: %v", err)
+	}
+
+	if received != expected {
+		mu.Fatalf("error: only %d of %d members registered", received, expected)
+	}
+
+	return regs
+}
+
+// Returns the pre-shared IK for a member, if one was provisioned out of
+// band next to the ART config file, and nil otherwise.  Keys written by a
+// previous registration are pinned the same way.  The key file is in the
+// art.outform encoding, like the keys writeGroupConfig writes.
+func readPinnedIK(opts *Options, name string) (ed25519.PublicKey, error) {
+	configDir := filepath.Dir(opts.artConfigFile)
+	pubPath, _ := createKeyNames(filepath.Join(configDir, name), opts.outform, "ik")
+
+	_, err := os.Stat(pubPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	ik, err := art.ReadPublicIKFromFile(pubPath, opts.encoding)
+	if err != nil {
+		return nil, fmt.Errorf("can't read pinned IK for %q: %w", name, err)
+	}
+	return ik, nil
+}
+
+// Writes the registered public keys next to the ART config file and
+// generates the config file itself, with the initiator listed first.
+func writeGroupConfig(opts *Options, regs map[string]*artx.Registration) {
+	configDir := filepath.Dir(opts.artConfigFile)
+
+	var lines []string
+	initiatorIK, _ := createKeyNames(opts.basePath, opts.outform, "ik")
+	initiatorEK, _ := createKeyNames(opts.basePath, opts.outform, "ek")
+	lines = append(lines, fmt.Sprintf("%s %s %s", opts.initiator, filepath.Base(initiatorIK), filepath.Base(initiatorEK)))
+
+	for _, name := range opts.members {
+		reg := regs[name]
+		ik, ek, err := reg.Verify(nil)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+
+		ikPath, _ := createKeyNames(filepath.Join(configDir, name), opts.outform, "ik")
+		ekPath, _ := createKeyNames(filepath.Join(configDir, name), opts.outform, "ek")
+
+		// key files are written read-only, so replace rather than overwrite
+		os.Remove(ikPath)
+		if err := art.WritePublicIKToFile(ik, ikPath, opts.encoding); err != nil {
+			mu.Fatalf("error: writing public IK for %q: %v", name, err)
+		}
+		os.Remove(ekPath)
+		if err := art.WritePublicEKToFile(ek, ekPath, opts.encoding); err != nil {
+			mu.Fatalf("error: writing public EK for %q: %v", name, err)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s %s %s", name, filepath.Base(ikPath), filepath.Base(ekPath)))
+	}
+
+	err := os.WriteFile(opts.artConfigFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		mu.Fatalf("error: writing group config file: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/art"
+)
+
+type testMember struct {
+	ik ed25519.PrivateKey
+	ek *ecdh.PrivateKey
+}
+
+func newTestMember(t *testing.T) *testMember {
+	_, ik, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testMember{ik, ek}
+}
+
+func (m *testMember) publicIK() ed25519.PublicKey {
+	return m.ik.Public().(ed25519.PublicKey)
+}
+
+func (m *testMember) register(t *testing.T, group, name string) []byte {
+	reg, err := artx.NewRegistration(group, name, m.ik, m.ek.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newRegisterOptions(t *testing.T, group string, members ...string) *Options {
+	dir := filepath.Join(t.TempDir(), group)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return &Options{
+		group:         group,
+		members:       members,
+		initiator:     "akesod",
+		basePath:      filepath.Join(dir, "akesod"),
+		artConfigFile: filepath.Join(dir, "art.conf"),
+		outform:       "pem",
+		encoding:      art.EncodingPEM,
+	}
+}
+
+// Registrations for two groups arrive among bundles that must be rejected:
+// only the valid ones, with the IK each member first registered with, are
+// collected.
+func TestCollectRegistrations(t *testing.T) {
+	const topic = "registration"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	finance := newRegisterOptions(t, "finance", "bob", "cici")
+	hr := newRegisterOptions(t, "hr", "dave")
+	hr.requirePinnedIK = true
+
+	bob, cici, dave, eve := newTestMember(t), newTestMember(t), newTestMember(t), newTestMember(t)
+	pinPath, _ := createKeyNames(filepath.Join(filepath.Dir(hr.artConfigFile), "dave"), hr.outform, "ik")
+	if err := art.WritePublicIKToFile(dave.publicIK(), pinPath, hr.encoding); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := eve.register(t, "finance", "cici")
+	var reg artx.Registration
+	if err := json.Unmarshal(forged, &reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.Name = "bob"
+	forged, _ = json.Marshal(&reg)
+
+	mb := bus.NewMemory()
+	mb.CreateSubscription(topic, topic+"-akesod")
+	for _, data := range [][]byte{
+		[]byte("{"),
+		eve.register(t, "legal", "eve"),
+		eve.register(t, "finance", "eve"),
+		forged,
+		eve.register(t, "hr", "dave"), // not the pinned IK
+		bob.register(t, "finance", "bob"),
+		bob.register(t, "finance", "bob"), // resent
+		eve.register(t, "finance", "bob"), // replaces bob's IK
+		dave.register(t, "hr", "dave"),
+		cici.register(t, "finance", "cici"),
+	} {
+		if _, err := mb.Publish(ctx, topic, &bus.Message{Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	regs := collectRegistrations(ctx, mb, topic, []*Options{finance, hr})
+	expected := map[string]map[string]*testMember{
+		"finance": {"bob": bob, "cici": cici},
+		"hr":      {"dave": dave},
+	}
+	for group, members := range expected {
+		if len(regs[group]) != len(members) {
+			t.Errorf("group %s: got %d registrations; expected %d", group, len(regs[group]), len(members))
+		}
+		for name, m := range members {
+			reg, ok := regs[group][name]
+			if !ok {
+				t.Errorf("%s of %s didn't register", name, group)
+				continue
+			}
+			ik, _, err := reg.Verify(nil)
+			if err != nil || !ik.Equal(m.publicIK()) {
+				t.Errorf("%s of %s registered with the wrong IK (%v)", name, group, err)
+			}
+		}
+	}
+}
+
+// The registered keys are written next to the ART config, listed in it
+// after the initiator, and pinned for the next setup.
+func TestWriteGroupConfig(t *testing.T) {
+	opts := newRegisterOptions(t, "finance", "bob", "cici")
+	regs := make(map[string]*artx.Registration)
+	members := make(map[string]*testMember)
+	for _, name := range opts.members {
+		members[name] = newTestMember(t)
+		reg, err := artx.NewRegistration(opts.group, name, members[name].ik, members[name].ek.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		regs[name] = reg
+	}
+
+	writeGroupConfig(opts, regs)
+	// a second setup replaces the read-only key files
+	writeGroupConfig(opts, regs)
+
+	data, err := os.ReadFile(opts.artConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "akesod akesod-ik-pub.pem akesod-ek-pub.pem\n" +
+		"bob bob-ik-pub.pem bob-ek-pub.pem\n" +
+		"cici cici-ik-pub.pem cici-ek-pub.pem\n"
+	if string(data) != expected {
+		t.Errorf("config:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	for name, m := range members {
+		ik, err := readPinnedIK(opts, name)
+		if err != nil || !ik.Equal(m.publicIK()) {
+			t.Errorf("pinned IK of %s: %v", name, err)
+		}
+	}
+	if ik, err := readPinnedIK(opts, "dave"); ik != nil || err != nil {
+		t.Errorf("pinned IK of an unregistered member: %v, %v", ik, err)
+	}
+
+	pinPath, _ := createKeyNames(filepath.Join(filepath.Dir(opts.artConfigFile), "bob"), opts.outform, "ik")
+	os.Remove(pinPath)
+	if err := os.WriteFile(pinPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPinnedIK(opts, "bob"); err == nil || !strings.Contains(err.Error(), "pinned IK") {
+		t.Errorf("malformed pinned IK: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/control"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/art"
+)
+
+// Objects re-keyed during a rotation are checkpointed here, so a resumed
+// rotation skips objects that are already under the new key.
+func rotationCheckpointPath(opts *Options, epoch uint64) string {
+	return filepath.Join(opts.stateDir, fmt.Sprintf("rotation-%020d.log", epoch))
+}
+
+// errRotationStopped is returned by rotateBucket once the rotation has been
+// stopped by shutdown or cancellation.
+var errRotationStopped = errors.New("rotation stopped")
+
+// errRotationCancelled is returned by rotate when the rotation was
+// cancelled on the control API.  The rotation stays pending.
+var errRotationCancelled = errors.New("rotation cancelled")
+
+// Re-keys each of the group's buckets from its key under oldKeys to its key
+// in the (already committed) current epoch, then clears the pending
+// rotation in the store.  trigger says what started the rotation, for the
+// control API.  oldKeys are destroyed when rotate returns.
+func (h *keyUpdateHandler) rotate(ctx context.Context, g *groupHandler, groupInfo *artx.GroupInfo, treeState *art.TreeState, oldKeys *epochKeys, trigger string) error {
+	newKeys := newEpochKeys(groupInfo, treeState, g.opts)
+	defer oldKeys.destroy()
+	defer newKeys.destroy()
+
+	status := h.rotations.start(g.opts.groupName(), groupInfo.Epoch, trigger, groupInfo.UpdateMsgID)
+
+	// stop is closed on shutdown or when the rotation is cancelled
+	stop := make(chan struct{})
+	rotated := make(chan struct{})
+	defer close(rotated)
+	go func() {
+		select {
+		case <-h.stopping:
+		case <-status.cancel:
+		case <-rotated:
+			return
+		}
+		close(stop)
+	}()
+
+	metrics.RotationsStarted.Inc()
+	recordAudit(audit.EventRotationStart, g.opts, groupInfo.Epoch, map[string]string{
+		"strategy": g.opts.strategy,
+		"buckets":  strings.Join(g.opts.buckets, ","),
+		"msgId":    groupInfo.UpdateMsgID,
+		"trigger":  trigger,
+	})
+
+	done, err := store.OpenSet(rotationCheckpointPath(g.opts, groupInfo.Epoch), 0)
+	if err != nil {
+		err = fmt.Errorf("opening rotation checkpoint: %w", err)
+		h.rotations.finish(status, control.StateFailed, err)
+		return err
+	}
+
+	var errs []error
+	for _, bucket := range g.opts.buckets {
+		if stopped(stop) {
+			errs = append(errs, fmt.Errorf("%w before bucket %s", errRotationStopped, bucket))
+			break
+		}
+
+		oldKey, newKey := oldKeys.bucketKey(bucket), newKeys.bucketKey(bucket)
+		err := rotateBucket(ctx, stop, status, h.layers, bucket, g.bkts[bucket], h.msgBus, g.opts, groupInfo.Epoch,
+			oldKey, newKey, done)
+		secret.Zero(oldKey, newKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", bucket, err))
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+
+		state := control.StateFailed
+		if errors.Is(err, errRotationStopped) {
+			if stopped(status.cancel) {
+				state = control.StateCancelled
+				err = fmt.Errorf("%w: %w", errRotationCancelled, err)
+			} else {
+				state = control.StateInterrupted
+			}
+		}
+
+		metrics.RotationsFailed.Inc()
+		recordAudit(audit.EventRotationFinish, g.opts, groupInfo.Epoch, map[string]string{
+			"result": state,
+			"error":  err.Error(),
+		})
+		h.rotations.finish(status, state, err)
+		done.Close(false)
+		return err
+	}
+
+	// until this is committed the rotation stays pending, and resuming it
+	// skips the objects recorded in done
+	groupInfo.PendingRotation = false
+	groupInfo.UpdateMsgID = ""
+	if err := commitGroupState(g.st, g.opts, groupInfo, treeState); err != nil {
+		metrics.RotationsFailed.Inc()
+		h.rotations.finish(status, control.StateFailed, err)
+		done.Close(false)
+		return err
+	}
+	metrics.RotationsCompleted.Inc()
+	recordAudit(audit.EventRotationFinish, g.opts, groupInfo.Epoch, map[string]string{
+		"result": "ok",
+	})
+	if r, layersDone := h.rotations.finish(status, control.StateCompleted, nil); layersDone {
+		recordLayersDone(g.opts, r)
+	}
+
+	if err := done.Close(true); err != nil {
+		log.Printf("error: removing rotation checkpoint: %v\n", err)
+	}
+	return nil
+}
+
+// Resumes a rotation that was interrupted after the tree was committed.  The
+// old key comes from the previous epoch's snapshot.
+func (h *keyUpdateHandler) resumeRotation(ctx context.Context, g *groupHandler, groupInfo *artx.GroupInfo, treeState *art.TreeState) error {
+	if groupInfo.Epoch == 0 {
+		return fmt.Errorf("group %q claims a pending rotation at epoch 0", g.opts.groupName())
+	}
+
+	data, err := g.st.LoadVersion(groupInfo.Epoch - 1)
+	if err != nil {
+		return fmt.Errorf("can't resume rotation of group %q to epoch %d: %w", g.opts.groupName(), groupInfo.Epoch, err)
+	}
+	prevInfo, prevTree, err := artx.UnmarshalGroupState(data)
+	if err != nil {
+		return fmt.Errorf("can't resume rotation of group %q to epoch %d: %w", g.opts.groupName(), groupInfo.Epoch, err)
+	}
+	defer secret.Zero(prevTree.Sk)
+
+	// members must have the update before their data moves to its key
+	if err := h.publishPendingUpdate(ctx, g, groupInfo, treeState); err != nil {
+		return err
+	}
+
+	log.Printf("Resuming rotation of group %q to epoch %d (msg id %s).\n", g.opts.groupName(), groupInfo.Epoch, groupInfo.UpdateMsgID)
+	return h.rotate(ctx, g, groupInfo, treeState, newEpochKeys(prevInfo, prevTree, g.opts), control.TriggerResume)
+}
+
+func stopped(stopping <-chan struct{}) bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the attributes of the bucket's notification, or of the metadata
+// update events akesod publishes itself, for a rotation of the akeso
+// strategy.  The workers that apply the layers get the rotation key only
+// wrapped to their key, for this rotation; no attribute carries a DEK.
+func layerAttributes(opts *Options, epoch uint64, bucket string, rotationKey []byte) (map[string]string, error) {
+	scope := dekwrap.Scope(opts.groupName(), epoch, bucket)
+	wrapped, err := dekwrap.Wrap(rotationKey, opts.workerKey, scope)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping the rotation key: %w", err)
+	}
+	return map[string]string{
+		dekwrap.AttrWrappedKey: wrapped,
+		dekwrap.AttrRotation:   scope,
+	}, nil
+}
+
+// Re-encrypts or re-keys every object of the bucket not yet in done,
+// recording each object in done as "BUCKET/NAME" as it completes, and its
+// progress in status.  The akeso layers it leaves to the workers are
+// followed in layers, if not nil.  Objects without valid akeso metadata get
+// the ingest policy, unless it is off, instead of failing; quarantined
+// objects are skipped.  Returns the errors of all failed objects.
+// Once stop is closed no more objects are started; the rotation is then
+// left pending and is resumed later.
+func rotateBucket(ctx context.Context, stop <-chan struct{}, status *rotationStatus, layers *layerTracker, bucket string, bkt *storage.BucketHandle, msgBus bus.Bus, opts *Options,
+	epoch uint64, old_key, new_key []byte, done *store.Set) error {
+	objects, err := listObjects(ctx, bucket, bkt)
+	if err != nil {
+		return err
+	}
+	if opts.ingestPolicy != ingestOff {
+		objects = slices.DeleteFunc(objects, func(o *storage.ObjectAttrs) bool { return ingestSkips(opts, o.Name) })
+	}
+
+	skipped := 0
+	for _, object := range objects {
+		if done.Contains(bucket + "/" + object.Name) {
+			skipped++
+		}
+	}
+	status.addObjects(len(objects)-skipped, skipped)
+
+	// each object's new akeso layer gets its own DEK, derived from the
+	// rotation key
+	rotationKey := aes256.NewRandomKey()
+	defer secret.Zero(rotationKey)
+
+	var layerAttrs map[string]string
+	if opts.strategy == "akeso" {
+		layerAttrs, err = layerAttributes(opts, epoch, bucket, rotationKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Configure Notifications to trigger Cloud Function in case akeso strategy is being run
+	if opts.strategy == "akeso" && opts.busKind == bus.KindPubSub {
+		err = gcsx.RemoveNotification(ctx, bkt, opts.metadataUpdateTopic, opts.project, "OBJECT_METADATA_UPDATE")
+		if err != nil {
+			return fmt.Errorf("gcsx.RemoveNotification failed: %w", err)
+		}
+
+		_, err := gcsx.AddNotification(ctx, bkt, &storage.Notification{
+			TopicID:          opts.metadataUpdateTopic,
+			TopicProjectID:   opts.project,
+			EventTypes:       []string{"OBJECT_METADATA_UPDATE"},
+			CustomAttributes: layerAttrs,
+			PayloadFormat:    storage.JSONPayload,
+		})
+		if err != nil {
+			return fmt.Errorf("gcsx.AddNotification failed: %w", err)
+		}
+	}
+
+	bucketUpdateStart := time.Now()
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, opts.maxConcUpdates)
+
+	interrupted := false
+
+objectLoop:
+	for _, object := range objects {
+		if done.Contains(bucket + "/" + object.Name) {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}: // Acquire semaphore
+		case <-stop:
+			interrupted = true
+			break objectLoop
+		}
+		wg.Add(1)
+
+		go func(object *storage.ObjectAttrs) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release semaphore
+
+			if opts.ingestPolicy != ingestOff {
+				if reason := checkIngest(object); reason != nil {
+					err := enforceIngest(ctx, opts, epoch, bucket, bkt, object, new_key, reason)
+					if err == nil {
+						err = done.Add(bucket + "/" + object.Name)
+					}
+					status.objectDone(err)
+					if err != nil {
+						mtx.Lock()
+						errs = append(errs, err)
+						mtx.Unlock()
+					}
+					return
+				}
+			}
+
+			var layer *pendingLayer
+			if layers != nil && opts.strategy == "akeso" {
+				layer = layers.expect(status, opts, epoch, bucket, object.Name, layerAttrs)
+			}
+
+			start := time.Now()
+			pending, err := updateObject(ctx, bucket, bkt, msgBus, opts, epoch, object.Name, old_key, new_key, rotationKey, layerAttrs)
+			if layer != nil && !pending {
+				layers.drop(layer)
+			}
+			if err == nil {
+				err = done.Add(bucket + "/" + object.Name)
+			}
+			metrics.ObserveObject(opts.strategy, object.Size, start, err)
+			status.objectDone(err)
+			auditObject(opts, epoch, bucket, object.Name, err)
+			if err != nil {
+				mtx.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", object.Name, err))
+				mtx.Unlock()
+			}
+		}(object)
+	}
+	wg.Wait()
+
+	duration := time.Since(bucketUpdateStart)
+	log.Printf("Duration for update/rotate keys of bucket %s by %s strategy is %v\n", bucket, opts.strategy, duration)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d objects failed to rotate: %w", len(errs), len(objects), errors.Join(errs...))
+	}
+	if interrupted {
+		return errRotationStopped
+	}
+	return nil
+}
+
+func auditObject(opts *Options, epoch uint64, bucket, name string, err error) {
+	fields := map[string]string{"bucket": bucket, "object": name, "result": "ok"}
+	if err != nil {
+		fields["result"] = "failed"
+		fields["error"] = err.Error()
+	}
+	recordAudit(audit.EventObject, opts, epoch, fields)
+}
+
+// rencrypt and upload a single object using new aes key.  layerAttrs carry
+// the wrapped rotation key for the akeso strategy's workers, and akeso
+// objects record epoch, whose key new_key is.  Reports
+// whether a layer was left for the workers to apply.
+func updateObject(ctx context.Context, bucket string, bkt *storage.BucketHandle, msgBus bus.Bus, opts *Options, epoch uint64,
+	file string, old_key, new_key, rotationKey []byte, layerAttrs map[string]string) (bool, error) {
+	switch opts.strategy {
+	case "strawman":
+		return false, encstr.StrawmanUpdate(bkt, file, old_key, new_key, ctx)
+	case "keywrap":
+		return false, encstr.KeyWrapUpdate(bkt, file, old_key, new_key, ctx)
+	case "akeso":
+		pending, err := encstr.AkesoUpdate(bkt, file, opts.maxReencryptions, old_key, new_key, rotationKey,
+			map[string]string{encstr.MetaEpoch: strconv.FormatUint(epoch, 10)}, ctx)
+		if err == nil && pending && opts.busKind != bus.KindPubSub {
+			err = publishMetadataUpdate(ctx, msgBus, opts, bucket, file, layerAttrs)
+		}
+		// without its event the object fails, and its layer is followed
+		// again when the rotation is retried
+		return pending && err == nil, err
+	case "csek":
+		return false, encstr.RotateCSEKKey(bkt, file, old_key, new_key, ctx)
+	case "cmek":
+		return false, encstr.UpdateCMEKKey(bkt, file, old_key, new_key, ctx)
+	}
+	return false, fmt.Errorf("unknown strategy %q", opts.strategy)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/secret/secrettest"
+)
+
+func TestDeadLetterRedactsKeys(t *testing.T) {
+	dek := aesx.GenerateRandomKey()
+	opts := &Options{deadLetterTopic: "dead-letters"}
+	mb := bus.NewMemory()
+	mb.CreateSubscription(opts.deadLetterTopic, "test")
+
+	msg := &bus.Message{
+		ID:   "1",
+		Data: []byte(`{"bucket":"b","name":"o"}`),
+		Attributes: map[string]string{
+			"eventType": "OBJECT_METADATA_UPDATE",
+			"new_dek":   base64.StdEncoding.EncodeToString(dek),
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var forwarded *bus.Message
+	out := secrettest.CaptureOutput(t, func() {
+		if err := deadLetter(ctx, mb, opts, "metadata-updates", msg, 5, "too many attempts"); err != nil {
+			t.Fatal(err)
+		}
+		mb.Subscribe(ctx, opts.deadLetterTopic, "test", func(ctx context.Context, m *bus.Message) {
+			forwarded = m
+			m.Ack()
+			cancel()
+		})
+	})
+
+	if forwarded == nil {
+		t.Fatal("nothing was published to the dead-letter topic")
+	}
+	if got := forwarded.Attributes["new_dek"]; got != secret.Redacted {
+		t.Errorf("dead-lettered new_dek = %q, expected %s", got, secret.Redacted)
+	}
+	if got := forwarded.Attributes["eventType"]; got != "OBJECT_METADATA_UPDATE" {
+		t.Errorf("dead-lettered eventType = %q", got)
+	}
+	secrettest.AssertNoLeak(t, out+fmt.Sprint(forwarded.Attributes), dek)
+}
+
+func TestEpochKeysDoNotLeak(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &epochKeys{
+		groupID:  "group",
+		epoch:    3,
+		schedule: aesx.ScheduleHKDFv1,
+		stageKey: secret.Bytes(sk),
+		purpose:  aesx.PurposeHeaderKEK,
+	}
+	bucketKey := keys.bucketKey("bucket")
+
+	out := secrettest.CaptureOutput(t, func() {
+		for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x"} {
+			fmt.Printf(verb+"\n", keys)
+		}
+		fmt.Println(keys.fingerprint())
+	})
+	secrettest.AssertNoLeak(t, out, sk, sk.Seed(), bucketKey)
+
+	keys.destroy()
+	for _, b := range sk {
+		if b != 0 {
+			t.Fatal("destroy did not wipe the stage key")
+		}
+	}
+}
+
+// The notification, and the events akesod publishes without Pub/Sub, carry
+// the rotation key only wrapped to the worker key.
+func TestLayerAttributesCarryNoDEK(t *testing.T) {
+	worker, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{group: "team-a", workerKey: worker.PublicKey(), metadataUpdateTopic: "metadata-updates"}
+	rotationKey := aes256.NewRandomKey()
+	dek, err := encstr.DeriveLayerKey(rotationKey, "bucket", "obj", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := layerAttributes(opts, 3, "bucket", rotationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mb := bus.NewMemory()
+	mb.CreateSubscription(opts.metadataUpdateTopic, "test")
+	if err := publishMetadataUpdate(ctx, mb, opts, "bucket", "obj", attrs); err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]string
+	mb.Subscribe(ctx, opts.metadataUpdateTopic, "test", func(ctx context.Context, m *bus.Message) {
+		event = m.Attributes
+		m.Ack()
+		cancel()
+	})
+
+	decodings := []func(string) ([]byte, error){
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+		hex.DecodeString,
+	}
+	for _, a := range []map[string]string{attrs, event} {
+		for name, value := range a {
+			for _, decode := range decodings {
+				b, err := decode(value)
+				if err == nil && (bytes.Equal(b, dek) || bytes.Equal(b, rotationKey)) {
+					t.Errorf("attribute %s decodes to a key", name)
+				}
+			}
+		}
+		secrettest.AssertNoLeak(t, fmt.Sprint(a), dek, rotationKey)
+	}
+
+	// only the worker can unwrap it, for this rotation
+	got, err := dekwrap.Unwrap(attrs[dekwrap.AttrWrappedKey], worker, attrs[dekwrap.AttrRotation])
+	if err != nil || !bytes.Equal(got, rotationKey) {
+		t.Errorf("the worker can't unwrap the rotation key: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/audit"
+	"github.com/etclab/akesod/internal/escrow"
+	"github.com/etclab/akesod/internal/metrics"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/store"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// Opens the group state store, sealed with the configured key file or
+// passphrase if either is set.
+func openStore(opts *Options) *store.Store {
+	storeOpts := &store.Options{Keep: opts.stateSnapshots}
+
+	if opts.stateKeyFile != "" {
+		key, err := aesx.ReadKeyFile(opts.stateKeyFile)
+		if err != nil {
+			mu.Fatalf("error: reading state key file: %v", err)
+		}
+		storeOpts.Key = key
+	} else if opts.statePassphraseEnv != "" {
+		passphrase := os.Getenv(opts.statePassphraseEnv)
+		if passphrase == "" {
+			mu.Fatalf("error: state passphrase variable %s is empty", opts.statePassphraseEnv)
+		}
+		storeOpts.Passphrase = []byte(passphrase)
+	}
+
+	st, err := store.Open(opts.stateDir, storeOpts)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	return st
+}
+
+// Loads the current group state.  If the store is empty but plaintext
+// state from an older akesod exists under keys/, that state is imported as
+// the first snapshot.
+func loadGroupState(st *store.Store, opts *Options) (*artx.GroupInfo, *art.TreeState, error) {
+	_, data, err := st.Load()
+	if errors.Is(err, store.ErrNoSnapshot) {
+		return importLegacyState(st, opts)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading state of group %q: %w", opts.groupName(), err)
+	}
+
+	info, tree, err := artx.UnmarshalGroupState(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading state of group %q: %w", opts.groupName(), err)
+	}
+	return info, tree, nil
+}
+
+// Reports whether plaintext state from an older akesod exists for import
+func hasLegacyState(opts *Options) bool {
+	_, err := os.Stat(filepath.Join(opts.outDir, "state.json"))
+	return err == nil
+}
+
+func importLegacyState(st *store.Store, opts *Options) (*artx.GroupInfo, *art.TreeState, error) {
+	treeStateFile := filepath.Join(opts.outDir, "state.json")
+	groupInfoFile := filepath.Join(opts.outDir, "group.json")
+
+	tree, err := artx.ReadTreeStateFile(treeStateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no group state in %s and no legacy state to import: %w", opts.stateDir, err)
+	}
+
+	info, err := artx.ReadGroupInfo(groupInfoFile)
+	if errors.Is(err, os.ErrNotExist) {
+		// state from before groups had IDs and epochs
+		info = artx.NewGroupInfo()
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if err := commitGroupState(st, opts, info, tree); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Imported legacy group state from %s as epoch %d; the plaintext files can now be removed.\n", treeStateFile, info.Epoch)
+	escrowGroupState(opts, info, tree)
+	return info, tree, nil
+}
+
+// Durably records the group state as the snapshot for its epoch
+func commitGroupState(st *store.Store, opts *Options, info *artx.GroupInfo, tree *art.TreeState) error {
+	data, err := artx.MarshalGroupState(info, tree)
+	if err != nil {
+		return err
+	}
+
+	if err := st.Commit(info.Epoch, data); err != nil {
+		return fmt.Errorf("committing state of group %q for epoch %d: %w", opts.groupName(), info.Epoch, err)
+	}
+	metrics.Epoch.WithLabelValues(opts.groupName()).Set(float64(info.Epoch))
+	return nil
+}
+
+// Splits the state of a new epoch among the escrow custodians, if escrow
+// is enabled.  Failing to escrow does not stop key management, but is
+// logged.
+func escrowGroupState(opts *Options, info *artx.GroupInfo, tree *art.TreeState) {
+	if opts.escrowThreshold == 0 {
+		return
+	}
+
+	err := func() error {
+		custodians, err := escrow.ParseCustodians(opts.escrowCustodians)
+		if err != nil {
+			return err
+		}
+		data, err := artx.MarshalGroupState(info, tree)
+		if err != nil {
+			return err
+		}
+		defer secret.Zero(data)
+
+		_, err = escrow.Escrow(opts.escrowDir, opts.groupName(), info.ID, info.Epoch, data, custodians, opts.escrowThreshold)
+		return err
+	}()
+	if err != nil {
+		log.Printf("error: escrowing epoch %d of group %q: %v\n", info.Epoch, opts.groupName(), err)
+		return
+	}
+
+	log.Printf("Escrowed epoch %d of group %q in %s; %d of %d custodians can recover it.\n",
+		info.Epoch, opts.groupName(), escrow.EpochDir(opts.escrowDir, info.Epoch), opts.escrowThreshold, len(opts.escrowCustodians))
+	recordAudit(audit.EventEscrow, opts, info.Epoch, map[string]string{
+		"groupId":    info.ID,
+		"threshold":  strconv.Itoa(opts.escrowThreshold),
+		"custodians": strings.Join(custodianNames(opts.escrowCustodians), ","),
+	})
+}
+
+func custodianNames(specs []string) []string {
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i], _, _ = strings.Cut(spec, "=")
+	}
+	return names
+}
+
+// epochKeys derives the keys of one epoch of a group.  Each bucket has
+// its own key, derived with the group's key schedule from the epoch's stage
+// key.  The stage key is a copy; destroy wipes it.
+type epochKeys struct {
+	groupID  string
+	epoch    uint64
+	schedule int
+	stageKey secret.Bytes
+	salt     []byte
+	purpose  string
+}
+
+func newEpochKeys(info *artx.GroupInfo, tree *art.TreeState, opts *Options) *epochKeys {
+	return &epochKeys{
+		groupID:  info.ID,
+		epoch:    info.Epoch,
+		schedule: info.KeySchedule,
+		stageKey: bytes.Clone(tree.StageKey()),
+		salt:     opts.kdfSalt,
+		purpose:  strategyPurpose(opts.strategy),
+	}
+}
+
+// The akeso strategy's key only encrypts object headers; the others
+// encrypt the data or its DEK.
+func strategyPurpose(strategy string) string {
+	if strategy == "akeso" {
+		return aesx.PurposeHeaderKEK
+	}
+	return aesx.PurposeDataKEK
+}
+
+// Returns the epoch's key for bucket
+func (k *epochKeys) bucketKey(bucket string) []byte {
+	key, err := aesx.ScheduleKey(k.schedule, ed25519.PrivateKey(k.stageKey), k.salt, aesx.KeyContext{
+		GroupID: k.groupID,
+		Epoch:   k.epoch,
+		Bucket:  bucket,
+		Purpose: k.purpose,
+	})
+	if err != nil {
+		mu.Fatalf("error: deriving key for bucket %s at epoch %d: %v", bucket, k.epoch, err)
+	}
+	return key
+}
+
+// Identifies the epoch's keys in the audit log
+func (k *epochKeys) fingerprint() string {
+	return audit.Fingerprint(k.stageKey)
+}
+
+// Describes the keys without the stage key, which fmt would print as an
+// unexported field.
+func (k *epochKeys) String() string {
+	return fmt.Sprintf("keys of epoch %d of group %s", k.epoch, k.groupID)
+}
+
+func (k *epochKeys) GoString() string {
+	return k.String()
+}
+
+// Wipes the stage key; the keys can't be derived afterwards
+func (k *epochKeys) destroy() {
+	k.stageKey.Zero()
+}
@@ -2,80 +2,166 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/dekwrap"
 	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/gcsx"
 	"github.com/etclab/mu"
 )
 
-func upload(bkt *storage.BucketHandle, fileName, objectName, strategy string, key []byte, ctx context.Context) error {
-	fileData, err := os.ReadFile(fileName)
+// Uploads a file, or stdin if fileName is "-".  Except with cmek, whose key
+// is only a KMS key name, the object gets the keyed digest of its plaintext,
+// for -sync and for downloads to check.  Streamed uploads don't, since GCS takes the metadata before
+// the data.
+func upload(bkt *storage.BucketHandle, fileName, objectName, strategy string, key []byte, maxBuffer int64, ctx context.Context) error {
+	var fileData []byte
+	var err error
+	if fileName == "-" {
+		if encstr.Streams(strategy) {
+			return encstr.UploadStream(ctx, bkt, objectName, strategy, os.Stdin, key, nil)
+		}
+		fileData, err = readStdin(strategy, maxBuffer)
+	} else {
+		fileData, err = os.ReadFile(fileName)
+	}
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return err
 	}
-	dek := aes256.NewRandomKey()
 
-	switch strategy {
-	case "strawman":
-		err = encstr.StrawmanUpload(bkt, objectName, fileData, key)
-	case "csek":
-		err = encstr.CsekUpload(bkt, objectName, fileData, key)
-	case "keywrap":
-		err = encstr.KeyWrapUpload(bkt, objectName, fileData, key)
-	case "akeso":
-		err = encstr.AkesoUpload(bkt, objectName, fileData, key, dek)
-	case "cmek":
-		err = encstr.CmekUpload(bkt, objectName, fileData, key, ctx)
-	default:
-		mu.Panicf("unknown strategy: %s", strategy)
+	var metadata map[string]string
+	if strategy != "cmek" {
+		metadata = encstr.PlaintextDigest(key, nil, fileData)
 	}
+	return encstr.Upload(ctx, bkt, objectName, strategy, fileData, key, metadata)
+}
 
-	return err
+// Reads stdin for a strategy that can't stream, which must seal all of it
+// at once, up to maxBuffer bytes
+func readStdin(strategy string, maxBuffer int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, maxBuffer+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBuffer {
+		return nil, fmt.Errorf("stdin is longer than -maxBuffer (%d bytes): the %s strategy encrypts the whole object with AES-GCM at once, so it can't stream; use csek or cmek to stream, or a larger -maxBuffer", maxBuffer, strategy)
+	}
+	return data, nil
 }
 
+// Downloads an object to a file, or to stdout if fileName is "-"
 func download(bkt *storage.BucketHandle, objectName, fileName, strategy string, key []byte, ctx context.Context) error {
 	var data []byte
 	var err error
 
-	switch strategy {
-	case "strawman":
-		data, err = encstr.StrawmanDownload(bkt, objectName, key)
-	case "csek":
-		data, err = encstr.CsekDownload(bkt, objectName, key)
-	case "keywrap":
-		data, err = encstr.KeyWrapDownload(bkt, objectName, key)
-	case "akeso":
-		data, err = encstr.AkesoDownload(bkt, objectName, key)
-	case "cmek":
-		data, err = encstr.CmekDownload(bkt, objectName, key, ctx)
-	default:
-		mu.Panicf("unknown strategy: %s", strategy)
+	// the AES-GCM strategies can only release the plaintext once all of it
+	// is authenticated
+	if fileName == "-" && encstr.Streams(strategy) {
+		return encstr.DownloadStream(ctx, bkt, objectName, strategy, key, os.Stdout)
 	}
 
+	data, err = encstr.Download(ctx, bkt, objectName, strategy, key)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return err
 	}
 
+	if fileName == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
 	return os.WriteFile(fileName, data, 0644)
 }
 
+// Returns the strategy an object was written with, from its metadata, and
+// its keys.  attrs are read if nil.  An explicit -strategy must match.
+func resolveObject(ctx context.Context, bkt *storage.BucketHandle, objectName string, attrs *storage.ObjectAttrs, opts *Options) (string, []byte, []byte, error) {
+	if attrs == nil {
+		var err error
+		attrs, err = bkt.Object(objectName).Attrs(ctx)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+		}
+	}
+
+	strategy, err := encstr.DetectStrategy(attrs)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("object %s: %w", objectName, err)
+	}
+	if opts.strategy != "" && opts.strategy != strategy {
+		return "", nil, nil, fmt.Errorf("object %s was written with the %s strategy, not %s; leave out -strategy to use the object's", objectName, strategy, opts.strategy)
+	}
+
+	key, newKey, err := opts.keysFor(strategy, attrs)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("object %s: %w", objectName, err)
+	}
+	return strategy, key, newKey, nil
+}
+
+// Copies an object to another bucket, or another name, under
+// -dstStrategy.  attrs are read if nil.  Returns whether the object was
+// copied, rather than skipped by -sync.
+func copyObject(ctx context.Context, bkt, dstBkt *storage.BucketHandle, objectName, dstObjectName string, attrs *storage.ObjectAttrs, opts *Options) (bool, error) {
+	if attrs == nil {
+		var err error
+		attrs, err = bkt.Object(objectName).Attrs(ctx)
+		if err != nil {
+			return false, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+		}
+	}
+	strategy, key, _, err := resolveObject(ctx, bkt, objectName, attrs, opts)
+	if err != nil {
+		return false, err
+	}
+
+	if opts.sync {
+		dstAttrs, err := dstBkt.Object(dstObjectName).Attrs(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return false, err
+		}
+		mac := attrs.Metadata[encstr.MetaPlaintextMAC]
+		if dstAttrs != nil && mac != "" && dstAttrs.Metadata[encstr.MetaPlaintextMAC] == mac {
+			return false, nil
+		}
+	}
+
+	dstStrategy := opts.dstStrategy
+	if dstStrategy == "" {
+		dstStrategy = strategy
+	}
+	dstKey, err := opts.dstKeyFor(dstStrategy, attrs)
+	if err != nil {
+		return false, fmt.Errorf("copy of %s: %w", objectName, err)
+	}
+
+	src := &encstr.CopyEnd{Bucket: bkt, Name: objectName, Strategy: strategy, Key: key}
+	dst := &encstr.CopyEnd{Bucket: dstBkt, Name: dstObjectName, Strategy: dstStrategy, Key: dstKey}
+	if err := encstr.Copy(ctx, attrs, src, dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func update(bkt *storage.BucketHandle, objectName, strategy string, maxReencryptions int, oldKey, newKey, dekOverride []byte, ctx context.Context) error {
 	var err error
 
 	switch strategy {
 	case "strawman":
-		err = encstr.StrawmanUpdate(bkt, objectName, oldKey, newKey)
+		err = encstr.StrawmanUpdate(bkt, objectName, oldKey, newKey, ctx)
 	case "keywrap":
-		err = encstr.KeyWrapUpdate(bkt, objectName, oldKey, newKey)
+		err = encstr.KeyWrapUpdate(bkt, objectName, oldKey, newKey, ctx)
 	case "akeso":
-		err = encstr.AkesoUpdate(bkt, objectName, maxReencryptions, oldKey, newKey, dekOverride, ctx)
+		_, err = encstr.AkesoUpdate(bkt, objectName, maxReencryptions, oldKey, newKey, dekOverride, nil, ctx)
 	case "csek":
-		err = encstr.RotateCSEKKey(bkt, objectName, oldKey, newKey)
+		err = encstr.RotateCSEKKey(bkt, objectName, oldKey, newKey, ctx)
 	case "cmek":
 		err = encstr.UpdateCMEKKey(bkt, objectName, oldKey, newKey, ctx)
 	default:
@@ -89,6 +175,39 @@ func update(bkt *storage.BucketHandle, objectName, strategy string, maxReencrypt
 	return nil
 }
 
+// Replaces the bucket's metadata update notification on -notifyTopic with
+// one that carries the -dekOverride rotation key wrapped to the workers'
+// key, the way akesod sets it up for a rotation.  The cloud function then
+// applies the layers of the updates made with that key.
+func setLayerNotification(ctx context.Context, bkt *storage.BucketHandle, opts *Options) error {
+	// not an akesod rotation, so there is no group or epoch; the time
+	// keeps each run's rotation distinct in the completion events
+	scope := dekwrap.Scope("cloud-cp", uint64(time.Now().UnixNano()), opts.bucketName)
+	wrapped, err := dekwrap.Wrap(opts.dekOverride, opts.workerKey, scope)
+	if err != nil {
+		return fmt.Errorf("wrapping the rotation key: %w", err)
+	}
+
+	err = gcsx.RemoveNotification(ctx, bkt, opts.notifyTopic, opts.projectId, "OBJECT_METADATA_UPDATE")
+	if err != nil {
+		return fmt.Errorf("gcsx.RemoveNotification failed: %w", err)
+	}
+	_, err = gcsx.AddNotification(ctx, bkt, &storage.Notification{
+		TopicID:        opts.notifyTopic,
+		TopicProjectID: opts.projectId,
+		EventTypes:     []string{"OBJECT_METADATA_UPDATE"},
+		CustomAttributes: map[string]string{
+			dekwrap.AttrWrappedKey: wrapped,
+			dekwrap.AttrRotation:   scope,
+		},
+		PayloadFormat: storage.JSONPayload,
+	})
+	if err != nil {
+		return fmt.Errorf("gcsx.AddNotification failed: %w", err)
+	}
+	return nil
+}
+
 func main() {
 	// Setting Logger
 	fileName := "logFile.log"
@@ -129,12 +248,36 @@ func main() {
 
 	bkt := client.Bucket(opts.bucketName)
 
-	if opts.updateKey != nil {
-		err = update(bkt, opts.objectName, opts.strategy, opts.maxReencryptions, opts.key, opts.updateKey, opts.dekOverride, ctx)
+	if opts.isCopy && opts.recursive {
+		err = copyTree(ctx, bkt, client.Bucket(opts.dstBucketName), opts)
+	} else if opts.isCopy {
+		_, err = copyObject(ctx, bkt, client.Bucket(opts.dstBucketName), opts.objectName, opts.dstObjectName, nil, opts)
+	} else if opts.recursive && opts.isUpload {
+		err = uploadTree(ctx, bkt, opts)
+	} else if opts.recursive {
+		err = downloadTree(ctx, bkt, opts)
 	} else if opts.isUpload {
-		err = upload(bkt, opts.fileName, opts.objectName, opts.strategy, opts.key, ctx)
+		var key []byte
+		key, _, err = opts.keysFor(opts.strategy, nil)
+		if err == nil {
+			err = upload(bkt, opts.fileName, opts.objectName, opts.strategy, key, opts.maxBuffer, ctx)
+		}
 	} else {
-		err = download(bkt, opts.objectName, opts.fileName, opts.strategy, opts.key, ctx)
+		var strategy string
+		var key, newKey []byte
+		strategy, key, newKey, err = resolveObject(ctx, bkt, opts.objectName, nil, opts)
+		if err == nil && opts.isUpdate && opts.notifyTopic != "" {
+			if strategy != "akeso" {
+				err = fmt.Errorf("-notifyTopic is for akeso objects, not %s", strategy)
+			} else {
+				err = setLayerNotification(ctx, bkt, opts)
+			}
+		}
+		if err == nil && opts.isUpdate {
+			err = update(bkt, opts.objectName, strategy, opts.maxReencryptions, key, newKey, opts.dekOverride, ctx)
+		} else if err == nil {
+			err = download(bkt, opts.objectName, opts.fileName, strategy, key, ctx)
+		}
 	}
 	if err != nil {
 		log.Println("error: ", err.Error())
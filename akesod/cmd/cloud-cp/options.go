@@ -1,14 +1,20 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"cloud.google.com/go/storage"
 	"github.com/etclab/akesod/internal/aesx"
 	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/art"
 	"github.com/etclab/mu"
 )
 
@@ -30,6 +36,23 @@ positional arguments:
   Note that one of SRC/DST must be a local file, and one must
   be a cloud object for upload and download. 
 
+  If both are cloud objects, SRC is copied to DST, which may be
+  in another bucket or project.  If the encryption stays the
+  same, or both ends are csek or cmek, GCS rewrites the object
+  on the server; otherwise it is decrypted and encrypted again
+  under -dstStrategy.  The copy keeps the object's user metadata
+  either way.  A DST ending in / gets SRC's base name.
+
+  SRC may be - to upload stdin, and DST - to download to
+  stdout.  csek and cmek stream the data; the other strategies
+  encrypt it with AES-GCM as a whole, so they read all of stdin
+  (up to -maxBuffer) before uploading, and only write to stdout
+  once the whole object is decrypted and authenticated.
+
+  With -r, the local file is a directory and the cloud object a
+  prefix, gs://BUCKET/PREFIX/.  Each file under the directory is
+  copied to or from PREFIX followed by its relative path.
+
   For update/rotate key, only one cloud object can be specified.
 
 options:
@@ -37,11 +60,22 @@ options:
     Display this usage statement and exit.
 
   -strategy STRATEGY
-    * strawman [default]
-	* akeso
+    * strawman [default for uploads]
+    * akeso
     * csek
-	* cmek
+    * cmek
     * keywrap
+    Downloads and updates read the strategy from the object's
+    akeso_strategy metadata, or its KMS or customer-supplied key,
+    so each object of a mixed bucket is handled by its own.  If
+    given, it must match the object's.
+
+  -cmekKey KMS_KEY
+    The KMS key for cmek uploads.  Downloads check the object's
+    KMS key against it if given.
+
+  -cmekUpdateKey KMS_KEY
+    The new KMS key when updating a cmek object.
 
   -key KEY_FILE
     The key file.  This file must have exactly 32 bytes.
@@ -51,10 +85,76 @@ options:
     The updated key file.  This file must have exactly 32 bytes.
     Default: keys/key
 
+  -dekOverride KEY_FILE
+    For an akeso update, the rotation key the new layer's DEK is
+    derived from, instead of a random one.  32 bytes.
+
+  -workerKey PUB_FILE
+    For an akeso update with -notifyTopic, the public key of the
+    workers (encrypt-worker -keygen), which the cloud function has
+    the private half of.
+
+  -notifyTopic TOPIC
+    For an akeso update with -dekOverride, first replace the bucket's
+    OBJECT_METADATA_UPDATE notification on TOPIC with one carrying
+    the -dekOverride key wrapped to -workerKey, as akesod does on a
+    rotation, so that the cloud function applies the layer.  Later
+    updates with the same -dekOverride can leave it out.
+
+  -project PROJECT_ID
+    The project of -notifyTopic.
+
+  -dstStrategy STRATEGY
+    For a cloud-to-cloud copy, the strategy of the copy.
+    Default: the source object's
+
+  -dstKey KEY_FILE
+    For a cloud-to-cloud copy, the key file of the copy.
+    Default: the -key file
+
+  -dstCmekKey KMS_KEY
+    For a cloud-to-cloud copy to cmek, the KMS key of the copy.
+    Default: the source object's, if it is cmek
+
+  -maxBuffer BYTES
+    The most of stdin read for a strategy that can't stream.
+    Default: 1073741824 (1 GiB)
+
+  -r
+    Recursively copy a directory tree to or from a prefix.
+
+  -j JOBS
+    With -r, the number of files copied at once.
+    Default: 8
+
+  -include PATTERN
+    With -r, only copy the files matching PATTERN.  A pattern
+    with a slash is matched against the path relative to the
+    tree's root, one without against the file's base name, both
+    with the syntax of Go's path.Match.  May be repeated.
+
+  -exclude PATTERN
+    With -r, skip the files matching PATTERN.  May be repeated,
+    and takes precedence over -include.
+
+  -sync
+    With -r, skip the files whose plaintext already matches the
+    other side, by the keyed digest of the plaintext that uploads
+    store in the object's akeso_plaintext_mac metadata.  The digest
+    key is the object's own, sealed under -key, and key rotations
+    seal it again under the new key.  Not supported with cmek.  For
+    a cloud-to-cloud copy, skips the objects whose copy already has
+    the source's digest.
+
 example:
 $ ./cloud-cp -key keys/key data/alice.txt gs://wmsr-test-bucket/wonderland.txt
 $ ./cloud-cp -key keys/key -strategy csek data/alice.txt gs://wmsr-test-bucket/wonderland.txt
 $ ./cloud-cp -key keys/key -updateKey keys/key2.key -strategy akeso -maxReenc 4 gs://wmsr-test-bucket/wonderland.txt
+$ ./cloud-cp -key keys/key -updateKey keys/key2.key -strategy akeso -dekOverride dek.bin -workerKey keys/worker-pub.pem -notifyTopic MetadataUpdate -project $PROJECT_ID gs://wmsr-test-bucket/wonderland.txt
+$ tar c data | ./cloud-cp -key keys/key -strategy csek - gs://wmsr-test-bucket/data.tar
+$ ./cloud-cp -key keys/key -strategy csek gs://wmsr-test-bucket/data.tar - | tar x
+$ ./cloud-cp -key keys/key -r -sync -exclude '*.tmp' data gs://wmsr-test-bucket/data/
+$ ./cloud-cp -key keys/key -dstStrategy akeso -dstKey keys/key2 -r gs://wmsr-test-bucket/data/ gs://wmsr-backup-bucket/data/
 `
 
 type Options struct {
@@ -67,20 +167,46 @@ type Options struct {
 	bucketName string
 	objectName string
 	isUpload   bool
+	isUpdate   bool
+	isCopy     bool
+
+	// derived, for a cloud-to-cloud copy
+	dstBucketName string
+	dstObjectName string
 
 	// optional
 	strategy         string
 	keyFile          string
 	updateKeyFile    string
 	dekOverrideFile  string
+	workerKeyFile    string
+	notifyTopic      string
+	projectId        string
 	cmekKey          string
 	cmekUpdateKey    string
 	key              []byte // derived
+	keyErr           error  // why key couldn't be read
 	updateKey        []byte // derived
-	dekOverride      []byte // derived
+	updateKeyErr     error
+	dekOverride      []byte          // derived
+	workerKey        *ecdh.PublicKey // derived
+	cmekKeySet       bool
 	maxReencryptions int
+	recursive        bool
+	jobs             int
+	include          patternList
+	exclude          patternList
+	sync             bool
+	maxBuffer        int64
+	dstStrategy      string
+	dstKeyFile       string
+	dstCmekKey       string
+	dstKey           []byte // derived
+	dstKeyErr        error
 }
 
+var strategies = []string{"strawman", "csek", "keywrap", "akeso", "cmek"}
+
 func printUsage() {
 	fmt.Fprintf(os.Stdout, "%s", usage)
 }
@@ -91,13 +217,25 @@ func parseOptions() *Options {
 
 	flag.Usage = printUsage
 	// general options
-	flag.StringVar(&opts.strategy, "strategy", "strawman", "")
+	flag.StringVar(&opts.strategy, "strategy", "", "")
 	flag.StringVar(&opts.keyFile, "key", "keys/key", "")
 	flag.StringVar(&opts.updateKeyFile, "updateKey", "keys/key", "")
 	flag.StringVar(&opts.dekOverrideFile, "dekOverride", "", "")
-	flag.StringVar(&opts.cmekKey, "cmekKey", "projects/projectId/locations/global/keyRings/keyRingID/cryptoKeys/cryptoKeyID", "")
-	flag.StringVar(&opts.cmekUpdateKey, "cmekUpdateKey", "projects/projectId/locations/global/keyRings/keyRingID/cryptoKeys/cryptoKeyID", "")
+	flag.StringVar(&opts.workerKeyFile, "workerKey", "", "")
+	flag.StringVar(&opts.notifyTopic, "notifyTopic", "", "")
+	flag.StringVar(&opts.projectId, "project", "", "")
+	flag.StringVar(&opts.cmekKey, "cmekKey", "", "")
+	flag.StringVar(&opts.cmekUpdateKey, "cmekUpdateKey", "", "")
 	flag.IntVar(&opts.maxReencryptions, "maxReenc", 2, "-maxReenc <NUM>")
+	flag.BoolVar(&opts.recursive, "r", false, "")
+	flag.IntVar(&opts.jobs, "j", 8, "")
+	flag.Var(&opts.include, "include", "")
+	flag.Var(&opts.exclude, "exclude", "")
+	flag.BoolVar(&opts.sync, "sync", false, "")
+	flag.Int64Var(&opts.maxBuffer, "maxBuffer", 1<<30, "")
+	flag.StringVar(&opts.dstStrategy, "dstStrategy", "", "")
+	flag.StringVar(&opts.dstKeyFile, "dstKey", "", "")
+	flag.StringVar(&opts.dstCmekKey, "dstCmekKey", "", "")
 
 	flag.Parse()
 
@@ -105,38 +243,82 @@ func parseOptions() *Options {
 		mu.Fatalf("error: expected two positional argument for upload/download and one for update but got %d", flag.NArg())
 	}
 
+	if opts.recursive && flag.NArg() != 2 {
+		mu.Fatalf("error: -r expects SRC and DST")
+	}
+	if !opts.recursive && (opts.sync || len(opts.include) > 0 || len(opts.exclude) > 0) {
+		mu.Fatalf("error: -sync, -include and -exclude need -r")
+	}
+	if opts.recursive && (flag.Arg(0) == "-" || flag.Arg(1) == "-") {
+		mu.Fatalf("error: -r copies directories, not stdin or stdout")
+	}
+	if opts.jobs < 1 {
+		mu.Fatalf("error: -j must be at least 1")
+	}
+
 	if flag.NArg() == 2 {
 
 		opts.src = flag.Arg(0)
 		opts.dst = flag.Arg(1)
 
-		if strings.HasPrefix(opts.src, "gs://") && strings.HasPrefix(opts.dst, "gs://") {
-			mu.Fatalf("error: SRC and DST can't both be GCS URLs")
-		}
-
 		if !strings.HasPrefix(opts.src, "gs://") && !strings.HasPrefix(opts.dst, "gs://") {
 			mu.Fatalf("error: either SRC or DST must be a GCS URL")
 		}
 
-		if strings.HasPrefix(opts.src, "gs://") {
+		if strings.HasPrefix(opts.src, "gs://") && strings.HasPrefix(opts.dst, "gs://") {
+			opts.isCopy = true
+			opts.bucketName, opts.objectName, err = gcsx.ParseUrl(opts.src)
+			if err != nil {
+				mu.Fatalf("error: %v", err)
+			}
+			opts.dstBucketName, opts.dstObjectName, err = gcsx.ParseUrl(opts.dst)
+			if err != nil {
+				mu.Fatalf("error: %v", err)
+			}
+			if opts.recursive {
+				if opts.objectName != "" && !strings.HasSuffix(opts.objectName, "/") {
+					opts.objectName += "/"
+				}
+				if opts.dstObjectName != "" && !strings.HasSuffix(opts.dstObjectName, "/") {
+					opts.dstObjectName += "/"
+				}
+			} else if opts.objectName == "" || strings.HasSuffix(opts.objectName, "/") {
+				mu.Fatalf("error: SRC must name an object; use -r to copy a prefix")
+			} else if opts.dstObjectName == "" || strings.HasSuffix(opts.dstObjectName, "/") {
+				opts.dstObjectName += path.Base(opts.objectName)
+			}
+			if opts.bucketName == opts.dstBucketName && opts.objectName == opts.dstObjectName {
+				mu.Fatalf("error: SRC and DST are the same")
+			}
+		} else if strings.HasPrefix(opts.src, "gs://") {
 			opts.bucketName, opts.objectName, err = gcsx.ParseUrl(opts.src)
 			if err != nil {
 				mu.Fatalf("error: %v", err)
 			}
 			opts.fileName = opts.dst
+			if opts.recursive && opts.objectName != "" && !strings.HasSuffix(opts.objectName, "/") {
+				opts.objectName += "/"
+			}
 		} else {
 			opts.bucketName, opts.objectName, err = gcsx.ParseUrl(opts.dst)
 			if err != nil {
 				mu.Fatalf("error: %v", err)
 			}
 			opts.fileName = opts.src
-			if opts.objectName == "" || strings.HasSuffix(opts.objectName, "/") {
+			if opts.recursive {
+				if opts.objectName != "" && !strings.HasSuffix(opts.objectName, "/") {
+					opts.objectName += "/"
+				}
+			} else if opts.fileName == "-" && (opts.objectName == "" || strings.HasSuffix(opts.objectName, "/")) {
+				mu.Fatalf("error: DST must name an object when SRC is -")
+			} else if opts.objectName == "" || strings.HasSuffix(opts.objectName, "/") {
 				baseName := filepath.Base(opts.fileName)
 				opts.objectName += baseName
 			}
 			opts.isUpload = true
 		}
 	} else {
+		opts.isUpdate = true
 		opts.src = flag.Arg(0)
 		if !strings.HasPrefix(opts.src, "gs://") {
 			mu.Fatalf("error: positional argument should be GCS URL")
@@ -147,35 +329,121 @@ func parseOptions() *Options {
 		}
 	}
 
-	if opts.strategy != "strawman" && opts.strategy != "csek" && opts.strategy != "keywrap" && opts.strategy != "akeso" && opts.strategy != "cmek" {
-		mu.Fatalf("invalid -strategy.  Must be stramwan, csek, akeso, cmek or keywrap")
+	if opts.strategy == "" && opts.isUpload {
+		opts.strategy = "strawman"
+	}
+	if opts.strategy != "" && !slices.Contains(strategies, opts.strategy) {
+		mu.Fatalf("invalid -strategy.  Must be strawman, csek, akeso, cmek or keywrap")
+	}
+	if opts.dstStrategy != "" && !slices.Contains(strategies, opts.dstStrategy) {
+		mu.Fatalf("invalid -dstStrategy.  Must be strawman, csek, akeso, cmek or keywrap")
+	}
+	if !opts.isCopy && (opts.dstStrategy != "" || opts.dstKeyFile != "" || opts.dstCmekKey != "") {
+		mu.Fatalf("error: -dstStrategy, -dstKey and -dstCmekKey need SRC and DST to both be GCS URLs")
+	}
+	opts.cmekKeySet = opts.cmekKey != ""
+
+	if opts.strategy == "cmek" && opts.sync && !opts.isCopy {
+		mu.Fatalf("error: -sync needs a key file, which cmek doesn't have")
 	}
 
-	if opts.strategy == "cmek" && opts.cmekKey == "" {
+	if opts.strategy == "cmek" && opts.isUpload && opts.cmekKey == "" {
 		mu.Fatalf("error: -cmekKey not given")
 	}
-	// TODO: Doesn't check if cmek updateKey exists for now
+	if opts.strategy == "cmek" && opts.isUpdate && opts.cmekUpdateKey == "" {
+		mu.Fatalf("error: -cmekUpdateKey not given")
+	}
+
+	// Without a -strategy, the key files are only needed if an object
+	// turns out to use them.
 	if opts.strategy != "cmek" {
-		opts.key, err = aesx.ReadKeyFile(opts.keyFile)
-		if err != nil {
-			mu.Fatalf("error: %v", err)
+		opts.key, opts.keyErr = aesx.ReadKeyFile(opts.keyFile)
+		if opts.isUpdate {
+			opts.updateKey, opts.updateKeyErr = aesx.ReadKeyFile(opts.updateKeyFile)
 		}
-		if flag.NArg() == 1 {
-			opts.updateKey, err = aesx.ReadKeyFile(opts.updateKeyFile)
-			if err != nil {
+		if opts.strategy != "" {
+			if err := errors.Join(opts.keyErr, opts.updateKeyErr); err != nil {
 				mu.Fatalf("error: %v", err)
 			}
 		}
+	}
+	if opts.isCopy && opts.dstKeyFile != "" {
+		opts.dstKey, opts.dstKeyErr = aesx.ReadKeyFile(opts.dstKeyFile)
 	} else {
-		opts.key = []byte(opts.cmekKey)
-		if flag.NArg() == 1 {
-			opts.updateKey = []byte(opts.cmekUpdateKey)
+		opts.dstKey, opts.dstKeyErr = opts.key, opts.keyErr
+	}
+	if opts.dstStrategy != "" && opts.dstStrategy != "cmek" && opts.dstKeyErr != nil {
+		mu.Fatalf("error: %v", opts.dstKeyErr)
+	}
+
+	if opts.sync && opts.keyErr != nil && !opts.isCopy {
+		mu.Fatalf("error: -sync: %v", opts.keyErr)
+	}
+
+	if (opts.strategy == "akeso" || opts.strategy == "") && opts.dekOverrideFile != "" {
+		opts.dekOverride, err = aesx.ReadKeyFile(opts.dekOverrideFile)
+		if err != nil {
+			mu.Fatalf("error: -dekOverride: %v", err)
 		}
 	}
 
-	if opts.strategy == "akeso" && opts.dekOverrideFile != "" {
-		opts.dekOverride, _ = aesx.ReadKeyFile(opts.dekOverrideFile)
+	// the layer's rotation key must be the one wrapped in the notification
+	if opts.notifyTopic != "" {
+		if !opts.isUpdate || opts.dekOverride == nil || opts.workerKeyFile == "" || opts.projectId == "" {
+			mu.Fatalf("error: -notifyTopic needs an akeso update with -dekOverride, -workerKey and -project")
+		}
+		opts.workerKey, err = art.ReadPublicEKFromFile(opts.workerKeyFile, art.EncodingPEM)
+		if err != nil {
+			mu.Fatalf("error: -workerKey: %v", err)
+		}
 	}
 
 	return &opts
 }
+
+// Returns the key, and for updates the new key, for the strategy of an
+// upload, or of the object in attrs.  For cmek these are KMS key names; a
+// download without -cmekKey takes the object's, which GCS decrypts with
+// anyway.
+func (opts *Options) keysFor(strategy string, attrs *storage.ObjectAttrs) ([]byte, []byte, error) {
+	if strategy == "cmek" {
+		key := opts.cmekKey
+		if !opts.cmekKeySet && attrs != nil {
+			key = attrs.KMSKeyName
+		}
+		if opts.isUpdate && opts.cmekUpdateKey == "" {
+			return nil, nil, fmt.Errorf("-cmekUpdateKey not given")
+		}
+		return []byte(key), []byte(opts.cmekUpdateKey), nil
+	}
+
+	if opts.keyErr != nil {
+		return nil, nil, fmt.Errorf("%s needs -key: %w", strategy, opts.keyErr)
+	}
+	if opts.updateKeyErr != nil {
+		return nil, nil, fmt.Errorf("%s needs -updateKey: %w", strategy, opts.updateKeyErr)
+	}
+	return opts.key, opts.updateKey, nil
+}
+
+// Returns the key of a cloud-to-cloud copy under strategy, of the object in
+// srcAttrs.  A copy to cmek without -dstCmekKey keeps a cmek object's KMS
+// key.
+func (opts *Options) dstKeyFor(strategy string, srcAttrs *storage.ObjectAttrs) ([]byte, error) {
+	if strategy == "cmek" {
+		if opts.dstCmekKey != "" {
+			return []byte(opts.dstCmekKey), nil
+		}
+		if srcAttrs.KMSKeyName == "" {
+			return nil, fmt.Errorf("-dstCmekKey not given")
+		}
+		// objects record the key version, but a rewrite takes the key
+		keyName, _, _ := strings.Cut(srcAttrs.KMSKeyName, "/cryptoKeyVersions/")
+		return []byte(keyName), nil
+	}
+
+	if opts.dstKeyErr != nil {
+		return nil, fmt.Errorf("%s needs -dstKey: %w", strategy, opts.dstKeyErr)
+	}
+	return opts.dstKey, nil
+}
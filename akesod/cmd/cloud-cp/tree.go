@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/secret"
+	"google.golang.org/api/iterator"
+)
+
+// patternList is a repeatable flag of path.Match patterns.  A pattern with
+// a slash is matched against the whole path relative to the tree's root,
+// one without against the base name.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %w", pattern, err)
+	}
+	*p = append(*p, pattern)
+	return nil
+}
+
+func (p patternList) match(rel string) bool {
+	for _, pattern := range p {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the -include and -exclude patterns select rel, a
+// slash-separated path relative to the tree's root
+func (opts *Options) selects(rel string) bool {
+	if len(opts.include) > 0 && !opts.include.match(rel) {
+		return false
+	}
+	return !opts.exclude.match(rel)
+}
+
+// A file to copy, by its path relative to the tree's root
+type transfer struct {
+	rel   string
+	file  string
+	attrs *storage.ObjectAttrs // the object, if it exists
+}
+
+// Counts of a tree copy
+type treeStats struct {
+	copied, skipped, failed atomic.Int64
+}
+
+// Runs fn on each transfer with opts.jobs at a time, and returns the
+// errors of those that failed
+func runTransfers(transfers []transfer, jobs int, stats *treeStats, fn func(t transfer) (bool, error)) error {
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var errs []error
+	ch := make(chan transfer)
+
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				copied, err := fn(t)
+				switch {
+				case err != nil:
+					stats.failed.Add(1)
+					log.Println("error: ", err.Error())
+					mtx.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", t.rel, err))
+					mtx.Unlock()
+				case copied:
+					stats.copied.Add(1)
+				default:
+					stats.skipped.Add(1)
+				}
+			}
+		}()
+	}
+	for _, t := range transfers {
+		ch <- t
+	}
+	close(ch)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Reports whether the object's plaintext digest matches the local file's,
+// so that -sync can skip it.  Objects written without a digest never
+// match, nor do those whose digest key doesn't open under key, which are
+// copied again with a digest of their own.
+func inSync(attrs *storage.ObjectAttrs, fileName string, key []byte) (bool, error) {
+	if attrs == nil || attrs.Metadata[encstr.MetaPlaintextMAC] == "" {
+		return false, nil
+	}
+	macKey, err := encstr.OpenPlaintextMACKey(attrs.Metadata, key)
+	if err != nil {
+		log.Printf("warning: %s: %v\n", attrs.Name, err)
+		return false, nil
+	}
+	defer secret.Zero(macKey)
+	fileData, err := os.ReadFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return encstr.PlaintextMAC(macKey, fileData) == attrs.Metadata[encstr.MetaPlaintextMAC], nil
+}
+
+// Uploads the files under the directory opts.fileName to the objects under
+// opts.objectName, the prefix
+func uploadTree(ctx context.Context, bkt *storage.BucketHandle, opts *Options) error {
+	if fi, err := os.Stat(opts.fileName); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("-r needs a directory, but %s is not one", opts.fileName)
+	}
+
+	var transfers []transfer
+	err := filepath.WalkDir(opts.fileName, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(opts.fileName, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if opts.selects(rel) {
+			transfers = append(transfers, transfer{rel: rel, file: file})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	key, _, err := opts.keysFor(opts.strategy, nil)
+	if err != nil {
+		return err
+	}
+
+	var stats treeStats
+	err = runTransfers(transfers, opts.jobs, &stats, func(t transfer) (bool, error) {
+		objectName := opts.objectName + t.rel
+		if opts.sync {
+			attrs, err := bkt.Object(objectName).Attrs(ctx)
+			if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				return false, err
+			}
+			if ok, err := inSync(attrs, t.file, opts.key); ok || err != nil {
+				return false, err
+			}
+		}
+		return true, upload(bkt, t.file, objectName, opts.strategy, key, opts.maxBuffer, ctx)
+	})
+	fmt.Printf("uploaded %d, skipped %d, failed %d\n", stats.copied.Load(), stats.skipped.Load(), stats.failed.Load())
+	return err
+}
+
+// Lists the objects under opts.objectName, the prefix, that the -include
+// and -exclude patterns select
+func listTree(ctx context.Context, bkt *storage.BucketHandle, opts *Options) ([]transfer, error) {
+	var transfers []transfer
+	it := bkt.Objects(ctx, &storage.Query{Prefix: opts.objectName})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing objects failed: %w", err)
+		}
+
+		rel := strings.TrimPrefix(attrs.Name, opts.objectName)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue // folder placeholders
+		}
+		if opts.selects(rel) {
+			transfers = append(transfers, transfer{rel: rel, attrs: attrs})
+		}
+	}
+	return transfers, nil
+}
+
+// Downloads the objects under opts.objectName, the prefix, to the directory
+// opts.fileName.  Each object is decrypted with its own strategy.
+func downloadTree(ctx context.Context, bkt *storage.BucketHandle, opts *Options) error {
+	transfers, err := listTree(ctx, bkt, opts)
+	if err != nil {
+		return err
+	}
+	for i := range transfers {
+		rel := transfers[i].rel
+		// object names may hold anything; none may land outside the
+		// destination directory
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return fmt.Errorf("object %s has no safe local path under %s", transfers[i].attrs.Name, opts.fileName)
+		}
+		transfers[i].file = filepath.Join(opts.fileName, filepath.FromSlash(rel))
+	}
+
+	var stats treeStats
+	err = runTransfers(transfers, opts.jobs, &stats, func(t transfer) (bool, error) {
+		if opts.sync {
+			if ok, err := inSync(t.attrs, t.file, opts.key); ok || err != nil {
+				return false, err
+			}
+		}
+		strategy, key, _, err := resolveObject(ctx, bkt, t.attrs.Name, t.attrs, opts)
+		if err != nil {
+			return false, err
+		}
+		if err := os.MkdirAll(filepath.Dir(t.file), 0755); err != nil {
+			return false, err
+		}
+		return true, download(bkt, t.attrs.Name, t.file, strategy, key, ctx)
+	})
+	fmt.Printf("downloaded %d, skipped %d, failed %d\n", stats.copied.Load(), stats.skipped.Load(), stats.failed.Load())
+	return err
+}
+
+// Copies the objects under opts.objectName, the prefix, to those under
+// opts.dstObjectName in dstBkt.  Each object is decrypted with its own
+// strategy.
+func copyTree(ctx context.Context, bkt, dstBkt *storage.BucketHandle, opts *Options) error {
+	transfers, err := listTree(ctx, bkt, opts)
+	if err != nil {
+		return err
+	}
+
+	var stats treeStats
+	err = runTransfers(transfers, opts.jobs, &stats, func(t transfer) (bool, error) {
+		return copyObject(ctx, bkt, dstBkt, t.attrs.Name, opts.dstObjectName+t.rel, t.attrs, opts)
+	})
+	fmt.Printf("copied %d, skipped %d, failed %d\n", stats.copied.Load(), stats.skipped.Load(), stats.failed.Load())
+	return err
+}
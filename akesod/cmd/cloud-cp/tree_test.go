@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestPatternList(t *testing.T) {
+	var p patternList
+	fs := flag.NewFlagSet("cloud-cp", flag.ContinueOnError)
+	fs.Var(&p, "include", "")
+	if err := fs.Parse([]string{"-include", "*.txt", "-include", "logs/*/app.log"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != "*.txt,logs/*/app.log" {
+		t.Errorf("got %q", p.String())
+	}
+	if err := p.Set("[a-"); err == nil {
+		t.Error("accepted a malformed pattern")
+	}
+
+	tests := []struct {
+		rel   string
+		match bool
+	}{
+		{"a.txt", true},
+		// without a slash, the pattern matches the base name at any depth
+		{"docs/notes/a.txt", true},
+		{"a.txt.bak", false},
+		{"a.md", false},
+		// with one, it matches the whole path, and * doesn't cross a slash
+		{"logs/web/app.log", true},
+		{"app.log", false},
+		{"logs/app.log", false},
+		{"logs/web/eu/app.log", false},
+		{"archive/logs/web/app.log", false},
+	}
+	for _, tt := range tests {
+		if got := p.match(tt.rel); got != tt.match {
+			t.Errorf("%s: matched %t; expected %t", tt.rel, got, tt.match)
+		}
+	}
+
+	var empty patternList
+	if empty.match("a.txt") {
+		t.Error("an empty list matched")
+	}
+}
+
+func TestSelects(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude patternList
+		selected         []string
+		skipped          []string
+	}{
+		{"no patterns", nil, nil, []string{"a.txt", "d/b.tmp"}, nil},
+		{"include", patternList{"*.txt", "data/*"}, nil,
+			[]string{"a.txt", "d/e/a.txt", "data/x.bin"}, []string{"b.tmp", "data/d/x.bin"}},
+		{"exclude", nil, patternList{"*.tmp", "cache/*"},
+			[]string{"a.txt", "d/cache/x"}, []string{"b.tmp", "d/b.tmp", "cache/x"}},
+		{"exclude takes precedence", patternList{"*.txt"}, patternList{"secret*"},
+			[]string{"a.txt", "d/a.txt"}, []string{"secret.txt", "d/secret-2.txt", "a.tmp"}},
+	}
+	for _, tt := range tests {
+		opts := &Options{include: tt.include, exclude: tt.exclude}
+		for _, rel := range tt.selected {
+			if !opts.selects(rel) {
+				t.Errorf("%s: %s wasn't selected", tt.name, rel)
+			}
+		}
+		for _, rel := range tt.skipped {
+			if opts.selects(rel) {
+				t.Errorf("%s: %s was selected", tt.name, rel)
+			}
+		}
+	}
+}
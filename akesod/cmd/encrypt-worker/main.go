@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/completion"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/encstr"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// The fields of a GCS JSON notification payload that the worker needs;
+// akesod publishes the same fields when it runs without Pub/Sub.
+type objectEvent struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+// worker publishes a completion event for each metadata update event it
+// handles, unless its topic is empty
+type worker struct {
+	client *storage.Client
+	key    *ecdh.PrivateKey
+	msgBus bus.Bus
+	topic  string
+	name   string
+}
+
+func (w *worker) handleEvent(ctx context.Context, msg *bus.Message) {
+	started := time.Now()
+
+	var ev objectEvent
+	if err := json.Unmarshal(msg.Data, &ev); err != nil {
+		log.Printf("Dropping malformed event %s: %v\n", msg.ID, err)
+		msg.Ack()
+		return
+	}
+	rotation := msg.Attributes[dekwrap.AttrRotation]
+
+	rotationKey, err := dekwrap.Unwrap(msg.Attributes[dekwrap.AttrWrappedKey], w.key, rotation)
+	if err != nil {
+		log.Printf("Dropping event %s for %s: %v\n", msg.ID, ev.Name, err)
+		w.publishCompletion(ctx, ev, rotation, started, "", err, false)
+		msg.Ack()
+		return
+	}
+	defer secret.Zero(rotationKey)
+
+	result, err := encstr.AkesoApplyLayer(w.client.Bucket(ev.Bucket), ev.Name, rotationKey, ctx)
+	if err != nil {
+		log.Printf("error: applying layer to gs://%s/%s: %v\n", ev.Bucket, ev.Name, err)
+		w.publishCompletion(ctx, ev, rotation, started, "", err, true)
+		msg.Nack()
+		return
+	}
+	w.publishCompletion(ctx, ev, rotation, started, result, nil, false)
+	msg.Ack()
+}
+
+// Tells akesod how handling the event for ev ended: with result, or with
+// err, in which case retrying says whether the event is redelivered.
+func (w *worker) publishCompletion(ctx context.Context, ev objectEvent, rotation string, started time.Time, result string, err error, retrying bool) {
+	if w.topic == "" || rotation == "" {
+		return
+	}
+
+	ce := &completion.Event{
+		Rotation: rotation,
+		Bucket:   ev.Bucket,
+		Name:     ev.Name,
+		Result:   result,
+		Worker:   w.name,
+		Started:  started.UTC(),
+		Finished: time.Now().UTC(),
+	}
+	if err != nil {
+		ce.Result = completion.ResultFailed
+		ce.Error = err.Error()
+		ce.Retrying = retrying
+	}
+	msg, err := ce.Message()
+	if err == nil {
+		_, err = w.msgBus.Publish(ctx, w.topic, msg)
+	}
+	if err != nil {
+		log.Printf("error: publishing completion of gs://%s/%s: %v\n", ev.Bucket, ev.Name, err)
+	}
+}
+
+// Creates the worker key pair
+func keygen(keyFile string) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	pubFile := strings.TrimSuffix(keyFile, ".pem") + "-pub.pem"
+	if err := art.WritePrivateEKToFile(priv, keyFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	if err := art.WritePublicEKToFile(priv.PublicKey(), pubFile, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	fmt.Printf("Wrote %s; set akesod's cloud.worker_key_file to %s.\n", keyFile, pubFile)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+
+	opts := parseOptions()
+	if opts.keygen {
+		keygen(opts.keyFile)
+		return
+	}
+
+	key, err := art.ReadPrivateEKFromFile(opts.keyFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: reading the worker key: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		mu.Fatalf("storage.NewClient failed: %v", err)
+	}
+	defer client.Close()
+
+	msgBus, err := bus.Open(ctx, opts.busKind, opts.projectId, opts.busAddress)
+	if err != nil {
+		mu.Fatalf("bus.Open: %v", err)
+	}
+	defer msgBus.Close()
+
+	hostname, _ := os.Hostname()
+	w := &worker{
+		client: client,
+		key:    key,
+		msgBus: msgBus,
+		topic:  opts.completionTopic,
+		name:   "encrypt-worker@" + hostname,
+	}
+
+	log.Printf("Waiting for metadata update events on %s.\n", opts.topicId)
+	err = msgBus.Subscribe(ctx, opts.topicId, opts.topicId+"-worker", w.handleEvent)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+}
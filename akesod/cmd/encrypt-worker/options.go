@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/etclab/akesod/internal/completion"
+)
+
+const usage = `Usage: encrypt-worker [options]
+
+Applies the new akeso layer to objects whose header akesod has updated.
+This does the same work as the encrypt-object cloud function, for running
+akesod without Google Cloud Functions.
+
+akesod wraps each rotation's key to the worker key; its public half goes in
+akesod's cloud.worker_key_file.  The cloud function uses the same key.
+
+options:
+  -bus BUS
+    The message bus: pubsub or local.
+    Default: local
+
+  -bus-address ADDRESS
+    The local broker address (unix:///PATH or tcp://HOST:PORT).
+    Default: unix:///tmp/akeso-bus.sock
+
+  -project-id PROJECT_ID
+    The cloud project, for -bus pubsub.
+
+  -topic-id TOPIC_ID
+    The metadata update topic.
+    Default: MetadataUpdate
+
+  -completion-topic TOPIC_ID
+    The topic to publish a completion event to for each object, so that
+    akesod can follow its rotations to the end.  Empty for none.
+    Default: ReencryptionComplete
+
+  -key KEY_FILE
+    The worker's private X25519 key, in PEM.
+    Default: keys/worker.pem
+
+  -keygen
+    Create KEY_FILE and its public key, KEY_FILE with -pub before .pem,
+    and exit.
+
+  -help
+    Display this usage statement and exit.
+
+Set STORAGE_EMULATOR_HOST to use a local GCS emulator instead of GCS.
+
+example:
+  $ ./encrypt-worker -keygen
+  $ ./encrypt-worker -bus local -bus-address unix:///tmp/akeso-bus.sock
+`
+
+type Options struct {
+	busKind         string
+	busAddress      string
+	projectId       string
+	topicId         string
+	completionTopic string
+	keyFile         string
+	keygen          bool
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+
+	flag.Usage = printUsage
+	flag.StringVar(&opts.busKind, "bus", "local", "")
+	flag.StringVar(&opts.busAddress, "bus-address", "unix:///tmp/akeso-bus.sock", "")
+	flag.StringVar(&opts.projectId, "project-id", "", "")
+	flag.StringVar(&opts.topicId, "topic-id", "MetadataUpdate", "")
+	flag.StringVar(&opts.completionTopic, "completion-topic", completion.DefaultTopic, "")
+	flag.StringVar(&opts.keyFile, "key", "keys/worker.pem", "")
+	flag.BoolVar(&opts.keygen, "keygen", false, "")
+
+	flag.Parse()
+
+	return &opts
+}
@@ -1,12 +1,27 @@
 package encobject
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -14,9 +29,69 @@ import (
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/etclab/aes256"
 	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
+const (
+	// How often an object that changed while its layer was applied is
+	// read again before the event is left to Pub/Sub's retry
+	maxApplyAttempts = 3
+
+	// The environment variable holding the worker's private key in PEM,
+	// e.g. from Secret Manager with --set-secrets
+	workerKeyEnv = "AKESO_WORKER_KEY"
+
+	// The environment variable holding the topic completion events are
+	// published to, as projects/PROJECT/topics/TOPIC; none if unset
+	completionTopicEnv = "AKESO_COMPLETION_TOPIC"
+
+	// The same as in akesod's internal/dekwrap
+	attrWrappedKey = "wrapped_rotation_key"
+	attrRotation   = "akeso_rotation"
+	wrapLabel      = "akeso dek wrap v1"
+
+	// The same as in akesod's internal/completion
+	resultApplied        = "applied"
+	resultAlreadyApplied = "already_applied"
+	resultNotPending     = "not_pending"
+	resultFailed         = "failed"
+)
+
+var (
+	workerKeyOnce sync.Once
+	workerKey     *ecdh.PrivateKey
+	workerKeyErr  error
+
+	pubsubOnce    sync.Once
+	pubsubService *pubsub.Service
+	pubsubErr     error
+)
+
+// The same as completion.Event in akesod: reports to akesod how the event
+// for an object ended
+type completionEvent struct {
+	Rotation string    `json:"rotation"`
+	Bucket   string    `json:"bucket"`
+	Name     string    `json:"name"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Retrying bool      `json:"retrying,omitempty"`
+	Worker   string    `json:"worker"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// permanentError marks a failure that redelivering the event can't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
 type PubSubMessage struct {
 	Data       []byte            `json:"data"`
 	Attributes map[string]string `json:"attributes"`
@@ -30,51 +105,280 @@ func init() {
 	functions.CloudEvent("EncryptObject", encryptObject)
 }
 
+// Applies the pending layer of the object in the event.  Pub/Sub delivers
+// events at least once, so the layer is only applied if the object's
+// akeso_layer_id says it is the layer of the event's rotation key and
+// akeso_layers_applied says it isn't applied yet; the write is conditioned
+// on the object's generation and metageneration.  Errors that a retry can't
+// fix are logged and the event is dropped; others are returned, so that the
+// event is redelivered if the function is deployed with --retry.  Either
+// way, the outcome is published to akesod on AKESO_COMPLETION_TOPIC.
 func encryptObject(ctx context.Context, e event.Event) error {
 
 	objectUpdateStart := time.Now()
 
 	var msg MessagePublishedData
 	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
+		log.Printf("Dropping malformed event %s: event.DataAs: %v", e.ID(), err)
+		return nil
 	}
 
 	var data storagedata.StorageObjectData
 	if err := protojson.Unmarshal(msg.Message.Data, &data); err != nil {
-		return fmt.Errorf("protojson.Unmarshal: %w", err)
+		log.Printf("Dropping malformed event %s: protojson.Unmarshal: %v", e.ID(), err)
+		return nil
 	}
 
+	ce := &completionEvent{
+		Rotation: msg.Message.Attributes[attrRotation],
+		Bucket:   data.GetBucket(),
+		Name:     data.GetName(),
+		Worker:   "cloud-function:" + os.Getenv("K_SERVICE"),
+		Started:  objectUpdateStart.UTC(),
+	}
+	result, err := handleObject(ctx, data.GetBucket(), data.GetName(), msg.Message.Attributes)
+	ce.Result = result
+	if err != nil {
+		ce.Result = resultFailed
+		ce.Error = err.Error()
+		var perr *permanentError
+		ce.Retrying = !errors.As(err, &perr)
+	}
+	ce.Finished = time.Now().UTC()
+	publishCompletion(ctx, ce)
+
+	if err != nil && !ce.Retrying {
+		log.Printf("Dropping event %s for %s: %v", e.ID(), data.GetName(), err)
+		return nil
+	}
+	if result == resultApplied {
+		duration := ce.Finished.Sub(objectUpdateStart)
+		log.Printf("[ENC] %s took %v from %dns to %dns\n", data.GetName(), duration, objectUpdateStart.UnixNano(), objectUpdateStart.Add(duration).UnixNano())
+	}
+	return err
+}
+
+// Applies the layer of the rotation in attrs to the object
+func handleObject(ctx context.Context, bucket, objectName string, attrs map[string]string) (string, error) {
+	workerKey, err := loadWorkerKey()
+	if err != nil {
+		return "", err
+	}
+	rotationKey, err := unwrapRotationKey(attrs[attrWrappedKey], workerKey, attrs[attrRotation])
+	if err != nil {
+		return "", &permanentError{err}
+	}
+	defer clear(rotationKey)
+
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Fatalf("storage.NewClient: %v", err)
+		return "", fmt.Errorf("storage.NewClient: %w", err)
 	}
 	defer client.Close()
 
-	bucket := client.Bucket(data.GetBucket())
+	object := client.Bucket(bucket).Object(objectName)
 
-	metadata := data.GetMetadata()
+	for attempt := 1; attempt <= maxApplyAttempts; attempt++ {
+		var result string
+		result, err = applyLayer(ctx, object, objectName, rotationKey)
+		if err == nil {
+			return result, nil
+		}
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != http.StatusPreconditionFailed {
+			break
+		}
+		log.Printf("%s changed while applying its layer (attempt %d of %d)", objectName, attempt, maxApplyAttempts)
+	}
+	return "", fmt.Errorf("applying layer of rotation %s to %s: %w", attrs[attrRotation], objectName, err)
+}
 
-	if metadata["updated_by"] == "akesod" {
-		log.Println("File was reencrypted by akesod itself.")
-		return nil
+// Publishes ce to AKESO_COMPLETION_TOPIC, if set.  akesod retries what a
+// failure to publish loses, so it is only logged.
+func publishCompletion(ctx context.Context, ce *completionEvent) {
+	topic := os.Getenv(completionTopicEnv)
+	if topic == "" || ce.Rotation == "" {
+		return
+	}
+
+	pubsubOnce.Do(func() {
+		pubsubService, pubsubErr = pubsub.NewService(context.Background())
+	})
+	if pubsubErr != nil {
+		log.Printf("error: publishing completion of %s: %v", ce.Name, pubsubErr)
+		return
 	}
 
-	attrs := msg.Message.Attributes
-	newDEK, err := base64.StdEncoding.DecodeString(attrs["new_dek"])
+	data, err := json.Marshal(ce)
+	if err != nil {
+		log.Printf("error: publishing completion of %s: %v", ce.Name, err)
+		return
+	}
+	_, err = pubsubService.Projects.Topics.Publish(topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{attrRotation: ce.Rotation, "result": ce.Result},
+		}},
+	}).Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Base64 Decoding of new DEK: %v", err)
+		log.Printf("error: publishing completion of %s: %v", ce.Name, err)
+	}
+}
+
+// Parses the worker key from the environment, once per instance
+func loadWorkerKey() (*ecdh.PrivateKey, error) {
+	workerKeyOnce.Do(func() {
+		block, _ := pem.Decode([]byte(os.Getenv(workerKeyEnv)))
+		if block == nil {
+			workerKeyErr = fmt.Errorf("%s does not hold a PEM key", workerKeyEnv)
+			return
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			workerKeyErr = fmt.Errorf("parsing %s: %w", workerKeyEnv, err)
+			return
+		}
+		var ok bool
+		if workerKey, ok = key.(*ecdh.PrivateKey); !ok || workerKey.Curve() != ecdh.X25519() {
+			workerKeyErr = fmt.Errorf("%s is not an X25519 key", workerKeyEnv)
+		}
+	})
+	return workerKey, workerKeyErr
+}
+
+// The same as dekwrap.Unwrap in akesod: the wrapped key is the ephemeral
+// X25519 key, the AES-GCM nonce and the sealed rotation key, with the
+// rotation as additional data
+func unwrapRotationKey(wrapped string, priv *ecdh.PrivateKey, rotation string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", attrWrappedKey, err)
+	}
+	const keySize, nonceSize = 32, 12
+	if len(data) < keySize+nonceSize {
+		return nil, fmt.Errorf("missing or short %s", attrWrappedKey)
+	}
+	ephData, nonce, ct := data[:keySize], data[keySize:keySize+nonceSize], data[keySize+nonceSize:]
+
+	eph, err := ecdh.X25519().NewPublicKey(ephData)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", attrWrappedKey, err)
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(shared)
+
+	salt := append(bytes.Clone(ephData), priv.PublicKey().Bytes()...)
+	key := make([]byte, 32)
+	defer clear(key)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(wrapLabel)), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rotationKey, err := aead.Open(nil, nonce, ct, []byte(rotation))
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap the key of rotation %s (wrong key or rotation?): %w", rotation, err)
+	}
+	return rotationKey, nil
+}
+
+// The same as encstr.DeriveLayerKey in akesod: the object's layer key is
+// derived from the rotation key and the object's bucket, name and
+// generation
+func deriveLayerKey(rotationKey []byte, bucket, objectName string, generation int64) ([]byte, error) {
+	if len(rotationKey) != 32 {
+		return nil, fmt.Errorf("rotation key has %d bytes, expected 32", len(rotationKey))
+	}
+	var info []byte
+	for _, s := range []string{"akeso-layer-key-v1", bucket, objectName} {
+		info = binary.BigEndian.AppendUint32(info, uint32(len(s)))
+		info = append(info, s...)
+	}
+	info = binary.BigEndian.AppendUint64(info, uint64(generation))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, rotationKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// The same as encstr.LayerID in akesod
+func layerID(dek []byte) string {
+	h := sha256.New()
+	h.Write([]byte("akeso-layer-id-v1"))
+	h.Write(dek)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// The same as encstr.AkesoApplyLayer in akesod.  Metadata that the layer
+// can't be applied with is a permanentError.
+func applyLayer(ctx context.Context, object *storage.ObjectHandle, objectName string, rotationKey []byte) (string, error) {
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	metadata := attrs.Metadata
+
+	newDEK, err := deriveLayerKey(rotationKey, attrs.Bucket, objectName, attrs.Generation)
+	if err != nil {
+		return "", err
+	}
+	defer clear(newDEK)
+	layerID := layerID(newDEK)
+
+	if metadata["akeso_layer_id"] != layerID {
+		log.Printf("%s: layer %s is not the object's newest layer; ignoring it.", objectName, layerID)
+		return resultNotPending, nil
+	}
+
+	times := 1
+	if v, ok := metadata["times_updated"]; ok {
+		if times, err = strconv.Atoi(v); err != nil || times < 1 {
+			return "", &permanentError{fmt.Errorf("%s has a malformed times_updated %q", objectName, v)}
+		}
+	}
+	applied := times
+	if v, ok := metadata["akeso_layers_applied"]; ok {
+		applied, err = strconv.Atoi(v)
+		if err != nil {
+			return "", &permanentError{fmt.Errorf("%s has a malformed akeso_layers_applied %q", objectName, v)}
+		}
+	} else if metadata["ongoing_reencryption"] == "true" {
+		applied = times - 1
+	}
+	if applied >= times {
+		log.Printf("%s: layer %s was already applied.", objectName, layerID)
+		return resultAlreadyApplied, nil
+	}
+	if applied != times-1 {
+		return "", &permanentError{fmt.Errorf("%s has %d of %d layers applied; only the last one can be", objectName, applied, times)}
 	}
 
 	base_iv, err := base64.StdEncoding.DecodeString(metadata["akeso_iv"])
 	if err != nil {
-		log.Fatalf("Base64 Decoding of current IV: %v", err)
+		return "", &permanentError{fmt.Errorf("%s has a malformed akeso_iv", objectName)}
 	}
 
-	objectName := data.GetName()
-	object := bucket.Object(objectName)
-	payload, err := GetObject(object)
+	// the object must not change between reading and writing it
+	object = object.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration})
+	payload, err := GetObject(ctx, object)
 	if err != nil {
-		return fmt.Errorf("error in getting object %s", objectName)
+		return "", fmt.Errorf("error in getting object %s: %w", objectName, err)
+	}
+	// corrupted in transit: retried, like any failed read
+	if got := crc32.Checksum(payload, crc32cTable); got != attrs.CRC32C {
+		return "", fmt.Errorf("object %s read with CRC32C %08x, but GCS has %08x", objectName, got, attrs.CRC32C)
 	}
 
 	objWriter := object.NewWriter(ctx)
@@ -82,27 +386,30 @@ func encryptObject(ctx context.Context, e event.Event) error {
 	objWriter.ObjectAttrs.Metadata = metadata
 	objWriter.ObjectAttrs.Metadata["updated_by"] = "cloud-function"
 	objWriter.ObjectAttrs.Metadata["ongoing_reencryption"] = "false"
+	objWriter.ObjectAttrs.Metadata["akeso_layers_applied"] = strconv.Itoa(times)
 
 	iv := aes256.CopyIV(base_iv)
-	times, _ := strconv.Atoi(metadata["times_updated"])
 	aes256.AddIV(iv, times-1)
-	if _, err = objWriter.Write(aes256.EncryptCTR(newDEK, iv, payload)); err != nil {
-		log.Fatalf("Writer.Write: %v", err)
+	ciphertext := aes256.EncryptCTR(newDEK, iv, payload)
+	objWriter.CRC32C = crc32.Checksum(ciphertext, crc32cTable)
+	objWriter.SendCRC32C = true
+	if _, err = objWriter.Write(ciphertext); err != nil {
+		objWriter.Close()
+		return "", fmt.Errorf("Writer.Write: %w", err)
 	}
 	if err := objWriter.Close(); err != nil {
-		log.Fatalf("Writer.Close: %v", err)
+		return "", fmt.Errorf("Writer.Close: %w", err)
 	}
-
-	objectUpdateEnd := time.Now()
-	duration := objectUpdateEnd.Sub(objectUpdateStart)
-	log.Printf("[ENC] %s took %v from %dns to %dns\n", objectName, duration, objectUpdateStart.UnixNano(), objectUpdateEnd.UnixNano())
-
-	return nil
+	return resultApplied, nil
 }
 
-func GetObject(obj *storage.ObjectHandle) ([]byte, error) {
-	ctx := context.Background()
-	r, err := obj.NewReader(ctx)
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// GetObject reads obj's data as stored: GCS doesn't decompress an object
+// stored gzip-encoded on the way, so the data can be checked against its
+// CRC32C
+func GetObject(ctx context.Context, obj *storage.ObjectHandle) ([]byte, error) {
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -8,6 +8,8 @@ require (
 	github.com/cloudevents/sdk-go/v2 v2.15.2
 	github.com/etclab/aes256 v0.1.0
 	github.com/googleapis/google-cloudevents-go v0.8.0
+	golang.org/x/crypto v0.23.0
+	google.golang.org/api v0.183.0
 	google.golang.org/protobuf v1.34.1
 )
 
@@ -40,14 +42,12 @@ require (
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0 // indirect
-	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/oauth2 v0.21.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
-	google.golang.org/api v0.183.0 // indirect
 	google.golang.org/genproto v0.0.0-20240528184218-531527333157 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240604185151-ef581f913117 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
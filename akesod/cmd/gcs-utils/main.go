@@ -7,6 +7,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/secret"
 	"github.com/etclab/mu"
 )
 
@@ -48,6 +49,8 @@ func main() {
 			mu.Fatalf("gcsx.AddNotification failed: %v", err)
 		}
 
+		// the attributes may include a DEK
+		notif.CustomAttributes = secret.RedactAttrs(notif.CustomAttributes)
 		fmt.Printf("Notification: %+v\n", notif)
 	}
 }
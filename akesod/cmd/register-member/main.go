@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// Reuses the member's IK if present so that a pinned IK stays valid
+func loadOrCreateIK(privPath, pubPath string) ed25519.PrivateKey {
+	ik, err := art.ReadPrivateIKFromFile(privPath, art.EncodingPEM)
+	if err == nil {
+		return ik
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		mu.Fatalf("error: reading IK: %v", err)
+	}
+
+	pub, ik, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		mu.Fatalf("error: generating IK: %v", err)
+	}
+	if err := art.WritePrivateIKToFile(ik, privPath, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: writing private IK: %v", err)
+	}
+	if err := art.WritePublicIKToFile(pub, pubPath, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: writing public IK: %v", err)
+	}
+	return ik
+}
+
+func createEK(privPath, pubPath string) *ecdh.PublicKey {
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		mu.Fatalf("error: generating EK: %v", err)
+	}
+
+	// a new EK replaces the one from any earlier registration
+	os.Remove(privPath)
+	os.Remove(pubPath)
+	if err := art.WritePrivateEKToFile(ek, privPath, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: writing private EK: %v", err)
+	}
+	if err := art.WritePublicEKToFile(ek.PublicKey(), pubPath, art.EncodingPEM); err != nil {
+		mu.Fatalf("error: writing public EK: %v", err)
+	}
+	return ek.PublicKey()
+}
+
+func publishMessage(opts *Options, data []byte) {
+	ctx := context.Background()
+	msgBus, err := bus.Open(ctx, opts.busKind, opts.projectId, opts.busAddress)
+	if err != nil {
+		mu.Fatalf("bus.Open: %v", err)
+	}
+	defer msgBus.Close()
+
+	id, err := msgBus.Publish(ctx, opts.topicId, &bus.Message{
+		Data:       data,
+		Attributes: map[string]string{"messageType": "register"},
+	})
+	if err != nil {
+		mu.Fatalf("Failed to publish: %v", err)
+	}
+
+	fmt.Printf("Published registration with msg ID: %v\n", id)
+}
+
+func main() {
+	opts := parseOptions()
+
+	if err := os.MkdirAll(opts.keyDir, 0750); err != nil {
+		mu.Fatalf("error: can't create key dir: %v", err)
+	}
+
+	base := filepath.Join(opts.keyDir, opts.name)
+	ik := loadOrCreateIK(base+"-ik.pem", base+"-ik-pub.pem")
+	ek := createEK(base+"-ek.pem", base+"-ek-pub.pem")
+
+	reg, err := artx.NewRegistration(opts.group, opts.name, ik, ek)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		mu.Fatalf("error: marshalling registration: %v", err)
+	}
+
+	publishMessage(opts, data)
+}
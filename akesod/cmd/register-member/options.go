@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/etclab/mu"
+)
+
+type Options struct {
+	// positional
+	name string
+
+	// optional
+	group      string
+	topicId    string
+	projectId  string
+	keyDir     string
+	busKind    string
+	busAddress string
+}
+
+const usage = `Usage: register-member [options] NAME
+
+Registers a group member with akesod:
+	- generates the member's identity key (IK) if one doesn't exist yet, and
+	  a fresh ephemeral key (EK), under KEY_DIR
+	- publishes a bundle with the public IK and EK, signed by the IK, to the
+	  registration topic
+	- the private keys never leave KEY_DIR
+
+positional arguments:
+  NAME
+    The member name; must be listed in akesod's art.members config, or in
+    the members of the group given by -group.
+
+Default options:
+	- group: "" (akesod's single group; set for a daemon with multiple groups)
+	- topic-id: MemberRegistration
+	- project-id: wild-flame-123456
+	- key-dir: keys
+	- bus: pubsub (or local, to use akesod's local broker)
+	- bus-address: unix:///tmp/akeso-bus.sock (only for -bus local)
+
+examples: 
+	$ ./register-member bob
+	$ ./register-member -group team-a -key-dir keys/team-a bob
+
+`
+
+func printUsage() {
+	fmt.Fprintf(os.Stdout, "%s", usage)
+}
+
+func parseOptions() *Options {
+	opts := Options{}
+
+	flag.Usage = printUsage
+
+	flag.StringVar(&opts.group, "group", "", "")
+	flag.StringVar(&opts.topicId, "topic-id", "MemberRegistration", "")
+	flag.StringVar(&opts.projectId, "project-id", "wild-flame-123456", "")
+	flag.StringVar(&opts.keyDir, "key-dir", "keys", "")
+	flag.StringVar(&opts.busKind, "bus", "pubsub", "")
+	flag.StringVar(&opts.busAddress, "bus-address", "unix:///tmp/akeso-bus.sock", "")
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		mu.Fatalf("error: expected one positional argument but got %d", flag.NArg())
+	}
+	opts.name = flag.Arg(0)
+
+	return &opts
+}
@@ -2,28 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 
-	"cloud.google.com/go/pubsub"
+	"github.com/etclab/akesod/internal/artx"
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/art"
 	"github.com/etclab/mu"
 )
 
-func publishMessage(projectID, topicID string, data []byte, attrs map[string]string) {
+func publishMessage(opts *Options, data []byte, attrs map[string]string) {
 	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, projectID)
+	msgBus, err := bus.Open(ctx, opts.busKind, opts.projectId, opts.busAddress)
 	if err != nil {
-		mu.Fatalf("pubsub.NewClient: %w", err)
+		mu.Fatalf("bus.Open: %v", err)
 	}
-	defer client.Close()
+	defer msgBus.Close()
 
-	topic := client.Topic(topicID)
-
-	res := topic.Publish(ctx, &pubsub.Message{
+	id, err := msgBus.Publish(ctx, opts.topicId, &bus.Message{
 		Data:       data,
 		Attributes: attrs,
 	})
-
-	id, err := res.Get(ctx)
 	if err != nil {
 		mu.Fatalf("Failed to publish: %v", err)
 	}
@@ -31,10 +33,57 @@ func publishMessage(projectID, topicID string, data []byte, attrs map[string]str
 	fmt.Printf("Published message with msg ID: %v\n", id)
 }
 
+// Updates the member's leaf key and publishes the signed update.  The
+// advanced state is written next to the state file first and only replaces
+// it once the update is published, so a failed publish leaves the member at
+// its current epoch.
+func publishSignedUpdate(opts *Options) {
+	state, err := artx.ReadTreeStateFile(opts.stateFile)
+	if err != nil {
+		mu.Fatalf("error: reading tree state: %v", err)
+	}
+	ik, err := art.ReadPrivateIKFromFile(opts.ikFile, art.EncodingPEM)
+	if err != nil {
+		mu.Fatalf("error: reading IK: %v", err)
+	}
+	idx, err := artx.MemberIndex(state, ik.Public().(ed25519.PublicKey))
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+
+	info := &artx.GroupInfo{ID: opts.groupId, Epoch: opts.epoch}
+	update, err := artx.NewLeafUpdate(state, info, idx, ik)
+	if err != nil {
+		mu.Fatalf("error: %v", err)
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		mu.Fatalf("error: marshalling update: %v", err)
+	}
+
+	newStateFile := opts.stateFile + ".new"
+	if err := artx.WriteTreeStateFile(newStateFile, state); err != nil {
+		mu.Fatalf("error: writing tree state: %v", err)
+	}
+	publishMessage(opts, data, map[string]string{
+		"messageType": "signed_update",
+		"epoch":       strconv.FormatUint(info.Epoch, 10),
+	})
+	if err := os.Rename(newStateFile, opts.stateFile); err != nil {
+		mu.Fatalf("error: the update is published, but the new tree state is still in %s: %v", newStateFile, err)
+	}
+	fmt.Printf("Member %d moved group %s to epoch %d.\n", idx, opts.groupId, info.Epoch)
+}
+
 func main() {
 	opts := parseOptions()
 
+	if opts.stateFile != "" {
+		publishSignedUpdate(opts)
+		return
+	}
+
 	msgAttrs := map[string]string{"messageType": opts.messageType, "messageFor": opts.messageFor}
-	publishMessage(opts.projectId, opts.topicId, []byte(opts.message), msgAttrs)
+	publishMessage(opts, []byte(opts.message), msgAttrs)
 
 }
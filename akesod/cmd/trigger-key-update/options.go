@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/etclab/mu"
 )
 
 type Options struct {
@@ -13,6 +15,14 @@ type Options struct {
 	message     string
 	messageType string
 	messageFor  string
+	busKind     string
+	busAddress  string
+
+	// signed update
+	stateFile string
+	ikFile    string
+	groupId   string
+	epoch     uint64
 }
 
 const usage = `Usage: trigger-key-update [options]
@@ -21,15 +31,33 @@ Util to trigger key update:
 	- "update_key" message is sent to trigger a key update 
 	- the message is sent to "KeyUpdate" topic by default; so all members receive it
 
+With -state, a member updates its own leaf key instead:
+	- reads the member's ART tree state (as written by art.TreeState.Save)
+	  and its private IK
+	- replaces the member's leaf key, and publishes the artx.SignedUpdate
+	  that akesod and the other members apply, signed by the IK
+	- writes the advanced tree state back to the -state file once published
+
 Default options:
 	- topic-id: KeyUpdate
 	- project-id: wild-flame-123456
 	- message: Update key
 	- message-type: update_key
 	- message-for: bob
+	- bus: pubsub (or local, to use akesod's local broker)
+	- bus-address: unix:///tmp/akeso-bus.sock (only for -bus local)
+
+Signed update options:
+	- state: the member's tree state file
+	- ik: the member's private IK (default keys/NAME-ik.pem, NAME being
+	  -message-for)
+	- group-id: the GroupID of akesod's setup message
+	- epoch: the group's current epoch, that of -state; the update moves
+	  the group to the next one.  0 right after setup.
 
 examples: 
 	$ ./trigger-key-update 
+	$ ./trigger-key-update -state keys/bob-state.json -message-for bob -group-id $GROUP_ID -epoch 0
 
 `
 
@@ -47,8 +75,26 @@ func parseOptions() *Options {
 	flag.StringVar(&opts.message, "message", "Update key", "")
 	flag.StringVar(&opts.messageType, "message-type", "update_key", "")
 	flag.StringVar(&opts.messageFor, "message-for", "bob", "")
+	flag.StringVar(&opts.busKind, "bus", "pubsub", "")
+	flag.StringVar(&opts.busAddress, "bus-address", "unix:///tmp/akeso-bus.sock", "")
+	flag.StringVar(&opts.stateFile, "state", "", "")
+	flag.StringVar(&opts.ikFile, "ik", "", "")
+	flag.StringVar(&opts.groupId, "group-id", "", "")
+	flag.Uint64Var(&opts.epoch, "epoch", 0, "")
 
 	flag.Parse()
 
+	if opts.stateFile == "" && (opts.ikFile != "" || opts.groupId != "") {
+		mu.Fatalf("error: -ik and -group-id need -state")
+	}
+	if opts.stateFile != "" {
+		if opts.groupId == "" {
+			mu.Fatalf("error: -state needs -group-id")
+		}
+		if opts.ikFile == "" {
+			opts.ikFile = "keys/" + opts.messageFor + "-ik.pem"
+		}
+	}
+
 	return &opts
 }
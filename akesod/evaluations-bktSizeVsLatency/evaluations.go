@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"os/exec"
@@ -24,6 +25,8 @@ const (
 	requestsPerMinute             = 50
 	sleepDuration                 = time.Second * 60 / requestsPerMinute
 	uploadKey                     = "../keys/updatekey"
+	workerPubKey                  = "../keys/worker-pub.pem"
+	dekFile                       = "dek.bin"
 	updateKey                     = "../keys/updatekey2"
 	bucketPrefix                  = "exp-"
 	akesoLogQueryLookbackDuration = -60 * time.Second // Adjustable lookback duration
@@ -64,6 +67,9 @@ func main() {
 	}
 }
 
+// The notifications carry no key; the first akeso update of each round
+// replaces its bucket's notification with one that carries that round's
+// dek.bin wrapped to the workers' key (cloud-cp -notifyTopic).
 func setNotifications(bucketSizes map[string]int) {
 	var wg sync.WaitGroup
 	for sizeKey := range bucketSizes {
@@ -71,7 +77,7 @@ func setNotifications(bucketSizes map[string]int) {
 		go func(currentSizeKey string) {
 			defer wg.Done()
 			bucketName := bucketPrefix + strings.ToLower(currentSizeKey) + "-akeso"
-			command := fmt.Sprintf("../gcs-utils -notification-config -topic-id %s -project-id %s -event-type OBJECT_METADATA_UPDATE -custom-attributes=new_dek=x++yudvAtO9scc4NPYQusmPD0bsiyQic9ZHziqu62DE= gs://%s", metadataUpdateTopic, projectID, bucketName)
+			command := fmt.Sprintf("../gcs-utils -notification-config -topic-id %s -project-id %s -event-type OBJECT_METADATA_UPDATE gs://%s", metadataUpdateTopic, projectID, bucketName)
 			cmdParts := strings.Fields(command)
 			cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
 			fmt.Println("Executing Notification Command: ", cmd.String())
@@ -86,6 +92,16 @@ func setNotifications(bucketSizes map[string]int) {
 	wg.Wait()
 }
 
+// Writes a fresh rotation key for the akeso updates of one bucket, so that
+// no two rounds share one
+func newRotationKey() error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	return os.WriteFile(dekFile, dek, 0600)
+}
+
 func setSoftDeleteOff(bucketSizes map[string]int, strategies []string) {
 	var wg sync.WaitGroup
 	for sizeKey := range bucketSizes {
@@ -334,6 +350,17 @@ func BenchmarkReencryptions(bucketSizes map[string]int, strategies []string) str
 					akesoQueryStartTimeForFilter.Format(time.RFC3339), sizeKey, strategy)
 			}
 
+			// each round gets its own rotation key, and sets the bucket's
+			// notification up with it on its first successful update
+			notified := false
+			if strategy == "akeso" {
+				if err := newRotationKey(); err != nil {
+					fmt.Printf("Error writing the rotation key to %s: %v\n", dekFile, err)
+					sizeReencTimes[strategy] = -1
+					continue
+				}
+			}
+
 			fmt.Printf("Benchmarking strategy: %s, size: %s (%d files)\n", strategy, sizeKey, numFiles)
 
 			for i := 1; i <= numFiles; i++ {
@@ -351,7 +378,11 @@ func BenchmarkReencryptions(bucketSizes map[string]int, strategies []string) str
 					cmdParts := strings.Fields(command)
 					cmd = exec.Command(cmdParts[0], cmdParts[1:]...)
 				case "akeso":
-					cmd = exec.Command("../cloud-cp", "-strategy", "akeso", "-maxReenc", "50", "-key", uploadKey, "-updateKey", updateKey, "-dekOverride", "dek.bin", gcsObjectURL)
+					args := []string{"-strategy", "akeso", "-maxReenc", "50", "-key", uploadKey, "-updateKey", updateKey, "-dekOverride", dekFile}
+					if !notified {
+						args = append(args, "-workerKey", workerPubKey, "-notifyTopic", metadataUpdateTopic, "-project", projectID)
+					}
+					cmd = exec.Command("../cloud-cp", append(args, gcsObjectURL)...)
 					if i == 1 {
 						akesoOperationStartTime = time.Now()
 						// Update the query filter to be more precise
@@ -363,6 +394,9 @@ func BenchmarkReencryptions(bucketSizes map[string]int, strategies []string) str
 				}
 
 				output, errCmd := cmd.CombinedOutput()
+				if strategy == "akeso" && errCmd == nil {
+					notified = true
+				}
 				if errCmd != nil {
 					fmt.Printf("Error executing update command for %s (strategy %s): %v\nCommand was: %s\nOutput: %s\n", sizeBasedFileName, strategy, errCmd, cmd.String(), string(output))
 					continue
@@ -9,8 +9,10 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/etclab/akesod/internal/secret"
 	"github.com/etclab/mu"
 	"golang.org/x/crypto/hkdf"
 )
@@ -103,12 +105,14 @@ func AESFromPEM(pemFile string, salt []byte) ([]byte, error) {
 	if err != nil {
 		mu.Panicf("Error reading private key file: %v\n", err)
 	}
+	defer secret.Zero(privateKeyPEM)
 
 	// Parse the PEM block to extract the private key
 	block, _ := pem.Decode(privateKeyPEM)
 	if block == nil || block.Type != "ED25519 PRIVATE KEY" {
 		mu.Panicf("Failed to decode PEM block containing private key")
 	}
+	defer secret.Zero(block.Bytes)
 
 	// Parse the private key
 	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
@@ -121,19 +125,35 @@ func AESFromPEM(pemFile string, salt []byte) ([]byte, error) {
 	if !ok {
 		mu.Panicf("Invalid private key type")
 	}
+	defer secret.Zero(ed25519PrivateKey)
 
+	aesKey, err := AESFromStageKey(ed25519PrivateKey, salt)
+	if err != nil {
+		mu.Panicf("Error deriving AES key: %v\n", err)
+	}
+
+	return aesKey, nil
+
+}
+
+// AESFromStageKey derives the AES-256 key for an ART stage key, exactly as
+// AESFromPEM does for a stage key stored in a PEM file.  This is the
+// ScheduleLegacy key; new groups use DeriveKey.
+func AESFromStageKey(stageKey ed25519.PrivateKey, salt []byte) ([]byte, error) {
 	// Use HKDF to derive an AES-256 key from the ED25519 private key
 	info := []byte("aes-256-key from ed25519")
 	hash := sha256.New
-	aesKey := make([]byte, 32) // 32 bytes for AES-256
+	aesKey := make([]byte, KeySize) // 32 bytes for AES-256
+
+	// Seed returns a copy of the key's seed
+	seed := stageKey.Seed()
+	defer secret.Zero(seed)
 
-	kdf := hkdf.New(hash, ed25519PrivateKey.Seed(), salt, info)
-	_, err = kdf.Read(aesKey)
+	kdf := hkdf.New(hash, seed, salt, info)
+	_, err := io.ReadFull(kdf, aesKey)
 	if err != nil {
-		mu.Panicf("Error deriving AES key: %v\n", err)
+		return nil, err
 	}
 
-	fmt.Printf("AESKEY: %s\n", aesKey)
 	return aesKey, nil
-
 }
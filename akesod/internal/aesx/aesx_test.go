@@ -0,0 +1,103 @@
+package aesx
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/etclab/akesod/internal/secret/secrettest"
+)
+
+func writeStageKeyPEM(t *testing.T) (string, ed25519.PrivateKey) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "stage-key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, sk
+}
+
+func TestAESFromPEMDoesNotLeak(t *testing.T) {
+	path, sk := writeStageKeyPEM(t)
+	salt := []byte("salt")
+
+	var key []byte
+	out := secrettest.CaptureOutput(t, func() {
+		var err error
+		key, err = AESFromPEM(path, salt)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	want, err := AESFromStageKey(sk, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, want) {
+		t.Fatal("AESFromPEM and AESFromStageKey derive different keys")
+	}
+	secrettest.AssertNoLeak(t, out, key, sk.Seed())
+}
+
+func TestDeriveKeyDoesNotLeak(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := bytes.Clone(sk)
+
+	var keys [][]byte
+	out := secrettest.CaptureOutput(t, func() {
+		for _, schedule := range []int{ScheduleLegacy, ScheduleHKDFv1} {
+			key, err := ScheduleKey(schedule, sk, nil, KeyContext{GroupID: "g", Epoch: 1, Bucket: "b", Purpose: PurposeDataKEK})
+			if err != nil {
+				t.Error(err)
+			}
+			keys = append(keys, key)
+		}
+	})
+
+	if !bytes.Equal(sk, orig) {
+		t.Error("deriving keys modified the stage key")
+	}
+	secrettest.AssertNoLeak(t, out, append(keys, sk.Seed())...)
+}
+
+// art keeps only the seed as the stage key until the tree state is saved
+func TestDeriveKeyFromSeed(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := KeyContext{GroupID: "g", Epoch: 1, Bucket: "b", Purpose: PurposeHeaderKEK}
+
+	want, err := DeriveKey(sk, nil, kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DeriveKey(sk.Seed(), nil, kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the seed and the full stage key derive different keys")
+	}
+
+	if _, err := DeriveKey(sk[:16], nil, kc); err == nil {
+		t.Error("derived a key from a short stage key")
+	}
+}
@@ -0,0 +1,101 @@
+package aesx
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/etclab/akesod/internal/secret"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key schedules.  A group records the schedule its epoch keys are derived
+// with, so data written under AESFromStageKey stays readable until the
+// group's next rotation moves it to the current schedule.
+const (
+	// ScheduleLegacy is the single key of AESFromStageKey, shared by every
+	// bucket and purpose.
+	ScheduleLegacy = 0
+	// ScheduleHKDFv1 derives an independent key per KeyContext with
+	// DeriveKey.
+	ScheduleHKDFv1 = 1
+
+	CurrentSchedule = ScheduleHKDFv1
+)
+
+// Purposes of keys derived from a stage key
+const (
+	// PurposeHeaderKEK encrypts the akeso strategy's object header, which
+	// holds the object's DEKs.
+	PurposeHeaderKEK = "header-kek"
+	// PurposeDataKEK encrypts object data, or wraps its DEK, in the other
+	// strategies.
+	PurposeDataKEK = "data-kek"
+	// PurposeNameKey encrypts or hashes object names.
+	PurposeNameKey = "name"
+)
+
+const scheduleLabel = "akeso key schedule v1"
+
+// KeyContext names the use of a derived key.  Keys for contexts that differ
+// in any field are independent.
+type KeyContext struct {
+	GroupID string
+	Epoch   uint64
+	Bucket  string
+	Purpose string
+}
+
+// info encodes the context unambiguously: each string is length-prefixed,
+// and the epoch is a fixed 8 bytes.
+func (kc *KeyContext) info() []byte {
+	var b []byte
+	appendString := func(s string) {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+		b = append(b, s...)
+	}
+
+	appendString(scheduleLabel)
+	appendString(kc.GroupID)
+	b = binary.BigEndian.AppendUint64(b, kc.Epoch)
+	appendString(kc.Bucket)
+	appendString(kc.Purpose)
+	return b
+}
+
+// DeriveKey derives the AES-256 key for kc from a stage key with
+// HKDF-SHA256.  salt is the deployment's KDF salt.  The stage key may be
+// the full Ed25519 key of a saved tree state, or just its seed, which is
+// what art leaves in the state right after an update.
+func DeriveKey(stageKey ed25519.PrivateKey, salt []byte, kc KeyContext) ([]byte, error) {
+	if len(stageKey) != ed25519.PrivateKeySize && len(stageKey) != ed25519.SeedSize {
+		return nil, fmt.Errorf("stage key has %d bytes, expected %d or %d", len(stageKey), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+	if kc.Purpose == "" {
+		return nil, errors.New("key context has no purpose")
+	}
+
+	seed := stageKey.Seed()
+	defer secret.Zero(seed)
+
+	key := make([]byte, KeySize)
+	kdf := hkdf.New(sha256.New, seed, salt, kc.info())
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ScheduleKey derives the key for kc under the given schedule
+func ScheduleKey(schedule int, stageKey ed25519.PrivateKey, salt []byte, kc KeyContext) ([]byte, error) {
+	switch schedule {
+	case ScheduleLegacy:
+		return AESFromStageKey(stageKey, salt)
+	case ScheduleHKDFv1:
+		return DeriveKey(stageKey, salt, kc)
+	}
+	return nil, fmt.Errorf("unknown key schedule %d", schedule)
+}
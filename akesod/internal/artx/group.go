@@ -0,0 +1,71 @@
+package artx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/art"
+	"github.com/etclab/mu"
+)
+
+// GroupInfo is akesod's bookkeeping for an ART group: a random group ID that
+// every update message is bound to, and the epoch of the current stage key.
+// The epoch is 0 right after setup and increases by one per processed update.
+// It is persisted as part of the group state snapshot (see MarshalGroupState).
+//
+// PendingRotation is set while the tree has advanced to Epoch but the bucket
+// has not been fully re-keyed yet; UpdateMsgID names the key update message
+// that started the rotation.  When akesod itself updated its leaf,
+// PendingUpdate holds the signed update until it has been published.
+//
+// KeySchedule is the aesx key schedule the epoch's keys are derived with.
+// Groups from before per-bucket keys have ScheduleLegacy (0) until their
+// next epoch.
+type GroupInfo struct {
+	ID              string `json:"id"`
+	Epoch           uint64 `json:"epoch"`
+	PendingRotation bool   `json:"pendingRotation,omitempty"`
+	UpdateMsgID     string `json:"updateMsgId,omitempty"`
+	PendingUpdate   []byte `json:"pendingUpdate,omitempty"`
+	KeySchedule     int    `json:"keySchedule,omitempty"`
+}
+
+func NewGroupInfo() *GroupInfo {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		mu.Panicf("artx.NewGroupInfo: rand.Read failed: %v", err)
+	}
+	return &GroupInfo{ID: hex.EncodeToString(id)}
+}
+
+// ReadGroupInfo reads a standalone group info file, as written by akesod
+// before group state was kept in a store.
+func ReadGroupInfo(path string) (*GroupInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info GroupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("can't parse group info %s: %w", path, err)
+	}
+	return &info, nil
+}
+
+// BucketKey derives the key of bucket for purpose at info's epoch from a
+// tree state at that epoch, with info's key schedule.  It is the key akesod
+// rotates the bucket to, so members holding the tree state can read and
+// write the bucket's objects without akesod.
+func BucketKey(state *art.TreeState, info *GroupInfo, salt []byte, bucket, purpose string) ([]byte, error) {
+	return aesx.ScheduleKey(info.KeySchedule, state.StageKey(), salt, aesx.KeyContext{
+		GroupID: info.ID,
+		Epoch:   info.Epoch,
+		Bucket:  bucket,
+		Purpose: purpose,
+	})
+}
@@ -0,0 +1,93 @@
+// Package artx contains the akesod-side glue around the ART library: member
+// registration, group metadata, and message formats exchanged with members.
+package artx
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/etclab/art"
+)
+
+// Registration is the bundle a member publishes to announce its public
+// identity key (IK) and ephemeral key (EK) to akesod.  The bundle is signed
+// with the member's private IK, which proves possession of the IK and binds
+// the EK to it.  Private keys never leave the member.
+//
+// Group names the akesod group the member joins; it is empty for a daemon
+// configured with a single, unnamed group.
+type Registration struct {
+	Group string `json:"group,omitempty"`
+	Name  string `json:"name"`
+	IK    []byte `json:"ik"`  // PEM-encoded ed25519 public key
+	EK    []byte `json:"ek"`  // PEM-encoded X25519 public key
+	Sig   []byte `json:"sig"` // ed25519 signature over signedBytes()
+}
+
+// NewRegistration creates and signs a registration bundle for member name
+// of group.
+func NewRegistration(group, name string, ik ed25519.PrivateKey, ek *ecdh.PublicKey) (*Registration, error) {
+	ikPEM, err := art.MarshalPublicIKToPEM(ik.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal public IK: %w", err)
+	}
+
+	ekPEM, err := art.MarshalPublicEKToPEM(ek)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal public EK: %w", err)
+	}
+
+	reg := &Registration{Group: group, Name: name, IK: ikPEM, EK: ekPEM}
+	reg.Sig = ed25519.Sign(ik, reg.signedBytes())
+	return reg, nil
+}
+
+// signedBytes returns the length-prefixed concatenation of the bundle
+// fields that the signature covers.  Bundles without a group keep the v1
+// encoding.
+func (reg *Registration) signedBytes() []byte {
+	var buf bytes.Buffer
+	fields := [][]byte{[]byte(reg.Name), reg.IK, reg.EK}
+	if reg.Group == "" {
+		buf.WriteString("akeso-registration-v1")
+	} else {
+		buf.WriteString("akeso-registration-v2")
+		fields = append([][]byte{[]byte(reg.Group)}, fields...)
+	}
+	for _, field := range fields {
+		fmt.Fprintf(&buf, "%d:", len(field))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+// Verify checks the bundle signature and returns the member's public keys.
+// If pinnedIK is not nil, the bundle's IK must also equal pinnedIK; this is
+// how a pre-shared identity key is enforced.
+func (reg *Registration) Verify(pinnedIK ed25519.PublicKey) (ed25519.PublicKey, *ecdh.PublicKey, error) {
+	if reg.Name == "" {
+		return nil, nil, fmt.Errorf("registration has an empty member name")
+	}
+
+	ik, err := art.UnmarshalPublicIKFromPEM(reg.IK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration for %q has a malformed IK: %w", reg.Name, err)
+	}
+
+	ek, err := art.UnmarshalPublicEKFromPEM(reg.EK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration for %q has a malformed EK: %w", reg.Name, err)
+	}
+
+	if !ed25519.Verify(ik, reg.signedBytes(), reg.Sig) {
+		return nil, nil, fmt.Errorf("registration for %q failed signature verification", reg.Name)
+	}
+
+	if pinnedIK != nil && !pinnedIK.Equal(ik) {
+		return nil, nil, fmt.Errorf("registration for %q does not match the pinned IK", reg.Name)
+	}
+
+	return ik, ek, nil
+}
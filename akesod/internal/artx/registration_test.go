@@ -0,0 +1,66 @@
+package artx
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func newTestRegistration(t *testing.T, group, name string) (*Registration, ed25519.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := NewRegistration(group, name, priv, ek.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg, pub
+}
+
+func TestRegistration(t *testing.T) {
+	for _, group := range []string{"", "finance"} {
+		reg, ik := newTestRegistration(t, group, "bob")
+		got, ek, err := reg.Verify(nil)
+		if err != nil {
+			t.Fatalf("group %q: %v", group, err)
+		}
+		if !got.Equal(ik) || ek == nil {
+			t.Errorf("group %q: Verify returned the wrong keys", group)
+		}
+		if _, _, err := reg.Verify(ik); err != nil {
+			t.Errorf("group %q: with its own IK pinned: %v", group, err)
+		}
+	}
+
+	other, otherIK := newTestRegistration(t, "finance", "eve")
+	tests := []struct {
+		name   string
+		modify func(reg *Registration)
+		pin    ed25519.PublicKey
+		err    string
+	}{
+		{"renamed", func(reg *Registration) { reg.Name = "eve" }, nil, "signature"},
+		{"moved to another group", func(reg *Registration) { reg.Group = "hr" }, nil, "signature"},
+		{"group dropped", func(reg *Registration) { reg.Group = "" }, nil, "signature"},
+		{"EK replaced", func(reg *Registration) { reg.EK = other.EK }, nil, "signature"},
+		{"IK and signature replaced", func(reg *Registration) { reg.IK, reg.Sig = other.IK, other.Sig }, nil, "signature"},
+		{"malformed IK", func(reg *Registration) { reg.IK = []byte("ik") }, nil, "malformed IK"},
+		{"no name", func(reg *Registration) { reg.Name = "" }, nil, "empty member name"},
+		{"another member's IK pinned", func(reg *Registration) {}, otherIK, "pinned IK"},
+	}
+	for _, tt := range tests {
+		reg, _ := newTestRegistration(t, "finance", "bob")
+		tt.modify(reg)
+		_, _, err := reg.Verify(tt.pin)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v; expected an error about %q", tt.name, err, tt.err)
+		}
+	}
+}
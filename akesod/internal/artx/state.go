@@ -0,0 +1,116 @@
+package artx
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/etclab/art"
+)
+
+// treeJSON has the same layout as the tree state files written by
+// art.TreeState.Save, so existing state.json files can be imported.
+type treeJSON struct {
+	PublicTree [][]byte `json:"publicTree"`
+	Sk         []byte   `json:"sk"`
+	Lk         []byte   `json:"lk"`
+	IKeys      [][]byte `json:"iKeys"`
+}
+
+// groupStateJSON is the snapshot akesod commits after setup and after each
+// processed update.  The tree includes the stage key.
+type groupStateJSON struct {
+	Group GroupInfo `json:"group"`
+	Tree  treeJSON  `json:"tree"`
+}
+
+func marshalTree(state *art.TreeState) (*treeJSON, error) {
+	publicTree, err := state.PublicTree.MarshalKeys()
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal public tree: %w", err)
+	}
+
+	sk, err := art.MarshalPrivateIKToPEM(state.Sk)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal stage key: %w", err)
+	}
+
+	lk, err := art.MarshalPrivateEKToPEM(state.Lk)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal leaf key: %w", err)
+	}
+
+	return &treeJSON{PublicTree: publicTree, Sk: sk, Lk: lk, IKeys: state.IKeys}, nil
+}
+
+func unmarshalTree(tree *treeJSON) (*art.TreeState, error) {
+	var err error
+	state := &art.TreeState{IKeys: tree.IKeys}
+
+	state.PublicTree, err = art.UnmarshalKeysToPublicTree(tree.PublicTree)
+	if err != nil {
+		return nil, fmt.Errorf("can't unmarshal public tree: %w", err)
+	}
+
+	state.Sk, err = art.UnmarshalPrivateIKFromPEM(tree.Sk)
+	if err != nil {
+		return nil, fmt.Errorf("can't unmarshal stage key: %w", err)
+	}
+
+	state.Lk, err = art.UnmarshalPrivateEKFromPEM(tree.Lk)
+	if err != nil {
+		return nil, fmt.Errorf("can't unmarshal leaf key: %w", err)
+	}
+
+	return state, nil
+}
+
+func MarshalGroupState(info *GroupInfo, state *art.TreeState) ([]byte, error) {
+	tree, err := marshalTree(state)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&groupStateJSON{Group: *info, Tree: *tree})
+}
+
+func UnmarshalGroupState(data []byte) (*GroupInfo, *art.TreeState, error) {
+	var gs groupStateJSON
+	if err := json.Unmarshal(data, &gs); err != nil {
+		return nil, nil, fmt.Errorf("malformed group state: %w", err)
+	}
+
+	state, err := unmarshalTree(&gs.Tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &gs.Group, state, nil
+}
+
+// ReadTreeStateFile reads a tree state file written by art.TreeState.Save.
+// Unlike art.ReadTreeState, it returns an error instead of exiting.
+func ReadTreeStateFile(path string) (*art.TreeState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree treeJSON
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("malformed tree state %s: %w", path, err)
+	}
+	return unmarshalTree(&tree)
+}
+
+// WriteTreeStateFile writes a tree state file in the layout of
+// art.TreeState.Save, as members keep it, readable only by the owner
+func WriteTreeStateFile(path string, state *art.TreeState) error {
+	tree, err := marshalTree(state)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
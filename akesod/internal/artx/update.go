@@ -0,0 +1,175 @@
+package artx
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/art"
+)
+
+var (
+	// ErrStaleUpdate means the update's epoch has already been processed.
+	ErrStaleUpdate = errors.New("replayed or stale update")
+	// ErrFutureUpdate means the update skips one or more epochs, e.g.
+	// because it was delivered before its predecessor.
+	ErrFutureUpdate = errors.New("out-of-order update")
+)
+
+// SignedUpdate is an ART update message as published on the key update
+// topic.  Besides the update and its MAC under the current stage key, it
+// names the group and the epoch the update moves the group to, and carries
+// the sender's IK signature over all of it.
+type SignedUpdate struct {
+	GroupID      string            `json:"groupId"`
+	Epoch        uint64            `json:"epoch"`
+	UpdateMsg    art.UpdateMessage `json:"updateMsg"`
+	UpdateMsgMac []byte            `json:"updateMsgMac"`
+	Sig          []byte            `json:"sig"`
+}
+
+// NewSignedUpdate is used by a member to wrap the output of art.UpdateKey.
+// prevStageKey is the stage key before the update, which keys the MAC.
+func NewSignedUpdate(groupID string, epoch uint64, msg *art.UpdateMessage,
+	prevStageKey, ik ed25519.PrivateKey) *SignedUpdate {
+	su := &SignedUpdate{
+		GroupID:      groupID,
+		Epoch:        epoch,
+		UpdateMsg:    *msg,
+		UpdateMsgMac: updateMAC(prevStageKey, msg),
+	}
+	su.Sig = ed25519.Sign(ik, su.signedBytes())
+	return su
+}
+
+// NewLeafUpdate replaces the leaf key of the member at selfIdx with a fresh
+// one, as art.UpdateKey does, advancing state and info to the next epoch.
+// It returns the signed update that brings the other members along.
+func NewLeafUpdate(state *art.TreeState, info *GroupInfo, selfIdx int, ik ed25519.PrivateKey) (*SignedUpdate, error) {
+	lk, err := art.DHKeyGen()
+	if err != nil {
+		return nil, fmt.Errorf("can't generate leaf key: %w", err)
+	}
+	state.Lk = lk
+
+	pathKeys := art.UpdateCoPathNodes(selfIdx, state)
+	msg := art.CreateUpdateMessage(selfIdx, pathKeys)
+	state.PublicTree = art.UpdatePublicTree(art.GetPublicKeys(pathKeys), state.PublicTree, selfIdx)
+
+	prevStageKey := state.Sk
+	state.DeriveStageKey(pathKeys[len(pathKeys)-1])
+	info.Epoch++
+
+	su := NewSignedUpdate(info.ID, info.Epoch, &msg, prevStageKey, ik)
+	secret.Zero(prevStageKey)
+	return su, nil
+}
+
+// MemberIndex returns the leaf index of the member with identity key ik in
+// the group's tree
+func MemberIndex(state *art.TreeState, ik ed25519.PublicKey) (int, error) {
+	for i, key := range state.IKeys {
+		memberIK, err := art.UnmarshalPublicIKFromPEM(key)
+		if err != nil {
+			return 0, fmt.Errorf("can't parse IK of member %d: %w", i+1, err)
+		}
+		if memberIK.Equal(ik) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("IK is not a member of the group")
+}
+
+// updateMAC mirrors the MAC computed by art's UpdateMessage.SaveMac.
+func updateMAC(stageKey ed25519.PrivateKey, msg *art.UpdateMessage) []byte {
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, uint32(msg.Idx))
+	macBytes := bytes.Join(msg.PathPublicKeys, []byte(" "))
+	macBytes = append(macBytes, bs...)
+
+	mac := art.NewHMAC(stageKey)
+	mac.Write(macBytes)
+	return mac.Sum(nil)
+}
+
+func (su *SignedUpdate) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("akeso-update-v1")
+	fmt.Fprintf(&buf, "%d:%s", len(su.GroupID), su.GroupID)
+	binary.Write(&buf, binary.BigEndian, su.Epoch)
+	binary.Write(&buf, binary.BigEndian, uint32(su.UpdateMsg.Idx))
+	for _, key := range su.UpdateMsg.PathPublicKeys {
+		fmt.Fprintf(&buf, "%d:", len(key))
+		buf.Write(key)
+	}
+	fmt.Fprintf(&buf, "%d:", len(su.UpdateMsgMac))
+	buf.Write(su.UpdateMsgMac)
+	return buf.Bytes()
+}
+
+// Verify checks, without modifying state, that the update belongs to this
+// group, is the next epoch, comes from a group member other than selfIdx,
+// has a valid sender signature, and has a valid MAC under the current stage
+// key.  The returned error describes why the update was rejected.
+func (su *SignedUpdate) Verify(state *art.TreeState, info *GroupInfo, selfIdx int) error {
+	if su.GroupID != info.ID {
+		return fmt.Errorf("update is for group %q, not %q", su.GroupID, info.ID)
+	}
+
+	if su.Epoch <= info.Epoch {
+		return fmt.Errorf("%w: epoch %d, current epoch %d", ErrStaleUpdate, su.Epoch, info.Epoch)
+	}
+	if su.Epoch != info.Epoch+1 {
+		return fmt.Errorf("%w: epoch %d, expected %d", ErrFutureUpdate, su.Epoch, info.Epoch+1)
+	}
+
+	idx := su.UpdateMsg.Idx
+	if idx < 1 || idx > len(state.IKeys) {
+		return fmt.Errorf("sender index %d is not a member of the group", idx)
+	}
+	if idx == selfIdx {
+		return fmt.Errorf("update claims to come from akesod itself (index %d)", idx)
+	}
+
+	copath := art.CoPath(state.PublicTree, idx, nil)
+	if len(su.UpdateMsg.PathPublicKeys) != len(copath)+1 {
+		return fmt.Errorf("update has %d path keys, expected %d", len(su.UpdateMsg.PathPublicKeys), len(copath)+1)
+	}
+	for i, key := range su.UpdateMsg.PathPublicKeys {
+		if _, err := art.UnmarshalPublicEKFromPEM(key); err != nil {
+			return fmt.Errorf("update path key %d is malformed: %w", i, err)
+		}
+	}
+
+	senderIK, err := art.UnmarshalPublicIKFromPEM(state.IKeys[idx-1])
+	if err != nil {
+		return fmt.Errorf("can't parse IK of sender %d: %w", idx, err)
+	}
+	if !ed25519.Verify(senderIK, su.signedBytes(), su.Sig) {
+		return fmt.Errorf("signature verification failed for sender %d", idx)
+	}
+
+	if !hmac.Equal(updateMAC(state.Sk, &su.UpdateMsg), su.UpdateMsgMac) {
+		return fmt.Errorf("MAC verification failed for sender %d", idx)
+	}
+
+	return nil
+}
+
+// Apply processes a verified update for the member at selfIdx, advancing
+// state to the new stage key and info to the update's epoch.
+func (su *SignedUpdate) Apply(state *art.TreeState, info *GroupInfo, selfIdx int) {
+	pathKeys := art.UnmarshallPublicKeys(su.UpdateMsg.PathPublicKeys)
+	state.PublicTree = art.UpdatePublicTree(pathKeys, state.PublicTree, su.UpdateMsg.Idx)
+
+	ownPathKeys := art.UpdateCoPathNodes(selfIdx, state)
+	prevStageKey := state.Sk
+	state.DeriveStageKey(ownPathKeys[len(ownPathKeys)-1])
+	secret.Zero(prevStageKey)
+
+	info.Epoch = su.Epoch
+}
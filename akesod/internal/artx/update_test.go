@@ -0,0 +1,287 @@
+package artx
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/art"
+	"github.com/etclab/nestedaes"
+)
+
+// A group set up by akesod, the first leaf, with members named after it.
+// states holds each leaf's tree state, and iks each leaf's private IK.
+type testGroup struct {
+	states []*art.TreeState
+	iks    []ed25519.PrivateKey
+}
+
+func newTestGroup(t *testing.T, members ...string) *testGroup {
+	t.Helper()
+	dir := t.TempDir()
+	names := append([]string{"akesod"}, members...)
+
+	g := &testGroup{}
+	var lines []string
+	var eks []*ecdh.PrivateKey
+	for _, name := range names {
+		pub, ik, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ikPath := filepath.Join(dir, name+"-ik-pub.pem")
+		ekPath := filepath.Join(dir, name+"-ek-pub.pem")
+		if err := art.WritePublicIKToFile(pub, ikPath, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePublicEKToFile(ek.PublicKey(), ekPath, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		if err := art.WritePrivateEKToFile(ek, filepath.Join(dir, name+"-ek.pem"), art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", name, filepath.Base(ikPath), filepath.Base(ekPath)))
+		g.iks = append(g.iks, ik)
+		eks = append(eks, ek)
+	}
+
+	configFile := filepath.Join(dir, "group.conf")
+	if err := os.WriteFile(configFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, setupMsg := art.SetupGroup(configFile, "akesod")
+	g.states = append(g.states, state)
+
+	// what art.ProcessSetupMessage does for each member, without the
+	// signature check
+	for i, name := range members {
+		idx := i + 2
+		member := &art.TreeState{PublicTree: setupMsg.GetPublicTree(), IKeys: setupMsg.IKeys}
+		member.Lk = art.DeriveLeafKeyOrFail(filepath.Join(dir, name+"-ek.pem"), setupMsg.GetSetupKey())
+		member.Sk = setupMsg.DeriveStageKey(member.DeriveTreeKey(idx))
+		g.states = append(g.states, member)
+	}
+
+	// akesod and members only ever use trees read back from their state
+	for i, state := range g.states {
+		tree, err := marshalTree(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.states[i], err = unmarshalTree(tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g
+}
+
+func TestMemberUpdate(t *testing.T) {
+	g := newTestGroup(t, "bob", "cici")
+	akesod, bob := g.states[0], g.states[1]
+	if !bytes.Equal(akesod.Sk, bob.Sk) {
+		t.Fatal("members don't share the stage key after setup")
+	}
+
+	// bob's side, as trigger-key-update -state does it
+	stateFile := filepath.Join(t.TempDir(), "bob-state.json")
+	if err := WriteTreeStateFile(stateFile, bob); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ReadTreeStateFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := MemberIndex(bob, g.iks[1].Public().(ed25519.PublicKey))
+	if err != nil || idx != 2 {
+		t.Fatalf("got index %d, %v; expected 2", idx, err)
+	}
+	bobInfo := &GroupInfo{ID: "g1", Epoch: 0}
+	update, err := NewLeafUpdate(bob, bobInfo, idx, g.iks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// akesod's side
+	var received SignedUpdate
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	info := &GroupInfo{ID: "g1", Epoch: 0}
+	if err := received.Verify(akesod, info, 1); err != nil {
+		t.Fatalf("akesod rejected the member's update: %v", err)
+	}
+	received.Apply(akesod, info, 1)
+	if info.Epoch != 1 || bobInfo.Epoch != 1 {
+		t.Errorf("got epochs %d and %d; expected 1", info.Epoch, bobInfo.Epoch)
+	}
+	if !bytes.Equal(akesod.Sk, bob.Sk) {
+		t.Error("akesod and the member derived different stage keys")
+	}
+
+	// a replay is stale, and another group's update is rejected
+	if err := received.Verify(akesod, info, 1); !errors.Is(err, ErrStaleUpdate) {
+		t.Errorf("replay: got %v; expected %v", err, ErrStaleUpdate)
+	}
+	if err := received.Verify(akesod, &GroupInfo{ID: "g2"}, 1); err == nil {
+		t.Error("update for another group was accepted")
+	}
+}
+
+// Each way an update can be forged, replayed out of order or corrupted is
+// rejected before akesod applies it
+func TestVerifyUpdate(t *testing.T) {
+	// with four leaves, every sender has the same number of path keys
+	g := newTestGroup(t, "bob", "cici", "dave")
+	akesod, bob := g.states[0], g.states[1]
+	update, err := NewLeafUpdate(bob, &GroupInfo{ID: "g1"}, 2, g.iks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resign is what a member with a valid IK can do to its own update
+	resign := func(ik ed25519.PrivateKey) func(su *SignedUpdate) {
+		return func(su *SignedUpdate) { su.Sig = ed25519.Sign(ik, su.signedBytes()) }
+	}
+	tests := []struct {
+		name   string
+		modify func(su *SignedUpdate)
+		err    string
+	}{
+		{"unmodified", func(su *SignedUpdate) {}, ""},
+		{"another group", func(su *SignedUpdate) { su.GroupID = "g2"; resign(g.iks[1])(su) }, "for group"},
+		{"skips an epoch", func(su *SignedUpdate) { su.Epoch = 2; resign(g.iks[1])(su) }, ErrFutureUpdate.Error()},
+		{"epoch changed", func(su *SignedUpdate) { su.Epoch = 2 }, ErrFutureUpdate.Error()},
+		{"unknown sender", func(su *SignedUpdate) { su.UpdateMsg.Idx = 5 }, "not a member"},
+		{"no sender", func(su *SignedUpdate) { su.UpdateMsg.Idx = 0 }, "not a member"},
+		{"from akesod", func(su *SignedUpdate) { su.UpdateMsg.Idx = 1 }, "akesod itself"},
+		{"path key dropped", func(su *SignedUpdate) {
+			su.UpdateMsg.PathPublicKeys = su.UpdateMsg.PathPublicKeys[1:]
+		}, "path keys"},
+		{"malformed path key", func(su *SignedUpdate) { su.UpdateMsg.PathPublicKeys[0] = []byte("key") }, "malformed"},
+		{"other sender", func(su *SignedUpdate) { su.UpdateMsg.Idx = 3 }, "signature"},
+		{"signed by another member", resign(g.iks[2]), "signature"},
+		{"unsigned", func(su *SignedUpdate) { su.Sig = nil }, "signature"},
+		{"MAC under another stage key", func(su *SignedUpdate) {
+			su.UpdateMsgMac = updateMAC(aes256.NewRandomKey(), &su.UpdateMsg)
+			resign(g.iks[1])(su)
+		}, "MAC"},
+	}
+	for _, tt := range tests {
+		var su SignedUpdate
+		if err := json.Unmarshal(data, &su); err != nil {
+			t.Fatal(err)
+		}
+		tt.modify(&su)
+		err := su.Verify(akesod, &GroupInfo{ID: "g1"}, 1)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v; expected an error about %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// A member derives the bucket keys from its own tree state, and reads the
+// headers akesod re-encrypted to them in a rotation.
+func TestMemberBucketKey(t *testing.T) {
+	g := newTestGroup(t, "bob")
+	akesod, bob := g.states[0], g.states[1]
+	salt := []byte("deployment salt")
+
+	// what cmd/akesod's epochKeys.bucketKey derives
+	akesodKey := func(info *GroupInfo, bucket string) []byte {
+		t.Helper()
+		key, err := aesx.ScheduleKey(info.KeySchedule, akesod.StageKey(), salt, aesx.KeyContext{
+			GroupID: info.ID,
+			Epoch:   info.Epoch,
+			Bucket:  bucket,
+			Purpose: aesx.PurposeHeaderKEK,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	info := &GroupInfo{ID: "g1", KeySchedule: aesx.CurrentSchedule}
+	header, err := nestedaes.NewHeader(aes256.NewRandomIV(), make([]byte, 16), aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := akesodKey(info, "bucket")
+
+	// akesod moves the group to epoch 1, as akesoctl rotate does, and
+	// re-encrypts the object's header with a new layer
+	update, err := NewLeafUpdate(akesod, info, 1, g.iks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := akesodKey(info, "bucket")
+	header.AddDEK(aes256.NewRandomKey())
+	data, err := header.Marshal(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UnmarshalHeader decrypts in place
+	if _, err := nestedaes.UnmarshalHeader(oldKey, bytes.Clone(data)); err == nil {
+		t.Fatal("the re-encrypted header opens with the old key")
+	}
+
+	// bob applies the update and derives the key, as akesoctl derive-key does
+	bobInfo := &GroupInfo{ID: "g1", KeySchedule: aesx.CurrentSchedule}
+	if err := update.Verify(bob, bobInfo, 2); err != nil {
+		t.Fatal(err)
+	}
+	update.Apply(bob, bobInfo, 2)
+	stateFile := filepath.Join(t.TempDir(), "bob-state.json")
+	if err := WriteTreeStateFile(stateFile, bob); err != nil {
+		t.Fatal(err)
+	}
+	if bob, err = ReadTreeStateFile(stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := BucketKey(bob, &GroupInfo{ID: "g1", Epoch: 1, KeySchedule: aesx.CurrentSchedule}, salt, "bucket", aesx.PurposeHeaderKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := nestedaes.UnmarshalHeader(key, data)
+	if err != nil {
+		t.Fatalf("the member's key doesn't open akesod's header: %v", err)
+	}
+	if len(got.DEKs) != 2 {
+		t.Errorf("got %d DEKs; expected 2", len(got.DEKs))
+	}
+
+	other, err := BucketKey(bob, bobInfo, salt, "other-bucket", aesx.PurposeHeaderKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other, key) {
+		t.Error("two buckets got the same key")
+	}
+}
@@ -0,0 +1,280 @@
+// Package audit implements akesod's append-only audit log.
+//
+// The log is a file of JSON lines.  Each entry carries the SHA-256 hash of
+// the previous entry, its own hash, and an ed25519 signature over that hash,
+// so an entry can't be altered, removed or reordered without breaking the
+// chain.  Keys never appear in the log, only their fingerprints.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventSetup          = "setup"
+	EventMember         = "member"
+	EventEpoch          = "epoch"
+	EventRotationStart  = "rotation_start"
+	EventRotationFinish = "rotation_finish"
+	EventObject         = "object"
+	EventLayer          = "layer"
+	EventLayersDone     = "layers_done"
+	EventEscrow         = "escrow"
+	EventIngest         = "ingest"
+)
+
+// Entry is a single audit record.  Hash covers every other field except
+// Sig; Sig is the signature over Hash.
+type Entry struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Group    string            `json:"group,omitempty"`
+	Epoch    uint64            `json:"epoch"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	PrevHash string            `json:"prevHash"`
+	Hash     string            `json:"hash"`
+	Sig      []byte            `json:"sig"`
+}
+
+// hash returns the hex SHA-256 of the entry with Hash and Sig cleared.
+// encoding/json writes struct fields in order and map keys sorted, so the
+// encoding is deterministic.
+func (e *Entry) hash() (string, error) {
+	c := *e
+	c.Hash = ""
+	c.Sig = nil
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Fingerprint identifies a key in the log without revealing it.
+func Fingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("akeso-audit-fingerprint-v1"))
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// logFile is the part of *os.File a Log writes with
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type Log struct {
+	mtx       sync.Mutex
+	f         logFile
+	size      int64 // end of the last entry written
+	key       ed25519.PrivateKey
+	seq       uint64
+	prevHash  string
+	recovered int64
+}
+
+// Open opens the log at path for appending, creating it if needed.  The last
+// entry is read to continue the chain; use Verify to check the whole file.
+// A malformed last line is an entry torn by a crash in Append, and is
+// removed; Recovered reports its size.  A malformed line before the last is
+// an error.
+func Open(path string, key ed25519.PrivateKey) (*Log, error) {
+	l := &Log{key: key}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *Entry
+	var offset int64
+	var torn error
+	newline := true // whether the file ends with one
+	r := bufio.NewReader(f)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		offset += int64(len(line))
+		if len(line) > 0 {
+			newline = line[len(line)-1] == '\n'
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if torn != nil {
+				f.Close()
+				return nil, torn
+			}
+			var e Entry
+			if err := json.Unmarshal(trimmed, &e); err != nil {
+				torn = fmt.Errorf("audit log %s: malformed entry after seq %d: %w", path, l.seq, err)
+			} else {
+				last = &e
+				l.seq = e.Seq
+			}
+		}
+		if torn == nil {
+			l.size = offset
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			f.Close()
+			return nil, readErr
+		}
+	}
+
+	if torn != nil {
+		if err := f.Truncate(l.size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit log %s: removing torn last entry: %w", path, err)
+		}
+		l.recovered = offset - l.size
+	} else if !newline {
+		// the last entry is complete but its newline was never written
+		if _, err := f.Write([]byte("\n")); err != nil {
+			f.Close()
+			return nil, err
+		}
+		l.size++
+	}
+
+	if last != nil {
+		l.prevHash = last.Hash
+	}
+	l.f = f
+	return l, nil
+}
+
+// Recovered returns the number of bytes of a torn last entry that Open
+// removed from the log, or 0.
+func (l *Log) Recovered() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.recovered
+}
+
+// Append signs and durably writes an entry.  If the write fails, whatever
+// part of the entry was written is removed again.  A nil Log discards
+// entries, so callers need not check whether auditing is enabled.
+func (l *Log) Append(typ, group string, epoch uint64, fields map[string]string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	e := &Entry{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Type:     typ,
+		Group:    group,
+		Epoch:    epoch,
+		Fields:   fields,
+		PrevHash: l.prevHash,
+	}
+
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	e.Sig = ed25519.Sign(l.key, []byte(hash))
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = l.f.Write(data)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// the next entry must not follow a partial one
+		if truncErr := l.f.Truncate(l.size); truncErr != nil {
+			return errors.Join(err, fmt.Errorf("removing partial entry: %w", truncErr))
+		}
+		return err
+	}
+
+	l.size += int64(len(data))
+	l.seq = e.Seq
+	l.prevHash = e.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Verify checks that the entries read from r form an unbroken chain that
+// starts at sequence number 1 and that every entry is signed by pub.  It
+// returns the number of entries and the hash of the last one.
+func Verify(r io.Reader, pub ed25519.PublicKey) (uint64, string, error) {
+	var seq uint64
+	prevHash := ""
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return seq, prevHash, fmt.Errorf("malformed entry after seq %d: %w", seq, err)
+		}
+
+		if e.Seq != seq+1 {
+			return seq, prevHash, fmt.Errorf("entry has seq %d, expected %d", e.Seq, seq+1)
+		}
+		if e.PrevHash != prevHash {
+			return seq, prevHash, fmt.Errorf("entry %d does not chain to the previous entry", e.Seq)
+		}
+
+		hash, err := e.hash()
+		if err != nil {
+			return seq, prevHash, err
+		}
+		if hash != e.Hash {
+			return seq, prevHash, fmt.Errorf("entry %d has been modified (hash mismatch)", e.Seq)
+		}
+		if !ed25519.Verify(pub, []byte(e.Hash), e.Sig) {
+			return seq, prevHash, fmt.Errorf("entry %d has an invalid signature", e.Seq)
+		}
+
+		seq = e.Seq
+		prevHash = e.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return seq, prevHash, err
+	}
+
+	if seq == 0 {
+		return 0, "", errors.New("audit log is empty")
+	}
+	return seq, prevHash, nil
+}
@@ -0,0 +1,264 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// Writes a log of n entries and returns its path
+func writeLog(t *testing.T, key ed25519.PrivateKey, n int) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 1; i <= n; i++ {
+		if err := l.Append(EventEpoch, "g", uint64(i), map[string]string{"i": strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func verify(t *testing.T, path string, pub ed25519.PublicKey) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, _, err := Verify(f, pub)
+	return n, err
+}
+
+func TestAppendVerify(t *testing.T) {
+	pub, priv := newKey(t)
+	path := writeLog(t, priv, 3)
+	if n, err := verify(t, path, pub); err != nil || n != 3 {
+		t.Fatalf("got %d entries, %v; expected 3", n, err)
+	}
+
+	// reopening continues the chain
+	l, err := Open(path, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(EventRotationStart, "g", 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if n, err := verify(t, path, pub); err != nil || n != 4 {
+		t.Errorf("after reopening: got %d entries, %v; expected 4", n, err)
+	}
+
+	other, _ := newKey(t)
+	if _, err := verify(t, path, other); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("with another key: %v", err)
+	}
+
+	// a nil Log discards entries
+	var nilLog *Log
+	if err := nilLog.Append(EventEpoch, "g", 1, nil); err != nil {
+		t.Errorf("nil Log: %v", err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	pub, priv := newKey(t)
+	_, forger := newKey(t)
+
+	// resign recomputes an entry's hash and signs it with key
+	resign := func(t *testing.T, line []byte, key ed25519.PrivateKey, modify func(e *Entry)) []byte {
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatal(err)
+		}
+		modify(&e)
+		hash, err := e.hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Hash = hash
+		e.Sig = ed25519.Sign(key, []byte(hash))
+		data, err := json.Marshal(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	edit := func(e *Entry) { e.Fields["i"] = "20" }
+
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, lines [][]byte) [][]byte
+		err    string
+	}{
+		{"edited", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"i":"2"`), []byte(`"i":"20"`), 1)
+			return lines
+		}, "entry 2 has been modified"},
+		{"reordered", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "seq 3, expected 2"},
+		{"deleted", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, "seq 3, expected 2"},
+		{"first deleted", func(t *testing.T, lines [][]byte) [][]byte {
+			return lines[1:]
+		}, "seq 2, expected 1"},
+		{"deleted and renumbered", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[2] = resign(t, lines[2], forger, func(e *Entry) { e.Seq = 2 })
+			return append(lines[:1], lines[2:]...)
+		}, "entry 2 does not chain"},
+		{"edited and re-signed", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1] = resign(t, lines[1], forger, edit)
+			return lines
+		}, "entry 2 has an invalid signature"},
+		{"edited, re-signed and re-chained", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1] = resign(t, lines[1], forger, edit)
+			var prev Entry
+			json.Unmarshal(lines[1], &prev)
+			lines[2] = resign(t, lines[2], forger, func(e *Entry) { e.PrevHash = prev.Hash })
+			return lines
+		}, "entry 2 has an invalid signature"},
+		{"edited and re-signed with the log's key, not re-chained", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[1] = resign(t, lines[1], priv, edit)
+			return lines
+		}, "entry 3 does not chain"},
+		{"emptied", func(t *testing.T, lines [][]byte) [][]byte {
+			return nil
+		}, "empty"},
+	}
+	for _, tt := range tests {
+		path := writeLog(t, priv, 3)
+		lines := tt.modify(t, readLines(t, path))
+		data := bytes.Join(lines, []byte("\n"))
+		if len(data) > 0 {
+			data = append(data, '\n')
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := verify(t, path, pub)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v; expected an error about %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// A crash in the middle of Append leaves part of an entry, which the next
+// Open removes
+func TestOpenTornEntry(t *testing.T) {
+	pub, priv := newKey(t)
+	path := writeLog(t, priv, 2)
+	lines := readLines(t, path)
+	torn := lines[1][:len(lines[1])/2]
+
+	for _, tail := range [][]byte{torn, lines[1]} {
+		data := bytes.Join([][]byte{lines[0], tail}, []byte("\n"))
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		l, err := Open(path, priv)
+		if err != nil {
+			t.Fatalf("opening a log with a torn last entry: %v", err)
+		}
+		if err := l.Append(EventEpoch, "g", 3, nil); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		expected := uint64(2)
+		if bytes.Equal(tail, lines[1]) {
+			// complete but for its newline
+			expected = 3
+		} else if l.Recovered() != int64(len(torn)) {
+			t.Errorf("recovered %d bytes; expected %d", l.Recovered(), len(torn))
+		}
+		if n, err := verify(t, path, pub); err != nil || n != expected {
+			t.Errorf("after appending: got %d entries, %v; expected %d", n, err, expected)
+		}
+	}
+
+	// a malformed entry that isn't the last is not a crash
+	path = writeLog(t, priv, 2)
+	lines = readLines(t, path)
+	lines[0] = lines[0][:10]
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, priv); err == nil || !strings.Contains(err.Error(), "malformed entry") {
+		t.Errorf("opening a log with a malformed entry: %v", err)
+	}
+}
+
+// failingFile writes only the first n bytes of each write, then fails
+type failingFile struct {
+	*os.File
+	n int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	n, _ := f.File.Write(p[:f.n])
+	return n, errors.New("disk full")
+}
+
+func TestAppendFailureLeavesNoPartialEntry(t *testing.T) {
+	pub, priv := newKey(t)
+	path := writeLog(t, priv, 2)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(path, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file := l.f.(*os.File)
+	l.f = &failingFile{File: file, n: 20}
+	if err := l.Append(EventEpoch, "g", 3, nil); err == nil {
+		t.Fatal("Append succeeded with a failing write")
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("the failed Append left %q", after[len(before):])
+	}
+
+	l.f = file
+	if err := l.Append(EventEpoch, "g", 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verify(t, path, pub); err != nil || n != 3 {
+		t.Errorf("after a failed Append: got %d entries, %v; expected 3", n, err)
+	}
+}
@@ -0,0 +1,100 @@
+// Package bus abstracts the message transport between akesod, its members,
+// and the re-encryption workers.  Implementations exist for Google Cloud
+// Pub/Sub, an in-process bus, and a local broker reachable over a TCP or
+// Unix socket, so the full setup -> update -> rotate flow can run without a
+// cloud project.
+package bus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	KindPubSub = "pubsub"
+	KindMemory = "memory"
+	KindLocal  = "local"
+)
+
+// Message is a message received from or published to a topic.
+type Message struct {
+	ID         string
+	Data       []byte
+	Attributes map[string]string
+
+	once sync.Once
+	ack  func(ok bool)
+}
+
+// Ack acknowledges the message so that it is not delivered again.
+func (m *Message) Ack() {
+	m.settle(true)
+}
+
+// Nack asks for the message to be redelivered.
+func (m *Message) Nack() {
+	m.settle(false)
+}
+
+func (m *Message) settle(ok bool) {
+	m.once.Do(func() {
+		if m.ack != nil {
+			m.ack(ok)
+		}
+	})
+}
+
+// NewMessage returns a message for delivering to a Handler outside of a
+// Bus, e.g. in tests.  settle is called with true when the message is
+// Acked and false when it is Nacked.
+func NewMessage(id string, data []byte, attrs map[string]string, settle func(ok bool)) *Message {
+	return &Message{ID: id, Data: data, Attributes: attrs, ack: settle}
+}
+
+// Handler processes a delivered message.  A message the handler returns
+// without settling is Nacked.
+type Handler func(ctx context.Context, msg *Message)
+
+type Bus interface {
+	// Publish publishes msg to topic and returns the message ID.
+	Publish(ctx context.Context, topic string, msg *Message) (string, error)
+
+	// Subscribe delivers the messages published to topic, through the
+	// named subscription, to handler until ctx is done.  Messages are
+	// delivered one at a time, in publish order.
+	Subscribe(ctx context.Context, topic, sub string, handler Handler) error
+
+	Close() error
+}
+
+// Open returns the Bus for kind.  project is the cloud project for
+// KindPubSub.  address is the broker address for KindLocal, of the form
+// unix:///path/to/socket or tcp://host:port.
+func Open(ctx context.Context, kind, project, address string) (Bus, error) {
+	switch kind {
+	case KindPubSub, "":
+		return NewPubSub(ctx, project)
+	case KindMemory:
+		return NewMemory(), nil
+	case KindLocal:
+		network, addr, err := ParseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		return DialLocal(network, addr)
+	default:
+		return nil, fmt.Errorf("unknown bus kind %q (must be pubsub, memory or local)", kind)
+	}
+}
+
+// ParseAddress splits a unix:// or tcp:// address into a network and an
+// address for net.Dial and net.Listen.
+func ParseAddress(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("bad bus address %q: expected unix:///PATH or tcp://HOST:PORT", address)
+	}
+	return network, addr, nil
+}
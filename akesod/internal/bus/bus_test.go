@@ -0,0 +1,180 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type delivery struct {
+	id, data, attr string
+}
+
+// testRoundTrip publishes two messages to b and checks that they arrive in
+// order on sub, that a Nacked message and one returned unsettled are
+// redelivered, and that nothing is delivered again once Acked.  sub must
+// already exist on "topic".
+func testRoundTrip(t *testing.T, b Bus) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deliveries := make(chan delivery, 10)
+	seen := make(map[string]int)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.Subscribe(ctx, "topic", "sub", func(ctx context.Context, msg *Message) {
+			data := string(msg.Data)
+			deliveries <- delivery{msg.ID, data, msg.Attributes["kind"]}
+			seen[data]++
+			switch {
+			case seen[data] > 1:
+				msg.Ack()
+			case data == "one":
+				msg.Nack()
+			}
+			// the first delivery of "two" is left unsettled
+		})
+	}()
+
+	var ids []string
+	for _, data := range []string{"one", "two"} {
+		id, err := b.Publish(ctx, "topic", &Message{
+			Data:       []byte(data),
+			Attributes: map[string]string{"kind": "test-" + data},
+		})
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("both messages have ID %q", ids[0])
+	}
+
+	expected := []delivery{
+		{ids[0], "one", "test-one"},
+		{ids[0], "one", "test-one"},
+		{ids[1], "two", "test-two"},
+		{ids[1], "two", "test-two"},
+	}
+	for i, want := range expected {
+		select {
+		case got := <-deliveries:
+			if got != want {
+				t.Errorf("delivery %d: got %+v; expected %+v", i, got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("delivery %d: timed out waiting for %+v", i, want)
+		}
+	}
+
+	select {
+	case got := <-deliveries:
+		t.Errorf("Acked message delivered again: %+v", got)
+	case <-time.After(3 * redeliveryDelay):
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("Subscribe: %v", err)
+	}
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	mb := NewMemory()
+	mb.CreateSubscription("topic", "sub")
+	testRoundTrip(t, mb)
+}
+
+func TestMemoryFanOut(t *testing.T) {
+	ctx := context.Background()
+	mb := NewMemory()
+	mb.CreateSubscription("topic", "a")
+	mb.CreateSubscription("topic", "b")
+
+	// drain returns the messages delivered on sub until it goes quiet
+	drain := func(topic, sub string) string {
+		ctx, cancel := context.WithTimeout(ctx, 5*redeliveryDelay)
+		defer cancel()
+		var got []string
+		err := mb.Subscribe(ctx, topic, sub, func(ctx context.Context, msg *Message) {
+			got = append(got, string(msg.Data))
+			msg.Ack()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(got)
+	}
+
+	if _, err := mb.Publish(ctx, "topic", &Message{Data: []byte("both")}); err != nil {
+		t.Fatal(err)
+	}
+	// no subscription on "other" yet, so the message is not retained
+	if _, err := mb.Publish(ctx, "other", &Message{Data: []byte("lost")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []string{"a", "b"} {
+		if got := drain("topic", sub); got != "[both]" {
+			t.Errorf("subscription %s: got %s; expected [both]", sub, got)
+		}
+	}
+	if got := drain("other", "c"); got != "[]" {
+		t.Errorf("subscription c: got %s; expected []", got)
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sock := filepath.Join(t.TempDir(), "bus.sock")
+	mb := NewMemory()
+	mb.CreateSubscription("topic", "sub")
+	served := make(chan error, 1)
+	go func() {
+		served <- ListenAndServe(ctx, "unix", sock, mb)
+	}()
+
+	var b Bus
+	var err error
+	for range 50 {
+		if b, err = Open(ctx, KindLocal, "", "unix://"+sock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	testRoundTrip(t, b)
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address, network, addr string
+		ok                     bool
+	}{
+		{"unix:///tmp/akeso-bus.sock", "unix", "/tmp/akeso-bus.sock", true},
+		{"tcp://localhost:7070", "tcp", "localhost:7070", true},
+		{"udp://localhost:7070", "", "", false},
+		{"unix://", "", "", false},
+		{"/tmp/akeso-bus.sock", "", "", false},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseAddress(tt.address)
+		if (err == nil) != tt.ok || network != tt.network || addr != tt.addr {
+			t.Errorf("ParseAddress(%q) = %q, %q, %v", tt.address, network, addr, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// frame is the unit of the local broker protocol: one JSON object per
+// frame, in both directions.
+type frame struct {
+	Op         string            `json:"op"`
+	Seq        uint64            `json:"seq,omitempty"`
+	Topic      string            `json:"topic,omitempty"`
+	Sub        string            `json:"sub,omitempty"`
+	ID         string            `json:"id,omitempty"`
+	Data       []byte            `json:"data,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+const (
+	opPublish   = "publish"
+	opPublished = "published"
+	opSubscribe = "subscribe"
+	opDeliver   = "deliver"
+	opAck       = "ack"
+	opNack      = "nack"
+	opError     = "error"
+)
+
+type conn struct {
+	c   net.Conn
+	dec *json.Decoder
+
+	mtx sync.Mutex // serializes writes
+	enc *json.Encoder
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{c: c, dec: json.NewDecoder(c), enc: json.NewEncoder(c)}
+}
+
+func (c *conn) send(f *frame) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.enc.Encode(f)
+}
+
+func (c *conn) recv() (*frame, error) {
+	var f frame
+	if err := c.dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ListenAndServe runs a local broker backed by mb on network/addr until ctx
+// is done.  A stale Unix socket file at addr is removed first.
+func ListenAndServe(ctx context.Context, network, addr string, mb *Memory) error {
+	if network == "unix" {
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, ln, mb)
+}
+
+// Serve accepts broker clients on ln until ctx is done.
+func Serve(ctx context.Context, ln net.Listener, mb *Memory) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveConn(ctx, newConn(c), mb)
+	}
+}
+
+func serveConn(ctx context.Context, c *conn, mb *Memory) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.c.Close()
+
+	var mtx sync.Mutex
+	acks := make(map[uint64]chan bool)
+	var seq uint64
+
+	for {
+		f, err := c.recv()
+		if err != nil {
+			return
+		}
+
+		switch f.Op {
+		case opPublish:
+			id, err := mb.Publish(ctx, f.Topic, &Message{Data: f.Data, Attributes: f.Attributes})
+			resp := &frame{Op: opPublished, Seq: f.Seq, ID: id}
+			if err != nil {
+				resp = &frame{Op: opError, Seq: f.Seq, Error: err.Error()}
+			}
+			c.send(resp)
+
+		case opSubscribe:
+			go func(topic, sub string) {
+				mb.Subscribe(ctx, topic, sub, func(ctx context.Context, msg *Message) {
+					mtx.Lock()
+					seq++
+					s := seq
+					ch := make(chan bool, 1)
+					acks[s] = ch
+					mtx.Unlock()
+
+					err := c.send(&frame{Op: opDeliver, Seq: s, ID: msg.ID, Data: msg.Data, Attributes: msg.Attributes})
+					if err != nil {
+						msg.Nack()
+						return
+					}
+
+					select {
+					case ok := <-ch:
+						if ok {
+							msg.Ack()
+						} else {
+							msg.Nack()
+						}
+					case <-ctx.Done():
+						msg.Nack()
+					}
+				})
+				cancel()
+			}(f.Topic, f.Sub)
+
+		case opAck, opNack:
+			mtx.Lock()
+			ch, ok := acks[f.Seq]
+			delete(acks, f.Seq)
+			mtx.Unlock()
+			if ok {
+				ch <- f.Op == opAck
+			}
+
+		default:
+			c.send(&frame{Op: opError, Seq: f.Seq, Error: fmt.Sprintf("unknown op %q", f.Op)})
+		}
+	}
+}
+
+// Local is a Bus client for a broker started with ListenAndServe.
+type Local struct {
+	network string
+	addr    string
+
+	mtx sync.Mutex // one publish in flight at a time
+	seq uint64
+	pub *conn
+}
+
+func DialLocal(network, addr string) (*Local, error) {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach local bus at %s://%s: %w", network, addr, err)
+	}
+	return &Local{network: network, addr: addr, pub: newConn(c)}, nil
+}
+
+func (lb *Local) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	lb.seq++
+	err := lb.pub.send(&frame{Op: opPublish, Seq: lb.seq, Topic: topic, Data: msg.Data, Attributes: msg.Attributes})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := lb.pub.recv()
+	if err != nil {
+		return "", err
+	}
+	if resp.Op == opError {
+		return "", errors.New(resp.Error)
+	}
+	if resp.Seq != lb.seq {
+		return "", fmt.Errorf("local bus: response for publish %d, expected %d", resp.Seq, lb.seq)
+	}
+	return resp.ID, nil
+}
+
+// Subscribe uses a dedicated broker connection per subscription.
+func (lb *Local) Subscribe(ctx context.Context, topic, sub string, handler Handler) error {
+	nc, err := net.Dial(lb.network, lb.addr)
+	if err != nil {
+		return err
+	}
+	c := newConn(nc)
+	defer nc.Close()
+
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	defer stop()
+
+	if err := c.send(&frame{Op: opSubscribe, Topic: topic, Sub: sub}); err != nil {
+		return err
+	}
+
+	for {
+		f, err := c.recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("local bus: subscription %s: %w", sub, err)
+		}
+		if f.Op != opDeliver {
+			continue
+		}
+
+		s := f.Seq
+		msg := &Message{
+			ID:         f.ID,
+			Data:       f.Data,
+			Attributes: f.Attributes,
+			ack: func(ok bool) {
+				op := opNack
+				if ok {
+					op = opAck
+				}
+				c.send(&frame{Op: op, Seq: s})
+			},
+		}
+		handler(ctx, msg)
+		msg.Nack()
+	}
+}
+
+func (lb *Local) Close() error {
+	return lb.pub.c.Close()
+}
@@ -0,0 +1,143 @@
+package bus
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pause before redelivering a Nacked message
+const redeliveryDelay = 100 * time.Millisecond
+
+// Memory is an in-process Bus.  Like Pub/Sub, a message is copied to every
+// subscription that exists on its topic when it is published, and a Nacked
+// message is redelivered.
+type Memory struct {
+	mtx    sync.Mutex
+	nextID uint64
+	topics map[string]map[string]*queue // topic -> subscription -> queue
+}
+
+type queue struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	pending []*Message
+}
+
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+func (q *queue) push(msg *Message, front bool) {
+	q.mtx.Lock()
+	if front {
+		q.pending = append([]*Message{msg}, q.pending...)
+	} else {
+		q.pending = append(q.pending, msg)
+	}
+	q.mtx.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop blocks until a message is available or ctx is done
+func (q *queue) pop(ctx context.Context) (*Message, bool) {
+	stop := context.AfterFunc(ctx, q.cond.Broadcast)
+	defer stop()
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for len(q.pending) == 0 {
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	msg := q.pending[0]
+	q.pending = q.pending[1:]
+	return msg, true
+}
+
+func NewMemory() *Memory {
+	return &Memory{topics: make(map[string]map[string]*queue)}
+}
+
+func (mb *Memory) subscription(topic, sub string) *queue {
+	mb.mtx.Lock()
+	defer mb.mtx.Unlock()
+
+	subs, ok := mb.topics[topic]
+	if !ok {
+		subs = make(map[string]*queue)
+		mb.topics[topic] = subs
+	}
+	q, ok := subs[sub]
+	if !ok {
+		q = newQueue()
+		subs[sub] = q
+	}
+	return q
+}
+
+// CreateSubscription creates sub on topic, so that messages published from
+// now on are retained for it even before anyone calls Subscribe.
+func (mb *Memory) CreateSubscription(topic, sub string) {
+	mb.subscription(topic, sub)
+}
+
+func (mb *Memory) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	mb.mtx.Lock()
+	mb.nextID++
+	id := strconv.FormatUint(mb.nextID, 10)
+	subs := make([]*queue, 0, len(mb.topics[topic]))
+	for _, q := range mb.topics[topic] {
+		subs = append(subs, q)
+	}
+	mb.mtx.Unlock()
+
+	for _, q := range subs {
+		q.push(&Message{
+			ID:         id,
+			Data:       msg.Data,
+			Attributes: maps.Clone(msg.Attributes),
+		}, false)
+	}
+	return id, nil
+}
+
+func (mb *Memory) Subscribe(ctx context.Context, topic, sub string, handler Handler) error {
+	q := mb.subscription(topic, sub)
+
+	for {
+		msg, ok := q.pop(ctx)
+		if !ok {
+			return nil
+		}
+
+		done := make(chan bool, 1)
+		delivery := &Message{
+			ID:         msg.ID,
+			Data:       msg.Data,
+			Attributes: msg.Attributes,
+			ack:        func(ok bool) { done <- ok },
+		}
+		handler(ctx, delivery)
+
+		// a handler that returns without settling is treated as a Nack
+		delivery.Nack()
+		if !<-done {
+			q.push(msg, true)
+			select {
+			case <-time.After(redeliveryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (mb *Memory) Close() error {
+	return nil
+}
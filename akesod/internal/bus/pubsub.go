@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSub is a Bus backed by Google Cloud Pub/Sub.
+type PubSub struct {
+	client *pubsub.Client
+}
+
+func NewPubSub(ctx context.Context, projectID string) (*PubSub, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSub{client: client}, nil
+}
+
+func (ps *PubSub) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	result := ps.client.Topic(topic).Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+	return result.Get(ctx)
+}
+
+// Subscribe creates the subscription if it doesn't exist yet.
+func (ps *PubSub) Subscribe(ctx context.Context, topic, sub string, handler Handler) error {
+	s, err := ps.client.CreateSubscription(ctx, sub, pubsub.SubscriptionConfig{
+		Topic:                 ps.client.Topic(topic),
+		AckDeadline:           20 * time.Second,
+		EnableMessageOrdering: true,
+	})
+	if err != nil {
+		s = ps.client.Subscription(sub)
+	}
+	s.ReceiveSettings.MaxOutstandingMessages = 1
+
+	return s.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		msg := &Message{
+			ID:         m.ID,
+			Data:       m.Data,
+			Attributes: m.Attributes,
+			ack: func(ok bool) {
+				if ok {
+					m.Ack()
+				} else {
+					m.Nack()
+				}
+			},
+		}
+		handler(ctx, msg)
+		msg.Nack()
+	})
+}
+
+func (ps *PubSub) Close() error {
+	return ps.client.Close()
+}
@@ -0,0 +1,76 @@
+// Package completion defines the events that the workers applying akeso
+// layers, the encrypt-object cloud function and encrypt-worker, publish for
+// each object they handle.  akesod collects them to follow a rotation until
+// every layer it left to the workers is applied, to retry the objects a
+// worker gave up on, and to time rotations end to end.
+//
+// The cloud function has its own copy of Event; the two must agree.
+package completion
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/etclab/akesod/internal/bus"
+	"github.com/etclab/akesod/internal/dekwrap"
+	"github.com/etclab/akesod/internal/encstr"
+)
+
+// DefaultTopic is the topic the workers publish their events to
+const DefaultTopic = "ReencryptionComplete"
+
+// Results.  All but ResultFailed are the outcomes of
+// encstr.AkesoApplyLayer.
+const (
+	ResultApplied        = encstr.LayerApplied
+	ResultAlreadyApplied = encstr.LayerAlreadyApplied
+	ResultNotPending     = encstr.LayerNotPending // replaced by a newer layer, or the object was rewritten
+	ResultFailed         = "failed"
+)
+
+// Event reports the outcome of one metadata update event for one object
+type Event struct {
+	Rotation string    `json:"rotation"` // the dekwrap scope of the layer's rotation
+	Bucket   string    `json:"bucket"`
+	Name     string    `json:"name"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Retrying bool      `json:"retrying,omitempty"` // the worker will retry the event itself
+	Worker   string    `json:"worker"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Message encodes the event for publishing.  The rotation and result are
+// also set as attributes, for subscription filters.
+func (e *Event) Message() (*bus.Message, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return &bus.Message{
+		Data: data,
+		Attributes: map[string]string{
+			dekwrap.AttrRotation: e.Rotation,
+			"result":             e.Result,
+		},
+	}, nil
+}
+
+// Parse decodes an event published with Message
+func Parse(msg *bus.Message) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(msg.Data, &e); err != nil {
+		return nil, fmt.Errorf("malformed completion event: %w", err)
+	}
+	if e.Rotation == "" || e.Bucket == "" || e.Name == "" {
+		return nil, fmt.Errorf("completion event is missing its rotation, bucket or name")
+	}
+	switch e.Result {
+	case ResultApplied, ResultAlreadyApplied, ResultNotPending, ResultFailed:
+	default:
+		return nil, fmt.Errorf("completion event has unknown result %q", e.Result)
+	}
+	return &e, nil
+}
@@ -0,0 +1,270 @@
+// Package control defines akesod's administrative HTTP API and a client for
+// it.  akesod serves the API on a Unix or TCP socket; akesoctl is its
+// command-line client.
+//
+// Routes:
+//
+//	GET    /v1/groups                         all groups
+//	GET    /v1/groups/{group}                 one group, with its members
+//	POST   /v1/groups/{group}/rotations       start (or resume) a rotation
+//	GET    /v1/groups/{group}/rotation        progress of the current or last rotation
+//	DELETE /v1/groups/{group}/rotation        cancel the current rotation
+//	GET    /v1/groups/{group}/stuck           objects left with ongoing_reencryption=true
+//	GET    /v1/rotations                      rotation history, optionally ?group=NAME
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Rotation states
+const (
+	StateRunning     = "running"
+	StateApplying    = "applying" // objects rotated; the workers are applying their akeso layers
+	StateCompleted   = "completed"
+	StateFailed      = "failed"
+	StateCancelled   = "cancelled"
+	StateInterrupted = "interrupted" // by shutdown; resumed on the next start
+)
+
+// Rotation triggers
+const (
+	TriggerKeyUpdate = "key_update"
+	TriggerControl   = "control"
+	TriggerResume    = "resume"
+)
+
+type Member struct {
+	Idx  int    `json:"idx"`
+	Name string `json:"name"`
+}
+
+type Group struct {
+	Name            string   `json:"name"`
+	ID              string   `json:"id"`
+	Epoch           uint64   `json:"epoch"`
+	PendingRotation bool     `json:"pendingRotation"`
+	Buckets         []string `json:"buckets"`
+	Members         []Member `json:"members,omitempty"`
+}
+
+type Rotation struct {
+	Group    string     `json:"group"`
+	Epoch    uint64     `json:"epoch"`
+	Trigger  string     `json:"trigger"`
+	MsgID    string     `json:"msgId,omitempty"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Total    int        `json:"total"`   // objects to rotate
+	Done     int        `json:"done"`    // objects rotated
+	Failed   int        `json:"failed"`  // objects that failed
+	Skipped  int        `json:"skipped"` // already rotated before a resume
+	Error    string     `json:"error,omitempty"`
+
+	// akeso layers left to the cloud function or encrypt-worker, as
+	// reported on the completion topic
+	Layers           int        `json:"layers,omitempty"`
+	LayersApplied    int        `json:"layersApplied,omitempty"`
+	LayersSuperseded int        `json:"layersSuperseded,omitempty"` // replaced before they were applied
+	LayersFailed     int        `json:"layersFailed,omitempty"`
+	LayersDone       *time.Time `json:"layersDone,omitempty"` // when the last layer was accounted for
+}
+
+// StartResult is the response to starting a rotation.  The rotation runs in
+// the background; follow it with Client.Rotation.
+type StartResult struct {
+	Group   string `json:"group"`
+	Epoch   uint64 `json:"epoch"`
+	Resumed bool   `json:"resumed"` // a pending rotation was resumed instead
+	MsgID   string `json:"msgId,omitempty"`
+}
+
+type StuckObject struct {
+	Bucket  string    `json:"bucket"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+// Error is the body of every non-2xx response
+type Error struct {
+	Error string `json:"error"`
+}
+
+// ErrNotFound is returned for a 404: an unknown group, or no rotation.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned for a 409: a rotation or key update is already
+// in progress.
+var ErrConflict = errors.New("conflict")
+
+// ParseAddress splits an address of the form unix:///PATH or
+// tcp://HOST:PORT.
+func ParseAddress(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("bad control address %q: expected unix:///PATH or tcp://HOST:PORT", address)
+	}
+	return network, addr, nil
+}
+
+// Client talks to akesod's control API
+type Client struct {
+	hc    *http.Client
+	base  string
+	token string
+}
+
+// NewClient returns a client for the API at address.  If token is not
+// empty it is sent as a bearer token.
+func NewClient(address, token string) (*Client, error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	base := "http://" + addr
+	tr := &http.Transport{}
+	if network == "unix" {
+		base = "http://akesod"
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}
+	}
+
+	return &Client{
+		hc:    &http.Client{Transport: tr, Timeout: time.Minute},
+		base:  base,
+		token: token,
+	}, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e Error
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", ErrNotFound, e.Error)
+		case http.StatusConflict:
+			return fmt.Errorf("%w: %s", ErrConflict, e.Error)
+		}
+		return errors.New(e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func groupPath(group string) string {
+	return "/v1/groups/" + url.PathEscape(group)
+}
+
+func (c *Client) Groups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := c.do(ctx, http.MethodGet, "/v1/groups", nil, &groups)
+	return groups, err
+}
+
+func (c *Client) Group(ctx context.Context, group string) (*Group, error) {
+	var g Group
+	if err := c.do(ctx, http.MethodGet, groupPath(group), nil, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// StartRotation has akesod update its own leaf key, publish the update,
+// and rotate the group's buckets to the new epoch.  If a rotation is
+// pending it is resumed instead.
+func (c *Client) StartRotation(ctx context.Context, group string) (*StartResult, error) {
+	var res StartResult
+	if err := c.do(ctx, http.MethodPost, groupPath(group)+"/rotations", struct{}{}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Rotation returns the group's running rotation, or else its last one
+func (c *Client) Rotation(ctx context.Context, group string) (*Rotation, error) {
+	var r Rotation
+	if err := c.do(ctx, http.MethodGet, groupPath(group)+"/rotation", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CancelRotation stops the group's running rotation after the objects in
+// flight.  The rotation stays pending and can be resumed with
+// StartRotation.
+func (c *Client) CancelRotation(ctx context.Context, group string) (*Rotation, error) {
+	var r Rotation
+	if err := c.do(ctx, http.MethodDelete, groupPath(group)+"/rotation", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Rotations returns the most recent rotations, oldest first.  An empty
+// group returns those of all groups.
+func (c *Client) Rotations(ctx context.Context, group string) ([]Rotation, error) {
+	path := "/v1/rotations"
+	if group != "" {
+		path += "?group=" + url.QueryEscape(group)
+	}
+	var rs []Rotation
+	err := c.do(ctx, http.MethodGet, path, nil, &rs)
+	return rs, err
+}
+
+// Stuck lists the group's objects that have had ongoing_reencryption=true
+// for longer than olderThan.
+func (c *Client) Stuck(ctx context.Context, group string, olderThan time.Duration) ([]StuckObject, error) {
+	path := groupPath(group) + "/stuck?older_than=" + url.QueryEscape(olderThan.String())
+	var objs []StuckObject
+	err := c.do(ctx, http.MethodGet, path, nil, &objs)
+	return objs, err
+}
@@ -0,0 +1,114 @@
+// Package dekwrap wraps the key of an akeso rotation, from which the DEK of
+// each object's new layer is derived, for the workers that apply the
+// layers: the encrypt-object cloud function or encrypt-worker.
+//
+// The key is sealed to the workers' X25519 key (ephemeral ECDH,
+// HKDF-SHA256 and AES-GCM), with the rotation's scope, its group, epoch and
+// bucket, as additional data.  The wrapped key thus travels in bucket
+// notifications and bus messages without revealing it to anyone who can
+// read them, and opens only for the rotation it was made for.
+//
+// The cloud function has its own copy of Unwrap; the two must agree.
+package dekwrap
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/secret"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// AttrWrappedKey is the message attribute holding the wrapped
+	// rotation key
+	AttrWrappedKey = "wrapped_rotation_key"
+	// AttrRotation is the message attribute holding the rotation's scope
+	AttrRotation = "akeso_rotation"
+
+	wrapLabel = "akeso dek wrap v1"
+	keySize   = 32 // X25519 public key
+)
+
+// Scope names one rotation of one bucket
+func Scope(group string, epoch uint64, bucket string) string {
+	return fmt.Sprintf("%s/%d/%s", group, epoch, bucket)
+}
+
+func wrappingKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(bytes.Clone(ephemeral), recipient...)
+	key := make([]byte, aesx.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(wrapLabel)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Wrap seals a rotation key to the workers' key for the rotation scope, and
+// returns it in base64
+func Wrap(rotationKey []byte, to *ecdh.PublicKey, scope string) (string, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := eph.ECDH(to)
+	if err != nil {
+		return "", err
+	}
+	defer secret.Zero(shared)
+	key, err := wrappingKey(shared, eph.PublicKey().Bytes(), to.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer secret.Zero(key)
+
+	nonce := aesx.GenerateRandomNonce()
+	ct := aesx.GcmEncrypt(bytes.Clone(rotationKey), []byte(scope), key, nonce)
+
+	var b bytes.Buffer
+	b.Write(eph.PublicKey().Bytes())
+	b.Write(nonce)
+	b.Write(ct)
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// Unwrap opens a rotation key wrapped by Wrap with the workers' private
+// key.  It fails if the key was wrapped for another scope.
+func Unwrap(wrapped string, priv *ecdh.PrivateKey, scope string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	if len(data) < keySize+aesx.NonceSize {
+		return nil, errors.New("wrapped key is too short")
+	}
+	ephData, nonce, ct := data[:keySize], data[keySize:keySize+aesx.NonceSize], data[keySize+aesx.NonceSize:]
+
+	eph, err := ecdh.X25519().NewPublicKey(ephData)
+	if err != nil {
+		return nil, fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(shared)
+	key, err := wrappingKey(shared, ephData, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(key)
+
+	rotationKey, err := aesx.GcmDecrypt(ct, []byte(scope), key, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap the key of rotation %s (wrong key or rotation?): %w", scope, err)
+	}
+	return rotationKey, nil
+}
@@ -0,0 +1,47 @@
+package dekwrap
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/secret/secrettest"
+)
+
+func TestUnwrap(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotationKey := aesx.GenerateRandomKey()
+	scope := Scope("team", 7, "bucket")
+
+	wrapped, err := Wrap(rotationKey, priv.PublicKey(), scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrettest.AssertNoLeak(t, wrapped, rotationKey)
+
+	got, err := Unwrap(wrapped, priv, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, rotationKey) {
+		t.Fatal("unwrapped a different key")
+	}
+
+	if _, err := Unwrap(wrapped, other, scope); err == nil {
+		t.Fatal("unwrapped with another key")
+	}
+	for _, s := range []string{Scope("team", 8, "bucket"), Scope("team", 7, "other"), Scope("other", 7, "bucket")} {
+		if _, err := Unwrap(wrapped, priv, s); err == nil {
+			t.Fatalf("unwrapped for rotation %s a key wrapped for %s", s, scope)
+		}
+	}
+}
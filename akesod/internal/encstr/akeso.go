@@ -2,22 +2,134 @@ package encstr
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"slices"
 	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/etclab/aes256"
 	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/secret"
 	"github.com/etclab/nestedaes"
+	"golang.org/x/crypto/hkdf"
 )
 
-func AkesoUpload(bkt *storage.BucketHandle, objectName string, fileData, key, dek []byte) error {
-	obj := bkt.Object(objectName)
+// FormatVersion is the version of the akeso object layout that this package
+// writes, recorded in the akeso_format metadata field.  Version 1 objects,
+// written before it was recorded, only say whether a layer is pending
+// (ongoing_reencryption); version 2 objects also record their newest
+// layer's ID (akeso_layer_id) and how many layers are applied to the data
+// (akeso_layers_applied).
+const FormatVersion = 2
+
+// MetaEpoch is the metadata field in which akesod records the epoch whose
+// key encrypts an akeso object's header
+const MetaEpoch = "akeso_epoch"
+
+// How often AkesoApplyLayer re-reads an object that changed while it was
+// applying a layer
+const maxApplyAttempts = 3
+
+// DeriveLayerKey derives the DEK of the layer a rotation adds to one object
+// from the rotation key and the object's identity with HKDF-SHA256.  Each
+// object thus gets its own layer key, and leaking it exposes no other
+// object, while one rotation key still covers the whole bucket.  The
+// generation is the object's when the layer is added to its header, which
+// the metadata update doesn't change.
+func DeriveLayerKey(rotationKey []byte, bucket, objectName string, generation int64) ([]byte, error) {
+	if len(rotationKey) != aes256.KeySize {
+		return nil, fmt.Errorf("rotation key has %d bytes, expected %d", len(rotationKey), aes256.KeySize)
+	}
+
+	// each string is length-prefixed, the generation a fixed 8 bytes
+	var info []byte
+	for _, s := range []string{"akeso-layer-key-v1", bucket, objectName} {
+		info = binary.BigEndian.AppendUint32(info, uint32(len(s)))
+		info = append(info, s...)
+	}
+	info = binary.BigEndian.AppendUint64(info, uint64(generation))
+
+	key := make([]byte, aes256.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, rotationKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LayerID identifies the layer a DEK adds to an object.  AkesoUpdate records
+// it in the object's akeso_layer_id metadata along with the header, and
+// AkesoApplyLayer only applies a DEK whose ID matches, so that each layer is
+// applied once and with its own DEK.
+func LayerID(dek []byte) string {
+	h := sha256.New()
+	h.Write([]byte("akeso-layer-id-v1"))
+	h.Write(dek)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// layersApplied returns how many of an object's numLayers layers are
+// applied to its data; the others are in the header only, waiting for the
+// cloud function.
+func layersApplied(metadata map[string]string, numLayers int) (int, error) {
+	v, ok := metadata["akeso_layers_applied"]
+	if !ok {
+		// objects written by an older akesod only say whether a layer
+		// is pending
+		if metadata["ongoing_reencryption"] == "true" {
+			return numLayers - 1, nil
+		}
+		return numLayers, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > numLayers {
+		return 0, fmt.Errorf("malformed akeso_layers_applied %q for %d layers", v, numLayers)
+	}
+	return n, nil
+}
+
+// unpackAkesoHeader checks that the object was written by the akeso
+// strategy and decrypts its header with key
+func unpackAkesoHeader(attrs *storage.ObjectAttrs, key []byte) (*nestedaes.Header, error) {
+	objectName := attrs.Name
+	strategy, ok := attrs.Metadata["akeso_strategy"]
+	if !ok {
+		return nil, fmt.Errorf("metadata for object %s does not have an akeso_strategy entry", objectName)
+	}
+	if strategy != "akeso" {
+		return nil, fmt.Errorf("expected metadata object %s to have akeso_strategy = akeso, but got %s", objectName, strategy)
+	}
+
+	akesoDEKsReceived, ok := attrs.Metadata["akeso_deks"]
+	if !ok {
+		return nil, fmt.Errorf("object %s does not have an akeso_deks metadata field", objectName)
+	}
+	akesoDEKsDecoded, err := base64.StdEncoding.DecodeString(akesoDEKsReceived)
+	if err != nil {
+		return nil, fmt.Errorf("object %s has a malformed akeso_deks metadata field", objectName)
+	}
+	akesoHeader, err := nestedaes.UnmarshalHeader(key, akesoDEKsDecoded)
+	if err != nil {
+		return nil, fmt.Errorf("error in unmarshalling akeso header for object %s: %w", objectName, err)
+	}
+	return akesoHeader, nil
+}
+
+func AkesoUpload(bkt *storage.BucketHandle, objectName string, fileData, key, dek []byte, ctx context.Context) error {
+	return akesoPut(ctx, bkt.Object(objectName), fileData, key, dek, nil)
+}
+
+func akesoPut(ctx context.Context, obj *storage.ObjectHandle, fileData, key, dek []byte, extra map[string]string) error {
 	if dek == nil {
 		dek = aes256.NewRandomKey()
+		defer secret.Zero(dek)
 	}
 
 	iv := aes256.NewRandomIV()
@@ -46,13 +158,16 @@ func AkesoUpload(bkt *storage.BucketHandle, objectName string, fileData, key, de
 	/*// For an object that does not yet exist, set the DoesNotExist precondition.
 	obj = obj.If(storage.Conditions{DoesNotExist: true})*/
 
-	metadata := map[string]string{
-		"akeso_strategy": "akeso",
-		"akeso_deks":     base64.StdEncoding.EncodeToString(hData),
-		"updated_by":     "akesod",
-		"akeso_iv":       base64.StdEncoding.EncodeToString(iv),
-	}
-	err = gcsx.PutObjectWithMetadata(obj, payload, metadata)
+	metadata := withMetadata(extra, map[string]string{
+		"akeso_strategy":       "akeso",
+		"akeso_deks":           base64.StdEncoding.EncodeToString(hData),
+		"updated_by":           "akesod",
+		"akeso_iv":             base64.StdEncoding.EncodeToString(iv),
+		"akeso_layer_id":       LayerID(dek),
+		"akeso_layers_applied": "1",
+		"akeso_format":         strconv.Itoa(FormatVersion),
+	})
+	err = gcsx.PutObjectWithMetadata(ctx, obj, payload, metadata)
 	if err != nil {
 		log.Println("Error: ", err.Error())
 		return fmt.Errorf("error in gcsx.PutObjectWithMetadata: %v", err)
@@ -60,13 +175,13 @@ func AkesoUpload(bkt *storage.BucketHandle, objectName string, fileData, key, de
 	return nil
 }
 
-func AkesoDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]byte, error) {
+func AkesoDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx context.Context) ([]byte, error) {
 	var err error
 
 	obj := bkt.Object(objectName)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("Error: ", err.Error())
 		return nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
@@ -75,44 +190,31 @@ func AkesoDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]
 	// Set the generation-match condition
 	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
 
-	// check and unpack metadata fields
-	strategy, ok := attrs.Metadata["akeso_strategy"]
-	if !ok {
-		log.Printf("metadata for object %s does not have an akeso_strategy entry", objectName)
-		return nil, fmt.Errorf("metadata for object %s does not have an akeso_strategy entry", objectName)
-	}
-	if strategy != "akeso" {
-		log.Printf("expected metadata object %s to have akeso_strategy = akeso, but got %s", objectName, strategy)
-		return nil, fmt.Errorf("expected metadata object %s to have akeso_strategy = akeso, but got %s", objectName, strategy)
-	}
-
-	akesoDEKsReceived, ok := attrs.Metadata["akeso_deks"]
-	if !ok {
-		log.Printf("object %s does not have an akeso_deks metadata field", objectName)
-		return nil, fmt.Errorf("object %s does not have an akeso_deks metadata field", objectName)
-	}
-	akesoDEKsDecoded, err := base64.StdEncoding.DecodeString(akesoDEKsReceived)
+	akesoHeader, err := unpackAkesoHeader(attrs, key)
 	if err != nil {
 		log.Println("Error: ", err.Error())
-		return nil, fmt.Errorf("object %s has a malformed akeso_deks metadata field", objectName)
+		return nil, err
 	}
-	akesoHeader, err := nestedaes.UnmarshalHeader(key, akesoDEKsDecoded)
+	defer secret.Zero(akesoHeader.DEKs...)
+
+	// layers still waiting for the cloud function aren't in the data yet
+	applied, err := layersApplied(attrs.Metadata, len(akesoHeader.DEKs))
 	if err != nil {
 		log.Println("Error: ", err.Error())
-		return nil, fmt.Errorf("error in unmarshalling akeso header for object %s: %w", objectName, err)
+		return nil, fmt.Errorf("object %s: %w", objectName, err)
 	}
 
 	// Download the raw data
-	data, err := gcsx.GetObject(obj)
+	data, err := gcsx.GetObjectChecked(ctx, obj, attrs)
 	if err != nil {
 		log.Println("Error: ", err.Error())
 		return nil, err
 	}
 
 	iv := aes256.CopyIV(akesoHeader.BaseIV)
-	aes256.AddIV(iv, len(akesoHeader.DEKs)-1) // fast-forward to largest IV
+	aes256.AddIV(iv, applied-1) // fast-forward to largest IV
 
-	i := len(akesoHeader.DEKs) - 1
+	i := applied - 1
 	for i > 0 {
 		dek := akesoHeader.DEKs[i]
 		aes256.DecryptCTR(dek, iv, data)
@@ -129,13 +231,35 @@ func AkesoDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]
 		return nil, err
 	}
 
+	if err := verifyPlaintextMAC(attrs, key, plaintext); err != nil {
+		log.Println("Error: ", err.Error())
+		return nil, err
+	}
+
 	return plaintext, nil
 }
 
-func AkesoUpdate(bkt *storage.BucketHandle, objectName string, max_reencryptions int, old_key, new_key []byte, dek []byte, ctx context.Context) error {
+// Removes the DEKs of the layers after the first n from h.  The header's
+// Size field counts its DEKs, so it shrinks with them.
+func dropLayers(h *nestedaes.Header, n int) {
+	h.Size -= uint32((len(h.DEKs) - n) * aes256.KeySize)
+	h.DEKs = slices.Clip(h.DEKs[:n])
+}
+
+// AkesoUpdate re-keys an object's header from old_key to new_key and adds a
+// layer, which the cloud function then applies to the data.  The layer's
+// DEK is derived from rotationKey with DeriveLayerKey.  Once the header
+// holds max_reencryptions DEKs, the object is re-encrypted from scratch
+// under that DEK instead.  Both writes are conditioned on the object's
+// generation and metageneration, and calling AkesoUpdate again with the
+// same keys is a no-op, so a rotation can be retried.  metadata, e.g. the
+// new epoch, is added to the object's.  AkesoUpdate reports whether it left
+// a layer for the cloud function to apply.
+func AkesoUpdate(bkt *storage.BucketHandle, objectName string, max_reencryptions int, old_key, new_key []byte, rotationKey []byte, metadata map[string]string, ctx context.Context) (bool, error) {
 	var err error
-	if dek == nil {
-		dek = aes256.NewRandomKey()
+	if rotationKey == nil {
+		rotationKey = aes256.NewRandomKey()
+		defer secret.Zero(rotationKey)
 	}
 
 	objectUpdateStart := time.Now()
@@ -143,76 +267,111 @@ func AkesoUpdate(bkt *storage.BucketHandle, objectName string, max_reencryptions
 	obj := bkt.Object(objectName)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("error: ", err.Error())
-		return fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+		return false, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
 	}
 
 	// Set the generation-match condition
-	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration})
 
-	// check and unpack metadata fields
-	strategy, ok := attrs.Metadata["akeso_strategy"]
-	if !ok {
-		log.Println("Error: ", err)
-		return fmt.Errorf("metadata for object %s does not have an akeso_strategy entry", objectName)
-	}
-	if strategy != "akeso" {
-		log.Println("Error: ", err)
-		return fmt.Errorf("expected metadata object %s to have akeso_strategy = akeso, but got %s", objectName, strategy)
+	dek, err := DeriveLayerKey(rotationKey, attrs.Bucket, objectName, attrs.Generation)
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return false, err
 	}
+	defer secret.Zero(dek)
 
-	akesoDEKsReceived, ok := attrs.Metadata["akeso_deks"]
-	if !ok {
-		log.Println("Error: ", err)
-		return fmt.Errorf("object %s does not have an akeso_deks metadata field", objectName)
+	headerKey := old_key
+	rekeyed := false
+	akesoHeader, err := unpackAkesoHeader(attrs, old_key)
+	if err != nil {
+		// this rotation may have got to the object before, e.g. before
+		// akesod was restarted
+		var rekeyedErr error
+		akesoHeader, rekeyedErr = unpackAkesoHeader(attrs, new_key)
+		if rekeyedErr != nil {
+			log.Println("error: ", err.Error())
+			return false, err
+		}
+		headerKey = new_key
+		rekeyed = true
 	}
-	akesoDEKsDecoded, err := base64.StdEncoding.DecodeString(akesoDEKsReceived)
+	defer secret.Zero(akesoHeader.DEKs...)
+
+	applied, err := layersApplied(attrs.Metadata, len(akesoHeader.DEKs))
 	if err != nil {
 		log.Println("error: ", err.Error())
-		return fmt.Errorf("object %s has a malformed akeso_deks metadata field", objectName)
+		return false, fmt.Errorf("object %s: %w", objectName, err)
+	}
+	pending := applied < len(akesoHeader.DEKs)
+
+	layerID := LayerID(dek)
+	rewrite := false
+	if rekeyed {
+		if !pending || attrs.Metadata["akeso_layer_id"] == layerID {
+			log.Printf("%s was already re-keyed by this rotation\n", objectName)
+			return pending, nil
+		}
+		// the pending layer's DEK was lost, e.g. with a restart.  Adding
+		// another layer would re-encrypt the header under new_key with
+		// the same nonce, so re-encrypt the object instead.
+		rewrite = true
+	} else if pending {
+		// a layer of an earlier rotation that was never applied; its
+		// DEK is replaced by this one.  dek is zeroed separately, so
+		// the dropped DEKs' slots must not be reused for it.
+		log.Printf("%s: dropping unapplied layer %s\n", objectName, attrs.Metadata["akeso_layer_id"])
+		dropLayers(akesoHeader, applied)
 	}
 
-	akesoHeader, err := nestedaes.UnmarshalHeader(old_key, akesoDEKsDecoded)
+	// the plaintext digest's key is sealed under the header's key
+	digest, err := resealPlaintextMACKey(attrs.Metadata, headerKey, new_key)
 	if err != nil {
 		log.Println("error: ", err.Error())
-		return fmt.Errorf("error in unmarshalling akeso header for object %s", objectName)
+		return false, fmt.Errorf("object %s: %w", objectName, err)
 	}
 
 	nonce := aes256.NewZeroNonce()
 
 	akesoHeader.AddDEK(dek)
 
-	if len(akesoHeader.DEKs) < max_reencryptions {
+	headerOnly := !rewrite && len(akesoHeader.DEKs) < max_reencryptions
+	if headerOnly {
 		// Only update the Header, so that Cloud Function does the actual update
 		hData, err := akesoHeader.Marshal(new_key)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error in nestedaes.Encrypt Header Marshalling: %w", err)
+			return false, fmt.Errorf("error in nestedaes.Encrypt Header Marshalling: %w", err)
 		}
 		attrs.Metadata["akeso_deks"] = base64.StdEncoding.EncodeToString(hData)
 		attrs.Metadata["updated_by"] = "akesod-metadata-updater"
 		attrs.Metadata["ongoing_reencryption"] = "true"
 		attrs.Metadata["times_updated"] = strconv.Itoa(len(akesoHeader.DEKs))
+		attrs.Metadata["akeso_layer_id"] = layerID
+		attrs.Metadata["akeso_layers_applied"] = strconv.Itoa(applied)
+		attrs.Metadata["akeso_format"] = strconv.Itoa(FormatVersion)
+		maps.Copy(attrs.Metadata, digest)
+		maps.Copy(attrs.Metadata, metadata)
 
-		err = gcsx.UpdateObjectMetadata(obj, attrs.Metadata)
+		err = gcsx.UpdateObjectMetadata(ctx, obj, attrs.Metadata)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error in updating akeso header for object %s", objectName)
+			return false, fmt.Errorf("error in updating akeso header for object %s: %w", objectName, err)
 		}
 	} else {
-		decryptedReceivedData, err := AkesoDownload(bkt, objectName, old_key)
+		decryptedReceivedData, err := AkesoDownload(bkt, objectName, headerKey, ctx)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error decrypting object %s: %w", objectName, err)
+			return false, fmt.Errorf("error decrypting object %s: %w", objectName, err)
 		}
 
 		payload := aes256.EncryptGCM(dek, nonce, decryptedReceivedData, nil)
 		payload, tag, err := aes256.SplitCiphertextTag(payload)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error in nestedaes.Encrypt SplitCiphertextTag: %w", err)
+			return false, fmt.Errorf("error in nestedaes.Encrypt SplitCiphertextTag: %w", err)
 		}
 		iv := aes256.NewRandomIV()
 
@@ -220,28 +379,148 @@ func AkesoUpdate(bkt *storage.BucketHandle, objectName string, max_reencryptions
 		header, err := nestedaes.NewHeader(iv, tag, dek)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error in nestedaes.Encrypt Header: %w", err)
+			return false, fmt.Errorf("error in nestedaes.Encrypt Header: %w", err)
 		}
 
 		hData, err := header.Marshal(new_key)
 		if err != nil {
 			log.Println("error: ", err.Error())
-			return fmt.Errorf("error in nestedaes.Encrypt Header Marshalling: %w", err)
+			return false, fmt.Errorf("error in nestedaes.Encrypt Header Marshalling: %w", err)
 		}
 
-		metadata := map[string]string{
-			"akeso_strategy": "akeso",
-			"akeso_deks":     base64.StdEncoding.EncodeToString(hData),
-			"updated_by":     "akesod",
-			"akeso_iv":       base64.StdEncoding.EncodeToString(iv),
+		metadata := withMetadata(metadata, map[string]string{
+			"akeso_strategy":       "akeso",
+			"akeso_deks":           base64.StdEncoding.EncodeToString(hData),
+			"updated_by":           "akesod",
+			"akeso_iv":             base64.StdEncoding.EncodeToString(iv),
+			"akeso_layer_id":       layerID,
+			"akeso_layers_applied": "1",
+			"akeso_format":         strconv.Itoa(FormatVersion),
+		})
+		maps.Copy(metadata, digest)
+
+		err = gcsx.PutObjectWithMetadata(ctx, obj, payload, metadata)
+		if err != nil {
+			log.Println("error: ", err.Error())
+			return false, fmt.Errorf("error in gcsx.PutObjectWithMetadata: %w", err)
 		}
-
-		gcsx.PutObjectWithMetadata(obj, payload, metadata)
 	}
 
 	objectUpdateEnd := time.Now()
 	duration := objectUpdateEnd.Sub(objectUpdateStart)
 	fmt.Printf("%s took %v from %dns to %dns\n", objectName, duration, objectUpdateStart.UnixNano(), objectUpdateEnd.UnixNano())
 
-	return err
+	return headerOnly, nil
+}
+
+// Outcomes of AkesoApplyLayer
+const (
+	LayerApplied        = "applied"
+	LayerAlreadyApplied = "already_applied"
+	LayerNotPending     = "not_pending"
+)
+
+// AkesoApplyLayer adds the CTR layer of rotationKey to an object whose
+// header was already updated by AkesoUpdate.  This is what the encrypt-object cloud
+// function does; it is used by the local encrypt-worker when akesod runs
+// without Google Cloud.
+//
+// The layer is applied only if it is the object's pending layer
+// (akeso_layer_id is the LayerID of the object's layer key); events for a layer that was already
+// applied or replaced are ignored, so redelivered events are harmless.  If
+// the object changes while the layer is applied, the write fails on its
+// generation condition, and the object is read again.  AkesoApplyLayer
+// returns LayerApplied, LayerAlreadyApplied or LayerNotPending.
+func AkesoApplyLayer(bkt *storage.BucketHandle, objectName string, rotationKey []byte, ctx context.Context) (string, error) {
+	objectUpdateStart := time.Now()
+
+	obj := bkt.Object(objectName)
+
+	var err error
+	for attempt := 1; attempt <= maxApplyAttempts; attempt++ {
+		var result string
+		result, err = applyLayer(ctx, obj, objectName, rotationKey)
+		if err == nil {
+			if result == LayerApplied {
+				duration := time.Since(objectUpdateStart)
+				log.Printf("[ENC] %s took %v from %dns to %dns\n", objectName, duration, objectUpdateStart.UnixNano(), objectUpdateStart.Add(duration).UnixNano())
+			}
+			return result, nil
+		}
+		if !gcsx.IsPreconditionFailed(err) {
+			return "", err
+		}
+		log.Printf("%s changed while applying its layer (attempt %d of %d)\n", objectName, attempt, maxApplyAttempts)
+	}
+	return "", err
+}
+
+// applyLayer makes one attempt of AkesoApplyLayer
+func applyLayer(ctx context.Context, obj *storage.ObjectHandle, objectName string, rotationKey []byte) (string, error) {
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return "", fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+	}
+
+	dek, err := DeriveLayerKey(rotationKey, attrs.Bucket, objectName, attrs.Generation)
+	if err != nil {
+		return "", err
+	}
+	defer secret.Zero(dek)
+	layerID := LayerID(dek)
+
+	if attrs.Metadata["akeso_layer_id"] != layerID {
+		log.Printf("%s: layer %s is not the object's newest layer; ignoring it.\n", objectName, layerID)
+		return LayerNotPending, nil
+	}
+
+	numLayers := 1
+	if v, ok := attrs.Metadata["times_updated"]; ok {
+		numLayers, err = strconv.Atoi(v)
+		if err != nil || numLayers < 1 {
+			return "", fmt.Errorf("object %s has a malformed times_updated metadata field", objectName)
+		}
+	}
+	applied, err := layersApplied(attrs.Metadata, numLayers)
+	if err != nil {
+		return "", fmt.Errorf("object %s: %w", objectName, err)
+	}
+	if applied == numLayers {
+		log.Printf("%s: layer %s was already applied.\n", objectName, layerID)
+		return LayerAlreadyApplied, nil
+	}
+	if applied != numLayers-1 {
+		return "", fmt.Errorf("object %s has %d of %d layers applied; only the last one can be", objectName, applied, numLayers)
+	}
+
+	baseIV, err := base64.StdEncoding.DecodeString(attrs.Metadata["akeso_iv"])
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return "", fmt.Errorf("object %s has a malformed akeso_iv metadata field", objectName)
+	}
+
+	// the object must not change between reading and writing it
+	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation, MetagenerationMatch: attrs.Metageneration})
+
+	payload, err := gcsx.GetObjectChecked(ctx, obj, attrs)
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return "", fmt.Errorf("error in getting object %s: %w", objectName, err)
+	}
+
+	iv := aes256.CopyIV(baseIV)
+	aes256.AddIV(iv, numLayers-1)
+
+	metadata := attrs.Metadata
+	metadata["updated_by"] = "cloud-function"
+	metadata["ongoing_reencryption"] = "false"
+	metadata["akeso_layers_applied"] = strconv.Itoa(numLayers)
+
+	err = gcsx.PutObjectWithMetadata(ctx, obj, aes256.EncryptCTR(dek, iv, payload), metadata)
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return "", fmt.Errorf("error in gcsx.PutObjectWithMetadata: %w", err)
+	}
+	return LayerApplied, nil
 }
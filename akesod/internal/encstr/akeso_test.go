@@ -0,0 +1,141 @@
+package encstr
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/gcsx/gcsxtest"
+	"github.com/etclab/nestedaes"
+)
+
+func TestDeriveLayerKey(t *testing.T) {
+	rotationKey := aes256.NewRandomKey()
+	key, err := DeriveLayerKey(rotationKey, "bucket", "a/b", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DeriveLayerKey(rotationKey, "bucket", "a/b", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Fatal("the same object got different layer keys")
+	}
+	if bytes.Equal(key, rotationKey) {
+		t.Fatal("the layer key is the rotation key")
+	}
+
+	others := []struct {
+		rotationKey []byte
+		bucket      string
+		object      string
+		generation  int64
+	}{
+		{aes256.NewRandomKey(), "bucket", "a/b", 7},
+		{rotationKey, "bucket2", "a/b", 7},
+		{rotationKey, "bucket", "a/c", 7},
+		{rotationKey, "bucket", "a/b", 8},
+		// the fields can't run into each other
+		{rotationKey, "bucketa", "/b", 7},
+	}
+	for _, o := range others {
+		other, err := DeriveLayerKey(o.rotationKey, o.bucket, o.object, o.generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(other, key) {
+			t.Errorf("%s/%s#%d got the layer key of bucket/a/b#7", o.bucket, o.object, o.generation)
+		}
+	}
+
+	if _, err := DeriveLayerKey(rotationKey[:16], "bucket", "a/b", 7); err == nil {
+		t.Error("derived a layer key from a short rotation key")
+	}
+}
+
+func TestDropLayers(t *testing.T) {
+	key := aes256.NewRandomKey()
+	h, err := nestedaes.NewHeader(aes256.NewRandomIV(), make([]byte, aes256.TagSize), aes256.NewRandomKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AddDEK(aes256.NewRandomKey())
+	h.AddDEK(aes256.NewRandomKey())
+
+	dropLayers(h, 1)
+	replacement := aes256.NewRandomKey()
+	h.AddDEK(replacement)
+	data, err := h.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := nestedaes.UnmarshalHeader(key, data)
+	if err != nil {
+		t.Fatalf("unmarshalling a header with a dropped layer: %v", err)
+	}
+	if len(got.DEKs) != 2 || !bytes.Equal(got.DEKs[0], h.DEKs[0]) || !bytes.Equal(got.DEKs[1], replacement) {
+		t.Errorf("got %d DEKs; expected the first and the replacement", len(got.DEKs))
+	}
+}
+
+// Rotations run against the fake GCS, with the layers applied as the cloud
+// function would, or left pending
+func TestAkesoUpdate(t *testing.T) {
+	ctx := context.Background()
+	bkt := gcsxtest.NewServer(t).Client(t).Bucket("bucket")
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+	keys := [][]byte{aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey()}
+	rotationKeys := [][]byte{nil, aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey()}
+
+	// update rotates the object from epoch i-1 to i, checking the result
+	update := func(t *testing.T, name string, i int, applyLayer bool) {
+		t.Helper()
+		pending, err := AkesoUpdate(bkt, name, 10, keys[i-1], keys[i], rotationKeys[i], nil, ctx)
+		if err != nil {
+			t.Fatalf("epoch %d: %v", i, err)
+		}
+		if !pending {
+			t.Fatalf("epoch %d: no layer left to apply", i)
+		}
+		// the same rotation again changes nothing
+		if pending, err := AkesoUpdate(bkt, name, 10, keys[i-1], keys[i], rotationKeys[i], nil, ctx); err != nil || !pending {
+			t.Fatalf("epoch %d again: %t, %v", i, pending, err)
+		}
+		if applyLayer {
+			if result, err := AkesoApplyLayer(bkt, name, rotationKeys[i], ctx); err != nil || result != LayerApplied {
+				t.Fatalf("applying the layer of epoch %d: %s, %v", i, result, err)
+			}
+		}
+		got, err := AkesoDownload(bkt, name, keys[i], ctx)
+		if err != nil {
+			t.Fatalf("downloading after epoch %d: %v", i, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("downloaded %q after epoch %d", got, i)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		applied []bool // by epoch, from 1
+	}{
+		{"applied", []bool{true, true, true}},
+		{"pending", []bool{false, false, false}},
+		{"pending then applied", []bool{false, true, true}},
+		{"applied then pending", []bool{true, false, true}},
+	} {
+		if err := AkesoUpload(bkt, tt.name, plaintext, keys[0], nil, ctx); err != nil {
+			t.Fatal(err)
+		}
+		for i, apply := range tt.applied {
+			update(t, tt.name, i+1, apply)
+		}
+	}
+
+	// a layer of an earlier rotation can't be applied once dropped
+	if result, err := AkesoApplyLayer(bkt, "pending", rotationKeys[2], ctx); err != nil || result != LayerNotPending {
+		t.Errorf("applying a dropped layer: %s, %v", result, err)
+	}
+}
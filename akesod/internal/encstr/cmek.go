@@ -8,25 +8,30 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/gcsx"
 )
 
 // uploadWithKMSKey writes an object using Cloud KMS encryption.
 func CmekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte, ctx context.Context) error {
-	keyName := string(key)
+	return cmekPut(ctx, bkt.Object(objectName), fileData, key, nil)
+}
 
-	obj := bkt.Object(objectName)
+func cmekPut(ctx context.Context, obj *storage.ObjectHandle, fileData, key []byte, extra map[string]string) error {
+	keyName := string(key)
 
 	/*// For an object that does not yet exist, set the DoesNotExist precondition.
 	obj = obj.If(storage.Conditions{DoesNotExist: true})*/
 
 	// Set the metadata fields
-	metadata := map[string]string{
+	metadata := withMetadata(extra, map[string]string{
 		"akeso_strategy": "cmek",
-	}
+	})
 	// Encrypt the object's contents.
 	wc := obj.NewWriter(ctx)
 	wc.KMSKeyName = keyName
 	wc.Metadata = metadata
+	wc.CRC32C = gcsx.CRC32C(fileData)
+	wc.SendCRC32C = true
 	if _, err := wc.Write(fileData); err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("Writer.Write: %w", err)
@@ -39,6 +44,23 @@ func CmekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []by
 }
 
 func CmekDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx context.Context) ([]byte, error) {
+	reader, err := cmekOpen(ctx, bkt, objectName, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Read the object's contents
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		log.Println("Error: ", err)
+		return nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+
+	return data, nil
+}
+
+func cmekOpen(ctx context.Context, bkt *storage.BucketHandle, objectName string, key []byte) (io.ReadCloser, error) {
 	obj := bkt.Object(objectName)
 
 	// Get the object's metadata
@@ -57,21 +79,18 @@ func CmekDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx
 	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
 
 	// Open the object for reading
-	reader, err := obj.NewReader(ctx)
+	reader, err := gcsx.OpenObject(ctx, obj)
 	if err != nil {
 		log.Println("Error: ", err)
 		return nil, fmt.Errorf("Object(%q).NewReader: %w", objectName, err)
 	}
-	defer reader.Close()
 
-	// Read the object's contents
-	data, err := io.ReadAll(reader)
+	c, err := newCheckedReader(reader, attrs, key)
 	if err != nil {
 		log.Println("Error: ", err)
-		return nil, fmt.Errorf("io.ReadAll: %w", err)
+		return nil, err
 	}
-
-	return data, nil
+	return c, nil
 }
 
 func UpdateCMEKKey(bkt *storage.BucketHandle, objectName string, oldKey, newKey []byte, ctx context.Context) error {
@@ -80,7 +99,7 @@ func UpdateCMEKKey(bkt *storage.BucketHandle, objectName string, oldKey, newKey
 	obj := bkt.Object(objectName)
 
 	// Open the object for reading
-	reader, err := obj.NewReader(ctx)
+	reader, err := gcsx.OpenObject(ctx, obj)
 	if err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("Object(%q).NewReader: %w", objectName, err)
@@ -108,6 +127,10 @@ func UpdateCMEKKey(bkt *storage.BucketHandle, objectName string, oldKey, newKey
 		log.Println("Error: ", err)
 		return fmt.Errorf("io.ReadAll: %w", err)
 	}
+	if err := gcsx.CheckCRC32C(objectName, gcsx.CRC32C(data), attrs.CRC32C); err != nil {
+		log.Println("Error: ", err)
+		return err
+	}
 
 	// Set the metadata fields
 	metadata := map[string]string{
@@ -117,6 +140,10 @@ func UpdateCMEKKey(bkt *storage.BucketHandle, objectName string, oldKey, newKey
 	wc := obj.NewWriter(ctx)
 	wc.KMSKeyName = string(newKey)
 	wc.Metadata = metadata
+	// the data is written back as stored
+	wc.ContentEncoding = attrs.ContentEncoding
+	wc.CRC32C = gcsx.CRC32C(data)
+	wc.SendCRC32C = true
 	if _, err := wc.Write(data); err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("Writer.Write: %w", err)
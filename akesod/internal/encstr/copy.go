@@ -0,0 +1,160 @@
+package encstr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/secret"
+)
+
+// Metadata fields that the strategies, akesod and the cloud function write,
+// besides those starting with akeso_
+var strategyMetadata = map[string]bool{
+	"times_updated":        true,
+	"ongoing_reencryption": true,
+	"updated_by":           true,
+}
+
+// UserMetadata returns the fields of an object's metadata that aren't the
+// strategy's: those a copy under another strategy or key keeps
+func UserMetadata(metadata map[string]string) map[string]string {
+	user := make(map[string]string)
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, "akeso_") && !strategyMetadata[k] {
+			user[k] = v
+		}
+	}
+	return user
+}
+
+// CopyEnd is one end of Copy: an object, and the strategy and key it is,
+// or is to be, encrypted with
+type CopyEnd struct {
+	Bucket   *storage.BucketHandle
+	Name     string
+	Strategy string
+	Key      []byte
+}
+
+// CanRewrite reports whether a copy from src to dst can be made by GCS
+// alone: if both ends are encrypted by GCS, with a customer-supplied or KMS
+// key, or if the encryption stays the same, ciphertext and metadata alike.
+func CanRewrite(src, dst *CopyEnd) bool {
+	return (Streams(src.Strategy) && Streams(dst.Strategy)) ||
+		(src.Strategy == dst.Strategy && bytes.Equal(src.Key, dst.Key))
+}
+
+// Copy copies the object in attrs, at src, to dst.  If CanRewrite, GCS
+// rewrites it on the server, and the copy keeps all the object's metadata
+// unless the strategy or key changes.  Otherwise it is decrypted and
+// encrypted again, which for the AES-GCM strategies holds it in memory.
+// Either way the copy keeps the object's user metadata and content
+// headers, and its plaintext digest, with the digest key sealed under the
+// copy's key.  A re-encrypted copy of an object without a digest gets a
+// new one, unless it is cmek, which has no key to seal it under.
+func Copy(ctx context.Context, attrs *storage.ObjectAttrs, src, dst *CopyEnd) error {
+	if CanRewrite(src, dst) {
+		return rewrite(ctx, attrs, src, dst)
+	}
+
+	plaintext, err := Download(ctx, src.Bucket, src.Name, src.Strategy, src.Key)
+	if err != nil {
+		return err
+	}
+	metadata := UserMetadata(attrs.Metadata)
+	if dst.Strategy != "cmek" {
+		var macKey []byte
+		if attrs.Metadata[MetaPlaintextMAC] != "" {
+			// the download checked the digest, so its key opens
+			if macKey, err = OpenPlaintextMACKey(attrs.Metadata, src.Key); err != nil {
+				return fmt.Errorf("copy of %s: %w", src.Name, err)
+			}
+			defer secret.Zero(macKey)
+		}
+		maps.Copy(metadata, PlaintextDigest(dst.Key, macKey, plaintext))
+	}
+	if err := Upload(ctx, dst.Bucket, dst.Name, dst.Strategy, plaintext, dst.Key, metadata); err != nil {
+		return err
+	}
+
+	// the strategies only write the metadata
+	headers, ok := contentHeaders(attrs)
+	if !ok {
+		return nil
+	}
+	if _, err := dst.Bucket.Object(dst.Name).Update(ctx, headers); err != nil {
+		log.Println("error: ", err.Error())
+		return fmt.Errorf("setting the content headers of %s: %w", dst.Name, err)
+	}
+	return nil
+}
+
+func rewrite(ctx context.Context, attrs *storage.ObjectAttrs, src, dst *CopyEnd) error {
+	srcObj := src.Bucket.Object(src.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	if src.Strategy == "csek" {
+		srcObj = srcObj.Key(src.Key)
+	}
+	dstObj := dst.Bucket.Object(dst.Name)
+	if dst.Strategy == "csek" {
+		dstObj = dstObj.Key(dst.Key)
+	}
+
+	c := dstObj.CopierFrom(srcObj)
+	if dst.Strategy == "cmek" {
+		c.DestinationKMSKeyName = string(dst.Key)
+	}
+	// GCS copies the metadata as is unless it is given; the digest key
+	// must be sealed under the copy's key, and a cmek copy has none
+	if src.Strategy != dst.Strategy || !bytes.Equal(src.Key, dst.Key) {
+		metadata := withMetadata(UserMetadata(attrs.Metadata), map[string]string{
+			"akeso_strategy": dst.Strategy,
+		})
+		if src.Strategy != "cmek" && dst.Strategy != "cmek" {
+			digest, err := resealPlaintextMACKey(attrs.Metadata, src.Key, dst.Key)
+			if err != nil {
+				return fmt.Errorf("copy of %s: %w", src.Name, err)
+			}
+			maps.Copy(metadata, digest)
+		}
+		c.ObjectAttrs = storage.ObjectAttrs{
+			ContentType:        attrs.ContentType,
+			ContentLanguage:    attrs.ContentLanguage,
+			ContentDisposition: attrs.ContentDisposition,
+			CacheControl:       attrs.CacheControl,
+			Metadata:           metadata,
+		}
+	}
+
+	if _, err := c.Run(ctx); err != nil {
+		log.Println("error: ", err.Error())
+		return fmt.Errorf("rewriting %s to %s: %w", src.Name, dst.Name, err)
+	}
+	return nil
+}
+
+// The content headers of attrs that a copy keeps, those that describe the
+// plaintext.  Content-Encoding is left out: it would apply to the
+// ciphertext.  Reports whether there are any.
+func contentHeaders(attrs *storage.ObjectAttrs) (storage.ObjectAttrsToUpdate, bool) {
+	var update storage.ObjectAttrsToUpdate
+	if attrs.ContentType != "" {
+		update.ContentType = attrs.ContentType
+	}
+	if attrs.ContentLanguage != "" {
+		update.ContentLanguage = attrs.ContentLanguage
+	}
+	if attrs.ContentDisposition != "" {
+		update.ContentDisposition = attrs.ContentDisposition
+	}
+	if attrs.CacheControl != "" {
+		update.CacheControl = attrs.CacheControl
+	}
+	ok := attrs.ContentType != "" || attrs.ContentLanguage != "" ||
+		attrs.ContentDisposition != "" || attrs.CacheControl != ""
+	return update, ok
+}
@@ -0,0 +1,43 @@
+package encstr
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestUserMetadata(t *testing.T) {
+	metadata := map[string]string{
+		"owner":                "bob",
+		"akeso_strategy":       "akeso",
+		"akeso_deks":           "x",
+		MetaPlaintextMAC:       "y",
+		"times_updated":        "3",
+		"ongoing_reencryption": "false",
+		"updated_by":           "akesod",
+	}
+	expected := map[string]string{"owner": "bob"}
+	if got := UserMetadata(metadata); !maps.Equal(got, expected) {
+		t.Errorf("got %v; expected %v", got, expected)
+	}
+}
+
+func TestCanRewrite(t *testing.T) {
+	k1 := []byte("key one")
+	k2 := []byte("key two")
+	tests := []struct {
+		src, dst CopyEnd
+		expected bool
+	}{
+		{CopyEnd{Strategy: "akeso", Key: k1}, CopyEnd{Strategy: "akeso", Key: k1}, true},
+		{CopyEnd{Strategy: "akeso", Key: k1}, CopyEnd{Strategy: "akeso", Key: k2}, false},
+		{CopyEnd{Strategy: "strawman", Key: k1}, CopyEnd{Strategy: "keywrap", Key: k1}, false},
+		{CopyEnd{Strategy: "csek", Key: k1}, CopyEnd{Strategy: "csek", Key: k2}, true},
+		{CopyEnd{Strategy: "csek", Key: k1}, CopyEnd{Strategy: "cmek", Key: k2}, true},
+		{CopyEnd{Strategy: "cmek", Key: k1}, CopyEnd{Strategy: "akeso", Key: k1}, false},
+	}
+	for _, tt := range tests {
+		if got := CanRewrite(&tt.src, &tt.dst); got != tt.expected {
+			t.Errorf("%s to %s: got %t; expected %t", tt.src.Strategy, tt.dst.Strategy, got, tt.expected)
+		}
+	}
+}
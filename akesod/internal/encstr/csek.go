@@ -3,6 +3,7 @@ package encstr
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"time"
 
@@ -10,9 +11,11 @@ import (
 	"github.com/etclab/akesod/internal/gcsx"
 )
 
-func CsekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte) error {
-	obj := bkt.Object(objectName)
+func CsekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte, ctx context.Context) error {
+	return csekPut(ctx, bkt.Object(objectName), objectName, fileData, key, nil)
+}
 
+func csekPut(ctx context.Context, obj *storage.ObjectHandle, objectName string, fileData, key []byte, extra map[string]string) error {
 	// set the Customer-Supplied Encryption Key (CSEK, which is a KEK)
 	obj = obj.Key(key)
 
@@ -20,11 +23,11 @@ func CsekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []by
 	obj = obj.If(storage.Conditions{DoesNotExist: true})*/
 
 	// Set the metadata fields
-	metadata := map[string]string{
+	metadata := withMetadata(extra, map[string]string{
 		"akeso_strategy": "csek",
-	}
+	})
 
-	err := gcsx.PutObjectWithMetadata(obj, fileData, metadata)
+	err := gcsx.PutObjectWithMetadata(ctx, obj, fileData, metadata)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return fmt.Errorf("gcsx.PutObject(%s): %w", objectName, err)
@@ -33,7 +36,16 @@ func CsekUpload(bkt *storage.BucketHandle, objectName string, fileData, key []by
 	return nil
 }
 
-func CsekDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]byte, error) {
+func CsekDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx context.Context) ([]byte, error) {
+	r, err := csekOpen(ctx, bkt, objectName, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func csekOpen(ctx context.Context, bkt *storage.BucketHandle, objectName string, key []byte) (io.ReadCloser, error) {
 	var err error
 
 	obj := bkt.Object(objectName)
@@ -42,7 +54,7 @@ func CsekDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]b
 	obj = obj.Key(key)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
@@ -62,28 +74,25 @@ func CsekDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]b
 		return nil, fmt.Errorf("expected metadata object %s to have akeso_strategy = csek, but got %s", objectName, strategy)
 	}
 
-	// Download the raw data
-	data, err := gcsx.GetObject(obj)
+	// Open the raw data
+	r, err := gcsx.OpenObject(ctx, obj)
 	if err != nil {
 		log.Println("Error: ", err)
 		return nil, err
 	}
 
-	return data, nil
+	c, err := newCheckedReader(r, attrs, key)
+	if err != nil {
+		log.Println("Error: ", err)
+		return nil, err
+	}
+	return c, nil
 }
 
 // rotateEncryptionKey encrypts an object with the newKey.
-func RotateCSEKKey(bkt *storage.BucketHandle, objectName string, key, newKey []byte) error {
+func RotateCSEKKey(bkt *storage.BucketHandle, objectName string, key, newKey []byte, ctx context.Context) error {
 	objectUpdateStart := time.Now()
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Println("Error: ", err)
-		return fmt.Errorf("storage.NewClient: %w", err)
-	}
-	defer client.Close()
-
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
@@ -97,10 +106,29 @@ func RotateCSEKKey(bkt *storage.BucketHandle, objectName string, key, newKey []b
 	}
 	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
 
-	_, err = obj.Key(newKey).CopierFrom(obj.Key(key)).Run(ctx)
+	c := obj.Key(newKey).CopierFrom(obj.Key(key))
+
+	// GCS copies the metadata as is unless it is given, and the plaintext
+	// digest's key must be sealed under newKey
+	digest, err := resealPlaintextMACKey(attrs.Metadata, key, newKey)
+	if err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("object %s: %w", objectName, err)
+	}
+	if digest != nil {
+		c.ObjectAttrs = storage.ObjectAttrs{
+			ContentType:        attrs.ContentType,
+			ContentLanguage:    attrs.ContentLanguage,
+			ContentDisposition: attrs.ContentDisposition,
+			CacheControl:       attrs.CacheControl,
+			Metadata:           withMetadata(attrs.Metadata, digest),
+		}
+	}
+
+	_, err = c.Run(ctx)
 	if err != nil {
 		log.Println("Error: ", err)
-		return fmt.Errorf("Key(%q).CopierFrom(%q).Run: %w", newKey, key, err)
+		return fmt.Errorf("rotating CSEK of %s: CopierFrom.Run: %w", objectName, err)
 	}
 	duration := time.Since(objectUpdateStart)
 	fmt.Printf("%s %v\n", objectName, duration)
@@ -0,0 +1,149 @@
+package encstr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/secret"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MetaPlaintextMAC is the metadata field holding an object's keyed
+// plaintext digest, as returned by PlaintextDigest
+const MetaPlaintextMAC = "akeso_plaintext_mac"
+
+// MetaPlaintextMACKey is the metadata field holding the key of an object's
+// plaintext digest, sealed under the object's key.  The digest key is the
+// object's own and doesn't rotate: key rotations seal it again under the
+// new key, so the digest stays valid.
+const MetaPlaintextMACKey = "akeso_plaintext_mac_key"
+
+// ErrPlaintextMAC is returned by downloads whose plaintext doesn't match
+// the object's digest
+var ErrPlaintextMAC = errors.New("plaintext doesn't match its digest")
+
+// ErrPlaintextMACKey is returned for an object with a plaintext digest
+// whose digest key doesn't open under the object's key: the digest was made
+// under another key, or its metadata was tampered with
+var ErrPlaintextMACKey = errors.New("plaintext digest key doesn't open under the object's key")
+
+// Returns the key that seals an object's digest key under key.  It is
+// derived with HKDF, so the digest key isn't sealed under key itself.
+func plaintextMACKEK(key []byte) []byte {
+	kek := make([]byte, aesx.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("akeso-plaintext-mac-wrap-v1")), kek); err != nil {
+		panic(err) // only fails past 255 blocks of output
+	}
+	return kek
+}
+
+// Seals macKey under key, for the MetaPlaintextMACKey metadata field: the
+// nonce followed by the ciphertext and tag
+func sealPlaintextMACKey(key, macKey []byte) string {
+	kek := plaintextMACKEK(key)
+	defer secret.Zero(kek)
+	nonce := aesx.GenerateRandomNonce()
+	sealed := aesx.GcmEncrypt(append([]byte(nil), macKey...), []byte(MetaPlaintextMACKey), kek, nonce)
+	return base64.StdEncoding.EncodeToString(append(nonce, sealed...))
+}
+
+// OpenPlaintextMACKey returns the digest key in an object's metadata,
+// opened under the object's key.  It fails with ErrPlaintextMACKey if
+// the metadata has no digest key, or it doesn't open under key.
+func OpenPlaintextMACKey(metadata map[string]string, key []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(metadata[MetaPlaintextMACKey])
+	if err != nil || len(sealed) != aesx.NonceSize+sha256.Size+aesx.TagSize {
+		return nil, ErrPlaintextMACKey
+	}
+	kek := plaintextMACKEK(key)
+	defer secret.Zero(kek)
+	macKey, err := aesx.GcmDecrypt(sealed[aesx.NonceSize:], []byte(MetaPlaintextMACKey), kek, sealed[:aesx.NonceSize])
+	if err != nil {
+		return nil, ErrPlaintextMACKey
+	}
+	return macKey, nil
+}
+
+// PlaintextMAC returns the encoded digest of data under macKey, for the
+// MetaPlaintextMAC metadata field
+func PlaintextMAC(macKey, data []byte) string {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PlaintextDigest returns the metadata fields of the digest of data, an
+// object's plaintext: the digest under macKey, and macKey sealed under
+// key, the object's key.  A nil macKey gets the object a fresh random
+// digest key; a copy passes the source's to keep its digest.
+func PlaintextDigest(key, macKey, data []byte) map[string]string {
+	if macKey == nil {
+		macKey = aesx.GenerateRandomKey()
+		defer secret.Zero(macKey)
+	}
+	return map[string]string{
+		MetaPlaintextMAC:    PlaintextMAC(macKey, data),
+		MetaPlaintextMACKey: sealPlaintextMACKey(key, macKey),
+	}
+}
+
+// Returns the digest fields of an object's metadata with the digest key
+// sealed again under newKey instead of oldKey, for a key rotation to
+// write.  Returns nil if the object has no digest.
+func resealPlaintextMACKey(metadata map[string]string, oldKey, newKey []byte) (map[string]string, error) {
+	if metadata[MetaPlaintextMAC] == "" {
+		return nil, nil
+	}
+	macKey, err := OpenPlaintextMACKey(metadata, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(macKey)
+	return map[string]string{
+		MetaPlaintextMAC:    metadata[MetaPlaintextMAC],
+		MetaPlaintextMACKey: sealPlaintextMACKey(newKey, macKey),
+	}, nil
+}
+
+// Returns a MAC to digest an object's plaintext with, or nil if the object
+// has no digest.  A digest whose key doesn't open under key, the object's
+// key, is an error rather than left unchecked.
+func plaintextMACOf(attrs *storage.ObjectAttrs, key []byte) (hash.Hash, error) {
+	if attrs.Metadata[MetaPlaintextMAC] == "" {
+		return nil, nil
+	}
+	macKey, err := OpenPlaintextMACKey(attrs.Metadata, key)
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %w", attrs.Name, err)
+	}
+	defer secret.Zero(macKey)
+	return hmac.New(sha256.New, macKey), nil
+}
+
+// Checks mac, which has digested an object's plaintext, against the digest
+// in the object's metadata
+func checkPlaintextMAC(attrs *storage.ObjectAttrs, mac hash.Hash) error {
+	want, err := base64.StdEncoding.DecodeString(attrs.Metadata[MetaPlaintextMAC])
+	if err != nil || !hmac.Equal(mac.Sum(nil), want) {
+		return fmt.Errorf("object %s: %w", attrs.Name, ErrPlaintextMAC)
+	}
+	return nil
+}
+
+// verifyPlaintextMAC checks plaintext, an object's data as decrypted under
+// key, against the object's digest, if it has one
+func verifyPlaintextMAC(attrs *storage.ObjectAttrs, key, plaintext []byte) error {
+	mac, err := plaintextMACOf(attrs, key)
+	if err != nil || mac == nil {
+		return err
+	}
+	mac.Write(plaintext)
+	return checkPlaintextMAC(attrs, mac)
+}
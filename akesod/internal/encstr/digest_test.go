@@ -0,0 +1,126 @@
+package encstr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/gcsx/gcsxtest"
+)
+
+func TestVerifyPlaintextMAC(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	plaintext := []byte("Call me Ishmael.")
+	digested := PlaintextDigest(key, nil, plaintext)
+	resealed, err := resealPlaintextMACKey(digested, key, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		metadata  map[string]string
+		key       []byte
+		plaintext []byte
+		err       error
+	}{
+		{"matches", digested, key, plaintext, nil},
+		{"corrupted", digested, key, []byte("Call me Ishmaal."), ErrPlaintextMAC},
+		{"another key", digested, otherKey, plaintext, ErrPlaintextMACKey},
+		{"resealed", resealed, otherKey, plaintext, nil},
+		{"resealed, old key", resealed, key, plaintext, ErrPlaintextMACKey},
+		{"no digest", nil, key, plaintext, nil},
+		{"no digest key", map[string]string{MetaPlaintextMAC: digested[MetaPlaintextMAC]}, key, plaintext, ErrPlaintextMACKey},
+		{"another object's digest key", map[string]string{
+			MetaPlaintextMAC:    digested[MetaPlaintextMAC],
+			MetaPlaintextMACKey: PlaintextDigest(key, nil, plaintext)[MetaPlaintextMACKey],
+		}, key, plaintext, ErrPlaintextMAC},
+	}
+	for _, tt := range tests {
+		attrs := &storage.ObjectAttrs{Name: "moby.txt", Metadata: tt.metadata}
+		if err := verifyPlaintextMAC(attrs, tt.key, tt.plaintext); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v; expected %v", tt.name, err, tt.err)
+		}
+	}
+
+	if m, err := resealPlaintextMACKey(nil, key, otherKey); m != nil || err != nil {
+		t.Errorf("resealing without a digest: got %v, %v", m, err)
+	}
+	if _, err := resealPlaintextMACKey(digested, otherKey, key); !errors.Is(err, ErrPlaintextMACKey) {
+		t.Errorf("resealing under the wrong key: got %v", err)
+	}
+}
+
+func TestRotationKeepsPlaintextMAC(t *testing.T) {
+	ctx := context.Background()
+	bkt := gcsxtest.NewServer(t).Client(t).Bucket("bucket")
+	plaintext := []byte("Call me Ishmael.")
+	keys := [][]byte{aes256.NewRandomKey(), aes256.NewRandomKey(), aes256.NewRandomKey()}
+
+	tests := []struct {
+		name     string
+		strategy string
+		update   func(name string, oldKey, newKey []byte) error
+	}{
+		{"strawman", "strawman", func(name string, oldKey, newKey []byte) error {
+			return StrawmanUpdate(bkt, name, oldKey, newKey, ctx)
+		}},
+		{"keywrap", "keywrap", func(name string, oldKey, newKey []byte) error {
+			return KeyWrapUpdate(bkt, name, oldKey, newKey, ctx)
+		}},
+		{"akeso", "akeso", func(name string, oldKey, newKey []byte) error {
+			_, err := AkesoUpdate(bkt, name, 10, oldKey, newKey, nil, nil, ctx)
+			return err
+		}},
+		// past max_reencryptions, the object is encrypted again
+		{"akeso rewritten", "akeso", func(name string, oldKey, newKey []byte) error {
+			_, err := AkesoUpdate(bkt, name, 1, oldKey, newKey, nil, nil, ctx)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		metadata := PlaintextDigest(keys[0], nil, plaintext)
+		metadata["owner"] = "ishmael"
+		if err := Upload(ctx, bkt, tt.name, tt.strategy, plaintext, keys[0], metadata); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < len(keys); i++ {
+			if err := tt.update(tt.name, keys[i-1], keys[i]); err != nil {
+				t.Fatalf("%s: rotation %d: %v", tt.name, i, err)
+			}
+		}
+
+		attrs, err := bkt.Object(tt.name).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Metadata[MetaPlaintextMAC] != metadata[MetaPlaintextMAC] {
+			t.Errorf("%s: the digest changed", tt.name)
+		}
+		if tt.strategy == "strawman" && attrs.Metadata["owner"] != "ishmael" {
+			t.Errorf("%s: the user metadata was lost: %v", tt.name, attrs.Metadata)
+		}
+		// the downloads check the digest
+		got, err := Download(ctx, bkt, tt.name, tt.strategy, keys[len(keys)-1])
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: downloaded %q, %v", tt.name, got, err)
+		}
+		if err := verifyPlaintextMAC(attrs, keys[len(keys)-1], []byte("Call me Ishmaal.")); !errors.Is(err, ErrPlaintextMAC) {
+			t.Errorf("%s: other plaintext: %v", tt.name, err)
+		}
+
+		// a digest whose key doesn't open fails the download
+		if _, err := bkt.Object(tt.name).Update(ctx, storage.ObjectAttrsToUpdate{
+			Metadata: map[string]string{MetaPlaintextMACKey: metadata[MetaPlaintextMACKey]},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Download(ctx, bkt, tt.name, tt.strategy, keys[len(keys)-1]); !errors.Is(err, ErrPlaintextMACKey) {
+			t.Errorf("%s: download with a stale digest key: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package encstr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/gcsx"
+)
+
+// ErrNoStrategy is returned by DetectStrategy for an object that carries no
+// sign of encryption, e.g. a plaintext upload with gsutil.
+var ErrNoStrategy = errors.New("object has no akeso_strategy metadata")
+
+// ErrBadMetadata is returned by DetectStrategy for an object whose
+// akeso_strategy metadata is unknown or lacks the fields its strategy needs.
+var ErrBadMetadata = errors.New("object has invalid akeso metadata")
+
+// The metadata fields each strategy needs besides akeso_strategy
+var strategyFields = map[string][]string{
+	"strawman": {"akeso_data_nonce", "akeso_data_tag"},
+	"keywrap":  {"akeso_data_nonce", "akeso_data_tag", "akeso_key_nonce", "akeso_wrapped_key"},
+	"akeso":    {"akeso_deks", "akeso_iv"},
+	"csek":     {},
+	"cmek":     {},
+}
+
+// DetectStrategy returns the strategy an object was encrypted with, from
+// its akeso_strategy metadata, or for objects written without it, from its
+// customer-supplied or KMS key.  It checks that the object has the metadata
+// the strategy needs.
+func DetectStrategy(attrs *storage.ObjectAttrs) (string, error) {
+	strategy, ok := attrs.Metadata["akeso_strategy"]
+	if !ok {
+		switch {
+		case attrs.CustomerKeySHA256 != "":
+			return "csek", nil
+		case attrs.KMSKeyName != "":
+			return "cmek", nil
+		}
+		return "", ErrNoStrategy
+	}
+
+	fields, ok := strategyFields[strategy]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown akeso_strategy %q", ErrBadMetadata, strategy)
+	}
+	for _, field := range fields {
+		if attrs.Metadata[field] == "" {
+			return "", fmt.Errorf("%w: akeso_strategy is %s but %s is missing", ErrBadMetadata, strategy, field)
+		}
+	}
+	switch {
+	case strategy == "csek" && attrs.CustomerKeySHA256 == "":
+		return "", fmt.Errorf("%w: akeso_strategy is csek but the object has no customer-supplied key", ErrBadMetadata)
+	case strategy == "cmek" && attrs.KMSKeyName == "":
+		return "", fmt.Errorf("%w: akeso_strategy is cmek but the object has no KMS key", ErrBadMetadata)
+	}
+	return strategy, nil
+}
+
+// EncryptInPlace replaces a plaintext object with its encryption under key
+// with strategy, which may not be cmek.  The object keeps its metadata, with
+// metadata added, and is only replaced if it is still the generation in
+// attrs.
+func EncryptInPlace(ctx context.Context, bkt *storage.BucketHandle, attrs *storage.ObjectAttrs, strategy string, key []byte, metadata map[string]string) error {
+	obj := bkt.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+
+	data, err := gcsx.GetObjectChecked(ctx, obj, attrs)
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return fmt.Errorf("error in getting object %s: %w", attrs.Name, err)
+	}
+	// the encrypted object holds the content, not a gzip encoding of it
+	r, err := gcsx.ContentReader(attrs, bytes.NewReader(data))
+	if err == nil {
+		data, err = io.ReadAll(r)
+	}
+	if err != nil {
+		log.Println("error: ", err.Error())
+		return fmt.Errorf("error in decompressing object %s: %w", attrs.Name, err)
+	}
+
+	if strategy == "cmek" {
+		return fmt.Errorf("can't encrypt object %s in place with the %s strategy", attrs.Name, strategy)
+	}
+	return put(ctx, obj, attrs.Name, strategy, data, key, withMetadata(attrs.Metadata, metadata))
+}
@@ -0,0 +1,118 @@
+package encstr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/gcsx/gcsxtest"
+)
+
+func TestDetectStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    storage.ObjectAttrs
+		strategy string
+		err      error
+	}{
+		{"plaintext", storage.ObjectAttrs{}, "", ErrNoStrategy},
+		{"other metadata", storage.ObjectAttrs{Metadata: map[string]string{"owner": "bob"}}, "", ErrNoStrategy},
+		{"akeso", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "akeso", "akeso_deks": "x", "akeso_iv": "y",
+		}}, "akeso", nil},
+		{"akeso without header", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "akeso", "akeso_iv": "y",
+		}}, "", ErrBadMetadata},
+		{"strawman", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "strawman", "akeso_data_nonce": "x", "akeso_data_tag": "y",
+		}}, "strawman", nil},
+		{"akeso with an empty header", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "akeso", "akeso_deks": "", "akeso_iv": "y",
+		}}, "", ErrBadMetadata},
+		{"strawman without tag", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "strawman", "akeso_data_nonce": "x",
+		}}, "", ErrBadMetadata},
+		{"keywrap", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "keywrap", "akeso_data_nonce": "x", "akeso_data_tag": "y", "akeso_key_nonce": "z", "akeso_wrapped_key": "w",
+		}}, "keywrap", nil},
+		{"keywrap without wrapped key", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "keywrap", "akeso_data_nonce": "x", "akeso_data_tag": "y", "akeso_key_nonce": "z",
+		}}, "", ErrBadMetadata},
+		{"unknown strategy", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": "rot13"}}, "", ErrBadMetadata},
+		{"empty strategy", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": ""}}, "", ErrBadMetadata},
+		{"strategy in the wrong case", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "Strawman", "akeso_data_nonce": "x", "akeso_data_tag": "y",
+		}}, "", ErrBadMetadata},
+		{"csek", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": "csek"}, CustomerKeySHA256: "h"}, "csek", nil},
+		{"csek without a key", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": "csek"}}, "", ErrBadMetadata},
+		{"cmek", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": "cmek"}, KMSKeyName: "projects/p/locations/l/keyRings/r/cryptoKeys/k"}, "cmek", nil},
+		{"cmek without a key", storage.ObjectAttrs{Metadata: map[string]string{"akeso_strategy": "cmek"}}, "", ErrBadMetadata},
+		{"customer key only", storage.ObjectAttrs{CustomerKeySHA256: "h"}, "csek", nil},
+		{"kms key only", storage.ObjectAttrs{KMSKeyName: "projects/p/locations/l/keyRings/r/cryptoKeys/k"}, "cmek", nil},
+		// the metadata names the strategy whatever key GCS also has
+		{"akeso under a bucket's kms key", storage.ObjectAttrs{Metadata: map[string]string{
+			"akeso_strategy": "akeso", "akeso_deks": "x", "akeso_iv": "y",
+		}, KMSKeyName: "projects/p/locations/l/keyRings/r/cryptoKeys/k"}, "akeso", nil},
+	}
+	for _, tt := range tests {
+		strategy, err := DetectStrategy(&tt.attrs)
+		if strategy != tt.strategy || !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %q, %v; expected %q, %v", tt.name, strategy, err, tt.strategy, tt.err)
+		}
+	}
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	ctx := context.Background()
+	srv := gcsxtest.NewServer(t)
+	bkt := srv.Client(t).Bucket("bucket")
+	key := aes256.NewRandomKey()
+	plaintext := bytes.Repeat([]byte("Call me Ishmael. "), 100)
+
+	// put writes a plaintext object around akesod, stored gzip-encoded if
+	// gzipped
+	put := func(name string, gzipped bool) *storage.ObjectAttrs {
+		t.Helper()
+		data := plaintext
+		w := bkt.Object(name).NewWriter(ctx)
+		if gzipped {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(plaintext)
+			zw.Close()
+			data = buf.Bytes()
+			w.ContentEncoding = "gzip"
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return w.Attrs()
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		attrs := put("moby.txt", gzipped)
+		if err := EncryptInPlace(ctx, bkt, attrs, "strawman", key, nil); err != nil {
+			t.Fatalf("gzipped %t: %v", gzipped, err)
+		}
+		got, err := Download(ctx, bkt, "moby.txt", "strawman", key)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("gzipped %t: downloaded %d bytes, %v", gzipped, len(got), err)
+		}
+	}
+
+	// the stored data is checked, whether or not it is compressed
+	for _, gzipped := range []bool{false, true} {
+		attrs := put("corrupt.txt", gzipped)
+		srv.Corrupt("bucket", "corrupt.txt", int(attrs.Size)/2)
+		if err := EncryptInPlace(ctx, bkt, attrs, "strawman", key, nil); err == nil {
+			t.Errorf("gzipped %t: encrypted corrupted data", gzipped)
+		}
+	}
+}
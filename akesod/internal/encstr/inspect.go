@@ -0,0 +1,343 @@
+package encstr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/aes256"
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/nestedaes"
+)
+
+// Report is what Inspect finds out about an object: its fields, decoded
+// from the strategy's metadata, in order, and the inconsistencies found.
+type Report struct {
+	Attrs    *storage.ObjectAttrs
+	Strategy string
+	Fields   []ReportField
+	Problems []string
+}
+
+type ReportField struct {
+	Name, Value string
+}
+
+func (r *Report) add(name, format string, args ...any) {
+	r.Fields = append(r.Fields, ReportField{name, fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Inspect decodes an object's strategy metadata and checks it for
+// consistency.  With key, the object's key (the KMS key name for cmek), it
+// also checks that the key opens the object's header or wrapped key.  With
+// verify, it also downloads and decrypts the object, and for akeso objects
+// finds out how many layers are really applied to the data.
+func Inspect(ctx context.Context, bkt *storage.BucketHandle, objectName string, key []byte, verify bool) (*Report, error) {
+	attrs, err := bkt.Object(objectName).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+	}
+
+	r := inspectAttrs(attrs, key)
+	if !verify || key == nil || r.Strategy == "" {
+		return r, nil
+	}
+	// the other strategies' downloads can't take malformed metadata
+	if r.Strategy != "akeso" && len(r.Problems) > 0 {
+		return r, nil
+	}
+
+	var plaintext []byte
+	obj := bkt.Object(objectName).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	switch r.Strategy {
+	case "akeso":
+		data, err := gcsx.GetObjectChecked(ctx, obj, attrs)
+		if errors.Is(err, gcsx.ErrChecksum) {
+			r.problem("%v", err)
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		plaintext = verifyAkeso(r, attrs, key, data)
+	case "strawman":
+		plaintext, err = StrawmanDownload(bkt, objectName, key, ctx)
+	case "keywrap":
+		plaintext, err = KeyWrapDownload(bkt, objectName, key, ctx)
+	case "csek":
+		plaintext, err = CsekDownload(bkt, objectName, key, ctx)
+	case "cmek":
+		plaintext, err = CmekDownload(bkt, objectName, key, ctx)
+	}
+	if err != nil {
+		r.problem("the object doesn't decrypt: %v", err)
+	}
+
+	if plaintext != nil && attrs.Metadata[MetaPlaintextMAC] != "" {
+		if err := verifyPlaintextMAC(attrs, key, plaintext); err != nil {
+			r.problem("%v", err)
+		} else {
+			r.add("plaintext digest", "matches")
+		}
+	}
+	return r, nil
+}
+
+// inspectAttrs is Inspect without the object's data
+func inspectAttrs(attrs *storage.ObjectAttrs, key []byte) *Report {
+	r := &Report{Attrs: attrs}
+	r.add("generation", "%d (metageneration %d)", attrs.Generation, attrs.Metageneration)
+	r.add("size", "%d", attrs.Size)
+
+	strategy, err := DetectStrategy(attrs)
+	if err != nil {
+		r.add("strategy", "none")
+		r.problem("%v", err)
+		return r
+	}
+	r.Strategy = strategy
+	r.add("strategy", "%s", strategy)
+
+	switch strategy {
+	case "akeso":
+		inspectAkeso(r, attrs, key)
+	case "strawman":
+		inspectNonce(r, attrs, "akeso_data_nonce")
+		inspectTag(r, attrs, "akeso_data_tag")
+	case "keywrap":
+		inspectNonce(r, attrs, "akeso_data_nonce")
+		inspectTag(r, attrs, "akeso_data_tag")
+		inspectWrappedKey(r, attrs, key)
+	case "csek":
+		r.add("customer key SHA-256", "%s", attrs.CustomerKeySHA256)
+		if key != nil {
+			sum := sha256.Sum256(key)
+			if base64.StdEncoding.EncodeToString(sum[:]) == attrs.CustomerKeySHA256 {
+				r.add("key", "matches")
+			} else {
+				r.problem("the object's customer-supplied key is not the given key")
+			}
+		}
+	case "cmek":
+		r.add("KMS key", "%s", attrs.KMSKeyName)
+		if key != nil && attrs.KMSKeyName != string(key) {
+			r.problem("the object is encrypted with KMS key %s, not %s", attrs.KMSKeyName, key)
+		}
+	}
+	if mac := attrs.Metadata[MetaPlaintextMAC]; mac != "" {
+		r.add("plaintext digest", "%s", mac)
+	}
+	return r
+}
+
+// The plaintext part of a marshalled nestedaes header: its size and base
+// IV.  The rest, the data tag and the DEKs, is sealed under the header KEK
+// with a tag of its own, so the number of layers follows from the size.
+const plainHeaderSize = 4 + aes256.IVSize
+
+func headerLayers(size int) int {
+	return (size - plainHeaderSize - 2*aes256.TagSize) / aes256.KeySize
+}
+
+func inspectAkeso(r *Report, attrs *storage.ObjectAttrs, key []byte) {
+	md := attrs.Metadata
+
+	version := 1
+	if v, ok := md["akeso_format"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > FormatVersion {
+			r.problem("unknown akeso_format %q", v)
+		} else {
+			version = n
+		}
+		r.add("format version", "%d", version)
+	} else {
+		if _, ok := md["akeso_layers_applied"]; ok {
+			version = 2
+		}
+		r.add("format version", "%d (not recorded)", version)
+	}
+
+	if epoch, ok := md[MetaEpoch]; ok {
+		r.add("header key epoch", "%s", epoch)
+	} else {
+		r.add("header key epoch", "unknown (written outside akesod's rotations)")
+	}
+
+	hData, err := base64.StdEncoding.DecodeString(md["akeso_deks"])
+	if err != nil {
+		r.problem("akeso_deks is not base64: %v", err)
+		return
+	}
+	if len(hData) < plainHeaderSize+2*aes256.TagSize+aes256.KeySize {
+		r.problem("the header is %d bytes, too short for a single layer", len(hData))
+		return
+	}
+	size := binary.BigEndian.Uint32(hData)
+	baseIV := hData[4:plainHeaderSize]
+	layers := headerLayers(len(hData))
+	r.add("header", "%d bytes", len(hData))
+	r.add("layers", "%d", layers)
+	r.add("base IV", "%s", hex.EncodeToString(baseIV))
+	if int(size) != len(hData) {
+		r.problem("the header's size field is %d but it is %d bytes", size, len(hData))
+	}
+	if (len(hData)-plainHeaderSize-2*aes256.TagSize)%aes256.KeySize != 0 {
+		r.problem("the header has a partial DEK")
+	}
+
+	if iv, err := base64.StdEncoding.DecodeString(md["akeso_iv"]); err != nil {
+		r.problem("akeso_iv is not base64: %v", err)
+	} else if !bytes.Equal(iv, baseIV) {
+		r.problem("akeso_iv %x is not the header's base IV", iv)
+	}
+
+	if v, ok := md["times_updated"]; ok {
+		r.add("times_updated", "%s", v)
+		if n, err := strconv.Atoi(v); err != nil || n != layers {
+			r.problem("times_updated is %s but the header has %d layers", v, layers)
+		}
+	}
+
+	applied, err := layersApplied(md, layers)
+	if err != nil {
+		r.problem("%v", err)
+	} else {
+		r.add("layers applied", "%d of %d", applied, layers)
+	}
+	if v, ok := md["ongoing_reencryption"]; ok {
+		r.add("ongoing_reencryption", "%s", v)
+		if err == nil && version >= 2 && (v == "true") != (applied < layers) {
+			r.problem("ongoing_reencryption is %s but %d of %d layers are applied", v, applied, layers)
+		}
+	}
+	if layerID, ok := md["akeso_layer_id"]; ok {
+		r.add("newest layer", "%s", layerID)
+	} else if version >= 2 {
+		r.problem("akeso_layer_id is missing")
+	}
+	if v, ok := md["updated_by"]; ok {
+		r.add("updated by", "%s", v)
+	}
+
+	if key == nil {
+		return
+	}
+	header, err := nestedaes.UnmarshalHeader(key, hData)
+	if err != nil {
+		r.problem("the header doesn't open with the given key (another epoch's key?): %v", err)
+		return
+	}
+	defer secret.Zero(header.DEKs...)
+	r.add("key", "opens the header")
+	if layerID, ok := md["akeso_layer_id"]; ok && LayerID(header.DEKs[len(header.DEKs)-1]) != layerID {
+		r.problem("akeso_layer_id %s is not the ID of the header's newest DEK", layerID)
+	}
+}
+
+// Decrypts an akeso object's data with the number of layers its metadata
+// says are applied, or failing that, finds the number that does.  Returns
+// the plaintext, or nil.
+func verifyAkeso(r *Report, attrs *storage.ObjectAttrs, key, data []byte) []byte {
+	hData, _ := base64.StdEncoding.DecodeString(attrs.Metadata["akeso_deks"])
+	header, err := nestedaes.UnmarshalHeader(key, hData)
+	if err != nil {
+		return nil // already reported
+	}
+	defer secret.Zero(header.DEKs...)
+
+	decrypt := func(applied int) ([]byte, error) {
+		buf := bytes.Clone(data)
+		iv := aes256.CopyIV(header.BaseIV)
+		aes256.AddIV(iv, applied-1)
+		for i := applied - 1; i > 0; i-- {
+			aes256.DecryptCTR(header.DEKs[i], iv, buf)
+			aes256.DecIV(iv)
+		}
+		buf = append(buf, header.DataTag...)
+		return aes256.DecryptGCM(header.DEKs[0], aes256.NewZeroNonce(), buf, nil)
+	}
+
+	recorded, err := layersApplied(attrs.Metadata, len(header.DEKs))
+	if err == nil {
+		if plaintext, err := decrypt(recorded); err == nil {
+			r.add("data", "decrypts with %d layers", recorded)
+			return plaintext
+		}
+	}
+	for applied := len(header.DEKs); applied >= 1; applied-- {
+		if applied == recorded {
+			continue
+		}
+		if plaintext, err := decrypt(applied); err == nil {
+			r.problem("the data has %d layers applied, but the metadata says %d", applied, recorded)
+			return plaintext
+		}
+	}
+	r.problem("the data doesn't decrypt with any number of the header's %d layers", len(header.DEKs))
+	return nil
+}
+
+func inspectNonce(r *Report, attrs *storage.ObjectAttrs, field string) {
+	nonce, err := base64.StdEncoding.DecodeString(attrs.Metadata[field])
+	switch {
+	case err != nil:
+		r.problem("%s is not base64: %v", field, err)
+	case len(nonce) != aesx.NonceSize:
+		r.problem("%s is %d bytes, not %d", field, len(nonce), aesx.NonceSize)
+	default:
+		r.add(field, "%x", nonce)
+	}
+}
+
+func inspectTag(r *Report, attrs *storage.ObjectAttrs, field string) {
+	tag, err := base64.StdEncoding.DecodeString(attrs.Metadata[field])
+	switch {
+	case err != nil:
+		r.problem("%s is not base64: %v", field, err)
+	case len(tag) != aes256.TagSize:
+		r.problem("%s is %d bytes, not %d", field, len(tag), aes256.TagSize)
+	default:
+		r.add(field, "%x", tag)
+	}
+}
+
+func inspectWrappedKey(r *Report, attrs *storage.ObjectAttrs, key []byte) {
+	inspectNonce(r, attrs, "akeso_key_nonce")
+	wrapped, err := base64.StdEncoding.DecodeString(attrs.Metadata["akeso_wrapped_key"])
+	if err != nil {
+		r.problem("akeso_wrapped_key is not base64: %v", err)
+		return
+	}
+	if len(wrapped) != aes256.KeySize+aes256.TagSize {
+		r.problem("akeso_wrapped_key is %d bytes, not %d", len(wrapped), aes256.KeySize+aes256.TagSize)
+		return
+	}
+	if key == nil {
+		return
+	}
+	nonce, err := base64.StdEncoding.DecodeString(attrs.Metadata["akeso_key_nonce"])
+	if err != nil || len(nonce) != aesx.NonceSize {
+		return // already reported
+	}
+	dataKey, err := aesx.GcmDecrypt(wrapped, nil, key, nonce)
+	if err != nil {
+		r.problem("the wrapped key doesn't open with the given key (another epoch's key?): %v", err)
+		return
+	}
+	secret.Zero(dataKey)
+	r.add("key", "opens the wrapped key")
+}
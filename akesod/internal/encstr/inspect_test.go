@@ -0,0 +1,99 @@
+package encstr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/aes256"
+	"github.com/etclab/nestedaes"
+)
+
+// Returns an akeso object's attributes and data with two layers, both
+// applied, as AkesoUpdate and AkesoApplyLayer leave them
+func akesoObject(t *testing.T, key, plaintext []byte) (*storage.ObjectAttrs, []byte) {
+	dek0, dek1 := aes256.NewRandomKey(), aes256.NewRandomKey()
+	iv := aes256.NewRandomIV()
+	data, tag, err := aes256.SplitCiphertextTag(aes256.EncryptGCM(dek0, aes256.NewZeroNonce(), plaintext, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := nestedaes.NewHeader(iv, tag, dek0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.AddDEK(dek1)
+	hData, err := header.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerIV := aes256.CopyIV(iv)
+	aes256.AddIV(layerIV, 1)
+	data = aes256.EncryptCTR(dek1, layerIV, data)
+
+	return &storage.ObjectAttrs{
+		Name:       "obj",
+		Generation: 1,
+		Metadata: map[string]string{
+			"akeso_strategy":       "akeso",
+			"akeso_deks":           base64.StdEncoding.EncodeToString(hData),
+			"akeso_iv":             base64.StdEncoding.EncodeToString(iv),
+			"akeso_layer_id":       LayerID(dek1),
+			"akeso_layers_applied": "2",
+			"akeso_format":         strconv.Itoa(FormatVersion),
+			"times_updated":        "2",
+			"ongoing_reencryption": "false",
+			MetaEpoch:              "4",
+		},
+	}, data
+}
+
+func field(r *Report, name string) string {
+	for _, f := range r.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func TestInspectAkeso(t *testing.T) {
+	key := aes256.NewRandomKey()
+	attrs, data := akesoObject(t, key, []byte("the plaintext"))
+
+	r := inspectAttrs(attrs, key)
+	if len(r.Problems) > 0 {
+		t.Fatalf("problems with a consistent object: %q", r.Problems)
+	}
+	if field(r, "layers") != "2" || field(r, "header key epoch") != "4" || field(r, "layers applied") != "2 of 2" {
+		t.Errorf("fields: %+v", r.Fields)
+	}
+	if plaintext := verifyAkeso(r, attrs, key, data); string(plaintext) != "the plaintext" || len(r.Problems) > 0 {
+		t.Errorf("verify: %q, %q", plaintext, r.Problems)
+	}
+
+	if r := inspectAttrs(attrs, aes256.NewRandomKey()); len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "doesn't open") {
+		t.Errorf("with the wrong key: %q", r.Problems)
+	}
+
+	// the metadata claims the worker's layer is still pending
+	attrs.Metadata["akeso_layers_applied"] = "1"
+	r = inspectAttrs(attrs, key)
+	if len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "ongoing_reencryption") {
+		t.Errorf("with a stale ongoing_reencryption: %q", r.Problems)
+	}
+	r = &Report{}
+	if plaintext := verifyAkeso(r, attrs, key, data); plaintext == nil || len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "has 2 layers applied") {
+		t.Errorf("verify with the wrong layer count: %q", r.Problems)
+	}
+
+	attrs.Metadata["times_updated"] = "3"
+	attrs.Metadata["akeso_iv"] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, aes256.IVSize))
+	if r := inspectAttrs(attrs, nil); len(r.Problems) != 3 {
+		t.Errorf("expected problems with times_updated, akeso_iv and ongoing_reencryption: %q", r.Problems)
+	}
+}
@@ -5,18 +5,25 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"maps"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/etclab/akesod/internal/aesx"
 	"github.com/etclab/akesod/internal/gcsx"
+	"github.com/etclab/akesod/internal/secret"
 )
 
 // key is a KEK, and nonce is the nonce for the key
-func KeyWrapUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte) error {
+func KeyWrapUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte, ctx context.Context) error {
+	return keyWrapPut(ctx, bkt.Object(objectName), objectName, fileData, key, nil)
+}
+
+func keyWrapPut(ctx context.Context, obj *storage.ObjectHandle, objectName string, fileData, key []byte, extra map[string]string) error {
 	// randomly generate a key nonece, data key, and data nonce
 	keyNonce := aesx.GenerateRandomNonce()
 	dataKey := aesx.GenerateRandomKey()
+	defer secret.Zero(dataKey)
 	dataNonce := aesx.GenerateRandomNonce()
 
 	// Encrypt the raw data
@@ -27,8 +34,6 @@ func KeyWrapUpload(bkt *storage.BucketHandle, objectName string, fileData, key [
 		return fmt.Errorf("aes256.SplitCiphertextTag failed for object %s: %w", objectName, err)
 	}
 
-	obj := bkt.Object(objectName)
-
 	/*// For an object that does not yet exist, set the DoesNotExist precondition.
 	obj = obj.If(storage.Conditions{DoesNotExist: true})*/
 
@@ -36,30 +41,30 @@ func KeyWrapUpload(bkt *storage.BucketHandle, objectName string, fileData, key [
 	wrappedKey := aesx.GcmEncrypt(dataKey, nil, key, keyNonce)
 
 	// Set the metadata fields
-	metadata := map[string]string{
+	metadata := withMetadata(extra, map[string]string{
 		"akeso_strategy":    "keywrap",
 		"akeso_data_nonce":  base64.StdEncoding.EncodeToString(dataNonce),
 		"akeso_data_tag":    base64.StdEncoding.EncodeToString(dataTag),
 		"akeso_key_nonce":   base64.StdEncoding.EncodeToString(keyNonce),
 		"akeso_wrapped_key": base64.StdEncoding.EncodeToString(wrappedKey),
-	}
+	})
 
-	err = gcsx.PutObjectWithMetadata(obj, ciphertext, metadata)
+	err = gcsx.PutObjectWithMetadata(ctx, obj, ciphertext, metadata)
 	if err != nil {
 		log.Println("error: ", err.Error())
-		return fmt.Errorf("gcsx.PutObjectWithMetadata(%s): %w", objectName, err)
+		return fmt.Errorf("gcsx.PutObjectWithMetadata(ctx, %s): %w", objectName, err)
 	}
 
 	return nil
 }
 
-func KeyWrapDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]byte, error) {
+func KeyWrapDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx context.Context) ([]byte, error) {
 	var err error
 
 	obj := bkt.Object(objectName)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
@@ -74,9 +79,10 @@ func KeyWrapDownload(bkt *storage.BucketHandle, objectName string, key []byte) (
 		log.Println("error: ", err.Error())
 		return nil, fmt.Errorf("can't unpack metadata for object %s: %w", objectName, err)
 	}
+	defer secret.Zero(dataKey)
 
 	// Download the raw data
-	data, err := gcsx.GetObject(obj)
+	data, err := gcsx.GetObjectChecked(ctx, obj, attrs)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return nil, err
@@ -90,6 +96,11 @@ func KeyWrapDownload(bkt *storage.BucketHandle, objectName string, key []byte) (
 		return nil, err
 	}
 
+	if err := verifyPlaintextMAC(attrs, key, data); err != nil {
+		log.Println("error: ", err.Error())
+		return nil, err
+	}
+
 	return data, nil
 }
 
@@ -157,13 +168,13 @@ func unpackMetadata(attrs *storage.ObjectAttrs, objectName string, key []byte) (
 	return dataKey, dataTag, dataNonce, keyNonce, nil
 }
 
-func KeyWrapUpdate(bkt *storage.BucketHandle, objectName string, old_key, new_key []byte) error {
+func KeyWrapUpdate(bkt *storage.BucketHandle, objectName string, old_key, new_key []byte, ctx context.Context) error {
 	objectUpdateStart := time.Now()
 
 	obj := bkt.Object(objectName)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
@@ -175,20 +186,28 @@ func KeyWrapUpdate(bkt *storage.BucketHandle, objectName string, old_key, new_ke
 		log.Println("Error: ", err)
 		return fmt.Errorf("can't unpack metadata for object %s: %w", objectName, err)
 	}
+	defer secret.Zero(dataKey)
+
+	digest, err := resealPlaintextMACKey(attrs.Metadata, old_key, new_key)
+	if err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("object %s: %w", objectName, err)
+	}
 
 	wrappedKey := aesx.GcmEncrypt(dataKey, nil, new_key, keyNonce)
 
 	// Set the metadata fields
 	metadata := attrs.Metadata
 	metadata["akeso_wrapped_key"] = base64.StdEncoding.EncodeToString(wrappedKey)
+	maps.Copy(metadata, digest)
 
 	// Set the generation-match condition
 	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
 
-	err = gcsx.UpdateObjectMetadata(obj, metadata)
+	err = gcsx.UpdateObjectMetadata(ctx, obj, metadata)
 	if err != nil {
 		log.Println("Error: ", err)
-		return fmt.Errorf("gcsx.UpdateObjectMetadata(%s): %w", objectName, err)
+		return fmt.Errorf("gcsx.UpdateObjectMetadata(ctx, %s): %w", objectName, err)
 	}
 
 	duration := time.Since(objectUpdateStart)
@@ -12,7 +12,11 @@ import (
 	"github.com/etclab/akesod/internal/gcsx"
 )
 
-func StrawmanUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte) error {
+func StrawmanUpload(bkt *storage.BucketHandle, objectName string, fileData, key []byte, ctx context.Context) error {
+	return strawmanPut(ctx, bkt.Object(objectName), objectName, fileData, key, nil)
+}
+
+func strawmanPut(ctx context.Context, obj *storage.ObjectHandle, objectName string, fileData, key []byte, extra map[string]string) error {
 	// randomly generate a data nonce
 	nonce := aesx.GenerateRandomNonce()
 
@@ -24,31 +28,28 @@ func StrawmanUpload(bkt *storage.BucketHandle, objectName string, fileData, key
 		return fmt.Errorf("aes256.SplitCiphertextTag failed for object %s: %w", objectName, err)
 	}
 
-	// Upload the encrypted data
-	obj := bkt.Object(objectName)
-
 	// Set the metadata fields
-	metadata := map[string]string{
+	metadata := withMetadata(extra, map[string]string{
 		"akeso_strategy":   "strawman",
 		"akeso_data_nonce": base64.StdEncoding.EncodeToString(nonce),
 		"akeso_data_tag":   base64.StdEncoding.EncodeToString(tag),
-	}
-	err = gcsx.PutObjectWithMetadata(obj, ciphertext, metadata)
+	})
+	err = gcsx.PutObjectWithMetadata(ctx, obj, ciphertext, metadata)
 	if err != nil {
 		log.Println("error: ", err.Error())
-		return fmt.Errorf("gcsx.PutObjectWithMetadata(%s): %w", objectName, err)
+		return fmt.Errorf("gcsx.PutObjectWithMetadata(ctx, %s): %w", objectName, err)
 	}
 
 	return nil
 }
 
-func StrawmanDownload(bkt *storage.BucketHandle, objectName string, key []byte) ([]byte, error) {
+func StrawmanDownload(bkt *storage.BucketHandle, objectName string, key []byte, ctx context.Context) ([]byte, error) {
 	var err error
 
 	obj := bkt.Object(objectName)
 
 	// Get the object's attributes
-	attrs, err := obj.Attrs(context.Background())
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		log.Println("error: ", err.Error())
 		return nil, fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
@@ -93,7 +94,7 @@ func StrawmanDownload(bkt *storage.BucketHandle, objectName string, key []byte)
 	}
 
 	// Download the raw data
-	data, err := gcsx.GetObject(obj)
+	data, err := gcsx.GetObjectChecked(ctx, obj, attrs)
 	if err != nil {
 		log.Println("Error: ", err)
 		return nil, err
@@ -107,19 +108,44 @@ func StrawmanDownload(bkt *storage.BucketHandle, objectName string, key []byte)
 		return nil, err
 	}
 
+	if err := verifyPlaintextMAC(attrs, key, data); err != nil {
+		log.Println("Error: ", err)
+		return nil, err
+	}
+
 	return data, nil
 }
 
-func StrawmanUpdate(bkt *storage.BucketHandle, objectName string, old_key, new_key []byte) error {
+func StrawmanUpdate(bkt *storage.BucketHandle, objectName string, old_key, new_key []byte, ctx context.Context) error {
 	objectUpdateStart := time.Now()
 
-	data, err := StrawmanDownload(bkt, objectName, old_key)
+	obj := bkt.Object(objectName)
+
+	// Get the object's attributes
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("can't get attributes for object %s: %w", objectName, err)
+	}
+
+	data, err := StrawmanDownload(bkt, objectName, old_key, ctx)
 	if err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("can't download using strawman for object %s: %w", objectName, err)
 	}
 
-	err = StrawmanUpload(bkt, objectName, data, new_key)
+	// The object keeps its user metadata and its plaintext digest
+	digest, err := resealPlaintextMACKey(attrs.Metadata, old_key, new_key)
+	if err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("object %s: %w", objectName, err)
+	}
+	metadata := withMetadata(UserMetadata(attrs.Metadata), digest)
+
+	// Set the generation-match condition, which the download read under
+	obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+
+	err = strawmanPut(ctx, obj, objectName, data, new_key, metadata)
 	if err != nil {
 		log.Println("Error: ", err)
 		return fmt.Errorf("can't upload using strawman for object %s: %w", objectName, err)
@@ -0,0 +1,149 @@
+package encstr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/gcsx"
+)
+
+// ErrNoStreaming is returned by UploadStream and DownloadStream for the
+// strategies that encrypt with AES-GCM on the client: the whole object is
+// sealed under one tag, which can only be computed, or checked, once all of
+// it is at hand.
+var ErrNoStreaming = errors.New("strategy can't stream")
+
+// Streams reports whether strategy can upload from, and download to, a
+// stream without holding the object in memory.  Only the strategies that
+// GCS encrypts on the server can.
+func Streams(strategy string) bool {
+	return strategy == "csek" || strategy == "cmek"
+}
+
+// UploadStream writes the data read from r to objectName with strategy, as
+// Upload does, without reading all of it first.  GCS only learns the data's
+// CRC32C at the end, so the object is checked against it once written, and
+// deleted if it doesn't match.
+func UploadStream(ctx context.Context, bkt *storage.BucketHandle, objectName, strategy string, r io.Reader, key []byte, metadata map[string]string) error {
+	if !Streams(strategy) {
+		return fmt.Errorf("%w: %s", ErrNoStreaming, strategy)
+	}
+
+	// cancelling the writer's context aborts the upload, so a failed read
+	// leaves no partial object
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	obj := bkt.Object(objectName)
+	if strategy == "csek" {
+		obj = obj.Key(key)
+	}
+	wc := obj.NewWriter(ctx)
+	if strategy == "cmek" {
+		wc.KMSKeyName = string(key)
+	}
+	wc.Metadata = withMetadata(metadata, map[string]string{
+		"akeso_strategy": strategy,
+	})
+
+	crc := gcsx.NewCRC32C()
+	if _, err := io.Copy(io.MultiWriter(wc, crc), r); err != nil {
+		cancel()
+		log.Println("Error: ", err)
+		return fmt.Errorf("streaming to object %s: %w", objectName, err)
+	}
+	if err := wc.Close(); err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("Writer.Close: %w", err)
+	}
+
+	attrs := wc.Attrs()
+	if err := gcsx.CheckCRC32C(objectName, crc.Sum32(), attrs.CRC32C); err != nil {
+		log.Println("Error: ", err)
+		// only the generation just written
+		if derr := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); derr != nil {
+			log.Println("Error: ", derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// DownloadStream copies the plaintext of an object written with strategy
+// to w, without holding all of it in memory.  The CRC32C, and the plaintext
+// digest if any, can only be checked at the end, so on an ErrChecksum or
+// ErrPlaintextMAC error w has already been written to.
+func DownloadStream(ctx context.Context, bkt *storage.BucketHandle, objectName, strategy string, key []byte, w io.Writer) error {
+	var r io.ReadCloser
+	var err error
+	switch strategy {
+	case "csek":
+		r, err = csekOpen(ctx, bkt, objectName, key)
+	case "cmek":
+		r, err = cmekOpen(ctx, bkt, objectName, key)
+	default:
+		return fmt.Errorf("%w: %s", ErrNoStreaming, strategy)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		log.Println("Error: ", err)
+		return fmt.Errorf("streaming object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// A checkedReader reads an object's content, and on reaching its end checks
+// the data as stored against the object's CRC32C, and the content against
+// its plaintext digest under key if it has one.  It is only for the
+// strategies whose data is the plaintext.
+type checkedReader struct {
+	r      io.Reader
+	closer io.Closer
+	attrs  *storage.ObjectAttrs
+	mac    hash.Hash // nil without a digest to check
+}
+
+// r reads the object's data as stored, as opened by gcsx.OpenObject.  Closes
+// r if the object's digest can't be checked under key.
+func newCheckedReader(r io.ReadCloser, attrs *storage.ObjectAttrs, key []byte) (*checkedReader, error) {
+	c := &checkedReader{closer: r, attrs: attrs}
+	var err error
+	if c.mac, err = plaintextMACOf(attrs, key); err == nil {
+		c.r, err = gcsx.ContentReader(attrs, gcsx.NewCheckedReader(r, attrs))
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.mac != nil {
+		c.mac.Write(p[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+
+	if c.mac != nil {
+		if merr := checkPlaintextMAC(c.attrs, c.mac); merr != nil {
+			return n, merr
+		}
+	}
+	return n, io.EOF
+}
+
+func (c *checkedReader) Close() error {
+	return c.closer.Close()
+}
@@ -0,0 +1,76 @@
+package encstr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/etclab/akesod/internal/gcsx"
+)
+
+func TestCheckedReader(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	data := strings.Repeat("Call me Ishmael. ", 1000)
+	attrs := &storage.ObjectAttrs{
+		Name:     "moby.txt",
+		CRC32C:   gcsx.CRC32C([]byte(data)),
+		Metadata: PlaintextDigest(key, nil, []byte(data)),
+	}
+	corrupted := strings.Replace(data, "Ishmael", "Ishmaal", 1)
+
+	// stored gzip-encoded, the CRC32C is of the compressed data
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	zw.Close()
+	compressed := buf.String()
+	gzipped := &storage.ObjectAttrs{
+		Name:            attrs.Name,
+		CRC32C:          gcsx.CRC32C(buf.Bytes()),
+		ContentEncoding: "gzip",
+		Metadata:        attrs.Metadata,
+	}
+
+	tests := []struct {
+		name    string
+		attrs   *storage.ObjectAttrs
+		stored  string
+		content string
+		err     error
+	}{
+		{"intact", attrs, data, data, nil},
+		{"corrupted in transit", attrs, corrupted, corrupted, gcsx.ErrChecksum},
+		// the CRC32C GCS has is of the corrupted data
+		{"corrupted at rest", &storage.ObjectAttrs{Name: attrs.Name, CRC32C: gcsx.CRC32C([]byte(corrupted)), Metadata: attrs.Metadata}, corrupted, corrupted, ErrPlaintextMAC},
+		{"gzip-encoded", gzipped, compressed, data, nil},
+		{"gzip-encoded, CRC32C of the content", &storage.ObjectAttrs{
+			Name: attrs.Name, CRC32C: attrs.CRC32C, ContentEncoding: "gzip", Metadata: attrs.Metadata,
+		}, compressed, data, gcsx.ErrChecksum},
+	}
+	for _, tt := range tests {
+		r, err := newCheckedReader(io.NopCloser(strings.NewReader(tt.stored)), tt.attrs, key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := io.ReadAll(r)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v; expected %v", tt.name, err, tt.err)
+		}
+		if string(got) != tt.content {
+			t.Errorf("%s: read %d bytes; expected the %d of the content", tt.name, len(got), len(tt.content))
+		}
+	}
+}
+
+func TestCheckedReaderWrongKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	attrs := &storage.ObjectAttrs{Name: "moby.txt", Metadata: PlaintextDigest(key, nil, []byte("Call me Ishmael."))}
+	if _, err := newCheckedReader(io.NopCloser(strings.NewReader("Call me Ishmael.")), attrs, otherKey); !errors.Is(err, ErrPlaintextMACKey) {
+		t.Errorf("got %v; expected %v", err, ErrPlaintextMACKey)
+	}
+}
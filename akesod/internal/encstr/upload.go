@@ -0,0 +1,60 @@
+package encstr
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"cloud.google.com/go/storage"
+)
+
+// Upload encrypts data under key with strategy and writes it to objectName.
+// The object gets metadata along with the strategy's own fields, which take
+// precedence; a digest in metadata must have its key sealed under key, as
+// PlaintextDigest returns.  For cmek, key is the KMS key name.
+func Upload(ctx context.Context, bkt *storage.BucketHandle, objectName, strategy string, data, key []byte, metadata map[string]string) error {
+	return put(ctx, bkt.Object(objectName), objectName, strategy, data, key, metadata)
+}
+
+func put(ctx context.Context, obj *storage.ObjectHandle, objectName, strategy string, data, key []byte, extra map[string]string) error {
+	switch strategy {
+	case "strawman":
+		return strawmanPut(ctx, obj, objectName, data, key, extra)
+	case "keywrap":
+		return keyWrapPut(ctx, obj, objectName, data, key, extra)
+	case "akeso":
+		return akesoPut(ctx, obj, data, key, nil, extra)
+	case "csek":
+		return csekPut(ctx, obj, objectName, data, key, extra)
+	case "cmek":
+		return cmekPut(ctx, obj, data, key, extra)
+	}
+	return fmt.Errorf("unknown strategy %q", strategy)
+}
+
+// Download reads and decrypts an object written with strategy
+func Download(ctx context.Context, bkt *storage.BucketHandle, objectName, strategy string, key []byte) ([]byte, error) {
+	switch strategy {
+	case "strawman":
+		return StrawmanDownload(bkt, objectName, key, ctx)
+	case "keywrap":
+		return KeyWrapDownload(bkt, objectName, key, ctx)
+	case "akeso":
+		return AkesoDownload(bkt, objectName, key, ctx)
+	case "csek":
+		return CsekDownload(bkt, objectName, key, ctx)
+	case "cmek":
+		return CmekDownload(bkt, objectName, key, ctx)
+	}
+	return nil, fmt.Errorf("unknown strategy %q", strategy)
+}
+
+// Returns extra with the strategy's metadata fields added
+func withMetadata(extra, fields map[string]string) map[string]string {
+	metadata := maps.Clone(extra)
+	if metadata == nil {
+		return fields
+	}
+	maps.Copy(metadata, fields)
+	return metadata
+}
@@ -0,0 +1,370 @@
+// Package escrow backs up a group's ART state with K-of-N custodians.
+//
+// The state, which includes the epoch's stage key, is split with Shamir
+// secret sharing so that any K shares recover it.  Each share is sealed to
+// one custodian's X25519 key (ephemeral ECDH, HKDF-SHA256 and AES-GCM) and
+// written to a file that can be handed to the custodian.  To recover, each
+// of K custodians opens their share with their private key, and the opened
+// shares are combined.
+package escrow
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/secret"
+	"github.com/etclab/akesod/internal/shamir"
+	"github.com/etclab/art"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	formatVersion = 1
+	sealLabel     = "akeso escrow share v1"
+	shareSuffix   = ".share"
+)
+
+var custodianNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Share is one custodian's part of an escrowed group state
+type Share struct {
+	Format    int    `json:"format"`
+	Group     string `json:"group"`
+	GroupID   string `json:"groupId"`
+	Epoch     uint64 `json:"epoch"`
+	Custodian string `json:"custodian"`
+	Threshold int    `json:"threshold"`
+	Total     int    `json:"total"`
+	// Digest is the SHA-256 of the escrowed state, which tells whether
+	// the shares were combined correctly.
+	Digest []byte `json:"digest"`
+	// Data is the Shamir share
+	Data secret.Bytes `json:"data"`
+}
+
+// SealedShare is a Share encrypted to its custodian.  The clear fields say
+// whose share it is, and are authenticated along with the ciphertext.
+type SealedShare struct {
+	Format       int    `json:"format"`
+	Group        string `json:"group"`
+	GroupID      string `json:"groupId"`
+	Epoch        uint64 `json:"epoch"`
+	Custodian    string `json:"custodian"`
+	EphemeralKey []byte `json:"ephemeralKey"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// Custodian holds one share of each escrowed state
+type Custodian struct {
+	Name string
+	Key  *ecdh.PublicKey
+}
+
+// ParseCustodian parses a custodian given as NAME=FILE, where FILE is the
+// custodian's public X25519 key in PEM.
+func ParseCustodian(spec string) (*Custodian, error) {
+	name, file, ok := strings.Cut(spec, "=")
+	if !ok || file == "" {
+		return nil, fmt.Errorf("custodian %q is not NAME=FILE", spec)
+	}
+	if !custodianNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid custodian name %q", name)
+	}
+	key, err := art.ReadPublicEKFromFile(file, art.EncodingPEM)
+	if err != nil {
+		return nil, fmt.Errorf("reading key of custodian %s: %w", name, err)
+	}
+	return &Custodian{Name: name, Key: key}, nil
+}
+
+// ParseCustodians parses each of specs with ParseCustodian
+func ParseCustodians(specs []string) ([]*Custodian, error) {
+	var custodians []*Custodian
+	names := make(map[string]bool)
+	for _, spec := range specs {
+		c, err := ParseCustodian(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("custodian %s is given twice", c.Name)
+		}
+		names[c.Name] = true
+		custodians = append(custodians, c)
+	}
+	return custodians, nil
+}
+
+// Split splits a group state into one share per custodian, threshold of
+// which recover it.
+func Split(group, groupID string, epoch uint64, state []byte, custodians []string, threshold int) ([]*Share, error) {
+	parts, err := shamir.Split(state, len(custodians), threshold)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(state)
+
+	shares := make([]*Share, len(custodians))
+	for i, name := range custodians {
+		shares[i] = &Share{
+			Format:    formatVersion,
+			Group:     group,
+			GroupID:   groupID,
+			Epoch:     epoch,
+			Custodian: name,
+			Threshold: threshold,
+			Total:     len(custodians),
+			Digest:    digest[:],
+			Data:      parts[i],
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the group state from at least the threshold number of
+// its shares.
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	first := shares[0]
+	parts := make([][]byte, len(shares))
+	custodians := make(map[string]bool)
+	for i, s := range shares {
+		if s.Format != formatVersion {
+			return nil, fmt.Errorf("share of %s has unknown format %d", s.Custodian, s.Format)
+		}
+		if s.GroupID != first.GroupID || s.Epoch != first.Epoch || s.Threshold != first.Threshold || !bytes.Equal(s.Digest, first.Digest) {
+			return nil, fmt.Errorf("share of %s is for group %s epoch %d, but share of %s is for group %s epoch %d",
+				s.Custodian, s.GroupID, s.Epoch, first.Custodian, first.GroupID, first.Epoch)
+		}
+		if custodians[s.Custodian] {
+			return nil, fmt.Errorf("share of %s is given twice", s.Custodian)
+		}
+		custodians[s.Custodian] = true
+		parts[i] = s.Data
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("need %d of the %d shares, got %d", first.Threshold, first.Total, len(shares))
+	}
+
+	state, err := shamir.Combine(parts)
+	if err != nil {
+		return nil, err
+	}
+	if digest := sha256.Sum256(state); !bytes.Equal(digest[:], first.Digest) {
+		secret.Zero(state)
+		return nil, errors.New("the combined shares don't match the escrowed state")
+	}
+	return state, nil
+}
+
+// aad is what the seal authenticates besides the share: the clear fields
+func (ss *SealedShare) aad() []byte {
+	c := *ss
+	c.Nonce = nil
+	c.Ciphertext = nil
+	data, err := json.Marshal(&c)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func sealingKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(bytes.Clone(ephemeral), recipient...)
+	key := make([]byte, aesx.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(sealLabel)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seal encrypts the share to its custodian's key
+func Seal(share *Share, to *ecdh.PublicKey) (*SealedShare, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(to)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(shared)
+	key, err := sealingKey(shared, eph.PublicKey().Bytes(), to.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(key)
+
+	plaintext, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(plaintext)
+
+	ss := &SealedShare{
+		Format:       formatVersion,
+		Group:        share.Group,
+		GroupID:      share.GroupID,
+		Epoch:        share.Epoch,
+		Custodian:    share.Custodian,
+		EphemeralKey: eph.PublicKey().Bytes(),
+		Nonce:        aesx.GenerateRandomNonce(),
+	}
+	ss.Ciphertext = aesx.GcmEncrypt(bytes.Clone(plaintext), ss.aad(), key, ss.Nonce)
+	return ss, nil
+}
+
+// Open decrypts the share with its custodian's private key
+func (ss *SealedShare) Open(priv *ecdh.PrivateKey) (*Share, error) {
+	eph, err := ecdh.X25519().NewPublicKey(ss.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ephemeral key: %w", err)
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(shared)
+	key, err := sealingKey(shared, ss.EphemeralKey, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(key)
+
+	plaintext, err := aesx.GcmDecrypt(bytes.Clone(ss.Ciphertext), ss.aad(), key, ss.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("can't open share of %s (wrong key?): %w", ss.Custodian, err)
+	}
+	defer secret.Zero(plaintext)
+
+	var share Share
+	if err := json.Unmarshal(plaintext, &share); err != nil {
+		return nil, fmt.Errorf("malformed share of %s: %w", ss.Custodian, err)
+	}
+	if share.Custodian != ss.Custodian || share.GroupID != ss.GroupID || share.Epoch != ss.Epoch {
+		return nil, fmt.Errorf("share of %s doesn't match its envelope", ss.Custodian)
+	}
+	return &share, nil
+}
+
+// EpochDir is the directory under dir that holds the sealed shares of an
+// epoch
+func EpochDir(dir string, epoch uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("epoch-%020d", epoch))
+}
+
+// Escrow splits a group state among custodians and writes each sealed
+// share to EpochDir(dir, epoch)/CUSTODIAN.share.  It returns the paths of
+// the written shares.
+func Escrow(dir, group, groupID string, epoch uint64, state []byte, custodians []*Custodian, threshold int) ([]string, error) {
+	names := make([]string, len(custodians))
+	for i, c := range custodians {
+		names[i] = c.Name
+	}
+	shares, err := Split(group, groupID, epoch, state, names, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, s := range shares {
+			s.Data.Zero()
+		}
+	}()
+
+	epochDir := EpochDir(dir, epoch)
+	if err := os.MkdirAll(epochDir, 0700); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for i, s := range shares {
+		ss, err := Seal(s, custodians[i].Key)
+		if err != nil {
+			return nil, fmt.Errorf("sealing share of %s: %w", s.Custodian, err)
+		}
+		path := filepath.Join(epochDir, s.Custodian+shareSuffix)
+		if err := writeJSON(path, ss); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// writeJSON atomically writes v to path, readable only by its owner
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	defer secret.Zero(data)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	defer secret.Zero(data)
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadSealedShare reads a share written by Escrow
+func ReadSealedShare(path string) (*SealedShare, error) {
+	var ss SealedShare
+	if err := readJSON(path, &ss); err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+// WriteShare writes an opened share, readable only by its owner
+func WriteShare(path string, share *Share) error {
+	return writeJSON(path, share)
+}
+
+// ReadShare reads a share written by WriteShare
+func ReadShare(path string) (*Share, error) {
+	var s Share
+	if err := readJSON(path, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
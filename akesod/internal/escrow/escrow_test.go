@@ -0,0 +1,152 @@
+package escrow
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/etclab/art"
+)
+
+type testCustodian struct {
+	spec string
+	priv *ecdh.PrivateKey
+}
+
+// newCustodians creates n custodian key pairs, as akeso-escrow keygen does
+func newCustodians(t *testing.T, n int) []*testCustodian {
+	dir := t.TempDir()
+	var custodians []*testCustodian
+	for i := 0; i < n; i++ {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("custodian%d", i)
+		pubFile := filepath.Join(dir, name+"-escrow-pub.pem")
+		if err := art.WritePublicEKToFile(priv.PublicKey(), pubFile, art.EncodingPEM); err != nil {
+			t.Fatal(err)
+		}
+		custodians = append(custodians, &testCustodian{spec: name + "=" + pubFile, priv: priv})
+	}
+	return custodians
+}
+
+// escrowState escrows state among 5 custodians with a threshold of 3 and
+// returns the custodians and the paths of their sealed shares
+func escrowState(t *testing.T, state []byte) ([]*testCustodian, []string) {
+	tcs := newCustodians(t, 5)
+	specs := make([]string, len(tcs))
+	for i, tc := range tcs {
+		specs[i] = tc.spec
+	}
+	custodians, err := ParseCustodians(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := Escrow(t.TempDir(), "team", "group-id", 7, state, custodians, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(tcs) {
+		t.Fatalf("got %d shares, expected %d", len(paths), len(tcs))
+	}
+	return tcs, paths
+}
+
+// openShare is what each custodian does during recovery
+func openShare(t *testing.T, path string, priv *ecdh.PrivateKey) *Share {
+	ss, err := ReadSealedShare(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := ss.Open(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// custodians hand over their opened share as a file
+	opened := filepath.Join(t.TempDir(), "opened.share")
+	if err := WriteShare(opened, share); err != nil {
+		t.Fatal(err)
+	}
+	share, err = ReadShare(opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestRecovery(t *testing.T) {
+	state := []byte(`{"info":{"id":"group-id","epoch":7},"tree":{"sk":"stage key"}}`)
+	tcs, paths := escrowState(t, state)
+
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var shares []*Share
+		for _, i := range pick {
+			shares = append(shares, openShare(t, paths[i], tcs[i].priv))
+		}
+		got, err := Combine(shares)
+		if err != nil {
+			t.Fatalf("custodians %v: %v", pick, err)
+		}
+		if !bytes.Equal(got, state) {
+			t.Fatalf("custodians %v recovered %q", pick, got)
+		}
+	}
+}
+
+func TestRecoveryNeedsThreshold(t *testing.T) {
+	tcs, paths := escrowState(t, []byte("state"))
+
+	shares := []*Share{openShare(t, paths[0], tcs[0].priv), openShare(t, paths[1], tcs[1].priv)}
+	if _, err := Combine(shares); err == nil {
+		t.Error("recovered the state from 2 of 3 shares")
+	}
+
+	shares = append(shares, shares[0])
+	if _, err := Combine(shares); err == nil {
+		t.Error("recovered the state with a share given twice")
+	}
+}
+
+func TestRecoveryRejectsWrongShares(t *testing.T) {
+	tcs, paths := escrowState(t, []byte("state"))
+
+	// a custodian can only open their own share
+	ss, err := ReadSealedShare(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Open(tcs[1].priv); err == nil {
+		t.Error("opened another custodian's share")
+	}
+
+	// the envelope can't be relabelled
+	ss.Epoch++
+	if _, err := ss.Open(tcs[0].priv); err == nil {
+		t.Error("opened a share with a modified epoch")
+	}
+
+	// shares of different escrows don't combine
+	otherTCs, otherPaths := escrowState(t, []byte("other"))
+	shares := []*Share{
+		openShare(t, paths[0], tcs[0].priv),
+		openShare(t, paths[1], tcs[1].priv),
+		openShare(t, otherPaths[2], otherTCs[2].priv),
+	}
+	if _, err := Combine(shares); err == nil {
+		t.Error("combined shares of different escrows")
+	}
+
+	// a corrupted share is detected by the digest
+	shares[2] = openShare(t, paths[2], tcs[2].priv)
+	shares[2].Data[0] ^= 1
+	if _, err := Combine(shares); err == nil {
+		t.Error("combined a corrupted share")
+	}
+}
@@ -1,15 +1,21 @@
 package gcsx
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"net/http"
 	"net/url"
 	"slices"
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 )
 
 // Returns bucketName, objectName, error
@@ -34,8 +40,33 @@ func ParseUrl(urlStr string) (string, string, error) {
 	return bucketName, objectName, nil
 }
 
-func GetObject(obj *storage.ObjectHandle) ([]byte, error) {
-	ctx := context.Background()
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksum is returned when data read from an object doesn't match the
+// CRC32C that GCS has for it
+var ErrChecksum = errors.New("CRC32C mismatch")
+
+// CRC32C returns the checksum GCS keeps for an object holding data
+func CRC32C(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// NewCRC32C returns a hash computing CRC32C, for data streamed to or from
+// GCS
+func NewCRC32C() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// CheckCRC32C returns an error wrapping ErrChecksum if got, the checksum of
+// the data read from objectName, isn't want, its CRC32C in GCS
+func CheckCRC32C(objectName string, got, want uint32) error {
+	if got != want {
+		return fmt.Errorf("%w: object %s read with CRC32C %08x, but GCS has %08x", ErrChecksum, objectName, got, want)
+	}
+	return nil
+}
+
+func GetObject(ctx context.Context, obj *storage.ObjectHandle) ([]byte, error) {
 	r, err := obj.NewReader(ctx)
 	if err != nil {
 		return nil, err
@@ -44,9 +75,76 @@ func GetObject(obj *storage.ObjectHandle) ([]byte, error) {
 	return io.ReadAll(r)
 }
 
-func PutObject(obj *storage.ObjectHandle, data []byte) error {
-	ctx := context.Background()
+// OpenObject opens obj to read its data as stored.  GCS doesn't decompress
+// an object stored gzip-encoded on the way, so what is read can always be
+// checked against the object's CRC32C.
+func OpenObject(ctx context.Context, obj *storage.ObjectHandle) (*storage.Reader, error) {
+	return obj.ReadCompressed(true).NewReader(ctx)
+}
+
+// GetObjectChecked reads obj's data as stored, checking it against the
+// CRC32C in attrs.  obj should be conditioned on the generation attrs are
+// from.
+func GetObjectChecked(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs) ([]byte, error) {
+	r, err := OpenObject(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckCRC32C(attrs.Name, CRC32C(data), attrs.CRC32C); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type checkedReader struct {
+	r     io.Reader
+	attrs *storage.ObjectAttrs
+	crc   hash.Hash32
+}
+
+// NewCheckedReader returns a reader of r, an object's data as stored, that
+// checks it against the CRC32C in attrs on reaching its end.  On a mismatch
+// it returns an ErrChecksum error instead of io.EOF.
+func NewCheckedReader(r io.Reader, attrs *storage.ObjectAttrs) io.Reader {
+	return &checkedReader{r: r, attrs: attrs, crc: NewCRC32C()}
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	if err == io.EOF {
+		if cerr := CheckCRC32C(c.attrs.Name, c.crc.Sum32(), c.attrs.CRC32C); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+// ContentReader returns a reader of the content of an object whose data as
+// stored r reads: r itself, or its decompression if the object is stored
+// gzip-encoded
+func ContentReader(attrs *storage.ObjectAttrs, r io.Reader) (io.Reader, error) {
+	if attrs.ContentEncoding != "gzip" {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("object %s is stored gzip-encoded: %w", attrs.Name, err)
+	}
+	return zr, nil
+}
+
+// PutObject writes data to obj.  GCS rejects the upload if the data it
+// receives doesn't match the data's CRC32C.
+func PutObject(ctx context.Context, obj *storage.ObjectHandle, data []byte) error {
 	w := obj.NewWriter(ctx)
+	w.CRC32C = CRC32C(data)
+	w.SendCRC32C = true
 	_, err := w.Write(data)
 	if err != nil {
 		return err
@@ -54,11 +152,10 @@ func PutObject(obj *storage.ObjectHandle, data []byte) error {
 	return w.Close()
 }
 
-func UpdateObjectMetadata(obj *storage.ObjectHandle, metadata map[string]string) error {
+func UpdateObjectMetadata(ctx context.Context, obj *storage.ObjectHandle, metadata map[string]string) error {
 	attrsToUpdate := storage.ObjectAttrsToUpdate{
 		Metadata: metadata,
 	}
-	ctx := context.Background()
 	_, err := obj.Update(ctx, attrsToUpdate)
 	if err != nil {
 		return err
@@ -66,10 +163,11 @@ func UpdateObjectMetadata(obj *storage.ObjectHandle, metadata map[string]string)
 	return nil
 }
 
-func PutObjectWithMetadata(obj *storage.ObjectHandle, data []byte, metadata map[string]string) error {
-	ctx := context.Background()
+func PutObjectWithMetadata(ctx context.Context, obj *storage.ObjectHandle, data []byte, metadata map[string]string) error {
 	w := obj.NewWriter(ctx)
 	w.Metadata = metadata
+	w.CRC32C = CRC32C(data)
+	w.SendCRC32C = true
 	_, err := w.Write(data)
 	if err != nil {
 		fmt.Printf("Error writing object: %v\n", err)
@@ -79,6 +177,26 @@ func PutObjectWithMetadata(obj *storage.ObjectHandle, data []byte, metadata map[
 	return w.Close()
 }
 
+// IsPreconditionFailed reports whether a request failed because its
+// generation or metageneration condition didn't hold, i.e. the object was
+// changed since its attributes were read.
+func IsPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// MoveObject copies the object in attrs to dstName in the same bucket and
+// deletes it.  The copy is only made from the generation in attrs and only
+// if dstName doesn't exist, and the delete only removes that generation.
+func MoveObject(ctx context.Context, bucket *storage.BucketHandle, attrs *storage.ObjectAttrs, dstName string) error {
+	src := bucket.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	dst := bucket.Object(dstName).If(storage.Conditions{DoesNotExist: true})
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return err
+	}
+	return src.Delete(ctx)
+}
+
 func AddNotification(ctx context.Context, bucket *storage.BucketHandle,
 	notification *storage.Notification) (*storage.Notification, error) {
 	notif, err := bucket.AddNotification(ctx, notification)
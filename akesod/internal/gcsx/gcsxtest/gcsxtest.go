@@ -0,0 +1,284 @@
+// Package gcsxtest is an in-memory fake of the parts of GCS the strategies
+// use: object attributes, reads, metadata updates and uploads, with their
+// generation conditions and CRC32C checks.
+package gcsxtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+type object struct {
+	Bucket          string            `json:"bucket"`
+	Name            string            `json:"name"`
+	Generation      int64             `json:"generation,string"`
+	Metageneration  int64             `json:"metageneration,string"`
+	Size            int64             `json:"size,string"`
+	CRC32C          string            `json:"crc32c"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Updated         time.Time         `json:"updated"`
+
+	data []byte
+}
+
+// Server serves the fake GCS until the test ends
+type Server struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*object // by bucket/name
+	gen     int64
+}
+
+func NewServer(t testing.TB) *Server {
+	s := &Server{objects: make(map[string]*object)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /storage/v1/b/{bucket}/o/{object}", s.getObject)
+	mux.HandleFunc("PATCH /storage/v1/b/{bucket}/o/{object}", s.patchObject)
+	mux.HandleFunc("POST /upload/storage/v1/b/{bucket}/o", s.insertObject)
+	mux.HandleFunc("GET /{bucket}/{object}", s.readObject)
+	s.srv = httptest.NewServer(mux)
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// Client returns a client of s
+func (s *Server) Client(t testing.TB) *storage.Client {
+	client, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(s.srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Corrupt flips a bit of an object's stored data, leaving its CRC32C as it
+// was
+func (s *Server) Corrupt(bucket, name string, offset int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+name].data[offset] ^= 1
+}
+
+func crc32c(data []byte) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+func writeError(w http.ResponseWriter, code int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	msg := fmt.Sprintf(format, args...)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": code, "message": msg}})
+}
+
+func writeObject(w http.ResponseWriter, o *object) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// Looks up the object in the request and checks the request's generation
+// conditions on it, replying with an error if it fails.  A condition on
+// generation 0 holds if the object doesn't exist.
+func (s *Server) lookup(w http.ResponseWriter, bucket, name string, ifGeneration, ifMetageneration string) (*object, bool) {
+	o := s.objects[bucket+"/"+name]
+	if ifGeneration == "0" {
+		if o != nil {
+			writeError(w, http.StatusPreconditionFailed, "%s/%s exists", bucket, name)
+			return nil, false
+		}
+		return nil, true
+	}
+	if o == nil {
+		if ifGeneration == "" && ifMetageneration == "" {
+			return nil, true
+		}
+		writeError(w, http.StatusNotFound, "no such object: %s/%s", bucket, name)
+		return nil, false
+	}
+	if ifGeneration != "" && ifGeneration != strconv.FormatInt(o.Generation, 10) ||
+		ifMetageneration != "" && ifMetageneration != strconv.FormatInt(o.Metageneration, 10) {
+		writeError(w, http.StatusPreconditionFailed, "%s/%s is at generation %d, metageneration %d", bucket, name, o.Generation, o.Metageneration)
+		return nil, false
+	}
+	return o, true
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	o, ok := s.lookup(w, r.PathValue("bucket"), r.PathValue("object"), q.Get("ifGenerationMatch"), q.Get("ifMetagenerationMatch"))
+	if !ok {
+		return
+	}
+	if o == nil {
+		writeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	writeObject(w, o)
+}
+
+// Merges the request's metadata into the object's; a null value removes a
+// key
+func (s *Server) patchObject(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Metadata map[string]*string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	o, ok := s.lookup(w, r.PathValue("bucket"), r.PathValue("object"), q.Get("ifGenerationMatch"), q.Get("ifMetagenerationMatch"))
+	if !ok {
+		return
+	}
+	if o == nil {
+		writeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	if o.Metadata == nil {
+		o.Metadata = make(map[string]string)
+	}
+	for k, v := range patch.Metadata {
+		if v == nil {
+			delete(o.Metadata, k)
+		} else {
+			o.Metadata[k] = *v
+		}
+	}
+	o.Metageneration++
+	o.Updated = time.Now()
+	writeObject(w, o)
+}
+
+// Stores a multipart upload: the object resource, then its data
+func (s *Server) insertObject(w http.ResponseWriter, r *http.Request) {
+	if t := r.URL.Query().Get("uploadType"); t != "multipart" {
+		writeError(w, http.StatusNotImplemented, "upload type %q", t)
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var o object
+	if err := json.NewDecoder(part).Decode(&o); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if part, err = mr.NextPart(); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if o.data, err = io.ReadAll(part); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if got := crc32c(o.data); o.CRC32C != "" && o.CRC32C != got {
+		writeError(w, http.StatusBadRequest, "CRC32C %s of the data doesn't match %s", got, o.CRC32C)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	o.Bucket = r.PathValue("bucket")
+	if o.Name == "" {
+		o.Name = q.Get("name")
+	}
+	if _, ok := s.lookup(w, o.Bucket, o.Name, q.Get("ifGenerationMatch"), q.Get("ifMetagenerationMatch")); !ok {
+		return
+	}
+	s.gen++
+	o.Generation = s.gen
+	o.Metageneration = 1
+	o.Size = int64(len(o.data))
+	o.CRC32C = crc32c(o.data)
+	o.Updated = time.Now()
+	s.objects[o.Bucket+"/"+o.Name] = &o
+	writeObject(w, &o)
+}
+
+// Serves an object's data as the XML API does.  Data stored gzip-encoded
+// is decompressed unless the client accepts gzip, as with
+// ReadCompressed(true); decompressed, it has no CRC32C to check.
+func (s *Server) readObject(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	o, ok := s.lookup(w, r.PathValue("bucket"), r.PathValue("object"), r.Header.Get("x-goog-if-generation-match"), r.Header.Get("x-goog-if-metageneration-match"))
+	if ok && o == nil {
+		writeError(w, http.StatusNotFound, "no such object")
+		ok = false
+	}
+	if ok && r.URL.Query().Has("generation") && r.URL.Query().Get("generation") != strconv.FormatInt(o.Generation, 10) {
+		writeError(w, http.StatusNotFound, "no such generation")
+		ok = false
+	}
+	var attrs object
+	if ok {
+		attrs = *o
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	data := attrs.data
+	h := w.Header()
+	h.Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(attrs.Metageneration, 10))
+	if attrs.ContentEncoding == "gzip" {
+		h.Set("X-Goog-Stored-Content-Encoding", "gzip")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.Set("Content-Encoding", "gzip")
+			h.Set("X-Goog-Hash", "crc32c="+attrs.CRC32C)
+		} else {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err == nil {
+				data, err = io.ReadAll(zr)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "decompressing: %v", err)
+				return
+			}
+		}
+	} else {
+		h.Set("X-Goog-Hash", "crc32c="+attrs.CRC32C)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
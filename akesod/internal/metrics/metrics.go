@@ -0,0 +1,204 @@
+// Package metrics exposes akesod's Prometheus metrics and its health and
+// readiness endpoints.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "akesod"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	RotationsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rotations_started_total",
+		Help:      "Bucket rotations started, including resumed rotations.",
+	})
+
+	RotationsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rotations_completed_total",
+		Help:      "Bucket rotations in which every object was rotated.",
+	})
+
+	RotationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rotations_failed_total",
+		Help:      "Bucket rotations that ended with at least one failed object.",
+	})
+
+	ObjectsRotated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "objects_rotated_total",
+		Help:      "Objects rotated to a new key, by strategy.",
+	}, []string{"strategy"})
+
+	ObjectFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "object_rotation_failures_total",
+		Help:      "Objects that failed to rotate, by strategy.",
+	}, []string{"strategy"})
+
+	BytesReencrypted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reencrypted_bytes_total",
+		Help:      "Size of the objects rotated, by strategy.",
+	}, []string{"strategy"})
+
+	ObjectLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "object_rotation_seconds",
+		Help:      "Time to rotate a single object, by strategy.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14), // 10ms to ~80s
+	}, []string{"strategy"})
+
+	Epoch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "epoch",
+		Help:      "Current epoch, by ART group.",
+	}, []string{"group"})
+
+	PendingReencryptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ongoing_reencryption_objects",
+		Help:      "Objects whose ongoing_reencryption metadata is true as of the last scan, by bucket.",
+	}, []string{"bucket"})
+
+	KeyUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_update_messages_total",
+		Help:      "Key update messages handled, by outcome (applied, duplicate, stale, retried, dead_lettered).",
+	}, []string{"outcome"})
+
+	LayerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "layer_events_total",
+		Help:      "Completion events for akeso layers, by result (applied, already_applied, not_pending, failed, unknown).",
+	}, []string{"result"})
+
+	LayerRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "layer_retries_total",
+		Help:      "Metadata update events republished for akeso layers a worker gave up on.",
+	})
+
+	LayerLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "layer_apply_seconds",
+		Help:      "Time from akesod updating an object's header to a worker applying its akeso layer.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16), // 100ms to ~55m
+	})
+
+	RotationEndToEnd = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rotation_end_to_end_seconds",
+		Help:      "Time from the start of a rotation to the last of its akeso layers being applied.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2.3h
+	})
+
+	UnencryptedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unencrypted_objects",
+		Help:      "Objects without valid akeso metadata found by the last ingest scan, by bucket.",
+	}, []string{"bucket"})
+
+	IngestActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_actions_total",
+		Help:      "Objects without valid akeso metadata handled, by action (encrypted, quarantined, alerted, failed).",
+	}, []string{"action"})
+)
+
+var ready atomic.Bool
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RotationsStarted,
+		RotationsCompleted,
+		RotationsFailed,
+		ObjectsRotated,
+		ObjectFailures,
+		BytesReencrypted,
+		ObjectLatency,
+		Epoch,
+		PendingReencryptions,
+		KeyUpdates,
+		LayerEvents,
+		LayerRetries,
+		LayerLatency,
+		RotationEndToEnd,
+		UnencryptedObjects,
+		IngestActions,
+	)
+}
+
+// SetReady sets what /readyz reports.
+func SetReady(r bool) {
+	ready.Store(r)
+}
+
+// ObserveObject records the outcome of rotating a single object of the given
+// size.
+func ObserveObject(strategy string, size int64, start time.Time, err error) {
+	if err != nil {
+		ObjectFailures.WithLabelValues(strategy).Inc()
+		return
+	}
+	ObjectsRotated.WithLabelValues(strategy).Inc()
+	BytesReencrypted.WithLabelValues(strategy).Add(float64(size))
+	ObjectLatency.WithLabelValues(strategy).Observe(time.Since(start).Seconds())
+}
+
+// Handler serves /metrics, /healthz and /readyz.  /healthz succeeds as long
+// as the process is serving; /readyz succeeds once SetReady(true) is called.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// ListenAndServe serves Handler on addr until ctx is done.
+func ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving metrics and health checks on %s.\n", addr)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	if code, _ := get(t, srv.URL+"/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: %d", code)
+	}
+
+	SetReady(false)
+	if code, _ := get(t, srv.URL+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before SetReady(true): %d", code)
+	}
+	SetReady(true)
+	if code, _ := get(t, srv.URL+"/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz after SetReady(true): %d", code)
+	}
+	SetReady(false)
+
+	Epoch.WithLabelValues("finance").Set(7)
+	KeyUpdates.WithLabelValues("applied").Inc()
+	code, body := get(t, srv.URL+"/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("/metrics: %d", code)
+	}
+	for _, line := range []string{
+		`akesod_epoch{group="finance"} 7` + "\n",
+		`akesod_key_update_messages_total{outcome="applied"} `,
+		`akesod_rotations_started_total `,
+		`# TYPE go_goroutines gauge` + "\n",
+	} {
+		if !strings.Contains(body, "\n"+line) {
+			t.Errorf("/metrics has no line %q", line)
+		}
+	}
+}
+
+func TestObserveObject(t *testing.T) {
+	rotated := testutil.ToFloat64(ObjectsRotated.WithLabelValues("test"))
+	failed := testutil.ToFloat64(ObjectFailures.WithLabelValues("test"))
+	bytes := testutil.ToFloat64(BytesReencrypted.WithLabelValues("test"))
+
+	start := time.Now()
+	ObserveObject("test", 100, start, nil)
+	ObserveObject("test", 50, start, nil)
+	ObserveObject("test", 1000, start, errors.New("boom"))
+
+	if got := testutil.ToFloat64(ObjectsRotated.WithLabelValues("test")) - rotated; got != 2 {
+		t.Errorf("objects rotated: %v; expected 2", got)
+	}
+	if got := testutil.ToFloat64(ObjectFailures.WithLabelValues("test")) - failed; got != 1 {
+		t.Errorf("object failures: %v; expected 1", got)
+	}
+	// a failed object's size isn't counted as re-encrypted
+	if got := testutil.ToFloat64(BytesReencrypted.WithLabelValues("test")) - bytes; got != 150 {
+		t.Errorf("bytes re-encrypted: %v; expected 150", got)
+	}
+	if n := testutil.CollectAndCount(ObjectLatency, "akesod_object_rotation_seconds"); n == 0 {
+		t.Error("no latency observed")
+	}
+}
+
+func TestListenAndServeStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- ListenAndServe(ctx, "127.0.0.1:0") }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after ctx was done")
+	}
+
+	if err := ListenAndServe(context.Background(), "127.0.0.1:-1"); err == nil {
+		t.Error("ListenAndServe on a bad address succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+// Package secret helps keep key material out of places it outlives its
+// use: it wipes keys once they are no longer needed, and keeps them out of
+// log output and message attributes.
+package secret
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Redacted is printed in place of secret values
+const Redacted = "[redacted]"
+
+// Zero overwrites each buffer with zeros.  Buffers that may still be in use
+// elsewhere, such as a slice of a caller's key, must not be passed.
+func Zero(bufs ...[]byte) {
+	for _, b := range bufs {
+		clear(b)
+	}
+}
+
+// Bytes holds key material.  It prints as [redacted] with every fmt verb,
+// including as an exported field, element or map value of something that
+// is printed, so a key never reaches a log by accident.  fmt doesn't call
+// methods of unexported fields, so a struct that keeps Bytes in one should
+// implement fmt.Stringer and fmt.GoStringer itself.  Use the underlying []byte for
+// cryptographic operations.
+type Bytes []byte
+
+func (b Bytes) String() string {
+	return Redacted
+}
+
+func (b Bytes) GoString() string {
+	return Redacted
+}
+
+func (b Bytes) Format(f fmt.State, verb rune) {
+	io.WriteString(f, Redacted)
+}
+
+// Zero wipes the key
+func (b Bytes) Zero() {
+	clear(b)
+}
+
+// Substrings of attribute names that carry key material.  Names containing
+// "wrapped" hold keys encrypted under a KEK, which are safe to store.
+var sensitiveNames = []string{"dek", "key", "secret", "passphrase", "password", "token", "private"}
+
+// IsSensitiveAttr reports whether an attribute or metadata entry named
+// name may carry key material, such as the new_dek attribute that older
+// akesods put in metadata update events.
+func IsSensitiveAttr(name string) bool {
+	name = strings.ToLower(name)
+	if strings.Contains(name, "wrapped") || strings.HasSuffix(name, "fingerprint") ||
+		strings.HasSuffix(name, "nonce") || name == "akeso_deks" {
+		return false
+	}
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactAttrs returns a copy of attrs in which the values of sensitive
+// attributes are replaced by [redacted].  Use it before logging or
+// forwarding the attributes of a message.
+func RedactAttrs(attrs map[string]string) map[string]string {
+	if attrs == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		if IsSensitiveAttr(k) {
+			v = Redacted
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
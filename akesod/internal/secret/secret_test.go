@@ -0,0 +1,109 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/etclab/akesod/internal/secret/secrettest"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestBytesFormat(t *testing.T) {
+	key := Bytes(bytes.Clone(testKey))
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d", "%08b"} {
+		out := fmt.Sprintf(verb, key)
+		secrettest.AssertNoLeak(t, out, testKey)
+		if !strings.Contains(out, Redacted) {
+			t.Errorf("%s: got %q, expected %s", verb, out, Redacted)
+		}
+	}
+
+	for _, out := range []string{key.String(), key.GoString(), fmt.Sprint(key), fmt.Sprintln(key)} {
+		secrettest.AssertNoLeak(t, out, testKey)
+	}
+}
+
+func TestBytesInStruct(t *testing.T) {
+	type options struct {
+		Name string
+		Key  Bytes
+		Keys []Bytes
+		Env  map[string]Bytes
+	}
+	opts := &options{
+		Name: "store",
+		Key:  bytes.Clone(testKey),
+		Keys: []Bytes{bytes.Clone(testKey)},
+		Env:  map[string]Bytes{"KEY": bytes.Clone(testKey)},
+	}
+
+	for _, verb := range []string{"%v", "%+v", "%#v"} {
+		secrettest.AssertNoLeak(t, fmt.Sprintf(verb, opts), testKey)
+		secrettest.AssertNoLeak(t, fmt.Sprintf(verb, *opts), testKey)
+	}
+}
+
+func TestBytesInLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	key := Bytes(bytes.Clone(testKey))
+	logger.Printf("key %v, %x, %s", key, key, key)
+	logger.Println("key", key)
+	logger.Print(fmt.Errorf("wrapping %v", key))
+
+	secrettest.AssertNoLeak(t, buf.String(), testKey)
+}
+
+func TestZero(t *testing.T) {
+	a, b := bytes.Clone(testKey), Bytes(bytes.Clone(testKey))
+	Zero(a, nil)
+	b.Zero()
+
+	for _, buf := range [][]byte{a, b} {
+		if len(buf) != len(testKey) || !bytes.Equal(buf, make([]byte, len(testKey))) {
+			t.Errorf("buffer not zeroed: %x", buf)
+		}
+	}
+}
+
+func TestRedactAttrs(t *testing.T) {
+	dek := base64.StdEncoding.EncodeToString(testKey)
+	attrs := map[string]string{
+		"new_dek":           dek,
+		"eventType":         "OBJECT_METADATA_UPDATE",
+		"akeso_wrapped_key": "d3JhcHBlZA==",
+		"akeso_key_nonce":   "bm9uY2U=",
+		"akeso_deks":        "aGVhZGVy",
+		"keyFingerprint":    "0011",
+		"Control-Token":     "hunter2",
+		"stage_key":         dek,
+	}
+
+	redacted := RedactAttrs(attrs)
+	secrettest.AssertNoLeak(t, fmt.Sprint(redacted), testKey)
+
+	for _, name := range []string{"new_dek", "Control-Token", "stage_key"} {
+		if redacted[name] != Redacted {
+			t.Errorf("%s = %q, expected it redacted", name, redacted[name])
+		}
+	}
+	for _, name := range []string{"eventType", "akeso_wrapped_key", "akeso_key_nonce", "akeso_deks", "keyFingerprint"} {
+		if redacted[name] != attrs[name] {
+			t.Errorf("%s = %q, expected it kept as %q", name, redacted[name], attrs[name])
+		}
+	}
+
+	if attrs["new_dek"] != dek {
+		t.Error("RedactAttrs modified its argument")
+	}
+	if RedactAttrs(nil) != nil {
+		t.Error("RedactAttrs(nil) != nil")
+	}
+}
@@ -0,0 +1,77 @@
+// Package secrettest checks output for leaked key material in tests.
+package secrettest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Encodings returns key in each form it is likely to be printed in, by
+// the name of the form.
+func Encodings(key []byte) map[string]string {
+	return map[string]string{
+		"raw":        string(key),
+		"hex":        hex.EncodeToString(key),
+		"HEX":        strings.ToUpper(hex.EncodeToString(key)),
+		"base64":     base64.StdEncoding.EncodeToString(key),
+		"base64url":  base64.RawURLEncoding.EncodeToString(key),
+		"byte slice": strings.Trim(fmt.Sprint(key), "[]"),
+	}
+}
+
+// AssertNoLeak fails the test if out contains any of keys in any of its
+// Encodings.
+func AssertNoLeak(t testing.TB, out string, keys ...[]byte) {
+	t.Helper()
+	for i, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		for name, enc := range Encodings(key) {
+			if strings.Contains(out, enc) {
+				t.Errorf("output leaks key %d (%s): %q", i, name, out)
+			}
+		}
+	}
+}
+
+// CaptureOutput runs f and returns everything it wrote to the standard
+// logger, stdout and stderr.
+func CaptureOutput(t testing.TB, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	logOut, logFlags := log.Writer(), log.Flags()
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(w)
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		log.SetOutput(logOut)
+		log.SetFlags(logFlags)
+	}()
+
+	var buf bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(copied)
+	}()
+
+	f()
+	w.Close()
+	<-copied
+	r.Close()
+	return buf.String()
+}
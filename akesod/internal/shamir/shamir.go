@@ -0,0 +1,148 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// A secret is split into N shares, any K of which recover it; fewer than K
+// reveal nothing about it.  Each byte of the secret is the constant term of
+// its own random polynomial of degree K-1, and a share holds the values of
+// those polynomials at one non-zero x.  x is stored as the share's last
+// byte, so a share is one byte longer than the secret.
+//
+// Combine can't tell whether it was given enough shares: too few, or shares
+// of different secrets, give a wrong result without an error.  Callers that
+// need to know should check the result, e.g. against a digest.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// MaxShares is the largest number of shares a secret can be split into
+const MaxShares = 255
+
+// Split splits secret into n shares, any k of which recover it
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("can't split an empty secret")
+	}
+	if k < 2 {
+		return nil, fmt.Errorf("threshold must be at least 2, not %d", k)
+	}
+	if n < k {
+		return nil, fmt.Errorf("can't split into %d shares with a threshold of %d", n, k)
+	}
+	if n > MaxShares {
+		return nil, fmt.Errorf("can't split into more than %d shares", MaxShares)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, k)
+	defer clear(coeffs)
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[j] = evaluate(coeffs, share[len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from at least the threshold number of its
+// shares
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are needed")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share is too short")
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+		x := share[size-1]
+		if x == 0 {
+			return nil, fmt.Errorf("share %d has x = 0", i)
+		}
+		if seen[x] {
+			return nil, fmt.Errorf("share %d repeats x = %d", i, x)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at x = 0; in GF(2^8) subtraction is xor
+	basis := make([]byte, len(shares))
+	for i := range xs {
+		basis[i] = 1
+		for m := range xs {
+			if m != i {
+				basis[i] = mul(basis[i], div(xs[m], xs[m]^xs[i]))
+			}
+		}
+	}
+
+	secret := make([]byte, size-1)
+	for j := range secret {
+		var b byte
+		for i, share := range shares {
+			b ^= mul(share[j], basis[i])
+		}
+		secret[j] = b
+	}
+	return secret, nil
+}
+
+// evaluate returns the polynomial with coefficients coeffs, lowest degree
+// first, at x
+func evaluate(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1.
+// It takes the same time for all inputs.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ 0x1b&carry
+		b >>= 1
+	}
+	return p
+}
+
+// inv returns the multiplicative inverse of a, a^254; inv(0) is 0
+func inv(a byte) byte {
+	b := mul(a, a) // a^2
+	c := mul(a, b) // a^3
+	b = mul(c, c)  // a^6
+	b = mul(b, b)  // a^12
+	c = mul(b, c)  // a^15
+	b = mul(b, b)  // a^24
+	b = mul(b, b)  // a^48
+	b = mul(b, c)  // a^63
+	b = mul(b, b)  // a^126
+	b = mul(a, b)  // a^127
+	return mul(b, b)
+}
+
+func div(a, b byte) byte {
+	return mul(a, inv(b))
+}
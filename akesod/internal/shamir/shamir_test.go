@@ -0,0 +1,103 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFieldInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := mul(byte(a), inv(byte(a))); p != 1 {
+			t.Fatalf("%d * inv(%d) = %d", a, a, p)
+		}
+	}
+}
+
+// subsets calls f with every subset of shares of size k
+func subsets(shares [][]byte, k int, f func([][]byte)) {
+	var pick func(start int, chosen [][]byte)
+	pick = func(start int, chosen [][]byte) {
+		if len(chosen) == k {
+			f(chosen)
+			return
+		}
+		for i := start; i < len(shares); i++ {
+			pick(i+1, append(chosen, shares[i]))
+		}
+	}
+	pick(0, nil)
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("the group's stage key and ART state")
+
+	for _, tt := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		shares, err := Split(secret, tt.n, tt.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != tt.n {
+			t.Fatalf("got %d shares, expected %d", len(shares), tt.n)
+		}
+
+		for k := tt.k; k <= tt.n; k++ {
+			subsets(shares, k, func(subset [][]byte) {
+				got, err := Combine(subset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, secret) {
+					t.Errorf("%d-of-%d: %d shares recovered %q", tt.k, tt.n, k, got)
+				}
+			})
+		}
+
+		// below the threshold the result is unrelated to the secret
+		if tt.k > 2 {
+			subsets(shares, tt.k-1, func(subset [][]byte) {
+				got, err := Combine(subset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(got, secret) {
+					t.Errorf("%d-of-%d: %d shares recovered the secret", tt.k, tt.n, tt.k-1)
+				}
+			})
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	for _, tt := range []struct {
+		secret []byte
+		n, k   int
+	}{
+		{nil, 3, 2},
+		{[]byte("s"), 3, 1},
+		{[]byte("s"), 2, 3},
+		{[]byte("s"), 256, 2},
+	} {
+		if _, err := Split(tt.secret, tt.n, tt.k); err == nil {
+			t.Errorf("Split(%q, %d, %d) succeeded", tt.secret, tt.n, tt.k)
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, bad := range map[string][][]byte{
+		"one share": shares[:1],
+		"duplicate": {shares[0], shares[0]},
+		"length":    {shares[0], shares[1][1:]},
+		"x = 0":     {shares[0], append(bytes.Clone(shares[1][:6]), 0)},
+		"too short": {{1}, {2}},
+	} {
+		if _, err := Combine(bad); err == nil {
+			t.Errorf("%s: Combine succeeded", name)
+		}
+	}
+}
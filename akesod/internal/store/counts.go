@@ -0,0 +1,76 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Counts is a durable set of named counters, kept as a JSON object that is
+// rewritten atomically on every change.  It is meant for a few entries at a
+// time, such as the delivery attempts of the messages in flight.
+type Counts struct {
+	mtx    sync.Mutex
+	path   string
+	counts map[string]int
+}
+
+func OpenCounts(path string) (*Counts, error) {
+	c := &Counts{path: path, counts: make(map[string]int)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.counts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Counts) save() error {
+	data, err := json.Marshal(c.counts)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(c.path, data, 0600)
+}
+
+// Inc durably increments the counter for key and returns its new value.
+func (c *Counts) Inc(key string) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	n := c.counts[key]
+	c.counts[key] = n + 1
+	if err := c.save(); err != nil {
+		if n == 0 {
+			delete(c.counts, key)
+		} else {
+			c.counts[key] = n
+		}
+		return 0, err
+	}
+	return n + 1, nil
+}
+
+// Delete durably removes the counter for key.
+func (c *Counts) Delete(key string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	n, ok := c.counts[key]
+	if !ok {
+		return nil
+	}
+	delete(c.counts, key)
+	if err := c.save(); err != nil {
+		c.counts[key] = n
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Set is a durable set of strings kept as an append-only file with one
+// entry per line.  Each Add is fsynced before it returns.  If max is
+// positive, only the max most recently added entries are remembered.
+type Set struct {
+	mtx     sync.Mutex
+	path    string
+	max     int
+	f       *os.File
+	entries []string
+	members map[string]bool
+}
+
+func OpenSet(path string, max int) (*Set, error) {
+	s := &Set{path: path, max: max, members: make(map[string]bool)}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				s.remember(line)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Set) remember(v string) {
+	if s.members[v] {
+		return
+	}
+	s.members[v] = true
+	s.entries = append(s.entries, v)
+
+	if s.max > 0 && len(s.entries) > s.max {
+		delete(s.members, s.entries[0])
+		s.entries = s.entries[1:]
+	}
+}
+
+// compact rewrites the file with only the remembered entries and reopens
+// it for appending.
+func (s *Set) compact() error {
+	if s.f != nil {
+		s.f.Close()
+	}
+
+	var data []byte
+	if len(s.entries) > 0 {
+		data = []byte(strings.Join(s.entries, "\n") + "\n")
+	}
+	if err := WriteFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	return nil
+}
+
+func (s *Set) Contains(v string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.members[v]
+}
+
+func (s *Set) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.entries)
+}
+
+// Add durably records v.  Entries must not contain newlines.
+func (s *Set) Add(v string) error {
+	if strings.ContainsRune(v, '\n') {
+		return errors.New("store.Set: entry contains a newline")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.members[v] {
+		return nil
+	}
+	s.remember(v)
+
+	if _, err := s.f.WriteString(v + "\n"); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+
+	// keep the file from growing without bound
+	if s.max > 0 && len(s.entries) == s.max {
+		return s.compact()
+	}
+	return nil
+}
+
+// Close closes the set's file.  With remove set, the file is also deleted.
+func (s *Set) Close(remove bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.f.Close()
+	if remove {
+		if rmErr := os.Remove(s.path); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,344 @@
+// Package store keeps versioned snapshots of akesod's group state on disk.
+//
+// Every snapshot is written atomically (temp file, fsync, rename) and a
+// CURRENT file names the snapshot in use, so a crash at any point leaves
+// either the old or the new state intact.  Snapshots can optionally be
+// encrypted at rest with AES-GCM under a key file or a passphrase.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/etclab/akesod/internal/aesx"
+	"github.com/etclab/akesod/internal/secret"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	currentFile    = "CURRENT"
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".json"
+
+	envelopeVersion = 1
+
+	// scrypt parameters recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var ErrNoSnapshot = errors.New("store has no snapshot")
+
+type Options struct {
+	// Key is a 32-byte AES key used to seal snapshots.
+	Key secret.Bytes
+	// Passphrase is stretched with scrypt into a sealing key.  Ignored if
+	// Key is set.
+	Passphrase secret.Bytes
+	// Keep is the number of most recent snapshots to retain; 0 keeps all.
+	Keep int
+}
+
+type Store struct {
+	dir        string
+	key        secret.Bytes
+	passphrase secret.Bytes
+	keep       int
+}
+
+// envelope is the on-disk format of a snapshot.  Data is plaintext when
+// Encrypted is false, and AES-GCM ciphertext||tag otherwise.
+type envelope struct {
+	Format    int    `json:"format"`
+	Version   uint64 `json:"version"`
+	Encrypted bool   `json:"encrypted"`
+	Salt      []byte `json:"salt,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Data      []byte `json:"data"`
+}
+
+func Open(dir string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Key != nil && len(opts.Key) != aesx.KeySize {
+		return nil, fmt.Errorf("invalid store key size: expected %d, got %d", aesx.KeySize, len(opts.Key))
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can't create store dir %s: %w", dir, err)
+	}
+
+	return &Store{
+		dir:        dir,
+		key:        opts.Key,
+		passphrase: opts.Passphrase,
+		keep:       opts.Keep,
+	}, nil
+}
+
+// Describes the store without its key or passphrase
+func (s *Store) String() string {
+	return fmt.Sprintf("store %s (encrypted: %t)", s.dir, s.encrypted())
+}
+
+func (s *Store) GoString() string {
+	return s.String()
+}
+
+func (s *Store) encrypted() bool {
+	return s.key != nil || s.passphrase != nil
+}
+
+func (s *Store) snapshotPath(version uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, version, snapshotSuffix))
+}
+
+// Returns the key that seals snapshots with salt, and a function that
+// wipes it once the caller is done with it.
+func (s *Store) sealingKey(salt []byte) ([]byte, func(), error) {
+	if s.key != nil {
+		return s.key, func() {}, nil
+	}
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, aesx.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, func() { secret.Zero(key) }, nil
+}
+
+// Commit durably writes data as snapshot version and makes it current.
+// Snapshots newer than version, left by a rollback, are removed: they
+// belong to the history the rollback abandoned.
+func (s *Store) Commit(version uint64, data []byte) error {
+	env := envelope{Format: envelopeVersion, Version: version}
+
+	if s.encrypted() {
+		if s.key == nil {
+			env.Salt = aesx.GenerateRandomKey()
+		}
+		key, wipe, err := s.sealingKey(env.Salt)
+		if err != nil {
+			return fmt.Errorf("can't derive store key: %w", err)
+		}
+		defer wipe()
+		env.Encrypted = true
+		env.Nonce = aesx.GenerateRandomNonce()
+		env.Data = aesx.GcmEncrypt(slices.Clone(data), envelopeAD(version), key, env.Nonce)
+	} else {
+		env.Data = data
+	}
+
+	envData, err := json.Marshal(&env)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(s.snapshotPath(version), envData, 0600); err != nil {
+		return fmt.Errorf("can't write snapshot %d: %w", version, err)
+	}
+
+	if err := s.setCurrent(version); err != nil {
+		return err
+	}
+
+	return s.prune()
+}
+
+// binds a sealed snapshot to its version, so snapshots can't be swapped
+func envelopeAD(version uint64) []byte {
+	return []byte("akesod-store-v1:" + strconv.FormatUint(version, 10))
+}
+
+func (s *Store) setCurrent(version uint64) error {
+	data := []byte(strconv.FormatUint(version, 10) + "\n")
+	if err := WriteFileAtomic(filepath.Join(s.dir, currentFile), data, 0600); err != nil {
+		return fmt.Errorf("can't update %s: %w", currentFile, err)
+	}
+	return nil
+}
+
+// Current returns the version of the snapshot in use.
+func (s *Store) Current() (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, currentFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrNoSnapshot
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s file: %w", currentFile, err)
+	}
+	return version, nil
+}
+
+// Load returns the current snapshot and its version.
+func (s *Store) Load() (uint64, []byte, error) {
+	version, err := s.Current()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := s.LoadVersion(version)
+	return version, data, err
+}
+
+func (s *Store) LoadVersion(version uint64) ([]byte, error) {
+	envData, err := os.ReadFile(s.snapshotPath(version))
+	if err != nil {
+		return nil, fmt.Errorf("can't read snapshot %d: %w", version, err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(envData, &env); err != nil {
+		return nil, fmt.Errorf("malformed snapshot %d: %w", version, err)
+	}
+
+	if env.Format != envelopeVersion {
+		return nil, fmt.Errorf("snapshot %d has unsupported format %d", version, env.Format)
+	}
+	if env.Version != version {
+		return nil, fmt.Errorf("snapshot file for version %d claims version %d", version, env.Version)
+	}
+
+	if !env.Encrypted {
+		if s.encrypted() {
+			return nil, fmt.Errorf("snapshot %d is not encrypted, but the store requires encryption", version)
+		}
+		return env.Data, nil
+	}
+
+	if !s.encrypted() {
+		return nil, fmt.Errorf("snapshot %d is encrypted, but no store key or passphrase was given", version)
+	}
+
+	key, wipe, err := s.sealingKey(env.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("can't derive store key: %w", err)
+	}
+	defer wipe()
+
+	data, err := aesx.GcmDecrypt(env.Data, envelopeAD(version), key, env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt snapshot %d (wrong key or passphrase?): %w", version, err)
+	}
+	return data, nil
+}
+
+// Versions lists the retained snapshot versions in increasing order.
+func (s *Store) Versions() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		v := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// Rollback makes an older snapshot current.  The snapshot must be readable
+// with the store's key, so a rollback can't leave the store unusable.
+// Newer snapshots are kept until the next Commit, so until then a rollback
+// can be undone with another one.
+func (s *Store) Rollback(version uint64) error {
+	if _, err := s.LoadVersion(version); err != nil {
+		return err
+	}
+	return s.setCurrent(version)
+}
+
+// prune keeps the current snapshot and the keep-1 before it.  It removes
+// older ones, and newer ones, which a commit after a rollback replaces.
+func (s *Store) prune() error {
+	versions, err := s.Versions()
+	if err != nil {
+		return err
+	}
+	current, err := s.Current()
+	if err != nil {
+		return err
+	}
+
+	var remove []uint64
+	for i, v := range versions {
+		if v > current {
+			remove = append(remove, versions[i:]...)
+			versions = versions[:i]
+			break
+		}
+	}
+	if s.keep > 0 && len(versions) > s.keep {
+		remove = append(remove, versions[:len(versions)-s.keep]...)
+	}
+	for _, v := range remove {
+		if err := os.Remove(s.snapshotPath(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temp file in the same directory, fsyncs
+// it, renames it over path, and fsyncs the directory.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
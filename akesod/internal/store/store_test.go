@@ -0,0 +1,251 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/etclab/akesod/internal/secret/secrettest"
+)
+
+func TestStoreDoesNotLeakSecrets(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		opts, wrong *Options
+	}{
+		{&Options{Passphrase: passphrase}, &Options{Passphrase: []byte("wrong")}},
+		{&Options{Key: key}, &Options{Key: []byte("fedcba9876543210fedcba9876543210")}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+
+		out := secrettest.CaptureOutput(t, func() {
+			st, err := Open(dir, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := st.Commit(1, []byte("state")); err != nil {
+				t.Fatal(err)
+			}
+			for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x"} {
+				fmt.Printf(verb+"\n", st)
+				fmt.Printf(verb+"\n", tt.opts)
+				fmt.Printf(verb+"\n", *tt.opts)
+			}
+		})
+
+		// the error for a wrong secret must show neither secret
+		st, err := Open(dir, tt.wrong)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := st.Load(); err == nil {
+			t.Error("loaded a snapshot with the wrong key")
+		} else {
+			out += err.Error()
+		}
+
+		secrettest.AssertNoLeak(t, out, passphrase, key)
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{"plaintext", nil},
+		{"key", &Options{Key: []byte("0123456789abcdef0123456789abcdef")}},
+		{"passphrase", &Options{Passphrase: []byte("correct horse battery staple")}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		st, err := Open(dir, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := st.Load(); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("%s: empty store: got %v; expected %v", tt.name, err, ErrNoSnapshot)
+		}
+
+		for v := uint64(1); v <= 3; v++ {
+			if err := st.Commit(v, []byte(fmt.Sprintf("state %d", v))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		version, data, err := st.Load()
+		if err != nil || version != 3 || string(data) != "state 3" {
+			t.Errorf("%s: got %d, %q, %v; expected 3, %q", tt.name, version, data, err, "state 3")
+		}
+
+		// reopening reads the same state
+		st, err = Open(dir, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := st.LoadVersion(2); err != nil || string(data) != "state 2" {
+			t.Errorf("%s: reopened: got %q, %v; expected %q", tt.name, data, err, "state 2")
+		}
+
+		// sealed snapshots don't hold the plaintext
+		raw, err := os.ReadFile(st.snapshotPath(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte("state 3"))
+		if tt.opts != nil && bytes.Contains(raw, []byte(encoded)) {
+			t.Errorf("%s: sealed snapshot holds the plaintext", tt.name)
+		}
+	}
+}
+
+func TestStoreSealedSnapshotsCantBeSwapped(t *testing.T) {
+	dir := t.TempDir()
+	st, err := Open(dir, &Options{Key: []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v := uint64(1); v <= 2; v++ {
+		if err := st.Commit(v, []byte(fmt.Sprintf("state %d", v))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an old snapshot renamed to a newer version doesn't load
+	if err := os.Rename(st.snapshotPath(1), st.snapshotPath(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.Load(); err == nil {
+		t.Error("loaded a snapshot under another version")
+	}
+}
+
+func TestStorePruneAfterRollback(t *testing.T) {
+	st, err := Open(t.TempDir(), &Options{Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(v uint64, data string) {
+		t.Helper()
+		if err := st.Commit(v, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := func() []uint64 {
+		t.Helper()
+		vs, err := st.Versions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vs
+	}
+
+	for v := uint64(1); v <= 4; v++ {
+		commit(v, fmt.Sprintf("state %d", v))
+	}
+	if got := versions(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Fatalf("got versions %v; expected [3 4]", got)
+	}
+
+	// a rollback can be undone until the next commit
+	if err := st.Rollback(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Errorf("after rollback: got versions %v; expected [3 4]", got)
+	}
+	if err := st.Rollback(4); err != nil {
+		t.Errorf("rolling forward: %v", err)
+	}
+
+	// the next commit after a rollback replaces the newer snapshots
+	if err := st.Rollback(3); err != nil {
+		t.Fatal(err)
+	}
+	commit(4, "state 4 again")
+	if got := versions(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Errorf("after commit: got versions %v; expected [3 4]", got)
+	}
+	if version, data, err := st.Load(); err != nil || version != 4 || string(data) != "state 4 again" {
+		t.Errorf("after commit: got %d, %q, %v; expected 4, %q", version, data, err, "state 4 again")
+	}
+
+	// a store that kept every snapshot is reopened with a limit: retention
+	// counts back from the current snapshot, and the commit after a
+	// rollback removes the abandoned ones
+	dir := t.TempDir()
+	if st, err = Open(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	for v := uint64(1); v <= 6; v++ {
+		commit(v, fmt.Sprintf("state %d", v))
+	}
+	if st, err = Open(dir, &Options{Keep: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Rollback(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(); !slices.Equal(got, []uint64{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("after rollback to 3: got versions %v; expected [1 2 3 4 5 6]", got)
+	}
+	commit(4, "state 4 again")
+	if got := versions(); !slices.Equal(got, []uint64{3, 4}) {
+		t.Errorf("after commit: got versions %v; expected [3 4]", got)
+	}
+
+	// without a limit, the abandoned snapshots are removed all the same
+	if st, err = Open(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	commit(5, "state 5")
+	commit(6, "state 6")
+	if err := st.Rollback(4); err != nil {
+		t.Fatal(err)
+	}
+	commit(5, "state 5 again")
+	if got := versions(); !slices.Equal(got, []uint64{3, 4, 5}) {
+		t.Errorf("without a limit: got versions %v; expected [3 4 5]", got)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counts.json")
+	c, err := OpenCounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 3; want++ {
+		n, err := c.Inc("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("Inc(a) = %d; expected %d", n, want)
+		}
+	}
+	if _, err := c.Inc("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counts survive reopening
+	if c, err = OpenCounts(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Inc("a"); err != nil || n != 4 {
+		t.Errorf("after reopening, Inc(a) = %d, %v; expected 4", n, err)
+	}
+	if n, err := c.Inc("b"); err != nil || n != 1 {
+		t.Errorf("after deleting, Inc(b) = %d, %v; expected 1", n, err)
+	}
+}
@@ -65,16 +65,10 @@ setup_directories() {
     # Create keys directory if it doesn't exist
     mkdir -p keys
     
-    # Generate group member configuration
-    # Note: This assumes the key files already exist. You may need to generate them first.
-    cat > keys/4.conf << EOF
-akesod  keys/akesod-ik-pub.pem   keys/akesod-ek-pub.pem
-bob     keys/bob-ik-pub.pem      keys/bob-ek-pub.pem
-cici    keys/cici-ik-pub.pem     keys/cici-ek-pub.pem
-dave    keys/dave-ik-pub.pem     keys/dave-ek-pub.pem
-EOF
-    
-    print_success "Key configuration created"
+    # The group config file (keys/4.conf) is generated by akesod from the
+    # member registrations received on the MemberRegistration topic.
+
+    print_success "Key directory created"
 }
 
 # Setup configuration file
@@ -99,6 +93,7 @@ enable_gcloud_services() {
         cloudtasks.googleapis.com \
         cloudfunctions.googleapis.com \
         pubsub.googleapis.com \
+        secretmanager.googleapis.com \
         storage.googleapis.com \
         --project="$PROJECT_ID"
     
@@ -125,6 +120,22 @@ create_pubsub_topics() {
         print_success "KeyUpdate topic created"
     fi
     
+    # Create MemberRegistration topic
+    if gcloud pubsub topics describe MemberRegistration --project="$PROJECT_ID" >/dev/null 2>&1; then
+        print_warning "MemberRegistration topic already exists"
+    else
+        gcloud pubsub topics create MemberRegistration --project="$PROJECT_ID"
+        print_success "MemberRegistration topic created"
+    fi
+    
+    # Create KeyUpdateDeadLetter topic
+    if gcloud pubsub topics describe KeyUpdateDeadLetter --project="$PROJECT_ID" >/dev/null 2>&1; then
+        print_warning "KeyUpdateDeadLetter topic already exists"
+    else
+        gcloud pubsub topics create KeyUpdateDeadLetter --project="$PROJECT_ID"
+        print_success "KeyUpdateDeadLetter topic created"
+    fi
+    
     # Create MetadataUpdate topic
     if gcloud pubsub topics describe MetadataUpdate --project="$PROJECT_ID" >/dev/null 2>&1; then
         print_warning "MetadataUpdate topic already exists"
@@ -132,6 +143,14 @@ create_pubsub_topics() {
         gcloud pubsub topics create MetadataUpdate --project="$PROJECT_ID"
         print_success "MetadataUpdate topic created"
     fi
+
+    # Create ReencryptionComplete topic
+    if gcloud pubsub topics describe ReencryptionComplete --project="$PROJECT_ID" >/dev/null 2>&1; then
+        print_warning "ReencryptionComplete topic already exists"
+    else
+        gcloud pubsub topics create ReencryptionComplete --project="$PROJECT_ID"
+        print_success "ReencryptionComplete topic created"
+    fi
 }
 
 # Setup Cloud KMS
@@ -223,6 +242,21 @@ deploy_cloud_function() {
     print_status "Deploying encrypt-object cloud function..."
     
     if [[ -d "./cmd/gcs-utils/cloud-functions/encrypt-object/" ]]; then
+        # akesod wraps each rotation's DEK to this key; the function gets
+        # the private key from Secret Manager
+        if [[ ! -f "keys/worker.pem" ]]; then
+            ./encrypt-worker -keygen
+        fi
+        if gcloud secrets describe akeso-worker-key --project="$PROJECT_ID" &>/dev/null; then
+            gcloud secrets versions add akeso-worker-key --data-file=keys/worker.pem --project="$PROJECT_ID"
+        else
+            gcloud secrets create akeso-worker-key --data-file=keys/worker.pem --project="$PROJECT_ID"
+        fi
+        gcloud secrets add-iam-policy-binding akeso-worker-key \
+            --member="serviceAccount:${PROJECT_NUMBER}-compute@developer.gserviceaccount.com" \
+            --role=roles/secretmanager.secretAccessor \
+            --project="$PROJECT_ID"
+
         gcloud functions deploy encrypt-object \
             --gen2 \
             --runtime=go122 \
@@ -230,6 +264,9 @@ deploy_cloud_function() {
             --source=./cmd/gcs-utils/cloud-functions/encrypt-object/ \
             --entry-point=EncryptObject \
             --trigger-topic=MetadataUpdate \
+            --retry \
+            --set-secrets=AKESO_WORKER_KEY=akeso-worker-key:latest \
+            --set-env-vars=AKESO_COMPLETION_TOPIC=projects/${PROJECT_ID}/topics/ReencryptionComplete \
             --memory=512MB \
             --cpu=0.5 \
             --project="$PROJECT_ID"
@@ -266,12 +303,10 @@ main() {
     print_status "Next steps:"
     echo "1. Review and update config/config.yaml with your specific values"
     echo "2. Ensure setupRequired is set to 'true' in config.yaml for initialization"
-    echo "3. Generate or place the required key files in the keys/ directory"
+    echo "3. Have each member listed in art.members run ./register-member NAME"
     echo "4. Run the daemon with: ./akesod"
-    echo "5. Set up GCS bucket notification using gcs-utils if needed"
     echo
-    print_status "For GCS notification setup, use:"
-    echo "./gcs-utils -notification-config -topic-id MetadataUpdate -project-id $PROJECT_ID -event-type OBJECT_METADATA_UPDATE -custom-attributes=new_dek=<YOUR_KEY> gs://<YOUR_BUCKET>"
+    print_status "akesod sets up each bucket's notification for the cloud function on every rotation."
 }
 
 # Run main function